@@ -2,9 +2,13 @@
 set BINARY_DIR=bin
 set SERVER_BIN=%BINARY_DIR%\kvd.exe
 set CLIENT_BIN=%BINARY_DIR%\kvcli.exe
+set AOF_TOOL_BIN=%BINARY_DIR%\kvaof.exe
+set CHECK_TOOL_BIN=%BINARY_DIR%\kvcheck.exe
 set GUI_BIN=%BINARY_DIR%\kvgui.exe
 set SERVER_SRC=.\cmd\kvd
 set CLIENT_SRC=.\cmd\kvcli
+set AOF_TOOL_SRC=.\cmd\kvaof
+set CHECK_TOOL_SRC=.\cmd\kvcheck
 set GUI_DIR=.\cmd\kvgui
 
 if "%1"=="build" goto build
@@ -20,6 +24,8 @@ echo Building...
 if not exist "%BINARY_DIR%" mkdir %BINARY_DIR%
 go build -o %SERVER_BIN% %SERVER_SRC%
 go build -o %CLIENT_BIN% %CLIENT_SRC%
+go build -o %AOF_TOOL_BIN% %AOF_TOOL_SRC%
+go build -o %CHECK_TOOL_BIN% %CHECK_TOOL_SRC%
 echo Build complete!
 goto end
 
@@ -48,7 +54,7 @@ goto end
 :help
 echo Available commands:
 echo   build.bat        - Build all binaries (default)
-echo   build.bat build  - Build kvd and kvcli
+echo   build.bat build  - Build kvd, kvcli, kvaof and kvcheck
 echo   build.bat gui    - Build kvgui (requires Wails CLI)
 echo   build.bat clean  - Remove binaries and clean cache
 echo   build.bat test   - Run all tests
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/shinerio/gopher-kv/internal/storage"
+)
+
+// kvaof converts an AOF file between the text and binary formats offline.
+// The output is written to a temporary file and renamed into place, so an
+// interrupted conversion never leaves a partial file behind. An encrypted
+// input is decrypted with the keys given by -key-file or -key-env; the
+// output is always unencrypted.
+func main() {
+	in := flag.String("in", "", "input AOF file")
+	out := flag.String("out", "", "output AOF file")
+	to := flag.String("to", "binary", "output format: binary or text")
+	keyFile := flag.String("key-file", "", "file with the encryption keys of an encrypted input")
+	keyEnv := flag.String("key-env", "", "environment variable with the encryption keys of an encrypted input")
+	flag.Parse()
+
+	if *in == "" || *out == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	format, err := storage.ParseAOFFormat(*to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if abs(*in) == abs(*out) {
+		log.Fatal("input and output must be different files")
+	}
+	var keys *storage.Keyring
+	if *keyFile != "" || *keyEnv != "" {
+		if keys, err = storage.LoadKeyring(*keyFile, *keyEnv); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	n, err := convert(*in, *out, format, keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("converted %d records to %s format: %s\n", n, format, *out)
+}
+
+func convert(in, out string, format storage.AOFFormat, keys *storage.Keyring) (int, error) {
+	src, err := os.Open(in)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	tmpPath := out + ".tmp"
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := storage.ConvertAOF(dst, src, format, keys)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return n, err
+	}
+	return n, os.Rename(tmpPath, out)
+}
+
+func abs(path string) string {
+	if p, err := filepath.Abs(path); err == nil {
+		return p
+	}
+	return path
+}
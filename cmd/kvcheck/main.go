@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shinerio/gopher-kv/internal/storage"
+)
+
+// kvcheck inspects and repairs AOF and RDB files offline, without starting
+// kvd. A path may name an AOF file, an RDB snapshot, an AOF manifest or the
+// AOF directory holding one; repair and decrypt work on single files only.
+// Encrypted files are read with the keys given by -key-file or -key-env.
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	args := os.Args[2:]
+	var code int
+	switch os.Args[1] {
+	case "verify":
+		code = runVerify(args)
+	case "stats":
+		code = runStats(args)
+	case "repair":
+		code = runRepair(args)
+	case "dump":
+		code = runDump(args)
+	case "decrypt":
+		code = runDecrypt(args)
+	default:
+		usage()
+		code = 2
+	}
+	os.Exit(code)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  kvcheck verify <path>                  Check every record and section, report damage")
+	fmt.Fprintln(os.Stderr, "  kvcheck stats <path>                   Record, key and TTL statistics")
+	fmt.Fprintln(os.Stderr, "  kvcheck repair [-mode truncate|skip] [-out file] [-compression none|deflate] <file>")
+	fmt.Fprintln(os.Stderr, "                                         Drop damaged data; in place with a .bak copy unless -out is given")
+	fmt.Fprintln(os.Stderr, "  kvcheck dump <path>                    Print the contents as JSON lines")
+	fmt.Fprintln(os.Stderr, "  kvcheck decrypt [-out file] [-compression none|deflate] <file>")
+	fmt.Fprintln(os.Stderr, "                                         Write an encrypted file unencrypted; in place with a .bak copy unless -out is given")
+	fmt.Fprintln(os.Stderr, "Every command takes -key-file <file> or -key-env <variable> to read encrypted files.")
+}
+
+// keyring decrypts encrypted files; it is nil unless a key flag is given.
+var keyring *storage.Keyring
+
+type fileKind int
+
+const (
+	kindAOF fileKind = iota
+	kindRDB
+)
+
+type target struct {
+	path string
+	kind fileKind
+}
+
+// resolve expands path into the files to inspect, in replay order.
+func resolve(path string) ([]target, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if st.IsDir() {
+		manifests, err := filepath.Glob(filepath.Join(path, "*.manifest"))
+		if err != nil {
+			return nil, err
+		}
+		if len(manifests) != 1 {
+			return nil, fmt.Errorf("%s: expected one AOF manifest, found %d", path, len(manifests))
+		}
+		path = manifests[0]
+	}
+	if !strings.HasSuffix(path, ".manifest") {
+		kind, err := detectKind(path)
+		return []target{{path: path, kind: kind}}, err
+	}
+
+	paths, err := storage.AOFManifestFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]target, 0, len(paths))
+	for _, p := range paths {
+		kind, err := detectKind(p)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target{path: p, kind: kind})
+	}
+	return targets, nil
+}
+
+func detectKind(path string) (fileKind, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return kindAOF, err
+	}
+	defer f.Close()
+	head := make([]byte, 6)
+	n, _ := io.ReadFull(f, head)
+	if string(head[:n]) == "GKVRDB" || strings.HasSuffix(path, ".rdb") {
+		return kindRDB, nil
+	}
+	return kindAOF, nil
+}
+
+// fileReport summarizes one file scanned with the skip policy.
+type fileReport struct {
+	target
+	aof      storage.AOFScanResult
+	rdb      storage.RDBScanResult
+	ops      map[storage.AOFOp]int
+	firstSeq int64
+	lastSeq  int64
+}
+
+func (r *fileReport) damage() []storage.Damage {
+	if r.kind == kindRDB {
+		return r.rdb.Damage
+	}
+	return r.aof.Damage
+}
+
+func (r *fileReport) summary() string {
+	if r.kind == kindRDB {
+		version := fmt.Sprintf("v%d", r.rdb.Version)
+		if r.rdb.Version == 0 {
+			version = "gob"
+		}
+		s := fmt.Sprintf("rdb %s, %d entries in %d sections, last seq %d", version, r.rdb.Entries, r.rdb.Sections, r.rdb.LastSeq)
+		if r.rdb.KeyID != "" {
+			s += ", encrypted with key " + r.rdb.KeyID
+		}
+		return s
+	}
+	s := fmt.Sprintf("%s aof, %d records", r.aof.Format, r.aof.Records)
+	if r.lastSeq > 0 {
+		s += fmt.Sprintf(", seq %d-%d", r.firstSeq, r.lastSeq)
+	}
+	if r.aof.KeyID != "" {
+		s += ", encrypted with key " + r.aof.KeyID
+	}
+	return s
+}
+
+func (r *fileReport) keyID() string {
+	if r.kind == kindRDB {
+		return r.rdb.KeyID
+	}
+	return r.aof.KeyID
+}
+
+// scan reads t with the skip policy, passing AOF records to onRecord and
+// RDB entries to onEntry.
+func scan(t target, onRecord func(storage.AOFRecord), onEntry func(key []byte, entry storage.Entry)) (*fileReport, error) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rep := &fileReport{target: t, ops: make(map[storage.AOFOp]int)}
+	if t.kind == kindRDB {
+		rep.rdb, err = storage.ScanRDB(f, storage.CorruptSkip, keyring, onEntry)
+		return rep, err
+	}
+	rep.aof, err = storage.ScanAOF(f, storage.CorruptSkip, keyring, func(rec storage.AOFRecord) {
+		rep.ops[rec.Op]++
+		if rec.Seq > 0 {
+			if rep.firstSeq == 0 {
+				rep.firstSeq = rec.Seq
+			}
+			rep.lastSeq = rec.Seq
+		}
+		onRecord(rec)
+	})
+	return rep, err
+}
+
+func printDamage(w io.Writer, d storage.Damage) {
+	fmt.Fprintf(w, "  offset %d: %v (%d bytes)\n", d.Offset, d.Err, d.Length)
+}
+
+// parsePath parses the flags of a command, loading the keyring if a key
+// flag is given, and returns its single path argument.
+func parsePath(fs *flag.FlagSet, args []string) (string, bool) {
+	keyFile := fs.String("key-file", "", "file with the encryption keys")
+	keyEnv := fs.String("key-env", "", "environment variable with the encryption keys")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		return "", false
+	}
+	if *keyFile != "" || *keyEnv != "" {
+		var err error
+		if keyring, err = storage.LoadKeyring(*keyFile, *keyEnv); err != nil {
+			log.Printf("load encryption keys: %v", err)
+			return "", false
+		}
+	}
+	return fs.Arg(0), true
+}
+
+func runVerify(args []string) int {
+	path, ok := parsePath(flag.NewFlagSet("verify", flag.ExitOnError), args)
+	if !ok {
+		return 2
+	}
+	targets, err := resolve(path)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	code := 0
+	for _, t := range targets {
+		rep, err := scan(t, func(storage.AOFRecord) {}, func([]byte, storage.Entry) {})
+		if err != nil {
+			fmt.Printf("BAD  %s: %v\n", t.path, err)
+			code = 1
+			continue
+		}
+		if len(rep.damage()) == 0 {
+			fmt.Printf("OK   %s: %s\n", t.path, rep.summary())
+			continue
+		}
+		code = 1
+		fmt.Printf("BAD  %s: %s\n", t.path, rep.summary())
+		for _, d := range rep.damage() {
+			printDamage(os.Stdout, d)
+		}
+	}
+	return code
+}
+
+func runStats(args []string) int {
+	path, ok := parsePath(flag.NewFlagSet("stats", flag.ExitOnError), args)
+	if !ok {
+		return 2
+	}
+	targets, err := resolve(path)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	// keys tracks the deadline of every key left after replaying the files
+	// in order; values are not needed for the statistics.
+	keys := make(map[string]int64)
+	onRecord := func(rec storage.AOFRecord) {
+		switch rec.Op {
+		case storage.AOFOpSet:
+			keys[rec.Key] = rec.ExpiresAt
+		case storage.AOFOpDel:
+			delete(keys, rec.Key)
+		case storage.AOFOpExpireAt:
+			if _, ok := keys[rec.Key]; ok {
+				keys[rec.Key] = rec.ExpiresAt
+			}
+		case storage.AOFOpPersist:
+			if _, ok := keys[rec.Key]; ok {
+				keys[rec.Key] = 0
+			}
+		}
+	}
+	onEntry := func(key []byte, entry storage.Entry) {
+		keys[string(key)] = entry.ExpiresAt
+	}
+
+	code := 0
+	ops := make(map[storage.AOFOp]int)
+	records, entries, damaged := 0, 0, 0
+	for _, t := range targets {
+		rep, err := scan(t, onRecord, onEntry)
+		if err != nil {
+			log.Printf("%s: %v", t.path, err)
+			return 1
+		}
+		fmt.Printf("file: %s (%s)\n", t.path, rep.summary())
+		for _, d := range rep.damage() {
+			printDamage(os.Stdout, d)
+			damaged++
+		}
+		for op, n := range rep.ops {
+			ops[op] += n
+		}
+		records += rep.aof.Records
+		entries += rep.rdb.Entries
+	}
+	if damaged > 0 {
+		code = 1
+	}
+
+	if len(targets) > 1 || records > 0 {
+		fmt.Printf("records: %d (SET %d, DEL %d, PEXPIREAT %d, PERSIST %d)\n", records,
+			ops[storage.AOFOpSet], ops[storage.AOFOpDel], ops[storage.AOFOpExpireAt], ops[storage.AOFOpPersist])
+	}
+	if entries > 0 {
+		fmt.Printf("rdb entries: %d\n", entries)
+	}
+	fmt.Printf("keys: %d\n", len(keys))
+
+	buckets := []struct {
+		label string
+		limit time.Duration
+		n     int
+	}{
+		{label: "<1m", limit: time.Minute},
+		{label: "<1h", limit: time.Hour},
+		{label: "<1d", limit: 24 * time.Hour},
+		{label: ">=1d"},
+	}
+	persistent, expired := 0, 0
+	now := time.Now().UnixMilli()
+	for _, expiresAt := range keys {
+		switch {
+		case expiresAt == 0:
+			persistent++
+		case expiresAt <= now:
+			expired++
+		default:
+			left := time.Duration(expiresAt-now) * time.Millisecond
+			for i := range buckets {
+				if buckets[i].limit == 0 || left < buckets[i].limit {
+					buckets[i].n++
+					break
+				}
+			}
+		}
+	}
+	fmt.Printf("ttl: none %d, expired %d", persistent, expired)
+	for _, b := range buckets {
+		fmt.Printf(", %s %d", b.label, b.n)
+	}
+	fmt.Println()
+	fmt.Printf("damage: %d\n", damaged)
+	return code
+}
+
+func runRepair(args []string) int {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	mode := fs.String("mode", "truncate", "truncate: drop everything from the first damage on; skip: drop only damaged records")
+	out := fs.String("out", "", "output file (default: repair in place, keeping the original as <file>.bak)")
+	compression := fs.String("compression", "none", "compression of a repaired RDB: none or deflate")
+	path, ok := parsePath(fs, args)
+	if !ok {
+		return 2
+	}
+	policy, err := storage.ParseCorruptPolicy(*mode)
+	if err != nil || policy == storage.CorruptFail {
+		log.Printf("invalid -mode %q", *mode)
+		return 2
+	}
+	comp, err := storage.ParseRDBCompression(*compression)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	kind, err := detectKind(path)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	rep, err := scan(target{path: path, kind: kind}, func(storage.AOFRecord) {}, func([]byte, storage.Entry) {})
+	if err != nil {
+		log.Printf("%s: %v", path, err)
+		return 1
+	}
+	if len(rep.damage()) == 0 && *out == "" {
+		fmt.Printf("%s: no damage found, nothing to repair\n", path)
+		return 0
+	}
+
+	dst := *out
+	if dst == "" {
+		dst = path
+	}
+	summary, damage, err := repair(path, dst, kind, policy, comp)
+	if err != nil {
+		log.Printf("repair %s: %v", path, err)
+		return 1
+	}
+	fmt.Printf("repaired %s -> %s (%s): %s\n", path, dst, policy, summary)
+	for _, d := range damage {
+		printDamage(os.Stdout, d)
+	}
+	return 0
+}
+
+// repair writes the readable contents of src to dst as rewrite does. It
+// returns a summary and the damage dropped.
+func repair(src, dst string, kind fileKind, policy storage.CorruptPolicy, comp storage.RDBCompression) (string, []storage.Damage, error) {
+	var summary string
+	var damage []storage.Damage
+	err := rewrite(src, dst, func(w io.Writer, r io.Reader) error {
+		if kind == kindRDB {
+			res, err := storage.RepairRDB(w, r, policy, comp, keyring)
+			summary, damage = fmt.Sprintf("kept %d entries", res.Entries), res.Damage
+			return err
+		}
+		res, err := storage.RepairAOF(w, r, policy, keyring)
+		summary, damage = fmt.Sprintf("kept %d records", res.Records), res.Damage
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return summary, damage, nil
+}
+
+// rewrite passes src to fill to write a temporary file and renames it to
+// dst, keeping src as a .bak copy when it is replaced.
+func rewrite(src, dst string, fill func(w io.Writer, r io.Reader) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpPath := dst + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	err = fill(tmp, in)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if abs(src) == abs(dst) {
+		if err := os.Rename(src, src+".bak"); err != nil {
+			_ = os.Remove(tmpPath)
+			return err
+		}
+	}
+	return os.Rename(tmpPath, dst)
+}
+
+func runDecrypt(args []string) int {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	out := fs.String("out", "", "output file (default: decrypt in place, keeping the original as <file>.bak)")
+	compression := fs.String("compression", "none", "compression of a decrypted RDB: none or deflate")
+	path, ok := parsePath(fs, args)
+	if !ok {
+		return 2
+	}
+	comp, err := storage.ParseRDBCompression(*compression)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	kind, err := detectKind(path)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	rep, err := scan(target{path: path, kind: kind}, func(storage.AOFRecord) {}, func([]byte, storage.Entry) {})
+	if err != nil {
+		log.Printf("%s: %v", path, err)
+		return 1
+	}
+	if rep.keyID() == "" {
+		fmt.Printf("%s: not encrypted, nothing to decrypt\n", path)
+		return 0
+	}
+	if len(rep.damage()) > 0 {
+		log.Printf("%s: file is damaged, run kvcheck repair first", path)
+		return 1
+	}
+
+	dst := *out
+	if dst == "" {
+		dst = path
+	}
+	var summary string
+	if err := rewrite(path, dst, func(w io.Writer, r io.Reader) error {
+		if kind == kindRDB {
+			res, err := storage.DecryptRDB(w, r, comp, keyring)
+			summary = fmt.Sprintf("%d entries", res.Entries)
+			return err
+		}
+		n, err := storage.ConvertAOF(w, r, storage.AOFFormatBinary, keyring)
+		summary = fmt.Sprintf("%d records", n)
+		return err
+	}); err != nil {
+		log.Printf("decrypt %s: %v", path, err)
+		return 1
+	}
+	fmt.Printf("decrypted %s -> %s (key %s): %s\n", path, dst, rep.keyID(), summary)
+	return 0
+}
+
+// dumpLine is one line of dump output. A key that is not valid UTF-8 would
+// be mangled in a JSON string and is given in base64 as KeyB64 instead.
+type dumpLine struct {
+	File        string `json:"file,omitempty"`
+	Seq         int64  `json:"seq,omitempty"`
+	Timestamp   int64  `json:"timestamp,omitempty"`
+	Op          string `json:"op,omitempty"`
+	Key         string `json:"key"`
+	KeyB64      []byte `json:"key_b64,omitempty"`
+	Value       []byte `json:"value"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`
+	Flags       uint32 `json:"flags,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+func runDump(args []string) int {
+	path, ok := parsePath(flag.NewFlagSet("dump", flag.ExitOnError), args)
+	if !ok {
+		return 2
+	}
+	targets, err := resolve(path)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+	var encErr error
+	emit := func(line dumpLine) {
+		if !utf8.ValidString(line.Key) {
+			line.Key, line.KeyB64 = "", []byte(line.Key)
+		}
+		if encErr == nil {
+			encErr = enc.Encode(line)
+		}
+	}
+
+	code := 0
+	for _, t := range targets {
+		file := ""
+		if len(targets) > 1 {
+			file = filepath.Base(t.path)
+		}
+		rep, err := scan(t, func(rec storage.AOFRecord) {
+			emit(dumpLine{
+				File:        file,
+				Seq:         rec.Seq,
+				Timestamp:   rec.Timestamp,
+				Op:          rec.Op.String(),
+				Key:         rec.Key,
+				Value:       rec.Value,
+				ExpiresAt:   rec.ExpiresAt,
+				Flags:       rec.Meta.Flags,
+				ContentType: rec.Meta.ContentType,
+			})
+		}, func(key []byte, entry storage.Entry) {
+			emit(dumpLine{File: file, Key: string(key), Value: entry.Value, ExpiresAt: entry.ExpiresAt, Flags: entry.Meta.Flags, ContentType: entry.Meta.ContentType})
+		})
+		if err != nil {
+			w.Flush()
+			log.Printf("%s: %v", t.path, err)
+			return 1
+		}
+		for _, d := range rep.damage() {
+			log.Printf("%s: skipped damage at offset %d: %v (%d bytes)", t.path, d.Offset, d.Err, d.Length)
+			code = 1
+		}
+	}
+	if encErr != nil {
+		log.Print(encErr)
+		return 1
+	}
+	return code
+}
+
+func abs(path string) string {
+	if p, err := filepath.Abs(path); err == nil {
+		return p
+	}
+	return path
+}
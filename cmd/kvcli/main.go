@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -18,10 +20,16 @@ type CLI struct {
 	prompt string
 }
 
-func NewCLI(host string, port int) *CLI {
+// NewCLI connects to the HTTP API at host:port, or to the binary protocol
+// listener there if binary is set.
+func NewCLI(host string, port int, binary bool) *CLI {
 	baseURL := fmt.Sprintf("http://%s:%d", host, port)
+	var opts []client.Option
+	if binary {
+		opts = append(opts, client.WithBinaryTransport(fmt.Sprintf("%s:%d", host, port)))
+	}
 	return &CLI{
-		client: client.NewClient(baseURL),
+		client: client.NewClient(baseURL, opts...),
 		prompt: fmt.Sprintf("%s:%d> ", host, port),
 	}
 }
@@ -33,10 +41,67 @@ func (cli *CLI) printHelp() {
 	fmt.Println("  del <key>                         - Delete key")
 	fmt.Println("  exists <key>                      - Check if key exists")
 	fmt.Println("  ttl <key>                         - Show key ttl")
+	fmt.Println("  pttl <key>                        - Show key ttl in milliseconds")
+	fmt.Println("  expire <key> <seconds>            - Set key expiry in seconds")
+	fmt.Println("  pexpire <key> <milliseconds>      - Set key expiry in milliseconds")
+	fmt.Println("  expireat <key> <unix-seconds>     - Set absolute key expiry")
+	fmt.Println("  pexpireat <key> <unix-millis>     - Set absolute key expiry in milliseconds")
+	fmt.Println("  persist <key>                     - Remove key expiry")
+	fmt.Println("  scan <cursor> [match <pattern>] [prefix <prefix>] [count <n>]")
+	fmt.Println("                                    - Iterate keys page by page")
 	fmt.Println("  stats                             - Show server statistics")
 	fmt.Println("  snapshot                          - Trigger RDB snapshot")
+	fmt.Println("  snapshots                         - List RDB snapshots")
+	fmt.Println("  restore <snapshot-id>             - Replace all data with a snapshot")
+	fmt.Println("  bgrewriteaof                      - Start an AOF rewrite in the background")
+	fmt.Println("  aofstatus                         - Show AOF rewrite status and sizes")
 	fmt.Println("  help                              - Show this help")
 	fmt.Println("  exit / quit                       - Exit the CLI")
+	fmt.Println()
+	fmt.Println("Arguments may be quoted: \"...\" takes escapes such as \\t, \\n and \\xff for")
+	fmt.Println("binary keys and values, '...' is taken literally.")
+}
+
+// splitArgs splits a command line into arguments at whitespace. An argument
+// in double quotes is unescaped as a Go string literal, so "\xff\x00" is two
+// bytes; one in single quotes is taken as is.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for i := 0; i < len(line); {
+		switch line[i] {
+		case ' ', '\t':
+			i++
+		case '"':
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, errors.New("unterminated quote")
+			}
+			arg, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted argument %s", line[i:end+1])
+			}
+			args, i = append(args, arg), end+1
+		case '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated quote")
+			}
+			args, i = append(args, line[i+1:i+1+end]), i+end+2
+		default:
+			end := strings.IndexAny(line[i:], " \t")
+			if end < 0 {
+				end = len(line) - i
+			}
+			args, i = append(args, line[i:i+end]), i+end
+		}
+	}
+	return args, nil
 }
 
 func (cli *CLI) run() error {
@@ -59,7 +124,14 @@ func (cli *CLI) run() error {
 			continue
 		}
 
-		parts := strings.Fields(line)
+		parts, err := splitArgs(line)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		if len(parts) == 0 {
+			continue
+		}
 		cmd := strings.ToLower(parts[0])
 
 		switch cmd {
@@ -78,10 +150,26 @@ func (cli *CLI) run() error {
 			cli.handleExists(parts)
 		case "ttl":
 			cli.handleTTL(parts)
+		case "pttl":
+			cli.handlePTTL(parts)
+		case "expire", "pexpire", "expireat", "pexpireat":
+			cli.handleExpire(cmd, parts)
+		case "persist":
+			cli.handlePersist(parts)
+		case "scan":
+			cli.handleScan(parts)
 		case "stats":
 			cli.handleStats()
 		case "snapshot":
 			cli.handleSnapshot()
+		case "snapshots":
+			cli.handleSnapshots()
+		case "restore":
+			cli.handleRestore(parts)
+		case "bgrewriteaof":
+			cli.handleRewriteAOF()
+		case "aofstatus":
+			cli.handleAOFStatus()
 		default:
 			fmt.Printf("Unknown command: %s\n", cmd)
 			fmt.Println("Type 'help' for available commands")
@@ -102,12 +190,12 @@ func (cli *CLI) handleSet(parts []string) {
 	var ttl time.Duration
 
 	if len(parts) >= 5 && parts[3] == "ttl" {
-		sec, err := strconv.Atoi(parts[4])
-		if err != nil {
+		sec, err := strconv.ParseInt(parts[4], 10, 64)
+		var ok bool
+		if ttl, ok = scaleDuration(sec, time.Second); err != nil || !ok {
 			fmt.Println("Invalid TTL value")
 			return
 		}
-		ttl = time.Duration(sec) * time.Second
 	}
 
 	if err := cli.client.Set(key, []byte(value), ttl); err != nil {
@@ -135,7 +223,7 @@ func (cli *CLI) handleGet(parts []string) {
 		return
 	}
 
-	fmt.Printf("\"%s\"\n", string(value))
+	fmt.Printf("%q\n", value)
 }
 
 func (cli *CLI) handleDelete(parts []string) {
@@ -186,6 +274,132 @@ func (cli *CLI) handleTTL(parts []string) {
 	fmt.Printf("(integer) %d\n", ttl)
 }
 
+func (cli *CLI) handlePTTL(parts []string) {
+	if len(parts) != 2 {
+		fmt.Println("Usage: pttl <key>")
+		return
+	}
+
+	pttl, err := cli.client.PTTL(parts[1])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("(integer) %d\n", pttl)
+}
+
+// scaleDuration returns n units as a Duration, or false if that overflows.
+func scaleDuration(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+func (cli *CLI) handleExpire(cmd string, parts []string) {
+	units := map[string]string{
+		"expire":    "seconds",
+		"pexpire":   "milliseconds",
+		"expireat":  "unix-seconds",
+		"pexpireat": "unix-millis",
+	}
+	if len(parts) != 3 {
+		fmt.Printf("Usage: %s <key> <%s>\n", cmd, units[cmd])
+		return
+	}
+
+	n, err := strconv.ParseInt(parts[2], 10, 64)
+	// Out of range values would wrap around on the way to the server; the
+	// bounds of a Duration are also well within those of Unix milliseconds.
+	unit := time.Second
+	if strings.HasPrefix(cmd, "p") {
+		unit = time.Millisecond
+	}
+	ttl, ok := scaleDuration(n, unit)
+	if err != nil || !ok {
+		fmt.Println("Invalid expiry value")
+		return
+	}
+
+	switch cmd {
+	case "expire", "pexpire":
+		err = cli.client.Expire(parts[1], ttl)
+	case "expireat":
+		err = cli.client.ExpireAt(parts[1], time.Unix(n, 0))
+	case "pexpireat":
+		err = cli.client.ExpireAt(parts[1], time.UnixMilli(n))
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Println("OK")
+}
+
+func (cli *CLI) handlePersist(parts []string) {
+	if len(parts) != 2 {
+		fmt.Println("Usage: persist <key>")
+		return
+	}
+
+	persisted, err := cli.client.Persist(parts[1])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	if persisted {
+		fmt.Println("(integer) 1")
+	} else {
+		fmt.Println("(integer) 0")
+	}
+}
+
+func (cli *CLI) handleScan(parts []string) {
+	usage := "Usage: scan <cursor> [match <pattern>] [prefix <prefix>] [count <n>]"
+	if len(parts) < 2 || len(parts)%2 != 0 {
+		fmt.Println(usage)
+		return
+	}
+
+	var opts client.ScanOptions
+	for i := 2; i < len(parts); i += 2 {
+		switch strings.ToLower(parts[i]) {
+		case "match":
+			opts.Match = parts[i+1]
+		case "prefix":
+			opts.Prefix = parts[i+1]
+		case "count":
+			n, err := strconv.Atoi(parts[i+1])
+			if err != nil || n <= 0 {
+				fmt.Println("Invalid count value")
+				return
+			}
+			opts.Count = n
+		default:
+			fmt.Println(usage)
+			return
+		}
+	}
+
+	keys, cursor, err := cli.client.ScanPage(parts[1], opts)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("cursor: %s\n", cursor)
+	if len(keys) == 0 {
+		fmt.Println("(empty page)")
+		return
+	}
+	for i, key := range keys {
+		fmt.Printf("%d) %q\n", i+1, key)
+	}
+}
+
 func (cli *CLI) handleStats() {
 	stats, err := cli.client.Stats()
 	if err != nil {
@@ -193,6 +407,23 @@ func (cli *CLI) handleStats() {
 		return
 	}
 	fmt.Printf("keys=%d memory=%d hits=%d misses=%d uptime=%ds\n", stats.Keys, stats.Memory, stats.Hits, stats.Misses, stats.Uptime)
+	fmt.Printf("evicted_keys=%d expired_keys=%d expire_cycle_cpu=%dus\n", stats.EvictedKeys, stats.ExpiredKeys, stats.ExpireCycleCPU)
+	if stats.AOF != nil {
+		fmt.Printf("aof: fsync=%s fsyncs=%d fsync_last=%dus fsync_max=%dus pending_bytes=%d last_seq=%d streams=%d\n",
+			stats.AOF.FsyncPolicy, stats.AOF.Fsyncs, stats.AOF.FsyncLastUs, stats.AOF.FsyncMaxUs, stats.AOF.PendingBytes, stats.AOF.LastSeq, stats.AOF.Streams)
+		fmt.Printf("aof: rewrite_in_progress=%t rewrites=%d rewrite_failures=%d\n",
+			stats.AOF.RewriteInProgress, stats.AOF.Rewrites, stats.AOF.RewriteFailures)
+	}
+	if stats.EncryptionKey != "" {
+		fmt.Printf("encryption: key=%s\n", stats.EncryptionKey)
+	}
+	if r := stats.Recovery; r != nil {
+		fmt.Printf("recovery: source=%s entries=%d rdb_entries=%d aof_records=%d aof_skipped=%d duration=%dms\n",
+			r.Source, r.Entries, r.RDBEntries, r.AOFRecords, r.AOFSkipped, r.DurationMs)
+		for _, d := range r.AOFDamage {
+			fmt.Printf("  aof damage (%s): file=%s offset=%d dropped_bytes=%d error=%s\n", d.Action, d.File, d.Offset, d.Dropped, d.Error)
+		}
+	}
 	fmt.Println("requests:")
 	for op, cnt := range stats.Requests {
 		fmt.Printf("  %s: %d\n", op, cnt)
@@ -208,12 +439,67 @@ func (cli *CLI) handleSnapshot() {
 	fmt.Printf("OK: %s (%s)\n", resp.Status, resp.Path)
 }
 
+func (cli *CLI) handleSnapshots() {
+	snapshots, err := cli.client.Snapshots()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(snapshots) == 0 {
+		fmt.Println("(no snapshots)")
+		return
+	}
+	for _, snap := range snapshots {
+		created := time.UnixMilli(snap.CreatedAt).Format(time.RFC3339)
+		fmt.Printf("%s  created=%s keys=%d size=%d\n", snap.ID, created, snap.Keys, snap.Size)
+	}
+}
+
+func (cli *CLI) handleRestore(parts []string) {
+	if len(parts) != 2 {
+		fmt.Println("Usage: restore <snapshot-id>")
+		return
+	}
+	resp, err := cli.client.RestoreSnapshot(parts[1])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("OK: restored %d keys from %s\n", resp.Keys, resp.ID)
+}
+
+func (cli *CLI) handleRewriteAOF() {
+	if _, err := cli.client.RewriteAOF(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("OK: background AOF rewrite started")
+}
+
+func (cli *CLI) handleAOFStatus() {
+	st, err := cli.client.AOFStatus()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("rewrite_in_progress=%t rewrites=%d rewrite_failures=%d\n", st.RewriteInProgress, st.Rewrites, st.RewriteFailures)
+	if st.LastRewriteStatus != "" {
+		fmt.Printf("last_rewrite=%s at=%s duration=%dms\n", st.LastRewriteStatus,
+			time.UnixMilli(st.LastRewriteAt).Format(time.RFC3339), st.LastRewriteDurationMs)
+	}
+	if st.LastRewriteError != "" {
+		fmt.Printf("last_rewrite_error=%s\n", st.LastRewriteError)
+	}
+	fmt.Printf("base_size=%d current_size=%d incr_size=%d rewrite_threshold=%d\n", st.BaseSize, st.CurrentSize, st.IncrSize, st.RewriteThreshold)
+}
+
 func main() {
 	host := flag.String("h", "localhost", "server host")
 	port := flag.Int("p", 6380, "server port")
+	binary := flag.Bool("binary", false, "use the binary protocol; -p is then the binary_port of the server")
 	flag.Parse()
 
-	cli := NewCLI(*host, *port)
+	cli := NewCLI(*host, *port, *binary)
 	if err := cli.run(); err != nil {
 		log.Fatal(err)
 	}
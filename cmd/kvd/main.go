@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/shinerio/gopher-kv/internal/config"
 	"github.com/shinerio/gopher-kv/internal/core"
@@ -36,6 +37,10 @@ func setupLogger(level string) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(runRestore(os.Args[2:]))
+	}
+
 	configPath := flag.String("config", "configs/config.yaml", "path to config file")
 	flag.Parse()
 
@@ -48,6 +53,10 @@ func main() {
 	setupLogger(cfg.Log.Level)
 
 	service := core.NewService(cfg)
+	if err := service.LoadError(); err != nil {
+		slog.Error("Failed to load data, set aof.load_corrupt to truncate or skip, or repair it with kvcheck", "error", err)
+		os.Exit(1)
+	}
 	service.Start()
 
 	handler := server.NewHandler(service)
@@ -64,6 +73,31 @@ func main() {
 		}
 	}()
 
+	// Listeners for the other protocols, started when given a port.
+	var tcpServers []*server.TCPServer
+	for _, l := range []struct {
+		name string
+		port int
+		new  func(addr string, service *core.Service) *server.TCPServer
+	}{
+		{"RESP", cfg.Server.RespPort, server.NewRESPServer},
+		{"memcache", cfg.Server.MemcachePort, server.NewMemcacheServer},
+		{"binary", cfg.Server.BinaryPort, server.NewBinaryServer},
+	} {
+		if l.port <= 0 {
+			continue
+		}
+		tcpSrv := l.new(fmt.Sprintf(":%d", l.port), service)
+		tcpServers = append(tcpServers, tcpSrv)
+		go func() {
+			slog.Info("Starting "+l.name+" server", "port", l.port)
+			if err := tcpSrv.ListenAndServe(); err != nil && !errors.Is(err, server.ErrServerClosed) {
+				slog.Error(l.name+" server failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -75,7 +109,57 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		slog.Error("Server shutdown failed", "error", err)
 	}
+	for _, tcpSrv := range tcpServers {
+		if err := tcpSrv.Shutdown(ctx); err != nil {
+			slog.Error("Server shutdown failed", "error", err)
+		}
+	}
 
 	service.Stop()
 	slog.Info("Server stopped")
 }
+
+// runRestore implements "kvd restore": point-in-time recovery from the
+// snapshots and archived AOF of the configured data directory into a new one.
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := fs.String("config", "configs/config.yaml", "path to config file")
+	to := fs.String("to", "", `point in time to restore to, e.g. "2026-10-16T10:05:00Z"`)
+	out := fs.String("out", "", "new data directory to write the restored snapshot to")
+	_ = fs.Parse(args)
+
+	if *to == "" || *out == "" {
+		fs.Usage()
+		return 2
+	}
+	target, err := time.Parse(time.RFC3339, *to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --to: %v\n", err)
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("Failed to load config", "error", err)
+		return 1
+	}
+	setupLogger(cfg.Log.Level)
+
+	path, res, err := core.RestoreToTime(cfg, target, *out)
+	if err != nil {
+		slog.Error("Restore failed", "error", err)
+		return 1
+	}
+	slog.Info("Restore complete",
+		"snapshot", res.Snapshot,
+		"snapshot_entries", res.SnapshotEntries,
+		"aof_records", res.Records,
+		"first_seq", res.FirstSeq,
+		"last_seq", res.LastSeq,
+	)
+	if res.LastTimestamp > 0 {
+		fmt.Printf("restored up to the record written at %s\n", time.UnixMilli(res.LastTimestamp).UTC().Format(time.RFC3339Nano))
+	}
+	fmt.Printf("wrote %s; point rdb.file_path and aof.file_path into %s to start from it\n", path, *out)
+	return 0
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/shinerio/gopher-kv/pkg/client"
@@ -49,11 +50,25 @@ func (a *App) Disconnect() Result {
 	return Result{Success: true, Message: "disconnected"}
 }
 
+// parseKey reads a key typed into the frontend. A key in double quotes is
+// unescaped as a Go string literal, so binary keys can be entered as
+// "\xff\x00"; anything else is taken as is.
+func parseKey(key string) (string, error) {
+	if len(key) >= 2 && key[0] == '"' && key[len(key)-1] == '"' {
+		return strconv.Unquote(key)
+	}
+	return key, nil
+}
+
 // SetKey writes key=value with an optional TTL (0 means no expiry).
 func (a *App) SetKey(key, value string, ttlSeconds int) Result {
 	if a.client == nil {
 		return Result{Success: false, Message: "not connected"}
 	}
+	key, err := parseKey(key)
+	if err != nil {
+		return Result{Success: false, Message: fmt.Sprintf("invalid key: %v", err)}
+	}
 	var ttl time.Duration
 	if ttlSeconds > 0 {
 		ttl = time.Duration(ttlSeconds) * time.Second
@@ -70,6 +85,10 @@ func (a *App) GetKey(key string) Result {
 	if a.client == nil {
 		return Result{Success: false, Message: "not connected"}
 	}
+	key, err := parseKey(key)
+	if err != nil {
+		return Result{Success: false, Message: fmt.Sprintf("invalid key: %v", err)}
+	}
 	val, err := a.client.Get(key)
 	if err != nil {
 		return Result{Success: false, Message: err.Error()}
@@ -86,6 +105,10 @@ func (a *App) DeleteKey(key string) Result {
 	if a.client == nil {
 		return Result{Success: false, Message: "not connected"}
 	}
+	key, err := parseKey(key)
+	if err != nil {
+		return Result{Success: false, Message: fmt.Sprintf("invalid key: %v", err)}
+	}
 	if err := a.client.Delete(key); err != nil {
 		return Result{Success: false, Message: err.Error()}
 	}
@@ -97,6 +120,10 @@ func (a *App) ExistsKey(key string) Result {
 	if a.client == nil {
 		return Result{Success: false, Message: "not connected"}
 	}
+	key, err := parseKey(key)
+	if err != nil {
+		return Result{Success: false, Message: fmt.Sprintf("invalid key: %v", err)}
+	}
 	exists, err := a.client.Exists(key)
 	if err != nil {
 		return Result{Success: false, Message: err.Error()}
@@ -112,6 +139,10 @@ func (a *App) GetTTL(key string) Result {
 	if a.client == nil {
 		return Result{Success: false, Message: "not connected"}
 	}
+	key, err := parseKey(key)
+	if err != nil {
+		return Result{Success: false, Message: fmt.Sprintf("invalid key: %v", err)}
+	}
 	ttl, err := a.client.TTL(key)
 	if err != nil {
 		return Result{Success: false, Message: err.Error()}
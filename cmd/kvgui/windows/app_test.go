@@ -92,3 +92,21 @@ func TestConnect_InvalidAddress(t *testing.T) {
 		t.Fatal("Connect to invalid address should fail")
 	}
 }
+
+func TestParseKey(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain":      "plain",
+		`"tab\tkey"`: "tab\tkey",
+		`"\xff\x00"`: "\xff\x00",
+		`"`:          `"`,
+		`say "hi"`:   `say "hi"`,
+	} {
+		got, err := parseKey(in)
+		if err != nil || got != want {
+			t.Fatalf("parseKey(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := parseKey(`"\q"`); err == nil {
+		t.Fatal("expected an error for an invalid escape")
+	}
+}
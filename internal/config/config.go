@@ -9,37 +9,69 @@ import (
 )
 
 type Config struct {
-	Server  ServerConfig  `yaml:"server"`
-	Storage StorageConfig `yaml:"storage"`
-	AOF     AOFConfig     `yaml:"aof"`
-	RDB     RDBConfig     `yaml:"rdb"`
-	Log     LogConfig     `yaml:"log"`
+	Server     ServerConfig     `yaml:"server"`
+	Storage    StorageConfig    `yaml:"storage"`
+	TTL        TTLConfig        `yaml:"ttl"`
+	AOF        AOFConfig        `yaml:"aof"`
+	RDB        RDBConfig        `yaml:"rdb"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	Log        LogConfig        `yaml:"log"`
 }
 
 type ServerConfig struct {
 	Port            int           `yaml:"port"`
+	RespPort        int           `yaml:"resp_port"`
+	MemcachePort    int           `yaml:"memcache_port"`
+	BinaryPort      int           `yaml:"binary_port"`
 	ReadTimeout     time.Duration `yaml:"read_timeout"`
 	WriteTimeout    time.Duration `yaml:"write_timeout"`
 	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
 }
 
 type StorageConfig struct {
-	ShardCount   int   `yaml:"shard_count"`
-	MaxKeySize   int   `yaml:"max_key_size"`
-	MaxValueSize int   `yaml:"max_value_size"`
-	MaxMemory    int64 `yaml:"max_memory"`
+	ShardCount      int    `yaml:"shard_count"`
+	MaxKeySize      int    `yaml:"max_key_size"`
+	MaxValueSize    int    `yaml:"max_value_size"`
+	MaxMemory       int64  `yaml:"max_memory"`
+	EvictionPolicy  string `yaml:"eviction_policy"`
+	EvictionSamples int    `yaml:"eviction_samples"`
+	BinaryKeys      bool   `yaml:"binary_keys"`
+}
+
+type TTLConfig struct {
+	Engine                 string        `yaml:"engine"`
+	WheelTick              time.Duration `yaml:"wheel_tick"`
+	ActiveExpireInterval   time.Duration `yaml:"active_expire_interval"`
+	ActiveExpireSamples    int           `yaml:"active_expire_samples"`
+	ActiveExpireCPUPercent int           `yaml:"active_expire_cpu_percent"`
 }
 
 type AOFConfig struct {
 	Enabled          bool   `yaml:"enabled"`
 	FilePath         string `yaml:"file_path"`
+	DirName          string `yaml:"dir_name"`
 	RewriteThreshold int64  `yaml:"rewrite_threshold"`
+	Fsync            string `yaml:"fsync"`
+	Format           string `yaml:"format"`
+	ArchiveDir       string `yaml:"archive_dir"`
+	ArchiveKeepHours int    `yaml:"archive_keep_hours"`
+	LoadCorrupt      string `yaml:"load_corrupt"`
+	Streams          int    `yaml:"streams"`
 }
 
 type RDBConfig struct {
-	Enabled   bool       `yaml:"enabled"`
-	FilePath  string     `yaml:"file_path"`
-	SaveRules []SaveRule `yaml:"save_rules"`
+	Enabled     bool       `yaml:"enabled"`
+	FilePath    string     `yaml:"file_path"`
+	Compression string     `yaml:"compression"`
+	KeepLast    int        `yaml:"keep_last"`
+	KeepHours   int        `yaml:"keep_hours"`
+	SaveRules   []SaveRule `yaml:"save_rules"`
+}
+
+type EncryptionConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	KeyFile string `yaml:"key_file"`
+	KeyEnv  string `yaml:"key_env"`
 }
 
 type SaveRule struct {
@@ -60,25 +92,44 @@ func DefaultConfig() *Config {
 			ShutdownTimeout: 30 * time.Second,
 		},
 		Storage: StorageConfig{
-			ShardCount:   256,
-			MaxKeySize:   256,
-			MaxValueSize: 1048576,
-			MaxMemory:    268435456,
+			ShardCount:      256,
+			MaxKeySize:      256,
+			MaxValueSize:    1048576,
+			MaxMemory:       268435456,
+			EvictionPolicy:  "noeviction",
+			EvictionSamples: 5,
+		},
+		TTL: TTLConfig{
+			Engine:                 "heap",
+			WheelTick:              10 * time.Millisecond,
+			ActiveExpireInterval:   100 * time.Millisecond,
+			ActiveExpireSamples:    20,
+			ActiveExpireCPUPercent: 25,
 		},
 		AOF: AOFConfig{
 			Enabled:          true,
 			FilePath:         "./data/appendonly.aof",
+			DirName:          "appendonlydir",
 			RewriteThreshold: 67108864,
+			Fsync:            "everysec",
+			Format:           "binary",
+			LoadCorrupt:      "fail",
+			Streams:          1,
 		},
 		RDB: RDBConfig{
-			Enabled:  true,
-			FilePath: "./data/dump.rdb",
+			Enabled:     true,
+			FilePath:    "./data/dump.rdb",
+			Compression: "none",
+			KeepLast:    3,
 			SaveRules: []SaveRule{
 				{Seconds: 900, Changes: 1},
 				{Seconds: 300, Changes: 10},
 				{Seconds: 60, Changes: 10000},
 			},
 		},
+		Encryption: EncryptionConfig{
+			KeyEnv: "GOPHERKV_ENCRYPTION_KEY",
+		},
 		Log: LogConfig{
 			Level: "info",
 		},
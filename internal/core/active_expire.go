@@ -0,0 +1,81 @@
+package core
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultActiveExpireSamples    = 20
+	defaultActiveExpireCPUPercent = 25
+	// activeExpireStalePercent is the share of expired keys in a sample above
+	// which a shard is sampled again within the same cycle.
+	activeExpireStalePercent = 10
+)
+
+// activeExpireCycle reclaims keys that expired without the expiry engine
+// noticing them yet, e.g. ones only hidden by lazy checks in Get. Like Redis
+// it samples each shard in turn, keeps sampling a shard while more than
+// activeExpireStalePercent of the sample was expired, and stops once the
+// cycle has used its share of the interval. The next cycle resumes at the
+// shard where this one stopped.
+func (s *Service) activeExpireCycle(budget time.Duration) {
+	start := time.Now()
+	samples := s.cfg.TTL.ActiveExpireSamples
+	if samples <= 0 {
+		samples = defaultActiveExpireSamples
+	}
+
+	shardCount := s.storage.ShardCount()
+	for i := 0; i < shardCount; i++ {
+		idx := s.expireCursor
+		s.expireCursor = (idx + 1) % shardCount
+		for {
+			sampled, expired, memDelta := s.storage.ExpireSample(idx, samples, time.Now().UnixMilli())
+			if len(expired) > 0 {
+				atomic.AddInt64(&s.memUsage, memDelta)
+				atomic.AddInt64(&s.expiredKeys, int64(len(expired)))
+				for _, key := range expired {
+					s.ttlMgr.Remove(key)
+				}
+			}
+			if time.Since(start) >= budget {
+				s.expireCycleCPU.Add(time.Since(start).Microseconds())
+				return
+			}
+			if sampled == 0 || len(expired)*100 <= sampled*activeExpireStalePercent {
+				break
+			}
+		}
+	}
+	s.expireCycleCPU.Add(time.Since(start).Microseconds())
+}
+
+func (s *Service) startActiveExpireLoop() {
+	interval := s.cfg.TTL.ActiveExpireInterval
+	if interval <= 0 {
+		return
+	}
+	percent := s.cfg.TTL.ActiveExpireCPUPercent
+	if percent <= 0 || percent > 100 {
+		percent = defaultActiveExpireCPUPercent
+	}
+	budget := interval * time.Duration(percent) / 100
+
+	s.activeExpireWG.Add(1)
+	go func() {
+		defer s.activeExpireWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.activeExpireStopCh:
+				return
+			case <-ticker.C:
+				s.activeExpireCycle(budget)
+			}
+		}
+	}()
+	slog.Debug("active expire cycle started", "interval", interval, "budget", budget)
+}
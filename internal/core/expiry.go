@@ -0,0 +1,43 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shinerio/gopher-kv/internal/config"
+)
+
+const defaultWheelTick = 10 * time.Millisecond
+
+// ExpiryEngine tracks key deadlines and invokes its callback with the
+// deadline that fired. Implementations keep one pending deadline per key.
+type ExpiryEngine interface {
+	Add(key string, expiresAt int64)
+	Remove(key string)
+	Len() int
+	Start()
+	Stop()
+}
+
+var (
+	_ ExpiryEngine = (*TTLManager)(nil)
+	_ ExpiryEngine = (*TimingWheel)(nil)
+)
+
+// NewExpiryEngine builds the backend selected by cfg.Engine. The wheel is
+// sharded with the same shardOf function as the storage map so that writes
+// to different storage shards never contend on the same expiry lock.
+func NewExpiryEngine(cfg config.TTLConfig, shardCount int, shardOf func(key string) int, onExpire func(key string, expiresAt int64)) (ExpiryEngine, error) {
+	switch cfg.Engine {
+	case "", "heap":
+		return NewTTLManager(onExpire), nil
+	case "wheel":
+		tick := cfg.WheelTick
+		if tick <= 0 {
+			tick = defaultWheelTick
+		}
+		return NewTimingWheel(tick, shardCount, shardOf, onExpire), nil
+	default:
+		return nil, fmt.Errorf("unknown ttl engine %q", cfg.Engine)
+	}
+}
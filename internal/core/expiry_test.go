@@ -0,0 +1,110 @@
+package core
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shinerio/gopher-kv/internal/config"
+	"github.com/shinerio/gopher-kv/internal/storage"
+)
+
+func TestTimingWheelFiresOnDeadlineTickAcrossLevels(t *testing.T) {
+	fired := make(map[string]int64)
+	var current int64
+	w := NewTimingWheel(time.Millisecond, 1, nil, func(key string, _ int64) {
+		fired[key] = current
+	})
+	for _, sh := range w.shards {
+		sh.next = 0
+	}
+
+	deadlines := map[string]int64{
+		"level0":   5,
+		"level1":   70,
+		"boundary": 4096,
+		"level2":   5000,
+		"level3":   300000,
+	}
+	for key, at := range deadlines {
+		w.Add(key, at)
+	}
+	w.Add("removed", 10)
+	w.Remove("removed")
+	w.Add("moved", 20)
+	w.Add("moved", 80)
+	deadlines["moved"] = 80
+
+	for current = 0; current <= 300000; current++ {
+		w.advance(current)
+	}
+
+	if len(fired) != len(deadlines) {
+		t.Fatalf("expected %d expirations, got %v", len(deadlines), fired)
+	}
+	for key, at := range deadlines {
+		if fired[key] != at {
+			t.Errorf("%s fired at tick %d, want %d", key, fired[key], at)
+		}
+	}
+	if w.Len() != 0 {
+		t.Fatalf("wheel should be empty, has %d entries", w.Len())
+	}
+}
+
+func TestServiceWithWheelEngine(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	cfg.TTL = config.TTLConfig{Engine: "wheel", WheelTick: 5 * time.Millisecond}
+	svc := NewService(cfg)
+	if _, ok := svc.ttlMgr.(*TimingWheel); !ok {
+		t.Fatalf("expected timing wheel engine, got %T", svc.ttlMgr)
+	}
+	svc.Start()
+	defer svc.Stop()
+
+	for i := 0; i < 50; i++ {
+		if err := svc.Set(fmt.Sprintf("k%d", i), []byte("v"), 100*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := svc.Set("k0", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for svc.Keys() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only k0 to survive, got %d keys", svc.Keys())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if ok, _ := svc.Exists("k0"); !ok {
+		t.Fatal("k0 was rewritten without ttl and must survive")
+	}
+}
+
+func benchmarkExpiryEngineAdd(b *testing.B, engine string) {
+	cm := storage.NewConcurrentMap(256)
+	e, err := NewExpiryEngine(config.TTLConfig{Engine: engine}, cm.ShardCount(), cm.ShardIndex, func(string, int64) {})
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := make([]string, 1<<16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("session:%d", i)
+	}
+	base := time.Now().Add(time.Minute).UnixMilli()
+	var seq atomic.Int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := seq.Add(1)
+			e.Add(keys[n&int64(len(keys)-1)], base+n%30000)
+		}
+	})
+}
+
+func BenchmarkExpiryEngineAddHeap(b *testing.B)  { benchmarkExpiryEngineAdd(b, "heap") }
+func BenchmarkExpiryEngineAddWheel(b *testing.B) { benchmarkExpiryEngineAdd(b, "wheel") }
@@ -0,0 +1,45 @@
+package core
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// keyspaceStripes is the number of locks writes are spread over.
+const keyspaceStripes = 64
+
+// keyspaceLock keeps writes from straddling a snapshot, or the swap of the
+// keyspace on restore and the persistence that follows it. A write holds
+// the stripe of its key shared, so concurrent writes to different keys
+// rarely share a cache line; Lock takes every stripe, in order, and waits
+// for all writes in progress.
+type keyspaceLock struct {
+	seed    maphash.Seed
+	stripes [keyspaceStripes]struct {
+		sync.RWMutex
+		_ [40]byte // pad to a cache line
+	}
+}
+
+func newKeyspaceLock() *keyspaceLock {
+	return &keyspaceLock{seed: maphash.MakeSeed()}
+}
+
+// rlock holds the stripe of key shared and returns it for RUnlock.
+func (l *keyspaceLock) rlock(key string) *sync.RWMutex {
+	mu := &l.stripes[maphash.String(l.seed, key)%keyspaceStripes].RWMutex
+	mu.RLock()
+	return mu
+}
+
+func (l *keyspaceLock) Lock() {
+	for i := range l.stripes {
+		l.stripes[i].Lock()
+	}
+}
+
+func (l *keyspaceLock) Unlock() {
+	for i := range l.stripes {
+		l.stripes[i].Unlock()
+	}
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/shinerio/gopher-kv/internal/config"
+	"github.com/shinerio/gopher-kv/internal/storage"
+)
+
+// RestoreToTime rebuilds the keyspace as it was at target from the snapshots
+// and the archived AOF that cfg describes, and saves it as a snapshot in
+// dataDir, which must be empty or not exist yet. The source files are only
+// read, so this can run next to a live server. It returns the path of the
+// new snapshot.
+func RestoreToTime(cfg *config.Config, target time.Time, dataDir string) (string, storage.PITRResult, error) {
+	var res storage.PITRResult
+	if entries, err := os.ReadDir(dataDir); err == nil && len(entries) > 0 {
+		return "", res, fmt.Errorf("data directory %s is not empty", dataDir)
+	}
+	compression, err := storage.ParseRDBCompression(cfg.RDB.Compression)
+	if err != nil {
+		return "", res, err
+	}
+	var keys *storage.Keyring
+	if cfg.Encryption.Enabled {
+		if keys, err = storage.LoadKeyring(cfg.Encryption.KeyFile, cfg.Encryption.KeyEnv); err != nil {
+			return "", res, fmt.Errorf("load encryption keys: %w", err)
+		}
+	}
+
+	restored := storage.NewConcurrentMap(cfg.Storage.ShardCount)
+	res, err = storage.RecoverToTime(storage.PITROptions{
+		RDB: storage.RDBOptions{Path: cfg.RDB.FilePath, Keys: keys},
+		AOF: storage.AOFOptions{
+			Path:       cfg.AOF.FilePath,
+			DirName:    cfg.AOF.DirName,
+			ArchiveDir: cfg.AOF.ArchiveDir,
+			Streams:    cfg.AOF.Streams,
+			Keys:       keys,
+		},
+	}, target, restored)
+	if err != nil {
+		return "", res, err
+	}
+
+	rdb := storage.NewRDBManager(storage.RDBOptions{
+		Path:        filepath.Join(dataDir, filepath.Base(cfg.RDB.FilePath)),
+		Compression: compression,
+		Keys:        keys,
+	})
+	path, err := rdb.Save(restored, max(res.SnapshotSeq, res.LastSeq))
+	return path, res, err
+}
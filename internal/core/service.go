@@ -5,10 +5,11 @@ import (
 	"fmt"
 	"log/slog"
 	"math"
-	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/shinerio/gopher-kv/internal/config"
 	"github.com/shinerio/gopher-kv/internal/storage"
@@ -18,27 +19,55 @@ import (
 var (
 	ErrKeyNotFound   = errors.New("key not found")
 	ErrKeyTooLong    = errors.New("key too long")
+	ErrInvalidKey    = errors.New("key is not valid utf-8")
 	ErrValueTooLarge = errors.New("value too large")
 	ErrMemoryFull    = errors.New("memory full")
+	ErrInvalidCursor = storage.ErrInvalidCursor
+
+	ErrSnapshotNotFound = storage.ErrSnapshotNotFound
+
+	ErrAOFDisabled          = errors.New("aof disabled")
+	ErrAOFRewriteInProgress = storage.ErrAOFRewriteInProgress
+)
+
+const (
+	defaultScanCount = 10
+	maxScanCount     = 1000
 )
 
 type Service struct {
 	cfg            *config.Config
 	storage        *storage.ConcurrentMap
-	ttlMgr         *TTLManager
+	ttlMgr         ExpiryEngine
 	persister      *storage.AOFPersister
 	snapshotter    *storage.RDBManager
+	evictionPolicy storage.EvictionPolicy
+	fsyncPolicy    storage.FsyncPolicy
+	aofFormat      storage.AOFFormat
+	rdbCompression storage.RDBCompression
+	loadCorrupt    storage.CorruptPolicy
+	keys           *storage.Keyring
 	memUsage       int64
 	hits           int64
 	misses         int64
+	evictedKeys    int64
+	expiredKeys    int64
+	expireCycleCPU atomic.Int64
+	expireCursor   int
 	changes        int64
 	requests       atomic.Value
 	startTime      time.Time
+	recovery       protocol.RecoveryReport
+	loadErr        error
 	lastSnapshotAt atomic.Int64
 	stopOnce       sync.Once
 	snapshotMu     sync.Mutex
+	keyspace       *keyspaceLock
 	autoSaveStopCh chan struct{}
 	autoSaveWG     sync.WaitGroup
+
+	activeExpireStopCh chan struct{}
+	activeExpireWG     sync.WaitGroup
 }
 
 func NewService(cfg *config.Config) *Service {
@@ -46,16 +75,59 @@ func NewService(cfg *config.Config) *Service {
 		cfg:       cfg,
 		storage:   storage.NewConcurrentMap(cfg.Storage.ShardCount),
 		startTime: time.Now(),
+		keyspace:  newKeyspaceLock(),
 	}
-	s.ttlMgr = NewTTLManager(func(key string) {
-		memDelta := s.storage.Delete(key)
-		atomic.AddInt64(&s.memUsage, memDelta)
-		slog.Debug("TTL expired", "key", key)
+	policy, err := storage.ParseEvictionPolicy(cfg.Storage.EvictionPolicy)
+	if err != nil {
+		slog.Warn("invalid eviction policy, falling back to noeviction", "error", err)
+	}
+	s.evictionPolicy = policy
+	s.ttlMgr, err = NewExpiryEngine(cfg.TTL, s.storage.ShardCount(), s.storage.ShardIndex, s.onExpire)
+	if err != nil {
+		slog.Warn("invalid ttl engine, falling back to heap", "error", err)
+		s.ttlMgr = NewTTLManager(s.onExpire)
+	}
+	s.fsyncPolicy, err = storage.ParseFsyncPolicy(cfg.AOF.Fsync)
+	if err != nil {
+		slog.Warn("invalid aof fsync policy, falling back to everysec", "error", err)
+	}
+	s.aofFormat, err = storage.ParseAOFFormat(cfg.AOF.Format)
+	if err != nil {
+		slog.Warn("invalid aof format, falling back to binary", "error", err)
+	}
+	s.loadCorrupt, err = storage.ParseCorruptPolicy(cfg.AOF.LoadCorrupt)
+	if err != nil {
+		slog.Warn("invalid aof load_corrupt policy, falling back to fail", "error", err)
+	}
+	s.rdbCompression, err = storage.ParseRDBCompression(cfg.RDB.Compression)
+	if err != nil {
+		slog.Warn("invalid rdb compression, falling back to none", "error", err)
+	}
+	if cfg.Encryption.Enabled {
+		// Running without the keys would leave the data unreadable or
+		// write it unencrypted, so a missing key stops the load.
+		if s.keys, err = storage.LoadKeyring(cfg.Encryption.KeyFile, cfg.Encryption.KeyEnv); err != nil {
+			s.loadErr = fmt.Errorf("load encryption keys: %w", err)
+		} else if s.aofFormat == storage.AOFFormatText {
+			slog.Warn("aof text format cannot be encrypted, using binary")
+		}
+	}
+	s.snapshotter = storage.NewRDBManager(storage.RDBOptions{
+		Path:        cfg.RDB.FilePath,
+		Compression: s.rdbCompression,
+		KeepLast:    cfg.RDB.KeepLast,
+		KeepHours:   cfg.RDB.KeepHours,
+		Keys:        s.keys,
 	})
-	s.snapshotter = storage.NewRDBManager(cfg.RDB.FilePath)
-	s.loadOnStartup()
-	s.persister = storage.NewAOFPersister(cfg.AOF.FilePath, cfg.AOF.RewriteThreshold, s.storage)
-	if cfg.AOF.Enabled {
+	s.persister = storage.NewAOFPersister(s.aofOptions(), s.storage)
+	if s.loadErr == nil {
+		s.loadOnStartup()
+	} else {
+		s.recovery = protocol.RecoveryReport{Source: "none", Error: s.loadErr.Error()}
+		slog.Error("startup recovery skipped", "error", s.loadErr)
+	}
+	// Appending after a file that failed to load would bury the damage.
+	if cfg.AOF.Enabled && s.loadErr == nil {
 		if err := s.persister.OpenForAppend(); err != nil {
 			slog.Error("open aof append file failed", "error", err)
 		}
@@ -64,11 +136,39 @@ func NewService(cfg *config.Config) *Service {
 	s.lastSnapshotAt.Store(time.Now().Unix())
 	s.requests.Store(make(map[string]int64))
 	s.autoSaveStopCh = make(chan struct{})
+	s.activeExpireStopCh = make(chan struct{})
 	return s
 }
 
+func (s *Service) aofOptions() storage.AOFOptions {
+	return storage.AOFOptions{
+		Path:             s.cfg.AOF.FilePath,
+		DirName:          s.cfg.AOF.DirName,
+		RewriteThreshold: s.cfg.AOF.RewriteThreshold,
+		Fsync:            s.fsyncPolicy,
+		Format:           s.aofFormat,
+		BaseCompression:  s.rdbCompression,
+		ArchiveDir:       s.cfg.AOF.ArchiveDir,
+		ArchiveKeepHours: s.cfg.AOF.ArchiveKeepHours,
+		LoadCorrupt:      s.loadCorrupt,
+		Streams:          s.cfg.AOF.Streams,
+		Keys:             s.keys,
+	}
+}
+
+func (s *Service) onExpire(key string, expiresAt int64) {
+	memDelta, deleted := s.storage.DeleteIfExpired(key, expiresAt)
+	if !deleted {
+		return
+	}
+	atomic.AddInt64(&s.memUsage, memDelta)
+	atomic.AddInt64(&s.expiredKeys, 1)
+	slog.Debug("TTL expired", "key", key)
+}
+
 func (s *Service) Start() {
 	s.ttlMgr.Start()
+	s.startActiveExpireLoop()
 	s.startAutoSnapshotLoop()
 }
 
@@ -76,9 +176,12 @@ func (s *Service) Stop() {
 	s.stopOnce.Do(func() {
 		close(s.autoSaveStopCh)
 		s.autoSaveWG.Wait()
+		close(s.activeExpireStopCh)
+		s.activeExpireWG.Wait()
 		s.ttlMgr.Stop()
-		if s.cfg.RDB.Enabled {
-			if _, err := s.snapshotter.Save(s.storage); err != nil {
+		// A snapshot of a partial load would replace the last good one.
+		if s.cfg.RDB.Enabled && s.loadErr == nil {
+			if _, err := s.snapshotter.Save(s.storage, s.aofLastSeq()); err != nil {
 				slog.Error("snapshot on shutdown failed", "error", err)
 			}
 		}
@@ -94,26 +197,163 @@ func (s *Service) Stop() {
 }
 
 func (s *Service) loadOnStartup() {
-	if s.cfg.AOF.Enabled {
-		if _, err := os.Stat(s.cfg.AOF.FilePath); err == nil {
-			p := storage.NewAOFPersister(s.cfg.AOF.FilePath, s.cfg.AOF.RewriteThreshold, s.storage)
-			loaded, err := p.Replay()
-			if err != nil {
-				slog.Error("aof replay failed", "error", err)
-			} else {
-				slog.Info("aof replayed", "entries", loaded)
-			}
-			return
-		}
+	start := time.Now()
+	report := protocol.RecoveryReport{Source: "none"}
+	s.loadPersistedData(&report)
+	s.rebuildExpiryIndex(s.storage, &report)
+	report.DurationMs = time.Since(start).Milliseconds()
+	s.recovery = report
+
+	slog.Info("startup recovery finished",
+		"source", report.Source,
+		"entries", report.Entries,
+		"live_keys", report.LiveKeys,
+		"expired_on_load", report.ExpiredOnLoad,
+		"ttl_tracked", report.TTLTracked,
+		"duration_ms", report.DurationMs,
+	)
+}
+
+// LoadError returns the error that stopped the data on disk from being
+// loaded at startup, e.g. AOF damage under the fail policy. The service then
+// holds what was loaded before the error and does not append to the AOF.
+func (s *Service) LoadError() error {
+	return s.loadErr
+}
+
+// loadPersistedData restores the data set. When the RDB snapshot records the
+// last AOF record it includes and the AOF base is older, the snapshot is
+// loaded and only the AOF records after it are replayed; otherwise the AOF,
+// if any, is replayed in full and the snapshot is ignored.
+func (s *Service) loadPersistedData(report *protocol.RecoveryReport) {
+	hasAOF := s.cfg.AOF.Enabled && s.persister.Exists()
+	useRDB := s.cfg.RDB.Enabled && !hasAOF
+	if s.cfg.RDB.Enabled && hasAOF {
+		useRDB = s.rdbPrecedesAOF()
 	}
-	if s.cfg.RDB.Enabled {
-		loaded, err := s.snapshotter.Load(s.storage)
+
+	var rdbSeq int64
+	if useRDB {
+		path, _ := s.snapshotter.Latest()
+		loaded, seq, err := s.snapshotter.Load(s.storage)
 		if err != nil {
 			slog.Error("rdb load failed", "error", err)
+			if hasAOF {
+				// The AOF is replayed in full instead, which must not
+				// start from the entries the snapshot got to load.
+				s.storage.ReplaceWith(storage.NewConcurrentMap(s.storage.ShardCount()))
+				seq = 0
+			}
 		} else if loaded > 0 {
-			slog.Info("rdb loaded", "entries", loaded)
+			report.Source = "rdb"
+			report.Entries = loaded
+			report.RDBEntries = loaded
+			slog.Info("loaded rdb snapshot", "path", path, "entries", loaded, "seq_range", fmt.Sprintf("1-%d", seq))
+		}
+		rdbSeq = seq
+	}
+	if !s.cfg.AOF.Enabled {
+		return
+	}
+
+	res, err := s.persister.ReplayAfter(rdbSeq)
+	report.LoadCorrupt = s.loadCorrupt.String()
+	for _, d := range res.Damage {
+		action := "skipped"
+		if d.Truncated {
+			action = "truncated"
+		}
+		report.AOFDamage = append(report.AOFDamage, protocol.AOFDamageReport{
+			File:    d.File,
+			Offset:  d.Offset,
+			Dropped: d.Length,
+			Action:  action,
+			Error:   d.Err.Error(),
+		})
+		report.DroppedBytes += d.Length
+		slog.Warn("aof damage recovered", "file", d.File, "offset", d.Offset, "dropped_bytes", d.Length, "action", action, "error", d.Err)
+	}
+	if hasAOF {
+		switch report.Source {
+		case "rdb":
+			report.Source = "rdb+aof"
+		default:
+			report.Source = "aof"
+		}
+		report.Entries += res.BaseEntries + res.Records
+		report.AOFRecords = res.Records
+		report.AOFSkipped = res.Skipped
+		slog.Info("replayed aof", "path", s.cfg.AOF.FilePath, "base_entries", res.BaseEntries, "records", res.Records,
+			"skipped", res.Skipped, "seq_range", fmt.Sprintf("%d-%d", res.FirstSeq, res.LastSeq))
+	}
+	report.LastSeq = s.persister.LastSeq()
+	if err != nil {
+		s.loadErr = fmt.Errorf("aof replay: %w", err)
+		report.Error = s.loadErr.Error()
+		slog.Error("aof replay failed", "load_corrupt", report.LoadCorrupt, "error", err)
+	}
+}
+
+// rdbPrecedesAOF reports whether the RDB snapshot can be loaded with the AOF
+// records after it replayed on top.
+func (s *Service) rdbPrecedesAOF() bool {
+	rdbSeq, err := s.snapshotter.LastSeq()
+	if err != nil {
+		slog.Warn("read rdb header failed, replaying full aof", "error", err)
+		return false
+	}
+	if rdbSeq == 0 {
+		return false
+	}
+	baseSeq, err := s.persister.BaseSeq()
+	if err != nil {
+		slog.Warn("read aof base failed, replaying full aof", "error", err)
+		return false
+	}
+	// A base as new as the snapshot covers it as well and, after a restore,
+	// may hold different data for the same sequence number.
+	if baseSeq >= rdbSeq {
+		slog.Info("aof base is not older than rdb snapshot, replaying full aof", "rdb_seq", rdbSeq, "base_seq", baseSeq)
+		return false
+	}
+	return true
+}
+
+func (s *Service) aofLastSeq() int64 {
+	if !s.cfg.AOF.Enabled {
+		return 0
+	}
+	return s.persister.LastSeq()
+}
+
+// rebuildExpiryIndex purges the keys of cm that expired while the server was
+// down and registers the remaining deadlines with the TTL manager, which
+// would otherwise only learn about keys written after startup.
+func (s *Service) rebuildExpiryIndex(cm *storage.ConcurrentMap, report *protocol.RecoveryReport) {
+	now := time.Now().UnixMilli()
+	var expired []string
+	cm.Iterate(func(key string, entry storage.Entry) bool {
+		if entry.ExpiresAt == 0 {
+			return true
+		}
+		if entry.ExpiresAt <= now {
+			expired = append(expired, key)
+			return true
 		}
+		s.ttlMgr.Add(key, entry.ExpiresAt)
+		report.TTLTracked++
+		return true
+	})
+	for _, key := range expired {
+		cm.Delete(key)
 	}
+	report.ExpiredOnLoad = len(expired)
+	report.LiveKeys = cm.Keys()
+}
+
+// RecoveryReport describes what was restored from disk at startup.
+func (s *Service) RecoveryReport() protocol.RecoveryReport {
+	return s.recovery
 }
 
 func (s *Service) validateKey(key string) error {
@@ -123,6 +363,9 @@ func (s *Service) validateKey(key string) error {
 	if len(key) > s.cfg.Storage.MaxKeySize {
 		return fmt.Errorf("%w: max %d bytes", ErrKeyTooLong, s.cfg.Storage.MaxKeySize)
 	}
+	if !s.cfg.Storage.BinaryKeys && !utf8.ValidString(key) {
+		return ErrInvalidKey
+	}
 	return nil
 }
 
@@ -143,44 +386,171 @@ func (s *Service) recordRequest(op string) {
 	s.requests.Store(newReqs)
 }
 
+// SetMode makes a write conditional on whether the key already exists, like
+// the NX and XX options of Redis SET.
+type SetMode int
+
+const (
+	SetAlways SetMode = iota
+	SetIfAbsent
+	SetIfPresent
+)
+
 func (s *Service) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := s.set(key, value, ttl, SetAlways, storage.Meta{})
+	return err
+}
+
+// SetMeta is Set storing meta along with the value.
+func (s *Service) SetMeta(key string, value []byte, ttl time.Duration, meta storage.Meta) error {
+	_, err := s.set(key, value, ttl, SetAlways, meta)
+	return err
+}
+
+// SetIf stores value under key if mode allows it and reports whether it did.
+func (s *Service) SetIf(key string, value []byte, ttl time.Duration, mode SetMode) (bool, error) {
+	return s.set(key, value, ttl, mode, storage.Meta{})
+}
+
+func (s *Service) set(key string, value []byte, ttl time.Duration, mode SetMode, meta storage.Meta) (bool, error) {
 	s.recordRequest("set")
 
 	if err := s.validateKey(key); err != nil {
-		return err
+		return false, err
 	}
 	if err := s.validateValue(value); err != nil {
-		return err
+		return false, err
 	}
 
+	defer s.maybeAutoSnapshot()
+	mu := s.keyspace.rlock(key)
+	defer mu.RUnlock()
+
 	var expiresAt int64
 	if ttl > 0 {
 		expiresAt = time.Now().Add(ttl).UnixMilli()
 	}
 
-	currentMem := atomic.LoadInt64(&s.memUsage)
-	estimatedDelta := int64(len(key) + len(value))
-
-	if currentMem+estimatedDelta > s.cfg.Storage.MaxMemory {
-		return ErrMemoryFull
+	// A conditional write that will not be stored must not evict anything.
+	// SetIf checks again under the shard lock.
+	if mode != SetAlways && s.storage.Exists(key) != (mode == SetIfPresent) {
+		return false, nil
+	}
+	if err := s.ensureMemory(int64(len(key) + len(value))); err != nil {
+		return false, err
 	}
 
-	memDelta := s.storage.Set(key, value, expiresAt)
+	entry := storage.Entry{Value: value, ExpiresAt: expiresAt, Meta: meta}
+	var memDelta int64
+	if mode == SetAlways {
+		memDelta = s.storage.SetEntry(key, entry)
+	} else {
+		var ok bool
+		if memDelta, ok = s.storage.SetIf(key, entry, mode == SetIfPresent); !ok {
+			return false, nil
+		}
+	}
 	atomic.AddInt64(&s.memUsage, memDelta)
 
 	if s.cfg.AOF.Enabled && s.persister != nil {
-		if err := s.persister.AppendSet(key, value, expiresAt); err != nil {
-			return err
+		if err := s.persister.AppendEntry(key, entry); err != nil {
+			return true, err
 		}
 	}
 
 	atomic.AddInt64(&s.changes, 1)
-	s.maybeAutoSnapshot()
 
 	if ttl > 0 {
 		s.ttlMgr.Add(key, expiresAt)
+	} else {
+		s.ttlMgr.Remove(key)
+	}
+
+	return true, nil
+}
+
+// Update rewrites key with the entry fn derives from its current live entry,
+// nil if there is none; an error returned by fn aborts the update and is
+// returned as is. When another write of key races with it fn is called again
+// with the new entry, so it must have no side effects. The CAS of the entry
+// fn returns is ignored, and a non-zero deadline that is not in the future
+// deletes key.
+func (s *Service) Update(key string, fn func(cur *storage.Entry) (storage.Entry, error)) error {
+	s.recordRequest("set")
+
+	if err := s.validateKey(key); err != nil {
+		return err
+	}
+
+	defer s.maybeAutoSnapshot()
+	mu := s.keyspace.rlock(key)
+	defer mu.RUnlock()
+
+	for {
+		cur, found := s.storage.GetEntry(key)
+		var curp *storage.Entry
+		if found {
+			curp = &cur
+		}
+		next, err := fn(curp)
+		if err != nil {
+			return err
+		}
+		if err := s.validateValue(next.Value); err != nil {
+			return err
+		}
+		deleted := next.ExpiresAt != 0 && next.ExpiresAt <= time.Now().UnixMilli()
+		if deleted {
+			next.ExpiresAt = -1
+		} else if err := s.ensureMemory(int64(len(key) + len(next.Value))); err != nil {
+			return err
+		}
+
+		memDelta, swapped := s.storage.CompareAndSwap(key, cur.CAS, next)
+		if !swapped {
+			continue
+		}
+		atomic.AddInt64(&s.memUsage, memDelta)
+
+		if s.cfg.AOF.Enabled && s.persister != nil {
+			if deleted {
+				err = s.persister.AppendDel(key)
+			} else {
+				err = s.persister.AppendEntry(key, next)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		atomic.AddInt64(&s.changes, 1)
+
+		if !deleted && next.ExpiresAt > 0 {
+			s.ttlMgr.Add(key, next.ExpiresAt)
+		} else {
+			s.ttlMgr.Remove(key)
+		}
+		return nil
 	}
+}
 
+// ensureMemory makes room for a write of delta bytes, evicting keys according
+// to the configured policy until it fits.
+func (s *Service) ensureMemory(delta int64) error {
+	for atomic.LoadInt64(&s.memUsage)+delta > s.cfg.Storage.MaxMemory {
+		key, memDelta, ok := s.storage.Evict(s.evictionPolicy, s.cfg.Storage.EvictionSamples)
+		if !ok {
+			return ErrMemoryFull
+		}
+		atomic.AddInt64(&s.memUsage, memDelta)
+		atomic.AddInt64(&s.evictedKeys, 1)
+		s.ttlMgr.Remove(key)
+		slog.Debug("key evicted", "key", key, "policy", s.evictionPolicy)
+		if s.cfg.AOF.Enabled && s.persister != nil {
+			if err := s.persister.AppendDel(key); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -210,24 +580,48 @@ func (s *Service) Get(key string) ([]byte, time.Duration, error) {
 	return value, ttlRemaining, nil
 }
 
-func (s *Service) Delete(key string) error {
+// GetEntry is Get returning the whole live entry of key, with its metadata
+// and CAS.
+func (s *Service) GetEntry(key string) (storage.Entry, error) {
+	s.recordRequest("get")
+
+	if err := s.validateKey(key); err != nil {
+		return storage.Entry{}, err
+	}
+
+	entry, exists := s.storage.GetEntry(key)
+	if !exists {
+		atomic.AddInt64(&s.misses, 1)
+		return storage.Entry{}, ErrKeyNotFound
+	}
+
+	atomic.AddInt64(&s.hits, 1)
+	return entry, nil
+}
+
+// Delete removes key and reports whether it existed.
+func (s *Service) Delete(key string) (bool, error) {
 	s.recordRequest("del")
 
 	if err := s.validateKey(key); err != nil {
-		return err
+		return false, err
 	}
 
-	memDelta := s.storage.Delete(key)
+	defer s.maybeAutoSnapshot()
+	mu := s.keyspace.rlock(key)
+	defer mu.RUnlock()
+
+	memDelta, existed := s.storage.Delete(key)
 	atomic.AddInt64(&s.memUsage, memDelta)
+	s.ttlMgr.Remove(key)
 	if s.cfg.AOF.Enabled && s.persister != nil {
 		if err := s.persister.AppendDel(key); err != nil {
-			return err
+			return existed, err
 		}
 	}
 	atomic.AddInt64(&s.changes, 1)
-	s.maybeAutoSnapshot()
 
-	return nil
+	return existed, nil
 }
 
 func (s *Service) Exists(key string) (bool, error) {
@@ -261,6 +655,139 @@ func (s *Service) TTL(key string) (time.Duration, error) {
 	return time.Duration(math.Ceil(remaining.Seconds())) * time.Second, nil
 }
 
+// Scan returns one page of live keys matching the optional glob pattern and
+// prefix together with the cursor for the next page. count bounds the number
+// of keys examined, so a page can hold fewer keys than requested.
+func (s *Service) Scan(cursor, match, prefix string, count int) ([]string, string, error) {
+	s.recordRequest("scan")
+
+	if count <= 0 {
+		count = defaultScanCount
+	}
+	if count > maxScanCount {
+		count = maxScanCount
+	}
+
+	var filter func(key string) bool
+	if match != "" || prefix != "" {
+		filter = func(key string) bool {
+			if prefix != "" && !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			return match == "" || storage.MatchGlob(match, key)
+		}
+	}
+	return s.storage.Scan(cursor, count, filter)
+}
+
+// PTTL returns the remaining TTL with millisecond precision, or -1ms when the
+// key has no expiry.
+func (s *Service) PTTL(key string) (time.Duration, error) {
+	if err := s.validateKey(key); err != nil {
+		return 0, err
+	}
+
+	_, expiresAt, exists := s.storage.Get(key)
+	if !exists {
+		return -1 * time.Millisecond, ErrKeyNotFound
+	}
+	if expiresAt == 0 {
+		return -1 * time.Millisecond, nil
+	}
+
+	remaining := time.UnixMilli(expiresAt).Sub(time.Now()).Truncate(time.Millisecond)
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
+
+// Expire sets a relative expiry on an existing key. A non-positive ttl
+// deletes the key, like Redis EXPIRE.
+func (s *Service) Expire(key string, ttl time.Duration) error {
+	return s.ExpireAt(key, time.Now().Add(ttl))
+}
+
+// ExpireAt sets an absolute expiry on an existing key. A deadline in the past
+// deletes the key.
+func (s *Service) ExpireAt(key string, at time.Time) error {
+	s.recordRequest("expire")
+
+	if err := s.validateKey(key); err != nil {
+		return err
+	}
+
+	expiresAt := at.UnixMilli()
+	if expiresAt <= 0 {
+		// Zero means "no expiry" in storage; anything at or before the epoch
+		// is simply in the past.
+		expiresAt = -1
+	}
+
+	defer s.maybeAutoSnapshot()
+	mu := s.keyspace.rlock(key)
+	defer mu.RUnlock()
+
+	_, memDelta, found := s.storage.SetExpiry(key, expiresAt)
+	if !found {
+		return ErrKeyNotFound
+	}
+	atomic.AddInt64(&s.memUsage, memDelta)
+
+	deleted := memDelta != 0
+	if deleted {
+		s.ttlMgr.Remove(key)
+	} else {
+		s.ttlMgr.Add(key, expiresAt)
+	}
+
+	if s.cfg.AOF.Enabled && s.persister != nil {
+		var err error
+		if deleted {
+			err = s.persister.AppendDel(key)
+		} else {
+			err = s.persister.AppendExpireAt(key, expiresAt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&s.changes, 1)
+
+	return nil
+}
+
+// Persist removes the expiry of key and reports whether it had one.
+func (s *Service) Persist(key string) (bool, error) {
+	s.recordRequest("persist")
+
+	if err := s.validateKey(key); err != nil {
+		return false, err
+	}
+
+	defer s.maybeAutoSnapshot()
+	mu := s.keyspace.rlock(key)
+	defer mu.RUnlock()
+
+	prevExpiresAt, _, found := s.storage.SetExpiry(key, 0)
+	if !found {
+		return false, ErrKeyNotFound
+	}
+	if prevExpiresAt == 0 {
+		return false, nil
+	}
+	s.ttlMgr.Remove(key)
+
+	if s.cfg.AOF.Enabled && s.persister != nil {
+		if err := s.persister.AppendPersist(key); err != nil {
+			return true, err
+		}
+	}
+	atomic.AddInt64(&s.changes, 1)
+
+	return true, nil
+}
+
 func (s *Service) Keys() int {
 	return s.storage.Keys()
 }
@@ -269,14 +796,43 @@ func (s *Service) MemUsage() int64 {
 	return atomic.LoadInt64(&s.memUsage)
 }
 
+func (s *Service) MaxValueSize() int {
+	return s.cfg.Storage.MaxValueSize
+}
+
 func (s *Service) Stats() *protocol.StatsResponseData {
+	recovery := s.recovery
+	var aof *protocol.AOFStats
+	if s.cfg.AOF.Enabled && s.persister != nil {
+		st := s.persister.Stats()
+		aof = &protocol.AOFStats{
+			FsyncPolicy:  st.FsyncPolicy,
+			Fsyncs:       st.Fsyncs,
+			FsyncLastUs:  st.FsyncLastUs,
+			FsyncMaxUs:   st.FsyncMaxUs,
+			FsyncTotalUs: st.FsyncTotalUs,
+			PendingBytes: st.PendingBytes,
+			LastSeq:      st.LastSeq,
+			Streams:      st.Streams,
+
+			RewriteInProgress: st.RewriteInProgress,
+			Rewrites:          st.Rewrites,
+			RewriteFailures:   st.RewriteFailures,
+		}
+	}
 	return &protocol.StatsResponseData{
-		Keys:     s.Keys(),
-		Memory:   s.MemUsage(),
-		Hits:     atomic.LoadInt64(&s.hits),
-		Misses:   atomic.LoadInt64(&s.misses),
-		Requests: s.requests.Load().(map[string]int64),
-		Uptime:   int64(time.Since(s.startTime).Seconds()),
+		Keys:           s.Keys(),
+		Memory:         s.MemUsage(),
+		Hits:           atomic.LoadInt64(&s.hits),
+		Misses:         atomic.LoadInt64(&s.misses),
+		EvictedKeys:    atomic.LoadInt64(&s.evictedKeys),
+		ExpiredKeys:    atomic.LoadInt64(&s.expiredKeys),
+		ExpireCycleCPU: s.expireCycleCPU.Load(),
+		Requests:       s.requests.Load().(map[string]int64),
+		Uptime:         int64(time.Since(s.startTime).Seconds()),
+		Recovery:       &recovery,
+		AOF:            aof,
+		EncryptionKey:  s.keys.CurrentID(),
 	}
 }
 
@@ -293,6 +849,14 @@ func (s *Service) ErrorToCode(err error) int {
 		return protocol.CodeValueTooLarge
 	case errors.Is(err, ErrMemoryFull):
 		return protocol.CodeMemoryFull
+	case errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrInvalidKey):
+		return protocol.CodeInvalidParam
+	case errors.Is(err, ErrSnapshotNotFound):
+		return protocol.CodeSnapshotNotFound
+	case errors.Is(err, ErrAOFRewriteInProgress):
+		return protocol.CodeAOFRewriting
+	case errors.Is(err, ErrAOFDisabled):
+		return protocol.CodeAOFDisabled
 	default:
 		return protocol.CodeInternalError
 	}
@@ -302,7 +866,9 @@ func (s *Service) Snapshot() (string, error) {
 	s.snapshotMu.Lock()
 	defer s.snapshotMu.Unlock()
 
-	path, err := s.snapshotter.Save(s.storage)
+	snap, lastSeq := s.snapshotKeyspace()
+	defer snap.Close()
+	path, err := s.snapshotter.SaveSnapshot(snap, lastSeq)
 	if err != nil {
 		return "", err
 	}
@@ -311,6 +877,140 @@ func (s *Service) Snapshot() (string, error) {
 	return path, nil
 }
 
+// snapshotKeyspace takes a snapshot of the keyspace between writes, so that
+// it holds every write entirely or not at all, along with the last AOF
+// record it includes. Writes are only held off while it is taken, not while
+// it is read. The caller closes it.
+func (s *Service) snapshotKeyspace() (*storage.Snapshot, int64) {
+	s.keyspace.Lock()
+	defer s.keyspace.Unlock()
+	return s.storage.Snapshot(), s.aofLastSeq()
+}
+
+// RewriteAOF starts compacting the AOF in the background, like an automatic
+// rewrite once the incremental file reaches the threshold. Its outcome is
+// reported by AOFStatus.
+func (s *Service) RewriteAOF() error {
+	if !s.cfg.AOF.Enabled {
+		return ErrAOFDisabled
+	}
+	// A rewrite would replace the files that failed to load with the
+	// partial data.
+	if s.loadErr != nil {
+		return s.loadErr
+	}
+	return s.persister.StartRewrite()
+}
+
+func (s *Service) AOFStatus() (*protocol.AOFStatusResponseData, error) {
+	if !s.cfg.AOF.Enabled {
+		return nil, ErrAOFDisabled
+	}
+	st := s.persister.RewriteStatus()
+	status := &protocol.AOFStatusResponseData{
+		RewriteInProgress: st.InProgress,
+		Rewrites:          st.Rewrites,
+		RewriteFailures:   st.Failures,
+		BaseSize:          st.BaseSize,
+		CurrentSize:       st.CurrentSize,
+		IncrSize:          st.IncrSize,
+		RewriteThreshold:  st.RewriteThreshold,
+	}
+	if !st.StartedAt.IsZero() {
+		status.RewriteStartedAt = st.StartedAt.UnixMilli()
+	}
+	if !st.LastAt.IsZero() {
+		status.LastRewriteStatus = "ok"
+		if st.LastErr != nil {
+			status.LastRewriteStatus = "err"
+			status.LastRewriteError = st.LastErr.Error()
+		}
+		status.LastRewriteAt = st.LastAt.UnixMilli()
+		status.LastRewriteDurationMs = st.LastDuration.Milliseconds()
+	}
+	return status, nil
+}
+
+// Snapshots lists the RDB snapshots on disk, newest first.
+func (s *Service) Snapshots() ([]protocol.SnapshotInfo, error) {
+	snaps, err := s.snapshotter.List()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]protocol.SnapshotInfo, 0, len(snaps))
+	for _, snap := range snaps {
+		infos = append(infos, protocol.SnapshotInfo{
+			ID:        snap.ID,
+			Path:      snap.Path,
+			Size:      snap.Size,
+			Keys:      snap.Keys,
+			CreatedAt: snap.CreatedAt.UnixMilli(),
+		})
+	}
+	return infos, nil
+}
+
+// RestoreSnapshot replaces the keyspace with the contents of snapshot id and
+// returns the number of live keys restored. The snapshot is loaded aside and
+// the AOF rewritten from it before the keyspace is swapped; then a new
+// snapshot is taken, so that a restart comes back to the restored data.
+func (s *Service) RestoreSnapshot(id string) (int, error) {
+	restored := storage.NewConcurrentMap(s.cfg.Storage.ShardCount)
+	if _, _, err := s.snapshotter.LoadSnapshot(id, restored); err != nil {
+		return 0, err
+	}
+
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	// Registering the deadlines early is harmless: the TTL manager only
+	// deletes a key that still carries the deadline it was given.
+	var report protocol.RecoveryReport
+	s.rebuildExpiryIndex(restored, &report)
+
+	// The AOF is rewritten from the restored keyspace before it replaces the
+	// current one, so a failure leaves both as they were. Writes are only
+	// held off while appends move to the new incremental files and the
+	// keyspace is swapped.
+	var (
+		snap    *storage.Snapshot
+		lastSeq int64
+	)
+	swap := func() {
+		s.storage.ReplaceWith(restored)
+		atomic.StoreInt64(&s.memUsage, s.storage.MemUsage())
+		if s.cfg.RDB.Enabled {
+			snap, lastSeq = s.storage.Snapshot(), s.aofLastSeq()
+		}
+	}
+	if s.cfg.AOF.Enabled {
+		if err := s.persister.RestoreWith(restored, s.keyspace, swap); err != nil {
+			return 0, fmt.Errorf("rewrite aof for restore: %w", err)
+		}
+	} else {
+		s.keyspace.Lock()
+		swap()
+		s.keyspace.Unlock()
+	}
+	slog.Info("restored snapshot", "id", id, "live_keys", report.LiveKeys, "expired_on_load", report.ExpiredOnLoad)
+
+	// A fresh snapshot also marks the restore for point-in-time recovery,
+	// which must not replay the records before it on top of the restored
+	// keyspace.
+	if snap != nil {
+		defer snap.Close()
+		if _, err := s.snapshotter.SaveSnapshot(snap, lastSeq); err != nil {
+			return report.LiveKeys, fmt.Errorf("snapshot after restore: %w", err)
+		}
+		s.lastSnapshotAt.Store(time.Now().Unix())
+	}
+	atomic.StoreInt64(&s.changes, 0)
+	return report.LiveKeys, nil
+}
+
+// maybeAutoSnapshot takes a snapshot if a save rule is met. Writes defer it
+// until they have released their keyspace stripe, which taking the snapshot
+// needs.
 func (s *Service) maybeAutoSnapshot() {
 	if !s.cfg.RDB.Enabled || len(s.cfg.RDB.SaveRules) == 0 {
 		return
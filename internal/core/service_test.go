@@ -1,12 +1,19 @@
 package core
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/shinerio/gopher-kv/internal/config"
+	"github.com/shinerio/gopher-kv/internal/storage"
+	"github.com/shinerio/gopher-kv/pkg/protocol"
 )
 
 func TestServiceAutoSnapshotWithoutFurtherWrites(t *testing.T) {
@@ -52,11 +59,660 @@ func TestServiceAutoSnapshotWithoutFurtherWrites(t *testing.T) {
 
 	deadline := time.Now().Add(4 * time.Second)
 	for time.Now().Before(deadline) {
-		if _, err := os.Stat(rdbPath); err == nil {
+		if matches, _ := filepath.Glob(filepath.Join(dir, "dump-*.rdb")); len(matches) > 0 {
 			return
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
 
-	t.Fatalf("expected auto snapshot file %s to be created while service is running", rdbPath)
+	t.Fatalf("expected an auto snapshot next to %s to be created while service is running", rdbPath)
+}
+
+func newTestConfig(dir string) *config.Config {
+	return &config.Config{
+		Storage: config.StorageConfig{
+			ShardCount:   16,
+			MaxKeySize:   256,
+			MaxValueSize: 1024 * 1024,
+			MaxMemory:    256 * 1024 * 1024,
+		},
+		AOF: config.AOFConfig{
+			Enabled:          false,
+			FilePath:         filepath.Join(dir, "appendonly.aof"),
+			RewriteThreshold: 1024 * 1024,
+		},
+		RDB: config.RDBConfig{
+			Enabled:  false,
+			FilePath: filepath.Join(dir, "dump.rdb"),
+		},
+		Log: config.LogConfig{Level: "error"},
+	}
+}
+
+func TestServiceMemoryFullWithoutEviction(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	cfg.Storage.MaxMemory = 10
+
+	svc := NewService(cfg)
+	if err := svc.Set("k1", []byte("12345678"), 0); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if err := svc.Set("k2", []byte("12345678"), 0); !errors.Is(err, ErrMemoryFull) {
+		t.Fatalf("expected ErrMemoryFull, got %v", err)
+	}
+}
+
+func TestServiceBinaryKeys(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir)
+	cfg.AOF.Enabled = true
+	cfg.AOF.Format = "text"
+
+	svc := NewService(cfg)
+	key := "bin\xff\tkey"
+	if err := svc.Set(key, []byte("v"), 0); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+	if code := svc.ErrorToCode(ErrInvalidKey); code != protocol.CodeInvalidParam {
+		t.Fatalf("expected code %d, got %d", protocol.CodeInvalidParam, code)
+	}
+	if err := svc.Set("tab\tkey", []byte("utf8"), 0); err != nil {
+		t.Fatal(err)
+	}
+	svc.Stop()
+
+	cfg.Storage.BinaryKeys = true
+	svc = NewService(cfg)
+	if err := svc.Set(key, []byte("binary"), 0); err != nil {
+		t.Fatal(err)
+	}
+	svc.Stop()
+
+	svc = NewService(cfg)
+	defer svc.Stop()
+	for key, want := range map[string]string{"tab\tkey": "utf8", "bin\xff\tkey": "binary"} {
+		if v, _, err := svc.Get(key); err != nil || string(v) != want {
+			t.Fatalf("%q: expected %q, got %q (%v)", key, want, v, err)
+		}
+	}
+}
+
+func TestServiceEvictsWhenMemoryFull(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir)
+	cfg.Storage.MaxMemory = 10
+	cfg.Storage.EvictionPolicy = "allkeys-lru"
+	cfg.AOF.Enabled = true
+
+	svc := NewService(cfg)
+	if err := svc.Set("k1", []byte("12345678"), 0); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if err := svc.Set("k2", []byte("12345678"), 0); err != nil {
+		t.Fatalf("set with eviction failed: %v", err)
+	}
+	if ok, _ := svc.Exists("k1"); ok {
+		t.Fatal("k1 should have been evicted")
+	}
+	if got := svc.Stats().EvictedKeys; got != 1 {
+		t.Fatalf("expected 1 evicted key, got %d", got)
+	}
+	// Conditional sets that store nothing evict nothing.
+	if ok, err := svc.SetIf("k2", []byte("12345678"), 0, SetIfAbsent); err != nil || ok {
+		t.Fatalf("NX on an existing key should not write, got %v (%v)", ok, err)
+	}
+	if ok, err := svc.SetIf("k3", []byte("12345678"), 0, SetIfPresent); err != nil || ok {
+		t.Fatalf("XX on a missing key should not write, got %v (%v)", ok, err)
+	}
+	if ok, _ := svc.Exists("k2"); !ok {
+		t.Fatal("a no-op conditional set evicted k2")
+	}
+	svc.Stop()
+
+	restored := NewService(cfg)
+	defer restored.Stop()
+	if ok, _ := restored.Exists("k1"); ok {
+		t.Fatal("eviction should be persisted to the aof")
+	}
+	if ok, _ := restored.Exists("k2"); !ok {
+		t.Fatal("k2 should be restored from the aof")
+	}
+}
+
+func TestServiceRebuildsExpiryIndexOnStartup(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	cfg.AOF.Enabled = true
+
+	svc := NewService(cfg)
+	if err := svc.Set("persistent", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Set("short", []byte("v"), 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Set("gone", []byte("v"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	svc.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	restored := NewService(cfg)
+	restored.Start()
+	defer restored.Stop()
+
+	report := restored.RecoveryReport()
+	if report.Source != "aof" || report.Entries != 3 {
+		t.Fatalf("unexpected recovery source/entries: %+v", report)
+	}
+	if report.ExpiredOnLoad != 1 || report.TTLTracked != 1 || report.LiveKeys != 2 {
+		t.Fatalf("unexpected recovery counts: %+v", report)
+	}
+	if restored.Keys() != 2 {
+		t.Fatalf("expired key should be purged on load, got %d keys", restored.Keys())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for restored.Keys() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("recovered ttl key was not expired by the ttl manager, keys=%d", restored.Keys())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if restored.MemUsage() != int64(len("persistent")+len("v")) {
+		t.Fatalf("unexpected memory usage after expiry: %d", restored.MemUsage())
+	}
+}
+
+func TestServiceLoadCorruptPolicy(t *testing.T) {
+	content := "SET\tk1\tdjE=\t0\nBROKEN\tline\nSET\tk2\tdjI=\t0\n"
+	newService := func(policy string) *Service {
+		cfg := newTestConfig(t.TempDir())
+		cfg.AOF.Enabled = true
+		cfg.AOF.LoadCorrupt = policy
+		if err := os.WriteFile(cfg.AOF.FilePath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return NewService(cfg)
+	}
+
+	failed := newService("fail")
+	defer failed.Stop()
+	if !errors.Is(failed.LoadError(), storage.ErrAOFCorrupt) {
+		t.Fatalf("expected ErrAOFCorrupt, got %v", failed.LoadError())
+	}
+	if report := failed.RecoveryReport(); report.Error == "" || report.LoadCorrupt != "fail" {
+		t.Fatalf("unexpected recovery report: %+v", report)
+	}
+
+	skipped := newService("skip")
+	defer skipped.Stop()
+	if err := skipped.LoadError(); err != nil {
+		t.Fatal(err)
+	}
+	report := skipped.RecoveryReport()
+	if report.AOFRecords != 2 || len(report.AOFDamage) != 1 || report.DroppedBytes != int64(len("BROKEN\tline\n")) {
+		t.Fatalf("unexpected recovery report: %+v", report)
+	}
+	if d := report.AOFDamage[0]; d.Action != "skipped" || d.Offset != int64(len("SET\tk1\tdjE=\t0\n")) {
+		t.Fatalf("unexpected damage report: %+v", d)
+	}
+}
+
+func TestServiceRewriteAOFStatus(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir)
+	cfg.AOF.Enabled = true
+	svc := NewService(cfg)
+	defer svc.Stop()
+	for i := range 10 {
+		if err := svc.Set(fmt.Sprintf("k%d", i), []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitRewrite := func() *protocol.AOFStatusResponseData {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			st, err := svc.AOFStatus()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !st.RewriteInProgress {
+				return st
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("aof rewrite did not finish")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := svc.RewriteAOF(); err != nil {
+		t.Fatal(err)
+	}
+	st := waitRewrite()
+	if st.Rewrites != 1 || st.RewriteFailures != 0 || st.LastRewriteStatus != "ok" || st.BaseSize == 0 || st.CurrentSize < st.BaseSize {
+		t.Fatalf("unexpected status after rewrite: %+v", st)
+	}
+
+	// Without its directory the rewrite cannot start a new incremental file.
+	if err := os.RemoveAll(filepath.Join(dir, "appendonlydir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.RewriteAOF(); err != nil {
+		t.Fatal(err)
+	}
+	st = waitRewrite()
+	if st.Rewrites != 2 || st.RewriteFailures != 1 || st.LastRewriteStatus != "err" || st.LastRewriteError == "" {
+		t.Fatalf("unexpected status after failed rewrite: %+v", st)
+	}
+	if aof := svc.Stats().AOF; aof.Rewrites != 2 || aof.RewriteFailures != 1 {
+		t.Fatalf("unexpected rewrite counters in stats: %+v", aof)
+	}
+}
+
+func TestServiceStaleExpiryDoesNotDeleteRewrittenKey(t *testing.T) {
+	svc := NewService(newTestConfig(t.TempDir()))
+	svc.Start()
+	defer svc.Stop()
+
+	if err := svc.Set("k", []byte("v1"), 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Set("k", []byte("v2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Set("longer", []byte("v1"), 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Set("longer", []byte("v2"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	for _, key := range []string{"k", "longer"} {
+		value, _, err := svc.Get(key)
+		if err != nil || string(value) != "v2" {
+			t.Fatalf("%s should keep its rewritten value, got %q (%v)", key, value, err)
+		}
+	}
+	if n := svc.ttlMgr.Len(); n != 1 {
+		t.Fatalf("expected a single pending expiry, got %d", n)
+	}
+}
+
+func TestServiceExpireAndPersist(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	cfg.AOF.Enabled = true
+	svc := NewService(cfg)
+	svc.Start()
+
+	if err := svc.Expire("missing", time.Second); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err := svc.Set("k", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if pttl, _ := svc.PTTL("k"); pttl != -time.Millisecond {
+		t.Fatalf("expected -1ms for key without expiry, got %v", pttl)
+	}
+
+	if err := svc.Expire("k", 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	pttl, err := svc.PTTL("k")
+	if err != nil || pttl <= time.Second || pttl > 1500*time.Millisecond {
+		t.Fatalf("unexpected pttl %v (%v)", pttl, err)
+	}
+
+	persisted, err := svc.Persist("k")
+	if err != nil || !persisted {
+		t.Fatalf("expected expiry to be removed, got %v (%v)", persisted, err)
+	}
+	if persisted, _ := svc.Persist("k"); persisted {
+		t.Fatal("second persist should report no expiry")
+	}
+
+	if err := svc.Set("short", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Expire("short", 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.ExpireAt("gone", time.Now()); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err := svc.Set("gone", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.ExpireAt("gone", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := svc.Exists("gone"); ok {
+		t.Fatal("expiring at a past instant should delete the key")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if svc.Keys() != 1 {
+		t.Fatalf("expected only k to remain, got %d keys", svc.Keys())
+	}
+	svc.Stop()
+
+	restored := NewService(cfg)
+	defer restored.Stop()
+	if pttl, err := restored.PTTL("k"); err != nil || pttl != -time.Millisecond {
+		t.Fatalf("persist should survive restart, got %v (%v)", pttl, err)
+	}
+	if restored.Keys() != 1 {
+		t.Fatalf("expected 1 key after restart, got %d", restored.Keys())
+	}
+}
+
+func TestServiceSetIf(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	cfg.AOF.Enabled = true
+	svc := NewService(cfg)
+
+	if ok, err := svc.SetIf("k", []byte("xx"), 0, SetIfPresent); err != nil || ok {
+		t.Fatalf("XX on a missing key should not write, got %v (%v)", ok, err)
+	}
+	if ok, err := svc.SetIf("k", []byte("nx"), 0, SetIfAbsent); err != nil || !ok {
+		t.Fatalf("NX on a missing key should write, got %v (%v)", ok, err)
+	}
+	if ok, _ := svc.SetIf("k", []byte("nx2"), 0, SetIfAbsent); ok {
+		t.Fatal("NX on an existing key should not write")
+	}
+	if ok, err := svc.SetIf("k", []byte("xx"), time.Minute, SetIfPresent); err != nil || !ok {
+		t.Fatalf("XX on an existing key should write, got %v (%v)", ok, err)
+	}
+	if ok, err := svc.set("meta", []byte("v"), 0, SetIfAbsent, storage.Meta{Flags: 7}); err != nil || !ok {
+		t.Fatalf("NX on a missing key should write, got %v (%v)", ok, err)
+	}
+	if e, err := svc.GetEntry("meta"); err != nil || e.Meta.Flags != 7 {
+		t.Fatalf("a conditional set should store the meta, got %+v (%v)", e, err)
+	}
+	if _, err := svc.Delete("meta"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.Set("short", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Expire("short", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ok, _ := svc.SetIf("short", []byte("again"), 0, SetIfAbsent); !ok {
+		t.Fatal("NX should treat an expired key as absent")
+	}
+	if got, want := svc.MemUsage(), int64(len("k")+len("xx")+len("short")+len("again")); got != want {
+		t.Fatalf("expected memory %d, got %d", want, got)
+	}
+	svc.Stop()
+
+	restored := NewService(cfg)
+	defer restored.Stop()
+	for key, want := range map[string]string{"k": "xx", "short": "again"} {
+		if v, _, err := restored.Get(key); err != nil || string(v) != want {
+			t.Fatalf("%s: expected %q after restart, got %q (%v)", key, want, v, err)
+		}
+	}
+}
+
+func TestServiceActiveExpireReclaimsLazilyExpiredKeys(t *testing.T) {
+	svc := NewService(newTestConfig(t.TempDir()))
+	defer svc.Stop()
+
+	// The expiry engine is never started, so only the active cycle can
+	// remove these keys.
+	for i := 0; i < 200; i++ {
+		if err := svc.Set(fmt.Sprintf("tmp:%d", i), []byte("v"), time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := svc.Set(fmt.Sprintf("keep:%d", i), []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	svc.activeExpireCycle(time.Second)
+
+	if n := svc.Keys(); n != 10 {
+		t.Fatalf("expected 10 keys after active expire, got %d", n)
+	}
+	if mem, want := svc.MemUsage(), int64(10*len("keep:0v")); mem != want {
+		t.Fatalf("expected memory %d, got %d", want, mem)
+	}
+	stats := svc.Stats()
+	if stats.ExpiredKeys != 200 {
+		t.Fatalf("expected 200 expired keys, got %d", stats.ExpiredKeys)
+	}
+	if n := svc.ttlMgr.Len(); n != 0 {
+		t.Fatalf("expected no pending expiries, got %d", n)
+	}
+}
+
+func TestServiceLoadsRDBThenReplaysAOFTail(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir)
+	cfg.AOF.Enabled = true
+	cfg.RDB.Enabled = true
+
+	svc := NewService(cfg)
+	for _, key := range []string{"k1", "k2"} {
+		if err := svc.Set(key, []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := svc.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Set("k3", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	// Crash: the AOF is on disk, but no snapshot is taken on the way down.
+	if err := svc.persister.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	svc.persister.Close()
+
+	restored := NewService(cfg)
+	restored.Start()
+	defer restored.Stop()
+
+	report := restored.RecoveryReport()
+	if report.Source != "rdb+aof" || report.RDBEntries != 2 || report.AOFRecords != 2 || report.AOFSkipped != 2 || report.LastSeq != 4 {
+		t.Fatalf("unexpected recovery report: %+v", report)
+	}
+	if _, _, err := restored.Get("k1"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("k1 should stay deleted, got %v", err)
+	}
+	if restored.Keys() != 2 {
+		t.Fatalf("expected k2 and k3, got %d keys", restored.Keys())
+	}
+}
+
+func TestServiceDropsPartialRDBBeforeFullAOFReplay(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir)
+	cfg.AOF.Enabled = true
+	cfg.RDB.Enabled = true
+
+	svc := NewService(cfg)
+	if err := svc.Set("kept", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.persister.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	svc.persister.Close()
+
+	// A snapshot claiming to be newer than the AOF base, holding a key the
+	// AOF knows nothing of, whose trailer is damaged after its sections.
+	stale := storage.NewConcurrentMap(16)
+	stale.Set("stale", []byte("v"), 0)
+	path, err := svc.snapshotter.Save(stale, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewService(cfg)
+	defer restored.Stop()
+	if exists, _ := restored.Exists("stale"); exists {
+		t.Fatal("entries of a snapshot that failed to load should be dropped")
+	}
+	if exists, _ := restored.Exists("kept"); !exists || restored.Keys() != 1 {
+		t.Fatalf("expected only the AOF contents, got %d keys", restored.Keys())
+	}
+	if got, want := restored.MemUsage(), int64(len("kept")+len("v")); got != want {
+		t.Fatalf("expected memory %d, got %d", want, got)
+	}
+}
+
+func TestServiceRestoreSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	cfg := newTestConfig(dir)
+	cfg.AOF.Enabled = true
+	cfg.RDB.Enabled = true
+
+	svc := NewService(cfg)
+	if err := svc.Set("k1", []byte("v1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := svc.Snapshots()
+	if err != nil || len(snaps) != 1 || snaps[0].Keys != 1 {
+		t.Fatalf("expected one snapshot holding one key, got %+v (%v)", snaps, err)
+	}
+	if _, err := svc.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Set("k2", []byte("v2"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := svc.RestoreSnapshot("missing"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected ErrSnapshotNotFound, got %v", err)
+	}
+
+	// A restore whose AOF rewrite fails leaves the keyspace alone.
+	blocker := filepath.Join(dir, "appendonlydir", "appendonly.aof.1.base.rdb.tmp")
+	if err := os.Mkdir(blocker, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.RestoreSnapshot(snaps[0].ID); err == nil {
+		t.Fatal("expected the restore to fail")
+	}
+	if exists, _ := svc.Exists("k2"); !exists || svc.Keys() != 1 {
+		t.Fatalf("a failed restore should keep the keyspace, got %d keys", svc.Keys())
+	}
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := svc.RestoreSnapshot(snaps[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != 1 || svc.Keys() != 1 || svc.MemUsage() != int64(len("k1")+len("v1")) {
+		t.Fatalf("unexpected state after restore: keys=%d/%d mem=%d", keys, svc.Keys(), svc.MemUsage())
+	}
+	if v, _, err := svc.Get("k1"); err != nil || string(v) != "v1" {
+		t.Fatalf("k1 should be restored, got %q (%v)", v, err)
+	}
+	if err := svc.Set("k3", []byte("v3"), 0); err != nil {
+		t.Fatal(err)
+	}
+	svc.Stop()
+
+	restarted := NewService(cfg)
+	defer restarted.Stop()
+	if _, _, err := restarted.Get("k2"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("k2 should not survive the restore, got %v", err)
+	}
+	if restarted.Keys() != 2 {
+		t.Fatalf("expected k1 and k3 after restart, got %d keys", restarted.Keys())
+	}
+}
+
+func TestServiceUpdate(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	cfg.AOF.Enabled = true
+	svc := NewService(cfg)
+
+	errStop := errors.New("stop")
+	if err := svc.Update("k", func(cur *storage.Entry) (storage.Entry, error) {
+		return storage.Entry{}, errStop
+	}); !errors.Is(err, errStop) {
+		t.Fatalf("expected the error of fn, got %v", err)
+	}
+	if err := svc.Update("k", func(cur *storage.Entry) (storage.Entry, error) {
+		if cur != nil {
+			t.Fatal("k should not exist yet")
+		}
+		return storage.Entry{Value: []byte("a"), Meta: storage.Meta{Flags: 3}}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Update("k", func(cur *storage.Entry) (storage.Entry, error) {
+		next := *cur
+		next.Value = append(slices.Clone(cur.Value), 'b')
+		return next, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Set("gone", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Update("gone", func(cur *storage.Entry) (storage.Entry, error) {
+		return storage.Entry{Value: cur.Value, ExpiresAt: -1}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := svc.MemUsage(), int64(len("k")+len("ab")); got != want {
+		t.Fatalf("expected memory %d, got %d", want, got)
+	}
+	svc.Stop()
+
+	restored := NewService(cfg)
+	defer restored.Stop()
+	if e, err := restored.GetEntry("k"); err != nil || string(e.Value) != "ab" || e.Meta.Flags != 3 {
+		t.Fatalf("expected k to be restored with its flags, got %+v (%v)", e, err)
+	}
+	if _, err := restored.GetEntry("gone"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("gone should stay deleted, got %v", err)
+	}
+}
+
+func BenchmarkServiceSetParallel(b *testing.B) {
+	cfg := newTestConfig(b.TempDir())
+	cfg.Storage.ShardCount = 256
+	svc := NewService(cfg)
+	defer svc.Stop()
+	value := []byte("benchmark-value")
+	var next atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		prefix := fmt.Sprintf("bench-%d-", next.Add(1))
+		for i := 0; pb.Next(); i++ {
+			if err := svc.Set(prefix+strconv.Itoa(i%1024), value, 0); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
 }
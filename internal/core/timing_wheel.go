@@ -0,0 +1,239 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 5
+)
+
+// wheelOverflow marks keys whose deadline lies beyond the range of the
+// highest level; they are re-placed whenever that level wraps around.
+const wheelOverflow = wheelLevels
+
+type wheelPos struct {
+	level int
+	slot  int
+}
+
+// wheelShard is one independent hierarchical wheel. Level l holds deadlines
+// that share every digit above l with the current tick, in the slot given by
+// their level-l digit, so a slot is cascaded into the level below exactly
+// when the current tick reaches its first tick.
+type wheelShard struct {
+	mu       sync.Mutex
+	next     int64
+	levels   [wheelLevels][wheelSlots]map[string]int64
+	overflow map[string]int64
+	pos      map[string]wheelPos
+}
+
+// TimingWheel is a sharded hierarchical timing wheel. Each shard has its own
+// lock, so Add and Remove only contend with operations on keys of the same
+// shard, and a single ticker goroutine advances all shards.
+type TimingWheel struct {
+	tick     int64
+	shards   []*wheelShard
+	shardOf  func(key string) int
+	onExpire func(key string, expiresAt int64)
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func NewTimingWheel(tick time.Duration, shardCount int, shardOf func(key string) int, onExpire func(key string, expiresAt int64)) *TimingWheel {
+	tickMs := tick.Milliseconds()
+	if tickMs <= 0 {
+		tickMs = 1
+	}
+	if shardCount <= 0 {
+		shardCount = 1
+	}
+	now := time.Now().UnixMilli() / tickMs
+	shards := make([]*wheelShard, shardCount)
+	for i := range shards {
+		shards[i] = &wheelShard{
+			next:     now,
+			overflow: make(map[string]int64),
+			pos:      make(map[string]wheelPos),
+		}
+	}
+	return &TimingWheel{
+		tick:     tickMs,
+		shards:   shards,
+		shardOf:  shardOf,
+		onExpire: onExpire,
+		stopCh:   make(chan struct{}),
+	}
+}
+
+func (w *TimingWheel) shard(key string) *wheelShard {
+	if len(w.shards) == 1 || w.shardOf == nil {
+		return w.shards[0]
+	}
+	return w.shards[w.shardOf(key)%len(w.shards)]
+}
+
+func (w *TimingWheel) Add(key string, expiresAt int64) {
+	sh := w.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if p, ok := sh.pos[key]; ok {
+		if p == sh.locate(expiresAt, w.tick) {
+			sh.slotFor(p)[key] = expiresAt
+			return
+		}
+		sh.remove(key)
+	}
+	sh.place(key, expiresAt, w.tick)
+}
+
+func (w *TimingWheel) Remove(key string) {
+	sh := w.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.remove(key)
+}
+
+func (w *TimingWheel) Len() int {
+	total := 0
+	for _, sh := range w.shards {
+		sh.mu.Lock()
+		total += len(sh.pos)
+		sh.mu.Unlock()
+	}
+	return total
+}
+
+func (w *TimingWheel) Start() {
+	go w.run()
+}
+
+func (w *TimingWheel) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopCh)
+	})
+}
+
+func (w *TimingWheel) run() {
+	ticker := time.NewTicker(time.Duration(w.tick) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-ticker.C:
+			w.advance(time.Now().UnixMilli() / w.tick)
+		}
+	}
+}
+
+// advance processes every tick up to and including nowTick on all shards.
+func (w *TimingWheel) advance(nowTick int64) {
+	var due []TTLItem
+	for _, sh := range w.shards {
+		sh.mu.Lock()
+		if len(sh.pos) == 0 {
+			// Nothing to cascade; jump straight to the present.
+			if sh.next <= nowTick {
+				sh.next = nowTick + 1
+			}
+		}
+		for sh.next <= nowTick {
+			due = sh.processTick(due, w.tick)
+		}
+		sh.mu.Unlock()
+
+		if w.onExpire != nil {
+			for _, item := range due {
+				w.onExpire(item.Key, item.ExpiresAt)
+			}
+		}
+		due = due[:0]
+	}
+}
+
+// locate returns the level and slot for a deadline relative to sh.next.
+func (sh *wheelShard) locate(expiresAt, tick int64) wheelPos {
+	deadline := (expiresAt + tick - 1) / tick
+	if deadline < sh.next {
+		deadline = sh.next
+	}
+	for level := 0; level < wheelLevels; level++ {
+		shift := uint(wheelBits * (level + 1))
+		if deadline>>shift == sh.next>>shift {
+			return wheelPos{level: level, slot: int(deadline>>uint(wheelBits*level)) & wheelMask}
+		}
+	}
+	return wheelPos{level: wheelOverflow}
+}
+
+func (sh *wheelShard) slotFor(p wheelPos) map[string]int64 {
+	if p.level == wheelOverflow {
+		return sh.overflow
+	}
+	if sh.levels[p.level][p.slot] == nil {
+		sh.levels[p.level][p.slot] = make(map[string]int64)
+	}
+	return sh.levels[p.level][p.slot]
+}
+
+func (sh *wheelShard) place(key string, expiresAt, tick int64) {
+	p := sh.locate(expiresAt, tick)
+	sh.slotFor(p)[key] = expiresAt
+	sh.pos[key] = p
+}
+
+func (sh *wheelShard) remove(key string) {
+	p, ok := sh.pos[key]
+	if !ok {
+		return
+	}
+	delete(sh.slotFor(p), key)
+	delete(sh.pos, key)
+}
+
+// processTick cascades the slots that start at sh.next from the highest level
+// down, then expires the level-0 slot and moves on to the next tick.
+func (sh *wheelShard) processTick(due []TTLItem, tick int64) []TTLItem {
+	now := sh.next
+	if now&(1<<uint(wheelBits*wheelLevels)-1) == 0 && len(sh.overflow) > 0 {
+		pending := sh.overflow
+		sh.overflow = make(map[string]int64)
+		for key, expiresAt := range pending {
+			delete(sh.pos, key)
+			sh.place(key, expiresAt, tick)
+		}
+	}
+	for level := wheelLevels - 1; level > 0; level-- {
+		if now&(1<<uint(wheelBits*level)-1) != 0 {
+			continue
+		}
+		slot := int(now>>uint(wheelBits*level)) & wheelMask
+		pending := sh.levels[level][slot]
+		if len(pending) == 0 {
+			continue
+		}
+		sh.levels[level][slot] = nil
+		for key, expiresAt := range pending {
+			delete(sh.pos, key)
+			sh.place(key, expiresAt, tick)
+		}
+	}
+
+	slot := int(now) & wheelMask
+	for key, expiresAt := range sh.levels[0][slot] {
+		due = append(due, TTLItem{Key: key, ExpiresAt: expiresAt})
+		delete(sh.pos, key)
+	}
+	sh.levels[0][slot] = nil
+	sh.next = now + 1
+	return due
+}
@@ -6,6 +6,8 @@ import (
 	"time"
 )
 
+const ttlExpireBatch = 128
+
 type TTLItem struct {
 	Key       string
 	ExpiresAt int64
@@ -39,20 +41,28 @@ func (h *TTLHeap) Pop() interface{} {
 	return item
 }
 
+// TTLManager keeps at most one heap entry per key: re-adding a key moves its
+// existing entry instead of pushing a new one, so the heap is bounded by the
+// number of keys with a TTL. onExpire receives the deadline that fired and is
+// expected to delete the key only if it still carries that deadline.
 type TTLManager struct {
 	heap     TTLHeap
+	index    map[string]*TTLItem
 	mu       sync.Mutex
 	stopCh   chan struct{}
+	wakeCh   chan struct{}
 	stopped  bool
-	onExpire func(key string)
+	onExpire func(key string, expiresAt int64)
 }
 
-func NewTTLManager(onExpire func(key string)) *TTLManager {
+func NewTTLManager(onExpire func(key string, expiresAt int64)) *TTLManager {
 	h := &TTLHeap{}
 	heap.Init(h)
 	return &TTLManager{
 		heap:     *h,
+		index:    make(map[string]*TTLItem),
 		stopCh:   make(chan struct{}),
+		wakeCh:   make(chan struct{}, 1),
 		onExpire: onExpire,
 	}
 }
@@ -65,10 +75,42 @@ func (tm *TTLManager) Add(key string, expiresAt int64) {
 		return
 	}
 
-	heap.Push(&tm.heap, &TTLItem{
-		Key:       key,
-		ExpiresAt: expiresAt,
-	})
+	if item, ok := tm.index[key]; ok {
+		item.ExpiresAt = expiresAt
+		heap.Fix(&tm.heap, item.index)
+	} else {
+		item = &TTLItem{
+			Key:       key,
+			ExpiresAt: expiresAt,
+		}
+		heap.Push(&tm.heap, item)
+		tm.index[key] = item
+	}
+
+	// Wake the worker if the new deadline is now the earliest one.
+	if tm.heap[0].Key == key {
+		tm.wake()
+	}
+}
+
+// Remove drops the pending expiry of key, e.g. after it was deleted or
+// overwritten without a TTL.
+func (tm *TTLManager) Remove(key string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	item, ok := tm.index[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&tm.heap, item.index)
+	delete(tm.index, key)
+}
+
+func (tm *TTLManager) Len() int {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.heap.Len()
 }
 
 func (tm *TTLManager) Start() {
@@ -86,44 +128,76 @@ func (tm *TTLManager) Stop() {
 	tm.mu.Unlock()
 }
 
+func (tm *TTLManager) wake() {
+	select {
+	case tm.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
 func (tm *TTLManager) run() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
 	for {
+		wait, more := tm.process()
+		if more {
+			select {
+			case <-tm.stopCh:
+				return
+			default:
+			}
+			continue
+		}
+
+		var timerC <-chan time.Time
+		if wait > 0 {
+			timer.Reset(wait)
+			timerC = timer.C
+		}
 		select {
 		case <-tm.stopCh:
 			return
-		default:
-			tm.process()
+		case <-tm.wakeCh:
+		case <-timerC:
 		}
+		timer.Stop()
 	}
 }
 
-func (tm *TTLManager) process() {
+// process expires up to ttlExpireBatch due items. It returns how long to wait
+// for the next deadline (zero when the heap is empty) and whether due items
+// remain.
+func (tm *TTLManager) process() (time.Duration, bool) {
 	tm.mu.Lock()
-	if tm.heap.Len() == 0 {
-		tm.mu.Unlock()
-		time.Sleep(1 * time.Second)
-		return
-	}
-
 	now := time.Now().UnixMilli()
-	item := tm.heap[0]
-	if item.ExpiresAt > now {
-		waitTime := time.Duration(item.ExpiresAt-now) * time.Millisecond
-		tm.mu.Unlock()
-
-		select {
-		case <-tm.stopCh:
-			return
-		case <-time.After(waitTime):
+	due := make([]TTLItem, 0, 8)
+	for tm.heap.Len() > 0 && len(due) < ttlExpireBatch {
+		item := tm.heap[0]
+		if item.ExpiresAt > now {
+			break
 		}
-		return
+		heap.Pop(&tm.heap)
+		delete(tm.index, item.Key)
+		due = append(due, TTLItem{Key: item.Key, ExpiresAt: item.ExpiresAt})
 	}
 
-	heap.Pop(&tm.heap)
-	key := item.Key
+	var wait time.Duration
+	more := false
+	if tm.heap.Len() > 0 {
+		if next := tm.heap[0].ExpiresAt; next > now {
+			wait = time.Duration(next-now) * time.Millisecond
+		} else {
+			more = true
+		}
+	}
 	tm.mu.Unlock()
 
 	if tm.onExpire != nil {
-		tm.onExpire(key)
+		for _, item := range due {
+			tm.onExpire(item.Key, item.ExpiresAt)
+		}
 	}
+	return wait, more
 }
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLManagerKeepsOneEntryPerKey(t *testing.T) {
+	tm := NewTTLManager(nil)
+	now := time.Now().UnixMilli()
+	for i := 0; i < 100; i++ {
+		tm.Add("k", now+int64(i)*1000)
+	}
+	tm.Add("other", now+500)
+	if tm.Len() != 2 {
+		t.Fatalf("expected 2 heap entries, got %d", tm.Len())
+	}
+
+	tm.Remove("k")
+	tm.Remove("missing")
+	if tm.Len() != 1 {
+		t.Fatalf("expected 1 heap entry after remove, got %d", tm.Len())
+	}
+}
+
+func TestTTLManagerWakesForEarlierDeadline(t *testing.T) {
+	expired := make(chan string, 1)
+	tm := NewTTLManager(func(key string, _ int64) {
+		expired <- key
+	})
+	tm.Add("late", time.Now().Add(time.Hour).UnixMilli())
+	tm.Start()
+	defer tm.Stop()
+
+	time.Sleep(20 * time.Millisecond)
+	tm.Add("soon", time.Now().Add(50*time.Millisecond).UnixMilli())
+
+	select {
+	case key := <-expired:
+		if key != "soon" {
+			t.Fatalf("expected soon to expire first, got %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("worker did not wake up for the earlier deadline")
+	}
+}
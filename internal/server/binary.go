@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shinerio/gopher-kv/internal/core"
+	"github.com/shinerio/gopher-kv/pkg/protocol"
+)
+
+const (
+	// Requests of a connection run concurrently, up to this many at a time.
+	binaryMaxInFlight = 128
+	// Longer keys are skipped unread; the service allows far shorter ones.
+	binaryMaxKeyLen = 64 << 10
+)
+
+type binaryServer struct {
+	service *core.Service
+}
+
+// NewBinaryServer serves the length-prefixed binary protocol described in
+// package protocol. The requests of a connection are executed concurrently
+// and answered as they complete, so clients match responses by request ID.
+func NewBinaryServer(addr string, service *core.Service) *TCPServer {
+	bs := &binaryServer{service: service}
+	return newTCPServer("binary", addr, bs.serveConn)
+}
+
+type binaryResponse struct {
+	hdr   protocol.FrameHeader
+	key   []byte
+	value []byte
+}
+
+func (bs *binaryServer) serveConn(conn net.Conn) {
+	out := make(chan binaryResponse, binaryMaxInFlight)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		writeBinaryResponses(conn, out)
+	}()
+
+	var handlers sync.WaitGroup
+	inFlight := make(chan struct{}, binaryMaxInFlight)
+	r := bufio.NewReader(conn)
+	buf := make([]byte, protocol.FrameHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			break
+		}
+		hdr := protocol.ParseFrameHeader(buf)
+		if hdr.KeyLen > binaryMaxKeyLen || int64(hdr.ValueLen) > int64(bs.service.MaxValueSize()) {
+			if _, err := io.CopyN(io.Discard, r, int64(hdr.KeyLen)+int64(hdr.ValueLen)); err != nil {
+				break
+			}
+			if hdr.KeyLen > binaryMaxKeyLen {
+				out <- binaryError(hdr, protocol.CodeKeyTooLong, core.ErrKeyTooLong.Error())
+			} else {
+				out <- binaryError(hdr, protocol.CodeValueTooLarge, core.ErrValueTooLarge.Error())
+			}
+			continue
+		}
+		body := make([]byte, int(hdr.KeyLen)+int(hdr.ValueLen))
+		if _, err := io.ReadFull(r, body); err != nil {
+			break
+		}
+
+		inFlight <- struct{}{}
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			out <- bs.exec(hdr, body[:hdr.KeyLen], body[hdr.KeyLen:])
+			<-inFlight
+		}()
+	}
+	handlers.Wait()
+	close(out)
+	<-writerDone
+}
+
+// writeBinaryResponses writes the responses sent on out, flushing whenever
+// none is waiting. After a write error it discards the rest, so senders never
+// block on a dead connection.
+func writeBinaryResponses(conn net.Conn, out <-chan binaryResponse) {
+	w := bufio.NewWriter(conn)
+	var hdr []byte
+	for resp := range out {
+		resp.hdr.KeyLen = uint32(len(resp.key))
+		resp.hdr.ValueLen = uint32(len(resp.value))
+		hdr = resp.hdr.AppendTo(hdr[:0])
+		w.Write(hdr)
+		w.Write(resp.key)
+		w.Write(resp.value)
+		if len(out) > 0 {
+			continue
+		}
+		if err := w.Flush(); err != nil {
+			for range out {
+			}
+			return
+		}
+	}
+}
+
+func binaryError(req protocol.FrameHeader, code int, msg string) binaryResponse {
+	return binaryResponse{
+		hdr:   protocol.FrameHeader{Op: req.Op, ID: req.ID, Status: uint16(code)},
+		value: []byte(msg),
+	}
+}
+
+func boolArg(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (bs *binaryServer) exec(req protocol.FrameHeader, key, value []byte) binaryResponse {
+	svc := bs.service
+	resp := binaryResponse{hdr: protocol.FrameHeader{Op: req.Op, ID: req.ID}}
+	var (
+		data any
+		err  error
+	)
+	switch req.Op {
+	case protocol.OpPing:
+	case protocol.OpGet:
+		var ttl time.Duration
+		resp.value, ttl, err = svc.Get(string(key))
+		resp.hdr.Arg = ttl.Milliseconds()
+	case protocol.OpSet:
+		mode := core.SetAlways
+		switch req.Flags {
+		case 0:
+		case protocol.FlagIfAbsent:
+			mode = core.SetIfAbsent
+		case protocol.FlagIfPresent:
+			mode = core.SetIfPresent
+		default:
+			return binaryError(req, protocol.CodeInvalidParam, "invalid set flags")
+		}
+		if req.Arg < 0 {
+			return binaryError(req, protocol.CodeInvalidParam, "negative ttl")
+		}
+		ttl, ok := scaleDuration(req.Arg, time.Millisecond)
+		if !ok {
+			return binaryError(req, protocol.CodeInvalidParam, "ttl out of range")
+		}
+		var stored bool
+		stored, err = svc.SetIf(string(key), value, ttl, mode)
+		resp.hdr.Arg = boolArg(stored)
+	case protocol.OpDelete:
+		var deleted bool
+		deleted, err = svc.Delete(string(key))
+		resp.hdr.Arg = boolArg(deleted)
+	case protocol.OpExists:
+		var exists bool
+		exists, err = svc.Exists(string(key))
+		resp.hdr.Arg = boolArg(exists)
+	case protocol.OpTTL:
+		var ttl time.Duration
+		ttl, err = svc.TTL(string(key))
+		resp.hdr.Arg = int64(ttl.Seconds())
+	case protocol.OpPTTL:
+		var pttl time.Duration
+		pttl, err = svc.PTTL(string(key))
+		resp.hdr.Arg = pttl.Milliseconds()
+	case protocol.OpExpire:
+		ttl, ok := scaleDuration(req.Arg, time.Millisecond)
+		if !ok {
+			return binaryError(req, protocol.CodeInvalidParam, "ttl out of range")
+		}
+		err = svc.Expire(string(key), ttl)
+	case protocol.OpExpireAt:
+		err = svc.ExpireAt(string(key), time.UnixMilli(req.Arg))
+	case protocol.OpPersist:
+		var persisted bool
+		persisted, err = svc.Persist(string(key))
+		resp.hdr.Arg = boolArg(persisted)
+	case protocol.OpScan:
+		match, rest, ok1 := protocol.ReadBytes(value)
+		prefix, rest, ok2 := protocol.ReadBytes(rest)
+		if !ok1 || !ok2 || len(rest) > 0 || req.Arg < 0 {
+			return binaryError(req, protocol.CodeInvalidParam, "invalid scan request")
+		}
+		var keys []string
+		var cursor string
+		keys, cursor, err = svc.Scan(string(key), string(match), string(prefix), int(req.Arg))
+		resp.key = []byte(cursor)
+		for _, k := range keys {
+			resp.value = protocol.AppendBytes(resp.value, []byte(k))
+		}
+	case protocol.OpStats:
+		data = svc.Stats()
+	case protocol.OpSnapshot:
+		var path string
+		if path, err = svc.Snapshot(); err == nil {
+			data = &protocol.SnapshotResponseData{Status: "ok", Path: path}
+		}
+	case protocol.OpSnapshots:
+		var snapshots []protocol.SnapshotInfo
+		if snapshots, err = svc.Snapshots(); err == nil {
+			data = &protocol.SnapshotListResponseData{Snapshots: snapshots}
+		}
+	case protocol.OpRestoreSnapshot:
+		var keys int
+		if keys, err = svc.RestoreSnapshot(string(key)); err == nil {
+			data = &protocol.RestoreResponseData{ID: string(key), Keys: keys}
+		}
+	case protocol.OpRewriteAOF:
+		if err = svc.RewriteAOF(); err == nil {
+			data, err = svc.AOFStatus()
+		}
+	case protocol.OpAOFStatus:
+		data, err = svc.AOFStatus()
+	default:
+		return binaryError(req, protocol.CodeInvalidParam, "unknown op")
+	}
+	if err != nil {
+		return binaryError(req, svc.ErrorToCode(err), err.Error())
+	}
+	if data != nil {
+		if resp.value, err = json.Marshal(data); err != nil {
+			return binaryError(req, protocol.CodeInternalError, err.Error())
+		}
+	}
+	return resp
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/shinerio/gopher-kv/pkg/protocol"
+)
+
+func writeFrame(t *testing.T, w io.Writer, hdr protocol.FrameHeader, key, value string) {
+	t.Helper()
+	hdr.KeyLen = uint32(len(key))
+	hdr.ValueLen = uint32(len(value))
+	buf := hdr.AppendTo(nil)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	if _, err := w.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFrame(t *testing.T, r io.Reader) (protocol.FrameHeader, string, string) {
+	t.Helper()
+	buf := make([]byte, protocol.FrameHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	hdr := protocol.ParseFrameHeader(buf)
+	body := make([]byte, int(hdr.KeyLen)+int(hdr.ValueLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	return hdr, string(body[:hdr.KeyLen]), string(body[hdr.KeyLen:])
+}
+
+// binaryCall sends one request and waits for its response.
+func binaryCall(t *testing.T, conn net.Conn, r io.Reader, req protocol.FrameHeader, key, value string) (protocol.FrameHeader, string) {
+	t.Helper()
+	writeFrame(t, conn, req, key, value)
+	hdr, _, v := readFrame(t, r)
+	if hdr.ID != req.ID || hdr.Op != req.Op {
+		t.Fatalf("response %+v does not match request %+v", hdr, req)
+	}
+	return hdr, v
+}
+
+func TestBinaryPipelinedRequests(t *testing.T) {
+	svc := newTestService(t)
+	conn := dialTestTCPServer(t, NewBinaryServer("", svc))
+	r := bufio.NewReader(conn)
+
+	const n = 50
+	keys := make(map[uint32]string, n)
+	for id := uint32(1); id <= n; id++ {
+		key := strings.Repeat("k", int(id))
+		keys[id] = key
+		writeFrame(t, conn, protocol.FrameHeader{Op: protocol.OpSet, ID: id}, key, key)
+	}
+	for range n {
+		hdr, _, _ := readFrame(t, r)
+		if _, ok := keys[hdr.ID]; !ok || hdr.Status != protocol.CodeSuccess || hdr.Arg != 1 {
+			t.Fatalf("unexpected response %+v", hdr)
+		}
+		delete(keys, hdr.ID)
+	}
+
+	for id := uint32(1); id <= n; id++ {
+		writeFrame(t, conn, protocol.FrameHeader{Op: protocol.OpGet, ID: id}, strings.Repeat("k", int(id)), "")
+	}
+	for range n {
+		hdr, _, value := readFrame(t, r)
+		if hdr.Status != protocol.CodeSuccess || value != strings.Repeat("k", int(hdr.ID)) {
+			t.Fatalf("request %d got %q with status %d", hdr.ID, value, hdr.Status)
+		}
+	}
+}
+
+func TestBinaryRejectsOversizedFrames(t *testing.T) {
+	svc := newTestService(t)
+	conn := dialTestTCPServer(t, NewBinaryServer("", svc))
+	r := bufio.NewReader(conn)
+
+	hdr, _ := binaryCall(t, conn, r, protocol.FrameHeader{Op: protocol.OpSet, ID: 1}, "k", strings.Repeat("x", svc.MaxValueSize()+1))
+	if hdr.Status != protocol.CodeValueTooLarge {
+		t.Fatalf("expected code %d, got %+v", protocol.CodeValueTooLarge, hdr)
+	}
+	hdr, _ = binaryCall(t, conn, r, protocol.FrameHeader{Op: protocol.OpSet, ID: 2}, strings.Repeat("k", binaryMaxKeyLen+1), "v")
+	if hdr.Status != protocol.CodeKeyTooLong {
+		t.Fatalf("expected code %d, got %+v", protocol.CodeKeyTooLong, hdr)
+	}
+	// The bodies were skipped, so the connection is still in sync.
+	if hdr, _ := binaryCall(t, conn, r, protocol.FrameHeader{Op: protocol.OpPing, ID: 3}, "", ""); hdr.Status != protocol.CodeSuccess {
+		t.Fatalf("ping after rejected frames failed: %+v", hdr)
+	}
+	if exists, _ := svc.Exists("k"); exists {
+		t.Fatal("no value should have been stored")
+	}
+}
+
+func TestBinarySetFlagsAndTTL(t *testing.T) {
+	svc := newTestService(t)
+	conn := dialTestTCPServer(t, NewBinaryServer("", svc))
+	r := bufio.NewReader(conn)
+
+	steps := []struct {
+		req    protocol.FrameHeader
+		status uint16
+		arg    int64
+	}{
+		{protocol.FrameHeader{Op: protocol.OpSet, Flags: protocol.FlagIfPresent}, protocol.CodeSuccess, 0},
+		{protocol.FrameHeader{Op: protocol.OpSet, Flags: protocol.FlagIfAbsent}, protocol.CodeSuccess, 1},
+		{protocol.FrameHeader{Op: protocol.OpSet, Flags: protocol.FlagIfAbsent}, protocol.CodeSuccess, 0},
+		{protocol.FrameHeader{Op: protocol.OpSet, Flags: protocol.FlagIfAbsent | protocol.FlagIfPresent}, protocol.CodeInvalidParam, 0},
+		{protocol.FrameHeader{Op: protocol.OpSet, Arg: -1}, protocol.CodeInvalidParam, 0},
+		{protocol.FrameHeader{Op: protocol.OpSet, Arg: math.MaxInt64}, protocol.CodeInvalidParam, 0},
+		{protocol.FrameHeader{Op: protocol.OpExpire, Arg: math.MaxInt64}, protocol.CodeInvalidParam, 0},
+		{protocol.FrameHeader{Op: protocol.OpExpire, Arg: math.MinInt64}, protocol.CodeInvalidParam, 0},
+		{protocol.FrameHeader{Op: protocol.OpSet, Flags: protocol.FlagIfPresent, Arg: 100000}, protocol.CodeSuccess, 1},
+		{protocol.FrameHeader{Op: protocol.OpDelete}, protocol.CodeSuccess, 1},
+		{protocol.FrameHeader{Op: protocol.OpDelete}, protocol.CodeSuccess, 0},
+	}
+	for i, step := range steps {
+		step.req.ID = uint32(i + 1)
+		hdr, msg := binaryCall(t, conn, r, step.req, "k", "v")
+		if hdr.Status != step.status || hdr.Arg != step.arg {
+			t.Fatalf("step %d: expected status %d and arg %d, got %+v (%s)", i, step.status, step.arg, hdr, msg)
+		}
+	}
+}
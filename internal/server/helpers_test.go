@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shinerio/gopher-kv/internal/config"
+	"github.com/shinerio/gopher-kv/internal/core"
+)
+
+func newTestService(t *testing.T) *core.Service {
+	t.Helper()
+	dir := t.TempDir()
+	svc := core.NewService(&config.Config{
+		Storage: config.StorageConfig{
+			ShardCount:   16,
+			MaxKeySize:   256,
+			MaxValueSize: 1024,
+			MaxMemory:    256 * 1024 * 1024,
+			BinaryKeys:   true,
+		},
+		AOF: config.AOFConfig{FilePath: filepath.Join(dir, "appendonly.aof")},
+		RDB: config.RDBConfig{FilePath: filepath.Join(dir, "dump.rdb")},
+		Log: config.LogConfig{Level: "error"},
+	})
+	t.Cleanup(svc.Stop)
+	return svc
+}
+
+// dialTestTCPServer serves srv on a loopback port and returns a connection
+// to it.
+func dialTestTCPServer(t *testing.T, srv *TCPServer) net.Conn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+// expectReply reads len(want) bytes of replies and compares them with want.
+func expectReply(t *testing.T, r io.Reader, want string) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("reading %q: %v (got %q)", want, err, got)
+	}
+	if string(got) != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
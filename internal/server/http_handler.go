@@ -1,12 +1,20 @@
 package server
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/shinerio/gopher-kv/internal/core"
+	"github.com/shinerio/gopher-kv/internal/storage"
 	"github.com/shinerio/gopher-kv/pkg/protocol"
 )
 
@@ -26,12 +34,14 @@ func respondJSON(w http.ResponseWriter, code int, data interface{}, msg string)
 	w.Header().Set("Content-Type", "application/json")
 	httpCode := http.StatusOK
 	switch code {
-	case protocol.CodeKeyNotFound, protocol.CodeKeyExpired:
+	case protocol.CodeKeyNotFound, protocol.CodeKeyExpired, protocol.CodeSnapshotNotFound:
 		httpCode = http.StatusNotFound
 	case protocol.CodeKeyTooLong, protocol.CodeValueTooLarge, protocol.CodeInvalidParam:
 		httpCode = http.StatusBadRequest
 	case protocol.CodeMemoryFull:
 		httpCode = http.StatusInsufficientStorage
+	case protocol.CodeAOFRewriting, protocol.CodeAOFDisabled:
+		httpCode = http.StatusConflict
 	case protocol.CodeInternalError:
 		httpCode = http.StatusInternalServerError
 	}
@@ -43,6 +53,43 @@ func respondJSON(w http.ResponseWriter, code int, data interface{}, msg string)
 	})
 }
 
+// queryKey reads the key of a request from the k parameter, or from kb64
+// holding it in base64, which keeps binary keys readable in logs and URLs.
+func queryKey(query url.Values) (string, error) {
+	if raw := query.Get("kb64"); raw != "" {
+		key, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			return "", errors.New("invalid base64 key")
+		}
+		return string(key), nil
+	}
+	if key := query.Get("k"); key != "" {
+		return key, nil
+	}
+	return "", errors.New("missing key parameter")
+}
+
+// bodyKey returns the key of a JSON request: key_b64 decoded if set, since
+// JSON strings cannot hold bytes that are not UTF-8, else key.
+func bodyKey(key, keyB64 string) (string, error) {
+	if keyB64 == "" {
+		return key, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(keyB64)
+	if err != nil {
+		return "", errors.New("invalid base64 key")
+	}
+	return string(decoded), nil
+}
+
+// scaleDuration returns n units as a Duration, or false if that overflows.
+func scaleDuration(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, protocol.CodeSuccess, &protocol.HealthResponseData{
 		Status: "healthy",
@@ -56,6 +103,11 @@ func (h *Handler) SetKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	key, err := bodyKey(req.Key, req.KeyB64)
+	if err != nil {
+		respondJSON(w, protocol.CodeInvalidParam, nil, err.Error())
+		return
+	}
 	value, err := base64.StdEncoding.DecodeString(req.Value)
 	if err != nil {
 		respondJSON(w, protocol.CodeInvalidParam, nil, "invalid base64 value")
@@ -63,11 +115,18 @@ func (h *Handler) SetKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var ttl time.Duration
-	if req.TTL > 0 {
-		ttl = time.Duration(req.TTL) * time.Second
+	ok := true
+	if req.TTLMs > 0 {
+		ttl, ok = scaleDuration(req.TTLMs, time.Millisecond)
+	} else if req.TTL > 0 {
+		ttl, ok = scaleDuration(int64(req.TTL), time.Second)
+	}
+	if !ok {
+		respondJSON(w, protocol.CodeInvalidParam, nil, "ttl out of range")
+		return
 	}
 
-	err = h.service.Set(req.Key, value, ttl)
+	err = h.service.Set(key, value, ttl)
 	if err != nil {
 		code := h.service.ErrorToCode(err)
 		respondJSON(w, code, nil, protocol.CodeMessages[code])
@@ -78,9 +137,9 @@ func (h *Handler) SetKey(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) GetKey(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Query().Get("k")
-	if key == "" {
-		respondJSON(w, protocol.CodeInvalidParam, nil, "missing key parameter")
+	key, err := queryKey(r.URL.Query())
+	if err != nil {
+		respondJSON(w, protocol.CodeInvalidParam, nil, err.Error())
 		return
 	}
 
@@ -102,14 +161,103 @@ func (h *Handler) GetKey(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) DeleteKey(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Query().Get("k")
-	if key == "" {
-		respondJSON(w, protocol.CodeInvalidParam, nil, "missing key parameter")
+	key, err := queryKey(r.URL.Query())
+	if err != nil {
+		respondJSON(w, protocol.CodeInvalidParam, nil, err.Error())
 		return
 	}
 
-	err := h.service.Delete(key)
+	if _, err := h.service.Delete(key); err != nil {
+		code := h.service.ErrorToCode(err)
+		respondJSON(w, code, nil, protocol.CodeMessages[code])
+		return
+	}
+
+	respondJSON(w, protocol.CodeSuccess, nil, "ok")
+}
+
+// Headers of the raw value endpoints: the TTL of a PUT in seconds or
+// milliseconds, and the remaining TTL in the response to a GET.
+const (
+	headerTTL   = "X-TTL"
+	headerTTLMs = "X-TTL-Ms"
+	// Longer content types are refused rather than stored with the value.
+	maxContentTypeLen = 256
+
+	rawPathPrefix = "/v1/raw/"
+)
+
+// inlineContentTypes are the stored content types a browser may render
+// from GetRaw. Any other, such as text/html or image/svg+xml, could run
+// script on the server's origin, so it is served as a download.
+var inlineContentTypes = map[string]bool{
+	"application/json":         true,
+	"application/octet-stream": true,
+	"image/gif":                true,
+	"image/jpeg":               true,
+	"image/png":                true,
+	"image/webp":               true,
+	"text/plain":               true,
+}
+
+// rawTTL reads the TTL of a raw PUT from its headers, the millisecond one
+// taking precedence; zero means none.
+func rawTTL(header http.Header) (time.Duration, error) {
+	if raw := header.Get(headerTTLMs); raw != "" {
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		ttl, ok := scaleDuration(ms, time.Millisecond)
+		if err != nil || ms < 0 || !ok {
+			return 0, errors.New("invalid " + headerTTLMs + " header")
+		}
+		return ttl, nil
+	}
+	if raw := header.Get(headerTTL); raw != "" {
+		seconds, err := strconv.ParseInt(raw, 10, 64)
+		ttl, ok := scaleDuration(seconds, time.Second)
+		if err != nil || seconds < 0 || !ok {
+			return 0, errors.New("invalid " + headerTTL + " header")
+		}
+		return ttl, nil
+	}
+	return 0, nil
+}
+
+// SetRaw stores the request body as is under the key in the path, along with
+// its Content-Type, sparing clients the base64 of SetKey.
+func (h *Handler) SetRaw(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		respondJSON(w, protocol.CodeInvalidParam, nil, "missing key")
+		return
+	}
+	ttl, err := rawTTL(r.Header)
 	if err != nil {
+		respondJSON(w, protocol.CodeInvalidParam, nil, err.Error())
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if len(contentType) > maxContentTypeLen {
+		respondJSON(w, protocol.CodeInvalidParam, nil, "content type too long")
+		return
+	}
+
+	limit := int64(h.service.MaxValueSize())
+	if r.ContentLength > limit {
+		respondJSON(w, protocol.CodeValueTooLarge, nil, protocol.CodeMessages[protocol.CodeValueTooLarge])
+		return
+	}
+	body := bytes.NewBuffer(make([]byte, 0, max(r.ContentLength, 0)))
+	if _, err := body.ReadFrom(http.MaxBytesReader(w, r.Body, limit)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondJSON(w, protocol.CodeValueTooLarge, nil, protocol.CodeMessages[protocol.CodeValueTooLarge])
+		} else {
+			respondJSON(w, protocol.CodeInvalidParam, nil, "failed to read request body")
+		}
+		return
+	}
+
+	if err := h.service.SetMeta(key, body.Bytes(), ttl, storage.Meta{ContentType: contentType}); err != nil {
 		code := h.service.ErrorToCode(err)
 		respondJSON(w, code, nil, protocol.CodeMessages[code])
 		return
@@ -118,10 +266,41 @@ func (h *Handler) DeleteKey(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, protocol.CodeSuccess, nil, "ok")
 }
 
+// GetRaw answers the value of the key in the path as the response body, with
+// the content type it was stored with. The response is sandboxed, and
+// served as an attachment unless its type is safe to render.
+func (h *Handler) GetRaw(w http.ResponseWriter, r *http.Request) {
+	entry, err := h.service.GetEntry(r.PathValue("key"))
+	if err != nil {
+		code := h.service.ErrorToCode(err)
+		respondJSON(w, code, nil, protocol.CodeMessages[code])
+		return
+	}
+
+	contentType := entry.Meta.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || !inlineContentTypes[mediaType] {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.Value)))
+	if entry.ExpiresAt > 0 {
+		remaining := max(time.Until(time.UnixMilli(entry.ExpiresAt)), 0)
+		w.Header().Set(headerTTL, strconv.Itoa(int(remaining.Seconds())))
+		w.Header().Set(headerTTLMs, strconv.FormatInt(remaining.Milliseconds(), 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(entry.Value)
+}
+
 func (h *Handler) TTLKey(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Query().Get("k")
-	if key == "" {
-		respondJSON(w, protocol.CodeInvalidParam, nil, "missing key parameter")
+	key, err := queryKey(r.URL.Query())
+	if err != nil {
+		respondJSON(w, protocol.CodeInvalidParam, nil, err.Error())
 		return
 	}
 
@@ -137,6 +316,148 @@ func (h *Handler) TTLKey(w http.ResponseWriter, r *http.Request) {
 	}, "ok")
 }
 
+func (h *Handler) PTTLKey(w http.ResponseWriter, r *http.Request) {
+	key, err := queryKey(r.URL.Query())
+	if err != nil {
+		respondJSON(w, protocol.CodeInvalidParam, nil, err.Error())
+		return
+	}
+
+	pttl, err := h.service.PTTL(key)
+	if err != nil {
+		code := h.service.ErrorToCode(err)
+		respondJSON(w, code, nil, protocol.CodeMessages[code])
+		return
+	}
+
+	respondJSON(w, protocol.CodeSuccess, &protocol.PTTLResponseData{
+		PTTL: pttl.Milliseconds(),
+	}, "ok")
+}
+
+func (h *Handler) ExpireKey(w http.ResponseWriter, r *http.Request) {
+	var req protocol.ExpireRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, protocol.CodeInvalidParam, nil, "invalid request body")
+		return
+	}
+
+	var (
+		at  time.Time
+		set int
+	)
+	ok := true
+	now := time.Now()
+	if req.TTL != nil {
+		var ttl time.Duration
+		ttl, ok = scaleDuration(*req.TTL, time.Second)
+		at = now.Add(ttl)
+		set++
+	}
+	if req.TTLMs != nil {
+		var ttl time.Duration
+		ttl, ok = scaleDuration(*req.TTLMs, time.Millisecond)
+		at = now.Add(ttl)
+		set++
+	}
+	if req.At != nil {
+		// The deadline is kept in Unix milliseconds.
+		ok = *req.At <= math.MaxInt64/1000 && *req.At >= math.MinInt64/1000
+		at = time.Unix(*req.At, 0)
+		set++
+	}
+	if req.AtMs != nil {
+		at = time.UnixMilli(*req.AtMs)
+		set++
+	}
+	if set != 1 {
+		respondJSON(w, protocol.CodeInvalidParam, nil, "exactly one of ttl, ttl_ms, at, at_ms is required")
+		return
+	}
+	if !ok {
+		respondJSON(w, protocol.CodeInvalidParam, nil, "expire time out of range")
+		return
+	}
+	key, err := bodyKey(req.Key, req.KeyB64)
+	if err != nil {
+		respondJSON(w, protocol.CodeInvalidParam, nil, err.Error())
+		return
+	}
+
+	if err := h.service.ExpireAt(key, at); err != nil {
+		code := h.service.ErrorToCode(err)
+		respondJSON(w, code, nil, protocol.CodeMessages[code])
+		return
+	}
+
+	respondJSON(w, protocol.CodeSuccess, nil, "ok")
+}
+
+func (h *Handler) PersistKey(w http.ResponseWriter, r *http.Request) {
+	var req protocol.PersistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, protocol.CodeInvalidParam, nil, "invalid request body")
+		return
+	}
+
+	key, err := bodyKey(req.Key, req.KeyB64)
+	if err != nil {
+		respondJSON(w, protocol.CodeInvalidParam, nil, err.Error())
+		return
+	}
+	persisted, err := h.service.Persist(key)
+	if err != nil {
+		code := h.service.ErrorToCode(err)
+		respondJSON(w, code, nil, protocol.CodeMessages[code])
+		return
+	}
+
+	respondJSON(w, protocol.CodeSuccess, &protocol.PersistResponseData{
+		Persisted: persisted,
+	}, "ok")
+}
+
+func (h *Handler) ScanKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var count int
+	if raw := query.Get("count"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			respondJSON(w, protocol.CodeInvalidParam, nil, "invalid count parameter")
+			return
+		}
+		count = n
+	}
+
+	var encodeKeys bool
+	switch query.Get("encoding") {
+	case "":
+	case "base64":
+		encodeKeys = true
+	default:
+		respondJSON(w, protocol.CodeInvalidParam, nil, "invalid encoding parameter")
+		return
+	}
+
+	keys, cursor, err := h.service.Scan(query.Get("cursor"), query.Get("match"), query.Get("prefix"), count)
+	if err != nil {
+		code := h.service.ErrorToCode(err)
+		respondJSON(w, code, nil, err.Error())
+		return
+	}
+	if encodeKeys {
+		for i, key := range keys {
+			keys[i] = base64.StdEncoding.EncodeToString([]byte(key))
+		}
+	}
+
+	respondJSON(w, protocol.CodeSuccess, &protocol.ScanResponseData{
+		Cursor: cursor,
+		Keys:   keys,
+	}, "ok")
+}
+
 func (h *Handler) Stats(w http.ResponseWriter, r *http.Request) {
 	stats := h.service.Stats()
 	respondJSON(w, protocol.CodeSuccess, stats, "ok")
@@ -154,6 +475,74 @@ func (h *Handler) Snapshot(w http.ResponseWriter, r *http.Request) {
 	}, "ok")
 }
 
+func (h *Handler) ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := h.service.Snapshots()
+	if err != nil {
+		respondJSON(w, protocol.CodeInternalError, nil, protocol.CodeMessages[protocol.CodeInternalError])
+		return
+	}
+	respondJSON(w, protocol.CodeSuccess, &protocol.SnapshotListResponseData{
+		Snapshots: snapshots,
+	}, "ok")
+}
+
+func (h *Handler) RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	keys, err := h.service.RestoreSnapshot(id)
+	if err != nil {
+		code := h.service.ErrorToCode(err)
+		respondJSON(w, code, nil, err.Error())
+		return
+	}
+	respondJSON(w, protocol.CodeSuccess, &protocol.RestoreResponseData{
+		ID:   id,
+		Keys: keys,
+	}, "ok")
+}
+
+func (h *Handler) RewriteAOF(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.RewriteAOF(); err != nil {
+		code := h.service.ErrorToCode(err)
+		respondJSON(w, code, nil, err.Error())
+		return
+	}
+	h.AOFStatus(w, r)
+}
+
+func (h *Handler) AOFStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := h.service.AOFStatus()
+	if err != nil {
+		code := h.service.ErrorToCode(err)
+		respondJSON(w, code, nil, err.Error())
+		return
+	}
+	respondJSON(w, protocol.CodeSuccess, status, "ok")
+}
+
+// rawRoutes serves the raw value endpoints, taking the key as the rest of
+// the path as is, and passes other requests on to next. ServeMux would
+// redirect a path holding "//", "/./" or "/../" to its cleaned form, and so
+// to another key.
+func rawRoutes(handler *Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := strings.CutPrefix(r.URL.Path, rawPathPrefix)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.SetPathValue("key", key)
+		switch r.Method {
+		case http.MethodPut:
+			handler.SetRaw(w, r)
+		case http.MethodGet, http.MethodHead:
+			handler.GetRaw(w, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
+
 func NewHTTPServer(addr string, handler *Handler, middlewares ...Middleware) *http.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /v1/health", handler.Health)
@@ -161,10 +550,18 @@ func NewHTTPServer(addr string, handler *Handler, middlewares ...Middleware) *ht
 	mux.HandleFunc("GET /v1/key", handler.GetKey)
 	mux.HandleFunc("DELETE /v1/key", handler.DeleteKey)
 	mux.HandleFunc("GET /v1/ttl", handler.TTLKey)
+	mux.HandleFunc("GET /v1/pttl", handler.PTTLKey)
+	mux.HandleFunc("POST /v1/expire", handler.ExpireKey)
+	mux.HandleFunc("POST /v1/persist", handler.PersistKey)
+	mux.HandleFunc("GET /v1/keys", handler.ScanKeys)
 	mux.HandleFunc("GET /v1/stats", handler.Stats)
 	mux.HandleFunc("POST /v1/snapshot", handler.Snapshot)
+	mux.HandleFunc("GET /v1/snapshots", handler.ListSnapshots)
+	mux.HandleFunc("POST /v1/snapshots/{id}/restore", handler.RestoreSnapshot)
+	mux.HandleFunc("POST /v1/aof/rewrite", handler.RewriteAOF)
+	mux.HandleFunc("GET /v1/aof/status", handler.AOFStatus)
 
-	var root http.Handler = mux
+	root := rawRoutes(handler, mux)
 	for i := len(middlewares) - 1; i >= 0; i-- {
 		if middlewares[i] != nil {
 			root = middlewares[i](root)
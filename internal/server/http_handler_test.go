@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/shinerio/gopher-kv/internal/core"
+	"github.com/shinerio/gopher-kv/internal/storage"
+	"github.com/shinerio/gopher-kv/pkg/protocol"
+)
+
+func newTestHTTPServer(t *testing.T, svc *core.Service) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(NewHTTPServer("", NewHandler(svc)).Handler)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// doJSON sends a request with the given JSON body and returns the decoded
+// response and HTTP status.
+func doJSON(t *testing.T, method, url, body string) (protocol.Response, int) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out protocol.Response
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out, resp.StatusCode
+}
+
+func TestExpireKeyRejectsOverflowingTTL(t *testing.T) {
+	svc := newTestService(t)
+	ts := newTestHTTPServer(t, svc)
+	if err := svc.Set("k", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{"ttl", "ttl_ms", "at"} {
+		body := fmt.Sprintf(`{"key": "k", %q: 9223372036854775807}`, field)
+		resp, status := doJSON(t, "POST", ts.URL+"/v1/expire", body)
+		if status != http.StatusBadRequest || resp.Code != protocol.CodeInvalidParam {
+			t.Fatalf("%s: expected 400 with code %d, got %d with %+v", field, protocol.CodeInvalidParam, status, resp)
+		}
+	}
+	if exists, _ := svc.Exists("k"); !exists {
+		t.Fatal("a rejected expire should leave the key in place")
+	}
+
+	resp, status := doJSON(t, "PUT", ts.URL+"/v1/key", `{"key": "k", "value": "dg==", "ttl": 9223372036854775807}`)
+	if status != http.StatusBadRequest || resp.Code != protocol.CodeInvalidParam {
+		t.Fatalf("set: expected 400, got %d with %+v", status, resp)
+	}
+}
+
+func TestRawValueKeysWithSlashesAndBinaryBytes(t *testing.T) {
+	svc := newTestService(t)
+	ts := newTestHTTPServer(t, svc)
+
+	value := []byte{0x00, 0xff, '\r', '\n', 0x80}
+	for _, tc := range []struct{ path, key string }{
+		{"/v1/raw/a/b/c", "a/b/c"},
+		{"/v1/raw/a%2Fb/%E4%BD%A0", "a/b/你"},
+		{"/v1/raw/%FF%FE/%00", "\xff\xfe/\x00"},
+		// Paths ServeMux would clean and redirect.
+		{"/v1/raw/a//b", "a//b"},
+		{"/v1/raw/a/./b/", "a/./b/"},
+		{"/v1/raw/a/../c", "a/../c"},
+		{"/v1/raw/..", ".."},
+	} {
+		req, err := http.NewRequest("PUT", ts.URL+tc.path, bytes.NewReader(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-test")
+		req.Header.Set(headerTTLMs, "100000")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("PUT %s: expected 200, got %d", tc.path, resp.StatusCode)
+		}
+		if e, err := svc.GetEntry(tc.key); err != nil || !bytes.Equal(e.Value, value) || e.Meta.ContentType != "application/x-test" {
+			t.Fatalf("PUT %s: expected the value under %q, got %+v (%v)", tc.path, tc.key, e, err)
+		}
+
+		resp, err = http.Get(ts.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(body, value) {
+			t.Fatalf("GET %s: expected 200 with %x, got %d with %x (%v)", tc.path, value, resp.StatusCode, body, err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/x-test" {
+			t.Fatalf("GET %s: expected the stored content type, got %q", tc.path, ct)
+		}
+		if cd := resp.Header.Get("Content-Disposition"); cd != "attachment" {
+			t.Fatalf("GET %s: expected an unknown content type as an attachment, got %q", tc.path, cd)
+		}
+		if ms, err := strconv.ParseInt(resp.Header.Get(headerTTLMs), 10, 64); err != nil || ms <= 0 || ms > 100000 {
+			t.Fatalf("GET %s: expected a TTL of up to 100s, got %q", tc.path, resp.Header.Get(headerTTLMs))
+		}
+	}
+
+	// Types a browser could run script from are sandboxed and downloaded.
+	for contentType, inline := range map[string]bool{
+		"text/html":                 false,
+		"image/svg+xml":             false,
+		"bad/type;;":                false,
+		"text/plain; charset=utf-8": true,
+		"image/png":                 true,
+	} {
+		if err := svc.SetMeta("typed", []byte("<script>"), 0, storage.Meta{ContentType: contentType}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Get(ts.URL + "/v1/raw/typed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if csp := resp.Header.Get("Content-Security-Policy"); csp != "sandbox" {
+			t.Fatalf("%s: expected a sandbox policy, got %q", contentType, csp)
+		}
+		if attachment := resp.Header.Get("Content-Disposition") == "attachment"; attachment == inline {
+			t.Fatalf("%s: expected inline %v, got Content-Disposition %q", contentType, inline, resp.Header.Get("Content-Disposition"))
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/v1/raw/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("a prefix of a stored key should not be found, got %d", resp.StatusCode)
+	}
+
+	for header, raw := range map[string]string{headerTTL: "9223372036854775807", headerTTLMs: "-1"} {
+		req, _ := http.NewRequest("PUT", ts.URL+"/v1/raw/ttl", strings.NewReader("v"))
+		req.Header.Set(header, raw)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: %s: expected 400, got %d", header, raw, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/v1/raw/big", bytes.NewReader(make([]byte, svc.MaxValueSize()+1)))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("an oversized body should be refused, got %d", resp.StatusCode)
+	}
+	if exists, _ := svc.Exists("big"); exists {
+		t.Fatal("no value should have been stored")
+	}
+}
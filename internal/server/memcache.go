@@ -0,0 +1,419 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shinerio/gopher-kv/internal/core"
+	"github.com/shinerio/gopher-kv/internal/storage"
+)
+
+const (
+	// Command lines, including a get of many keys, must fit the read buffer.
+	mcReadBufferSize = 64 << 10
+	// An exptime up to 30 days is relative, a larger one a Unix timestamp.
+	mcMaxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+// The outcomes of a write that did not happen, which the client is told as
+// they are.
+var (
+	errMCNotStored  = errors.New("NOT_STORED")
+	errMCExists     = errors.New("EXISTS")
+	errMCNotFound   = errors.New("NOT_FOUND")
+	errMCNonNumeric = errors.New("CLIENT_ERROR cannot increment or decrement non-numeric value")
+)
+
+const (
+	mcErrBadFormat = "CLIENT_ERROR bad command line format"
+	mcErrBadChunk  = "CLIENT_ERROR bad data chunk"
+)
+
+type mcServer struct {
+	service *core.Service
+	tcp     *TCPServer
+}
+
+// NewMemcacheServer serves the memcached text protocol, so that memcached
+// clients can talk to the service. Flags are stored as metadata of the
+// values; CAS values identify the last write of a key and, as in memcached,
+// do not survive a restart.
+func NewMemcacheServer(addr string, service *core.Service) *TCPServer {
+	ms := &mcServer{service: service}
+	ms.tcp = newTCPServer("memcache", addr, ms.serveConn)
+	return ms.tcp
+}
+
+type mcConn struct {
+	srv *mcServer
+	r   *bufio.Reader
+	w   *bufio.Writer
+}
+
+func (ms *mcServer) serveConn(conn net.Conn) {
+	w := bufio.NewWriter(conn)
+	c := &mcConn{
+		srv: ms,
+		r:   bufio.NewReaderSize(&flushingReader{conn: conn, w: w}, mcReadBufferSize),
+		w:   w,
+	}
+	for {
+		line, err := c.r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			c.reply("CLIENT_ERROR line too long")
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			c.reply("ERROR")
+			continue
+		}
+		if quit := c.exec(fields); quit {
+			c.w.Flush()
+			return
+		}
+	}
+}
+
+// exec runs a command and reports whether the connection is to be closed.
+func (c *mcConn) exec(fields []string) bool {
+	switch cmd, args := fields[0], fields[1:]; cmd {
+	case "get", "gets":
+		c.get(args, cmd == "gets")
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return c.store(cmd, args)
+	case "delete":
+		c.delete(args)
+	case "incr", "decr":
+		c.incr(args, cmd == "decr")
+	case "touch":
+		c.touch(args)
+	case "stats":
+		c.stats(args)
+	case "version":
+		c.reply("VERSION gopher-kv")
+	case "quit":
+		return true
+	default:
+		c.reply("ERROR")
+	}
+	return false
+}
+
+func (c *mcConn) reply(line string) {
+	c.w.WriteString(line + "\r\n")
+}
+
+// replyError reports err: an outcome as its text, an error of the service
+// as a client or server error.
+func (c *mcConn) replyError(err error) {
+	switch {
+	case errors.Is(err, errMCNotStored), errors.Is(err, errMCExists), errors.Is(err, errMCNotFound), errors.Is(err, errMCNonNumeric):
+		c.reply(err.Error())
+	case errors.Is(err, core.ErrKeyNotFound):
+		c.reply("NOT_FOUND")
+	case errors.Is(err, core.ErrValueTooLarge):
+		c.reply("SERVER_ERROR object too large for cache")
+	case errors.Is(err, core.ErrMemoryFull):
+		c.reply("SERVER_ERROR out of memory storing object")
+	case errors.Is(err, core.ErrKeyTooLong), errors.Is(err, core.ErrInvalidKey):
+		c.reply("CLIENT_ERROR " + err.Error())
+	default:
+		c.reply("SERVER_ERROR " + err.Error())
+	}
+}
+
+// noreply strips a trailing "noreply" from args and reports whether there was
+// one.
+func noreply(args []string) ([]string, bool) {
+	if n := len(args); n > 0 && args[n-1] == "noreply" {
+		return args[:n-1], true
+	}
+	return args, false
+}
+
+// mcDeadline parses an exptime into a deadline in Unix milliseconds. Zero
+// means no expiry and a negative exptime one that has already passed. An
+// absolute exptime whose deadline does not fit is refused.
+func mcDeadline(s string) (int64, error) {
+	exptime, err := strconv.ParseInt(s, 10, 64)
+	switch {
+	case err != nil:
+		return 0, err
+	case exptime == 0:
+		return 0, nil
+	case exptime < 0:
+		return -1, nil
+	case exptime > math.MaxInt64/1000:
+		return 0, errors.New("exptime out of range")
+	case exptime > mcMaxRelativeExptime:
+		return exptime * 1000, nil
+	default:
+		return time.Now().Add(time.Duration(exptime) * time.Second).UnixMilli(), nil
+	}
+}
+
+func (c *mcConn) get(keys []string, withCAS bool) {
+	if len(keys) == 0 {
+		c.reply("ERROR")
+		return
+	}
+	for _, key := range keys {
+		entry, err := c.srv.service.GetEntry(key)
+		if errors.Is(err, core.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			c.replyError(err)
+			return
+		}
+		if withCAS {
+			fmt.Fprintf(c.w, "VALUE %s %d %d %d\r\n", key, entry.Meta.Flags, len(entry.Value), entry.CAS)
+		} else {
+			fmt.Fprintf(c.w, "VALUE %s %d %d\r\n", key, entry.Meta.Flags, len(entry.Value))
+		}
+		c.w.Write(entry.Value)
+		c.w.WriteString("\r\n")
+	}
+	c.reply("END")
+}
+
+// store implements the storage commands:
+//
+//	<cmd> <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+//
+// each followed by a data block of <bytes> bytes. It reports whether the
+// connection is to be closed because the data block cannot be found.
+func (c *mcConn) store(cmd string, args []string) bool {
+	args, quiet := noreply(args)
+	want := 4
+	if cmd == "cas" {
+		want = 5
+	}
+	if len(args) != want {
+		c.reply(mcErrBadFormat)
+		return false
+	}
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		// Without a valid length the data block cannot be skipped.
+		c.reply(mcErrBadFormat)
+		return true
+	}
+	key := args[0]
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	deadline, err2 := mcDeadline(args[2])
+	var unique uint64
+	var err3 error
+	if cmd == "cas" {
+		unique, err3 = strconv.ParseUint(args[4], 10, 64)
+	}
+	parseErr := errors.Join(err1, err2, err3)
+	if parseErr != nil || size > c.srv.service.MaxValueSize() {
+		if _, err := io.CopyN(io.Discard, c.r, int64(size)+2); err != nil {
+			return true
+		}
+		if parseErr != nil {
+			c.reply(mcErrBadFormat)
+		} else {
+			c.replyError(core.ErrValueTooLarge)
+		}
+		return false
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return true
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		// Skip the rest of the line to resume with the next command.
+		if data[len(data)-1] != '\n' {
+			if _, err := c.r.ReadSlice('\n'); err != nil {
+				return true
+			}
+		}
+		c.reply(mcErrBadChunk)
+		return false
+	}
+	data = data[:size]
+
+	err = c.srv.service.Update(key, func(cur *storage.Entry) (storage.Entry, error) {
+		next := storage.Entry{Value: data, ExpiresAt: deadline, Meta: storage.Meta{Flags: uint32(flags)}}
+		switch cmd {
+		case "add":
+			if cur != nil {
+				return next, errMCNotStored
+			}
+		case "replace":
+			if cur == nil {
+				return next, errMCNotStored
+			}
+		case "append", "prepend":
+			if cur == nil {
+				return next, errMCNotStored
+			}
+			// Flags and exptime are those of the stored item.
+			next = *cur
+			if cmd == "append" {
+				next.Value = slices.Concat(cur.Value, data)
+			} else {
+				next.Value = slices.Concat(data, cur.Value)
+			}
+		case "cas":
+			if cur == nil {
+				return next, errMCNotFound
+			}
+			if cur.CAS != unique {
+				return next, errMCExists
+			}
+		}
+		return next, nil
+	})
+	if quiet {
+		return false
+	}
+	if err != nil {
+		c.replyError(err)
+		return false
+	}
+	c.reply("STORED")
+	return false
+}
+
+// delete implements delete <key> [0] [noreply]; the 0 is sent by old
+// clients.
+func (c *mcConn) delete(args []string) {
+	args, quiet := noreply(args)
+	if len(args) == 2 && args[1] == "0" {
+		args = args[:1]
+	}
+	if len(args) != 1 {
+		c.reply(mcErrBadFormat)
+		return
+	}
+	deleted, err := c.srv.service.Delete(args[0])
+	if err == nil && !deleted {
+		err = errMCNotFound
+	}
+	if quiet {
+		return
+	}
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	c.reply("DELETED")
+}
+
+// incr implements incr and decr <key> <delta> [noreply]. The value is a
+// decimal unsigned 64-bit integer: incr wraps around, decr stops at zero.
+func (c *mcConn) incr(args []string, decr bool) {
+	args, quiet := noreply(args)
+	if len(args) != 2 {
+		c.reply(mcErrBadFormat)
+		return
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		c.reply("CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+
+	var result uint64
+	err = c.srv.service.Update(args[0], func(cur *storage.Entry) (storage.Entry, error) {
+		if cur == nil {
+			return storage.Entry{}, errMCNotFound
+		}
+		n, err := strconv.ParseUint(strings.TrimRight(string(cur.Value), " "), 10, 64)
+		if err != nil {
+			return storage.Entry{}, errMCNonNumeric
+		}
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		result = n
+		next := *cur
+		next.Value = strconv.AppendUint(nil, n, 10)
+		return next, nil
+	})
+	if quiet {
+		return
+	}
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	c.reply(strconv.FormatUint(result, 10))
+}
+
+// touch implements touch <key> <exptime> [noreply].
+func (c *mcConn) touch(args []string) {
+	args, quiet := noreply(args)
+	if len(args) != 2 {
+		c.reply(mcErrBadFormat)
+		return
+	}
+	deadline, err := mcDeadline(args[1])
+	if err != nil {
+		c.reply(mcErrBadFormat)
+		return
+	}
+	if deadline == 0 {
+		_, err = c.srv.service.Persist(args[0])
+	} else {
+		err = c.srv.service.ExpireAt(args[0], time.UnixMilli(deadline))
+	}
+	if quiet {
+		return
+	}
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	c.reply("TOUCHED")
+}
+
+// stats answers the general statistics; no other group is kept.
+func (c *mcConn) stats(args []string) {
+	if len(args) > 0 {
+		c.reply("END")
+		return
+	}
+	st := c.srv.service.Stats()
+	stat := func(name string, value any) {
+		fmt.Fprintf(c.w, "STAT %s %v\r\n", name, value)
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", st.Uptime)
+	stat("time", time.Now().Unix())
+	stat("version", "gopher-kv")
+	stat("curr_connections", c.srv.tcp.numConns())
+	stat("cmd_get", st.Requests["get"])
+	stat("cmd_set", st.Requests["set"])
+	stat("get_hits", st.Hits)
+	stat("get_misses", st.Misses)
+	stat("curr_items", st.Keys)
+	stat("bytes", st.Memory)
+	stat("evictions", st.EvictedKeys)
+	stat("reclaimed", st.ExpiredKeys)
+	c.reply("END")
+}
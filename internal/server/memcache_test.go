@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mcGets returns the CAS unique of key from a gets, failing unless its value
+// and flags are the given ones.
+func mcGets(t *testing.T, conn net.Conn, r *bufio.Reader, key, value string, flags uint32) uint64 {
+	t.Helper()
+	fmt.Fprintf(conn, "gets %s\r\n", key)
+	var cas uint64
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := fmt.Sprintf("VALUE %s %d %d ", key, flags, len(value))
+	if _, err := fmt.Sscanf(strings.TrimPrefix(line, prefix), "%d\r\n", &cas); err != nil || !strings.HasPrefix(line, prefix) {
+		t.Fatalf("expected %q<cas>, got %q", prefix, line)
+	}
+	expectReply(t, r, value+"\r\nEND\r\n")
+	return cas
+}
+
+func TestMemcacheStorageCommands(t *testing.T) {
+	svc := newTestService(t)
+	conn := dialTestTCPServer(t, NewMemcacheServer("", svc))
+	r := bufio.NewReader(conn)
+
+	// Pipelined, with the replies in order and none for noreply.
+	conn.Write([]byte("add k 5 0 1\r\na\r\nadd k 6 0 1\r\nb\r\nreplace k 7 0 1\r\nc\r\n" +
+		"replace missing 1 0 1\r\nx\r\nappend k 9 0 1 noreply\r\nd\r\nset n 0 0 1\r\n1\r\nget k n\r\n"))
+	expectReply(t, r, "STORED\r\nNOT_STORED\r\nSTORED\r\nNOT_STORED\r\nSTORED\r\n"+
+		"VALUE k 7 2\r\ncd\r\nVALUE n 0 1\r\n1\r\nEND\r\n")
+
+	cas := mcGets(t, conn, r, "k", "cd", 7)
+	fmt.Fprintf(conn, "cas k 8 0 1 %d\r\ne\r\ncas k 8 0 1 %d\r\nf\r\ncas missing 0 0 1 1\r\ng\r\n", cas, cas)
+	expectReply(t, r, "STORED\r\nEXISTS\r\nNOT_FOUND\r\n")
+	if next := mcGets(t, conn, r, "k", "e", 8); next == cas {
+		t.Fatal("a cas should change the CAS unique")
+	}
+
+	conn.Write([]byte("delete k\r\ndelete k\r\ndelete k 0\r\n"))
+	expectReply(t, r, "DELETED\r\nNOT_FOUND\r\nNOT_FOUND\r\n")
+}
+
+func TestMemcacheIncrDecr(t *testing.T) {
+	svc := newTestService(t)
+	conn := dialTestTCPServer(t, NewMemcacheServer("", svc))
+	r := bufio.NewReader(conn)
+
+	conn.Write([]byte("set n 3 0 2\r\n10\r\nincr n 5\r\ndecr n 100\r\n" +
+		"set max 0 0 20\r\n18446744073709551615\r\nincr max 2\r\n" +
+		"incr missing 1\r\nincr n -1\r\nset s 0 0 3\r\nabc\r\nincr s 1\r\nget n\r\n"))
+	expectReply(t, r, "STORED\r\n15\r\n0\r\nSTORED\r\n1\r\nNOT_FOUND\r\n"+
+		"CLIENT_ERROR invalid numeric delta argument\r\nSTORED\r\n"+
+		"CLIENT_ERROR cannot increment or decrement non-numeric value\r\nVALUE n 3 1\r\n0\r\nEND\r\n")
+}
+
+func TestMemcacheTouch(t *testing.T) {
+	svc := newTestService(t)
+	conn := dialTestTCPServer(t, NewMemcacheServer("", svc))
+	r := bufio.NewReader(conn)
+
+	conn.Write([]byte("set k 0 0 1\r\nv\r\ntouch k 100\r\ntouch missing 100\r\n"))
+	expectReply(t, r, "STORED\r\nTOUCHED\r\nNOT_FOUND\r\n")
+	if ttl, err := svc.TTL("k"); err != nil || ttl <= 0 || ttl > 100*time.Second {
+		t.Fatalf("expected a TTL of up to 100s, got %v (%v)", ttl, err)
+	}
+
+	conn.Write([]byte("touch k 0\r\n"))
+	expectReply(t, r, "TOUCHED\r\n")
+	if ttl, err := svc.TTL("k"); err != nil || ttl >= 0 {
+		t.Fatalf("touch with 0 should remove the expiry, got %v (%v)", ttl, err)
+	}
+
+	// An absolute exptime whose deadline in milliseconds overflows is
+	// refused rather than wrapped into the past.
+	conn.Write([]byte("touch k 9223372036854775807\r\nset k 0 9223372036854776 1\r\nw\r\nget k\r\n"))
+	expectReply(t, r, mcErrBadFormat+"\r\n"+mcErrBadFormat+"\r\nVALUE k 0 1\r\nv\r\nEND\r\n")
+
+	conn.Write([]byte("touch k -1\r\nget k\r\n"))
+	expectReply(t, r, "TOUCHED\r\nEND\r\n")
+}
@@ -0,0 +1,566 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/shinerio/gopher-kv/internal/core"
+)
+
+const (
+	respMaxArrayLen = 1 << 20
+	// Bulk strings may exceed the value size limit by this much, so that
+	// oversized values still get a proper error; longer ones are refused
+	// before anything is allocated for them.
+	respBulkMargin = 64 << 10
+	// The bulk strings of one command may add up to this much, or to one
+	// largest bulk string if that is more, like Redis's
+	// client-query-buffer-limit.
+	respMaxQueryLen = 64 << 20
+	// Inline commands must fit the read buffer.
+	respReadBufferSize = 16 << 10
+)
+
+const (
+	respErrSyntax     = "ERR syntax error"
+	respErrNotInteger = "ERR value is not an integer or out of range"
+)
+
+type respProtocolError string
+
+func (e respProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+type respServer struct {
+	service *core.Service
+	tcp     *TCPServer
+	nextID  atomic.Int64
+}
+
+// NewRESPServer serves the Redis protocol, RESP2 and, after HELLO 3, RESP3,
+// so that Redis clients can talk to the service. Pipelined commands are
+// answered in order, their replies written out together.
+func NewRESPServer(addr string, service *core.Service) *TCPServer {
+	rs := &respServer{service: service}
+	rs.tcp = newTCPServer("resp", addr, rs.serveConn)
+	return rs.tcp
+}
+
+type respConn struct {
+	srv   *respServer
+	id    int64
+	r     *bufio.Reader
+	w     *bufio.Writer
+	proto int
+}
+
+func (rs *respServer) serveConn(conn net.Conn) {
+	w := bufio.NewWriter(conn)
+	c := &respConn{
+		srv:   rs,
+		id:    rs.nextID.Add(1),
+		r:     bufio.NewReaderSize(&flushingReader{conn: conn, w: w}, respReadBufferSize),
+		w:     w,
+		proto: 2,
+	}
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			var perr respProtocolError
+			if errors.As(err, &perr) {
+				c.writeError("ERR " + perr.Error())
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if quit := c.exec(args); quit {
+			c.w.Flush()
+			return
+		}
+	}
+}
+
+// readCommand reads a command sent either as an array of bulk strings or
+// inline, as a line of space separated words. A blank line yields no
+// arguments.
+func (c *respConn) readCommand() ([][]byte, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		fields := strings.Fields(string(line))
+		args := make([][]byte, len(fields))
+		for i, f := range fields {
+			args[i] = []byte(f)
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > respMaxArrayLen {
+		return nil, respProtocolError("invalid multibulk length")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	// The arguments are only allocated as they arrive, so a large count
+	// costs nothing until the data for it is sent.
+	args := make([][]byte, 0, min(n, 16))
+	maxBulk := c.srv.service.MaxValueSize() + respBulkMargin
+	left := max(respMaxQueryLen, maxBulk)
+	for range n {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, respProtocolError(fmt.Sprintf("expected '$', got '%s'", line[:min(len(line), 1)]))
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, respProtocolError("invalid bulk length")
+		}
+		if left -= size; left < 0 {
+			return nil, respProtocolError("too big request")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, respProtocolError("bulk string not terminated by CRLF")
+		}
+		args = append(args, buf[:size])
+	}
+	return args, nil
+}
+
+// readLine returns the next line without its line ending. It is only valid
+// until the next read.
+func (c *respConn) readLine() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, respProtocolError("too big inline request")
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+type respCommand struct {
+	// arity counts the command name; a negative arity is a minimum.
+	arity int
+	run   func(c *respConn, args [][]byte)
+}
+
+var respCommands = map[string]respCommand{
+	"PING":    {-1, respPing},
+	"ECHO":    {2, respEcho},
+	"HELLO":   {-1, respHello},
+	"COMMAND": {-1, respCommandInfo},
+	"GET":     {2, respGet},
+	"SET":     {-3, respSet},
+	"DEL":     {-2, respDel},
+	"EXISTS":  {-2, respExists},
+	"TTL":     {2, respTTL},
+	"PTTL":    {2, respPTTL},
+	"EXPIRE":  {3, respExpire},
+	"INFO":    {-1, respInfo},
+	"DBSIZE":  {1, respDBSize},
+	"SAVE":    {1, respSave},
+}
+
+// exec runs a command and reports whether the connection is to be closed.
+func (c *respConn) exec(args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	if name == "QUIT" {
+		c.writeSimple("OK")
+		return true
+	}
+	cmd, ok := respCommands[name]
+	if !ok {
+		c.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		c.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+	cmd.run(c, args)
+	return false
+}
+
+func (c *respConn) writeSimple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *respConn) writeError(s string) {
+	c.w.WriteString("-" + s + "\r\n")
+}
+
+// writeServiceError reports an error of the service, with the error codes
+// Redis uses for the same conditions.
+func (c *respConn) writeServiceError(err error) {
+	prefix := "ERR "
+	if errors.Is(err, core.ErrMemoryFull) {
+		prefix = "OOM "
+	}
+	c.writeError(prefix + strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error()))
+}
+
+func (c *respConn) writeInt(n int64) {
+	c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *respConn) writeBulk(b []byte) {
+	c.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (c *respConn) writeNull() {
+	if c.proto == 3 {
+		c.w.WriteString("_\r\n")
+	} else {
+		c.w.WriteString("$-1\r\n")
+	}
+}
+
+func (c *respConn) writeArray(n int) {
+	c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// writeMap starts a map of n pairs, sent as a flat array in RESP2.
+func (c *respConn) writeMap(n int) {
+	if c.proto == 3 {
+		c.w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+	} else {
+		c.writeArray(2 * n)
+	}
+}
+
+func respPing(c *respConn, args [][]byte) {
+	switch len(args) {
+	case 1:
+		c.writeSimple("PONG")
+	case 2:
+		c.writeBulk(args[1])
+	default:
+		c.writeError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func respEcho(c *respConn, args [][]byte) {
+	c.writeBulk(args[1])
+}
+
+// respHello switches the protocol version. Authentication is not supported,
+// so AUTH is accepted as for a server without a password, like SETNAME.
+func respHello(c *respConn, args [][]byte) {
+	proto := c.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			c.writeError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v != 2 && v != 3 {
+			c.writeError("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+		for i := 2; i < len(args); i++ {
+			switch opt := strings.ToUpper(string(args[i])); {
+			case opt == "AUTH" && i+2 < len(args):
+				i += 2
+			case opt == "SETNAME" && i+1 < len(args):
+				i++
+			default:
+				c.writeError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))
+				return
+			}
+		}
+	}
+	c.proto = proto
+
+	c.writeMap(6)
+	c.writeBulk([]byte("server"))
+	c.writeBulk([]byte("gopher-kv"))
+	c.writeBulk([]byte("proto"))
+	c.writeInt(int64(c.proto))
+	c.writeBulk([]byte("id"))
+	c.writeInt(c.id)
+	c.writeBulk([]byte("mode"))
+	c.writeBulk([]byte("standalone"))
+	c.writeBulk([]byte("role"))
+	c.writeBulk([]byte("master"))
+	c.writeBulk([]byte("modules"))
+	c.writeArray(0)
+}
+
+// respCommandInfo answers COMMAND and its subcommands, which clients send
+// to discover commands, with an empty reply.
+func respCommandInfo(c *respConn, args [][]byte) {
+	if len(args) > 1 && strings.EqualFold(string(args[1]), "COUNT") {
+		c.writeInt(0)
+		return
+	}
+	c.writeArray(0)
+}
+
+func respGet(c *respConn, args [][]byte) {
+	value, _, err := c.srv.service.Get(string(args[1]))
+	if errors.Is(err, core.ErrKeyNotFound) {
+		c.writeNull()
+		return
+	}
+	if err != nil {
+		c.writeServiceError(err)
+		return
+	}
+	c.writeBulk(value)
+}
+
+// respSet implements SET key value [EX seconds | PX milliseconds] [NX | XX].
+func respSet(c *respConn, args [][]byte) {
+	var ttl time.Duration
+	mode := core.SetAlways
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "NX" && mode != core.SetIfPresent:
+			mode = core.SetIfAbsent
+		case opt == "XX" && mode != core.SetIfAbsent:
+			mode = core.SetIfPresent
+		case (opt == "EX" || opt == "PX") && ttl == 0 && i+1 < len(args):
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				c.writeError(respErrNotInteger)
+				return
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			if n <= 0 || n > math.MaxInt64/int64(unit) {
+				c.writeError("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		default:
+			c.writeError(respErrSyntax)
+			return
+		}
+	}
+
+	ok, err := c.srv.service.SetIf(string(args[1]), args[2], ttl, mode)
+	if err != nil {
+		c.writeServiceError(err)
+		return
+	}
+	if !ok {
+		c.writeNull()
+		return
+	}
+	c.writeSimple("OK")
+}
+
+func respDel(c *respConn, args [][]byte) {
+	var n int64
+	for _, arg := range args[1:] {
+		deleted, err := c.srv.service.Delete(string(arg))
+		if err != nil {
+			c.writeServiceError(err)
+			return
+		}
+		if deleted {
+			n++
+		}
+	}
+	c.writeInt(n)
+}
+
+func respExists(c *respConn, args [][]byte) {
+	var n int64
+	for _, arg := range args[1:] {
+		exists, err := c.srv.service.Exists(string(arg))
+		if err != nil {
+			c.writeServiceError(err)
+			return
+		}
+		if exists {
+			n++
+		}
+	}
+	c.writeInt(n)
+}
+
+// respTTL answers -2 for a missing key and -1 for a key without expiry.
+func respTTL(c *respConn, args [][]byte) {
+	ttl, err := c.srv.service.TTL(string(args[1]))
+	if errors.Is(err, core.ErrKeyNotFound) {
+		c.writeInt(-2)
+		return
+	}
+	if err != nil {
+		c.writeServiceError(err)
+		return
+	}
+	c.writeInt(int64(ttl / time.Second))
+}
+
+func respPTTL(c *respConn, args [][]byte) {
+	pttl, err := c.srv.service.PTTL(string(args[1]))
+	if errors.Is(err, core.ErrKeyNotFound) {
+		c.writeInt(-2)
+		return
+	}
+	if err != nil {
+		c.writeServiceError(err)
+		return
+	}
+	c.writeInt(pttl.Milliseconds())
+}
+
+func respExpire(c *respConn, args [][]byte) {
+	n, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		c.writeError(respErrNotInteger)
+		return
+	}
+	if n > math.MaxInt64/int64(time.Second) || n < math.MinInt64/int64(time.Second) {
+		c.writeError("ERR invalid expire time in 'expire' command")
+		return
+	}
+	err = c.srv.service.Expire(string(args[1]), time.Duration(n)*time.Second)
+	if errors.Is(err, core.ErrKeyNotFound) {
+		c.writeInt(0)
+		return
+	}
+	if err != nil {
+		c.writeServiceError(err)
+		return
+	}
+	c.writeInt(1)
+}
+
+func respInfo(c *respConn, args [][]byte) {
+	sections := map[string]bool{}
+	for _, arg := range args[1:] {
+		sections[strings.ToLower(string(arg))] = true
+	}
+	// As in Redis, commandstats is only included when asked for or by "all".
+	all := sections["all"] || sections["everything"]
+	defaults := all || len(sections) == 0 || sections["default"]
+	st := c.srv.service.Stats()
+
+	var b strings.Builder
+	section := func(name string, lines ...string) {
+		wanted := sections[strings.ToLower(name)]
+		if name == "Commandstats" {
+			wanted = wanted || all
+		} else {
+			wanted = wanted || defaults
+		}
+		if !wanted {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + name + "\r\n")
+		for _, line := range lines {
+			b.WriteString(line + "\r\n")
+		}
+	}
+
+	section("Server",
+		"server:gopher-kv",
+		"process_id:"+strconv.Itoa(os.Getpid()),
+		fmt.Sprintf("uptime_in_seconds:%d", st.Uptime),
+		fmt.Sprintf("uptime_in_days:%d", st.Uptime/86400),
+	)
+	section("Clients",
+		"connected_clients:"+strconv.Itoa(c.srv.tcp.numConns()),
+	)
+	section("Memory",
+		fmt.Sprintf("used_memory:%d", st.Memory),
+	)
+	persistence := []string{"aof_enabled:0"}
+	if st.AOF != nil {
+		persistence = []string{
+			"aof_enabled:1",
+			fmt.Sprintf("aof_rewrite_in_progress:%d", boolInt(st.AOF.RewriteInProgress)),
+			fmt.Sprintf("aof_rewrites:%d", st.AOF.Rewrites),
+			fmt.Sprintf("aof_last_seq:%d", st.AOF.LastSeq),
+			"aof_fsync_policy:" + st.AOF.FsyncPolicy,
+		}
+	}
+	section("Persistence", persistence...)
+
+	ops := make([]string, 0, len(st.Requests))
+	var total int64
+	for op, calls := range st.Requests {
+		ops = append(ops, op)
+		total += calls
+	}
+	sort.Strings(ops)
+	section("Stats",
+		fmt.Sprintf("total_commands_processed:%d", total),
+		fmt.Sprintf("keyspace_hits:%d", st.Hits),
+		fmt.Sprintf("keyspace_misses:%d", st.Misses),
+		fmt.Sprintf("expired_keys:%d", st.ExpiredKeys),
+		fmt.Sprintf("evicted_keys:%d", st.EvictedKeys),
+	)
+	cmdstats := make([]string, len(ops))
+	for i, op := range ops {
+		cmdstats[i] = fmt.Sprintf("cmdstat_%s:calls=%d", op, st.Requests[op])
+	}
+	section("Commandstats", cmdstats...)
+	var keyspace []string
+	if st.Keys > 0 {
+		keyspace = append(keyspace, fmt.Sprintf("db0:keys=%d", st.Keys))
+	}
+	section("Keyspace", keyspace...)
+
+	c.writeBulk([]byte(b.String()))
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func respDBSize(c *respConn, args [][]byte) {
+	c.writeInt(int64(c.srv.service.Keys()))
+}
+
+func respSave(c *respConn, args [][]byte) {
+	if _, err := c.srv.service.Snapshot(); err != nil {
+		c.writeServiceError(err)
+		return
+	}
+	c.writeSimple("OK")
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendRESPCommand(dst []byte, args ...string) []byte {
+	dst = append(dst, "*"+strconv.Itoa(len(args))+"\r\n"...)
+	for _, arg := range args {
+		dst = append(dst, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	return dst
+}
+
+func TestRESPPipelining(t *testing.T) {
+	svc := newTestService(t)
+	conn := dialTestTCPServer(t, NewRESPServer("", svc))
+
+	var req []byte
+	req = appendRESPCommand(req, "SET", "a", "1")
+	req = appendRESPCommand(req, "SET", "b", "2")
+	req = append(req, "GET a\r\n"...)
+	req = appendRESPCommand(req, "DEL", "a", "b", "c")
+	req = appendRESPCommand(req, "DEL", "a")
+	req = appendRESPCommand(req, "EXISTS", "a", "b")
+	req = appendRESPCommand(req, "QUIT")
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	expectReply(t, r, "+OK\r\n+OK\r\n$1\r\n1\r\n:2\r\n:0\r\n:0\r\n+OK\r\n")
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected QUIT to close the connection, got %v", err)
+	}
+}
+
+func TestRESPRejectsOversizedBulkLength(t *testing.T) {
+	svc := newTestService(t)
+	conn := dialTestTCPServer(t, NewRESPServer("", svc))
+	r := bufio.NewReader(conn)
+
+	// A value over the limit but within the margin reaches the service.
+	big := strings.Repeat("x", svc.MaxValueSize()+1)
+	conn.Write(appendRESPCommand(nil, "SET", "k", big))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "-ERR value too large") {
+		t.Fatalf("expected a value too large error, got %q (%v)", line, err)
+	}
+
+	// A length far beyond it is refused before the payload is read.
+	conn.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$536870911\r\n"))
+	expectReply(t, r, "-ERR Protocol error: invalid bulk length\r\n")
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	if exists, _ := svc.Exists("k"); exists {
+		t.Fatal("no value should have been stored")
+	}
+}
+
+func TestRESPRejectsOversizedRequest(t *testing.T) {
+	svc := newTestService(t)
+	conn := dialTestTCPServer(t, NewRESPServer("", svc))
+	r := bufio.NewReader(conn)
+
+	// Every argument is within the bulk limit, but together they are not.
+	arg := strings.Repeat("k", 64<<10)
+	n := respMaxQueryLen/len(arg) + 2
+	go func() {
+		conn.Write([]byte("*" + strconv.Itoa(n) + "\r\n$3\r\nDEL\r\n"))
+		for range n - 1 {
+			if _, err := conn.Write(appendRESPCommand(nil, arg)[4:]); err != nil {
+				return
+			}
+		}
+	}()
+	expectReply(t, r, "-ERR Protocol error: too big request\r\n")
+	// The rest of the request is left unread, so the close may be a reset.
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestRESPSetOptions(t *testing.T) {
+	svc := newTestService(t)
+	conn := dialTestTCPServer(t, NewRESPServer("", svc))
+	r := bufio.NewReader(conn)
+
+	steps := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "k", "v", "XX"}, "$-1\r\n"},
+		{[]string{"SET", "k", "v", "NX"}, "+OK\r\n"},
+		{[]string{"SET", "k", "w", "NX"}, "$-1\r\n"},
+		{[]string{"SET", "k", "w", "NX", "XX"}, "-ERR syntax error\r\n"},
+		{[]string{"SET", "k", "w", "EX"}, "-ERR syntax error\r\n"},
+		{[]string{"SET", "k", "w", "EX", "ten"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"SET", "k", "w", "EX", "0"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"SET", "k", "w", "EX", "9223372036854775807"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"SET", "k", "w", "PX", "9223372036854775807"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"SET", "k", "w", "XX", "EX", "100"}, "+OK\r\n"},
+		{[]string{"GET", "k"}, "$1\r\nw\r\n"},
+	}
+	for _, step := range steps {
+		if _, err := conn.Write(appendRESPCommand(nil, step.args...)); err != nil {
+			t.Fatal(err)
+		}
+		expectReply(t, r, step.want)
+	}
+	if ttl, err := svc.TTL("k"); err != nil || ttl <= 0 || ttl > 100*time.Second {
+		t.Fatalf("expected a TTL of up to 100s, got %v (%v)", ttl, err)
+	}
+}
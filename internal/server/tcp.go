@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+// TCPServer serves a request/response protocol on plain TCP connections, each
+// on its own goroutine. Shutdown interrupts connections waiting for their
+// next request, so a request already read is still answered.
+type TCPServer struct {
+	name  string
+	addr  string
+	serve func(conn net.Conn)
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func newTCPServer(name, addr string, serve func(conn net.Conn)) *TCPServer {
+	return &TCPServer{
+		name:  name,
+		addr:  addr,
+		serve: serve,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *TCPServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Shutdown, and then returns
+// ErrServerClosed.
+func (s *TCPServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrack(conn)
+			defer conn.Close()
+			s.serve(conn)
+		}()
+	}
+}
+
+func (s *TCPServer) numConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *TCPServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *TCPServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// Shutdown stops accepting connections and waits for the open ones to
+// finish their current request. Connections still open when ctx is done are
+// closed.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		slog.Warn("closed connections still busy at shutdown", "server", s.name)
+		return ctx.Err()
+	}
+}
+
+// flushingReader flushes the pending replies before blocking on the
+// connection for more input. Replies to a pipeline thus go out together
+// once it has been read, and no reply is held back waiting for input.
+type flushingReader struct {
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func (f *flushingReader) Read(p []byte) (int, error) {
+	if err := f.w.Flush(); err != nil {
+		return 0, err
+	}
+	return f.conn.Read(p)
+}
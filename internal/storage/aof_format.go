@@ -0,0 +1,666 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type AOFFormat int
+
+const (
+	AOFFormatBinary AOFFormat = iota
+	AOFFormatText
+)
+
+func ParseAOFFormat(s string) (AOFFormat, error) {
+	switch s {
+	case "", "binary":
+		return AOFFormatBinary, nil
+	case "text":
+		return AOFFormatText, nil
+	default:
+		return AOFFormatBinary, fmt.Errorf("unknown aof format %q", s)
+	}
+}
+
+func (f AOFFormat) String() string {
+	if f == AOFFormatText {
+		return "text"
+	}
+	return "binary"
+}
+
+type AOFOp byte
+
+const (
+	AOFOpSet AOFOp = iota + 1
+	AOFOpDel
+	AOFOpExpireAt
+	AOFOpPersist
+)
+
+func (op AOFOp) String() string {
+	switch op {
+	case AOFOpSet:
+		return "SET"
+	case AOFOpDel:
+		return "DEL"
+	case AOFOpExpireAt:
+		return "PEXPIREAT"
+	case AOFOpPersist:
+		return "PERSIST"
+	default:
+		return fmt.Sprintf("OP(%d)", byte(op))
+	}
+}
+
+// AOFRecord is one logged mutation. Timestamp is the time the record was
+// written in Unix milliseconds; records read from the text format have none.
+// Seq numbers records in the order they were appended, starting at 1, and is
+// 0 for records written before sequence numbers were introduced. Meta is
+// the metadata stored by a SET.
+type AOFRecord struct {
+	Op        AOFOp
+	Key       string
+	Value     []byte
+	ExpiresAt int64
+	Meta      Meta
+	Timestamp int64
+	Seq       int64
+}
+
+var ErrAOFCorrupt = errors.New("aof corrupt")
+
+// Binary AOF layout:
+//
+//	header:  magic "GKVAOF" | version uint16 [| key ID 8 bytes | salt 16 bytes]
+//	record:  payload length uint32 | CRC32C(payload) uint32 | payload
+//	payload: op byte | timestamp int64 | key (uvarint length + bytes)
+//	         | op fields | attributes (uvarint tag, uvarint length, bytes)
+//
+// Readers skip attributes they do not know. In encrypted files each payload
+// is sealed with AES-GCM on its own; the CRC covers the sealed payload, so
+// torn records are told apart without the key.
+const (
+	aofMagic            = "GKVAOF"
+	aofVersion          = 1
+	aofEncryptedVersion = 2
+	aofHeaderSize       = len(aofMagic) + 2
+	aofRecordHeader     = 8
+	maxAOFRecordLength  = 256 << 20
+)
+
+const aofAttrSeq = 1
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// aofHeader returns the header of a binary file encrypted with c, or of a
+// plain one if c is nil.
+func aofHeader(c *fileCipher) []byte {
+	if c == nil {
+		return binary.BigEndian.AppendUint16([]byte(aofMagic), aofVersion)
+	}
+	return c.header
+}
+
+// newAOFCipher returns the cipher of a new file encrypted with key.
+func newAOFCipher(key *cipherKey) (*fileCipher, error) {
+	salt := newFileSalt()
+	header := binary.BigEndian.AppendUint16([]byte(aofMagic), aofEncryptedVersion)
+	header = append(append(header, key.id[:]...), salt...)
+	return newFileCipher(key, header, salt)
+}
+
+func appendBinaryRecord(dst []byte, c *fileCipher, rec AOFRecord) []byte {
+	payload := make([]byte, 0, 16+len(rec.Key)+len(rec.Value))
+	payload = append(payload, byte(rec.Op))
+	payload = binary.BigEndian.AppendUint64(payload, uint64(rec.Timestamp))
+	payload = binary.AppendUvarint(payload, uint64(len(rec.Key)))
+	payload = append(payload, rec.Key...)
+	switch rec.Op {
+	case AOFOpSet:
+		payload = binary.AppendUvarint(payload, uint64(len(rec.Value)))
+		payload = append(payload, rec.Value...)
+		payload = binary.AppendVarint(payload, rec.ExpiresAt)
+		payload = appendMetaAttrs(payload, rec.Meta)
+	case AOFOpExpireAt:
+		payload = binary.AppendVarint(payload, rec.ExpiresAt)
+	}
+	if rec.Seq > 0 {
+		payload = binary.AppendUvarint(payload, aofAttrSeq)
+		payload = binary.AppendUvarint(payload, uint64(uvarintLen(uint64(rec.Seq))))
+		payload = binary.AppendUvarint(payload, uint64(rec.Seq))
+	}
+	if c != nil {
+		seq := binary.BigEndian.AppendUint64(nil, uint64(rec.Seq))
+		payload = c.seal(seq, payload, seq)
+	}
+
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	dst = binary.BigEndian.AppendUint32(dst, crc32.Checksum(payload, crc32c))
+	return append(dst, payload...)
+}
+
+func decodeBinaryPayload(payload []byte) (AOFRecord, error) {
+	var rec AOFRecord
+	if len(payload) < 9 {
+		return rec, errors.New("short record")
+	}
+	rec.Op = AOFOp(payload[0])
+	rec.Timestamp = int64(binary.BigEndian.Uint64(payload[1:9]))
+	buf := payload[9:]
+
+	readBytes := func() ([]byte, error) {
+		n, size := binary.Uvarint(buf)
+		if size <= 0 || n > uint64(len(buf)-size) {
+			return nil, errors.New("bad length")
+		}
+		b := buf[size : size+int(n)]
+		buf = buf[size+int(n):]
+		return b, nil
+	}
+	readVarint := func() (int64, error) {
+		v, size := binary.Varint(buf)
+		if size <= 0 {
+			return 0, errors.New("bad varint")
+		}
+		buf = buf[size:]
+		return v, nil
+	}
+
+	key, err := readBytes()
+	if err != nil {
+		return rec, err
+	}
+	rec.Key = string(key)
+	switch rec.Op {
+	case AOFOpSet:
+		value, err := readBytes()
+		if err != nil {
+			return rec, err
+		}
+		rec.Value = bytes.Clone(value)
+		if rec.ExpiresAt, err = readVarint(); err != nil {
+			return rec, err
+		}
+	case AOFOpExpireAt:
+		if rec.ExpiresAt, err = readVarint(); err != nil {
+			return rec, err
+		}
+		if rec.ExpiresAt <= 0 {
+			return rec, errors.New("invalid pexpireat deadline")
+		}
+	case AOFOpDel, AOFOpPersist:
+	default:
+		return rec, fmt.Errorf("unknown op %d", byte(rec.Op))
+	}
+
+	for len(buf) > 0 {
+		tag, size := binary.Uvarint(buf)
+		if size <= 0 {
+			return rec, errors.New("bad attribute tag")
+		}
+		buf = buf[size:]
+		attr, err := readBytes()
+		if err != nil {
+			return rec, err
+		}
+		if tag == aofAttrSeq {
+			seq, n := binary.Uvarint(attr)
+			if n != len(attr) || seq == 0 || seq > math.MaxInt64 {
+				return rec, errors.New("bad sequence number")
+			}
+			rec.Seq = int64(seq)
+		} else if _, err := rec.Meta.decodeAttr(tag, attr); err != nil {
+			return rec, err
+		}
+	}
+	return rec, nil
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+// Text records carry their sequence number as an optional last field,
+// "seq=<n>", which older readers reject, so it is only written when set.
+// Likewise a key that would break the line apart, or is not valid UTF-8, is
+// written in base64 and flagged by a "key=base64" field before it. The
+// metadata of a SET, if any, comes before that: "flags=<n>" and then the
+// content type in base64 as "ctype=<base64>".
+const (
+	textSeqPrefix         = "seq="
+	textKeyBase64         = "key=base64"
+	textFlagsPrefix       = "flags="
+	textContentTypePrefix = "ctype="
+)
+
+func appendTextRecord(dst []byte, rec AOFRecord) []byte {
+	key, encoded := rec.Key, textKeyNeedsEncoding(rec.Key)
+	if encoded {
+		key = base64.StdEncoding.EncodeToString([]byte(rec.Key))
+	}
+	switch rec.Op {
+	case AOFOpSet:
+		dst = fmt.Appendf(dst, "SET\t%s\t%s\t%d", key, base64.StdEncoding.EncodeToString(rec.Value), rec.ExpiresAt)
+		if rec.Meta.Flags != 0 {
+			dst = fmt.Appendf(dst, "\t%s%d", textFlagsPrefix, rec.Meta.Flags)
+		}
+		if rec.Meta.ContentType != "" {
+			dst = fmt.Appendf(dst, "\t%s%s", textContentTypePrefix, base64.StdEncoding.EncodeToString([]byte(rec.Meta.ContentType)))
+		}
+	case AOFOpExpireAt:
+		dst = fmt.Appendf(dst, "PEXPIREAT\t%s\t%d", key, rec.ExpiresAt)
+	default:
+		dst = fmt.Appendf(dst, "%s\t%s", rec.Op, key)
+	}
+	if encoded {
+		dst = append(dst, "\t"+textKeyBase64...)
+	}
+	if rec.Seq > 0 {
+		dst = fmt.Appendf(dst, "\t%s%d", textSeqPrefix, rec.Seq)
+	}
+	return append(dst, '\n')
+}
+
+func textKeyNeedsEncoding(key string) bool {
+	return strings.ContainsAny(key, "\t\r\n") || !utf8.ValidString(key)
+}
+
+func parseTextRecord(line string) (AOFRecord, error) {
+	var rec AOFRecord
+	parts := strings.Split(line, "\t")
+	if len(parts) < 2 {
+		return rec, fmt.Errorf("invalid aof line")
+	}
+	if last := parts[len(parts)-1]; len(parts) > 2 && strings.HasPrefix(last, textSeqPrefix) {
+		seq, err := strconv.ParseInt(strings.TrimPrefix(last, textSeqPrefix), 10, 64)
+		if err != nil || seq <= 0 {
+			return rec, fmt.Errorf("invalid sequence number")
+		}
+		rec.Seq = seq
+		parts = parts[:len(parts)-1]
+	}
+	rec.Key = parts[1]
+	if len(parts) > 2 && parts[len(parts)-1] == textKeyBase64 {
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return rec, fmt.Errorf("invalid base64 key")
+		}
+		rec.Key = string(key)
+		parts = parts[:len(parts)-1]
+	}
+	if parts[0] == "SET" && len(parts) > 4 {
+		if raw, ok := strings.CutPrefix(parts[len(parts)-1], textContentTypePrefix); ok {
+			contentType, err := base64.StdEncoding.DecodeString(raw)
+			if err != nil {
+				return rec, fmt.Errorf("invalid content type")
+			}
+			rec.Meta.ContentType = string(contentType)
+			parts = parts[:len(parts)-1]
+		}
+	}
+	if parts[0] == "SET" && len(parts) > 4 {
+		if raw, ok := strings.CutPrefix(parts[len(parts)-1], textFlagsPrefix); ok {
+			flags, err := strconv.ParseUint(raw, 10, 32)
+			if err != nil {
+				return rec, fmt.Errorf("invalid flags")
+			}
+			rec.Meta.Flags = uint32(flags)
+			parts = parts[:len(parts)-1]
+		}
+	}
+	switch parts[0] {
+	case "SET":
+		if len(parts) != 4 {
+			return rec, fmt.Errorf("invalid set line")
+		}
+		value, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return rec, err
+		}
+		expiresAt, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			return rec, err
+		}
+		rec.Op, rec.Value, rec.ExpiresAt = AOFOpSet, value, expiresAt
+	case "DEL":
+		if len(parts) != 2 {
+			return rec, fmt.Errorf("invalid del line")
+		}
+		rec.Op = AOFOpDel
+	case "PEXPIREAT":
+		if len(parts) != 3 {
+			return rec, fmt.Errorf("invalid pexpireat line")
+		}
+		expiresAt, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return rec, err
+		}
+		if expiresAt <= 0 {
+			return rec, fmt.Errorf("invalid pexpireat deadline")
+		}
+		rec.Op, rec.ExpiresAt = AOFOpExpireAt, expiresAt
+	case "PERSIST":
+		if len(parts) != 2 {
+			return rec, fmt.Errorf("invalid persist line")
+		}
+		rec.Op = AOFOpPersist
+	default:
+		return rec, fmt.Errorf("invalid aof op")
+	}
+	return rec, nil
+}
+
+// appendRecord encodes rec in format, encrypted with c unless it is nil.
+// Only the binary format can be encrypted.
+func appendRecord(dst []byte, format AOFFormat, c *fileCipher, rec AOFRecord) []byte {
+	if format == AOFFormatText {
+		return appendTextRecord(dst, rec)
+	}
+	return appendBinaryRecord(dst, c, rec)
+}
+
+// AOFReader decodes records from an AOF in either format; the format and
+// the encryption key are detected from the file header.
+type AOFReader struct {
+	r      *bufio.Reader
+	format AOFFormat
+	cipher *fileCipher
+	offset int64
+	// lastSeq is the sequence number of the last record read.
+	lastSeq int64
+	// bad holds the bytes consumed by the record that failed to decode.
+	bad []byte
+	// resync feeds r once SkipCorrupt has pushed bytes back.
+	resync *pushbackReader
+}
+
+// pushbackReader reads pending before src.
+type pushbackReader struct {
+	pending []byte
+	src     io.Reader
+}
+
+func (r *pushbackReader) Read(p []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	return r.src.Read(p)
+}
+
+// NewAOFReader reads the header of an AOF. An encrypted file is decrypted
+// with its key from keys, or ErrEncryptionKeyNotFound is returned.
+func NewAOFReader(r io.Reader, keys *Keyring) (*AOFReader, error) {
+	ar := &AOFReader{r: bufio.NewReaderSize(r, 64<<10), format: AOFFormatText}
+	head, err := ar.r.Peek(aofHeaderSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	magic := []byte(aofMagic)
+	switch {
+	case len(head) == aofHeaderSize && bytes.HasPrefix(head, magic):
+	case len(head) > 0 && (bytes.HasPrefix(head, magic) || bytes.HasPrefix(magic, head)):
+		return nil, fmt.Errorf("%w: truncated header", io.ErrUnexpectedEOF)
+	default:
+		// Empty file or text format.
+		return ar, nil
+	}
+	size := aofHeaderSize
+	switch v := binary.BigEndian.Uint16(head[len(aofMagic):]); v {
+	case aofVersion:
+	case aofEncryptedVersion:
+		size += keyIDSize + fileSaltSize
+		head, err = ar.r.Peek(size)
+		if err != nil {
+			return nil, fmt.Errorf("%w: truncated header", io.ErrUnexpectedEOF)
+		}
+		key, err := keys.lookup(head[aofHeaderSize : aofHeaderSize+keyIDSize])
+		if err != nil {
+			return nil, err
+		}
+		if ar.cipher, err = newFileCipher(key, bytes.Clone(head), head[aofHeaderSize+keyIDSize:]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrAOFCorrupt, v)
+	}
+	ar.format = AOFFormatBinary
+	_, _ = ar.r.Discard(size)
+	ar.offset = int64(size)
+	return ar, nil
+}
+
+func (ar *AOFReader) Format() AOFFormat {
+	return ar.format
+}
+
+// KeyID returns the ID of the key the file is encrypted with, or "" if it
+// is not.
+func (ar *AOFReader) KeyID() string {
+	if ar.cipher == nil {
+		return ""
+	}
+	return ar.cipher.key.String()
+}
+
+func (ar *AOFReader) decodePayload(payload []byte) (AOFRecord, error) {
+	c := ar.cipher
+	if c == nil {
+		return decodeBinaryPayload(payload)
+	}
+	if len(payload) < 8 {
+		return AOFRecord{}, errors.New("short record")
+	}
+	seq, payload := payload[:8], payload[8:]
+	payload, err := c.open(payload, seq)
+	if err != nil {
+		return AOFRecord{}, fmt.Errorf("decrypt: %w", err)
+	}
+	rec, err := decodeBinaryPayload(payload)
+	if err != nil {
+		return rec, err
+	}
+	if rec.Seq != int64(binary.BigEndian.Uint64(seq)) {
+		return rec, errors.New("sequence number mismatch")
+	}
+	if rec.Seq > 0 && rec.Seq <= ar.lastSeq {
+		return rec, fmt.Errorf("sequence number %d after %d", rec.Seq, ar.lastSeq)
+	}
+	return rec, nil
+}
+
+// Offset is the position just past the last record returned by Next.
+func (ar *AOFReader) Offset() int64 {
+	return ar.offset
+}
+
+// Next returns the next record, io.EOF at a clean end of file and
+// io.ErrUnexpectedEOF for a record cut short at the end of the file, as left
+// by a crash during a write. A record that is complete but fails to decode or
+// verify is reported as ErrAOFCorrupt.
+func (ar *AOFReader) Next() (AOFRecord, error) {
+	if ar.format == AOFFormatText {
+		return ar.nextText()
+	}
+	return ar.nextBinary()
+}
+
+func (ar *AOFReader) nextText() (AOFRecord, error) {
+	for {
+		line, err := ar.r.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return AOFRecord{}, err
+		}
+		if line == "" {
+			return AOFRecord{}, io.EOF
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			ar.offset += int64(len(line))
+			continue
+		}
+		rec, parseErr := parseTextRecord(trimmed)
+		if parseErr != nil {
+			ar.bad = []byte(line)
+			return rec, fmt.Errorf("%w: %v", ErrAOFCorrupt, parseErr)
+		}
+		ar.offset += int64(len(line))
+		return rec, nil
+	}
+}
+
+func (ar *AOFReader) nextBinary() (AOFRecord, error) {
+	var hdr [aofRecordHeader]byte
+	if n, err := io.ReadFull(ar.r, hdr[:]); err != nil {
+		if errors.Is(err, io.EOF) && n == 0 {
+			return AOFRecord{}, io.EOF
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return AOFRecord{}, io.ErrUnexpectedEOF
+		}
+		return AOFRecord{}, err
+	}
+	length := binary.BigEndian.Uint32(hdr[:4])
+	if length > maxAOFRecordLength {
+		ar.bad = append([]byte(nil), hdr[:]...)
+		return AOFRecord{}, fmt.Errorf("%w: record length %d", ErrAOFCorrupt, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ar.r, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return AOFRecord{}, io.ErrUnexpectedEOF
+		}
+		return AOFRecord{}, err
+	}
+	if crc32.Checksum(payload, crc32c) != binary.BigEndian.Uint32(hdr[4:]) {
+		ar.bad = append(append([]byte(nil), hdr[:]...), payload...)
+		return AOFRecord{}, fmt.Errorf("%w: checksum mismatch", ErrAOFCorrupt)
+	}
+	rec, err := ar.decodePayload(payload)
+	if err != nil {
+		ar.bad = append(append([]byte(nil), hdr[:]...), payload...)
+		return rec, fmt.Errorf("%w: %v", ErrAOFCorrupt, err)
+	}
+	ar.offset += aofRecordHeader + int64(length)
+	ar.lastSeq = max(ar.lastSeq, rec.Seq)
+	return rec, nil
+}
+
+// atEOF reports whether nothing follows the last record read.
+func (ar *AOFReader) atEOF() bool {
+	_, err := ar.r.Peek(1)
+	return errors.Is(err, io.EOF)
+}
+
+// aofResyncBuffer bounds the records SkipCorrupt can recognize when scanning
+// for the next valid one; larger records are skipped along with the damage.
+const aofResyncBuffer = 8 << 20
+
+// SkipCorrupt steps over the damage that made Next return ErrAOFCorrupt and
+// returns the number of bytes skipped. In the text format that is the bad
+// line. In the binary format a corrupt length may hide where the next record
+// starts, so the reader scans forward byte by byte from just past the start
+// of the bad record for the next record that verifies; if there is none the
+// rest of the file is skipped.
+func (ar *AOFReader) SkipCorrupt() (int64, error) {
+	bad := ar.bad
+	ar.bad = nil
+	if ar.format == AOFFormatText || len(bad) == 0 {
+		ar.offset += int64(len(bad))
+		return int64(len(bad)), nil
+	}
+
+	// Put back what the bad record consumed, except its first byte, ahead
+	// of what r has buffered. The first skip switches to a buffer large
+	// enough to verify records in; later ones reuse it.
+	if ar.resync == nil {
+		ar.resync = &pushbackReader{src: ar.r}
+		ar.r = bufio.NewReaderSize(ar.resync, aofResyncBuffer)
+	}
+	buffered, _ := ar.r.Peek(ar.r.Buffered())
+	ar.resync.pending = slices.Concat(bad[1:], buffered, ar.resync.pending)
+	ar.r.Reset(ar.resync)
+	skipped := int64(1)
+	for {
+		hdr, err := ar.r.Peek(aofRecordHeader)
+		if err != nil {
+			n, _ := ar.r.Discard(len(hdr))
+			skipped += int64(n)
+			break
+		}
+		if ar.peekValidRecord(hdr) {
+			break
+		}
+		_, _ = ar.r.Discard(1)
+		skipped++
+	}
+	ar.offset += skipped
+	return skipped, nil
+}
+
+func (ar *AOFReader) peekValidRecord(hdr []byte) bool {
+	length := binary.BigEndian.Uint32(hdr[:4])
+	if length > aofResyncBuffer-aofRecordHeader {
+		return false
+	}
+	sum := binary.BigEndian.Uint32(hdr[4:])
+	buf, err := ar.r.Peek(aofRecordHeader + int(length))
+	if err != nil {
+		return false
+	}
+	payload := buf[aofRecordHeader:]
+	if crc32.Checksum(payload, crc32c) != sum {
+		return false
+	}
+	_, err = ar.decodePayload(payload)
+	return err == nil
+}
+
+// ConvertAOF rewrites every record of src into dst using the given format
+// and returns the number of records converted. An encrypted src is
+// decrypted with keys; dst is never encrypted. Timestamps are lost when
+// converting to text.
+func ConvertAOF(dst io.Writer, src io.Reader, to AOFFormat, keys *Keyring) (int, error) {
+	ar, err := NewAOFReader(src, keys)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(dst)
+	if to == AOFFormatBinary {
+		if _, err := w.Write(aofHeader(nil)); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	var buf []byte
+	for {
+		rec, err := ar.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("record %d at offset %d: %w", n+1, ar.Offset(), err)
+		}
+		buf = appendRecord(buf[:0], to, nil, rec)
+		if _, err := w.Write(buf); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, w.Flush()
+}
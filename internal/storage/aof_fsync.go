@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+type FsyncPolicy int
+
+const (
+	// FsyncEverySec flushes the AOF from a background goroutine once per
+	// second, so a crash loses at most about a second of writes.
+	FsyncEverySec FsyncPolicy = iota
+	// FsyncAlways makes every append durable before it is acknowledged.
+	// Concurrent appends share a single fsync (group commit).
+	FsyncAlways
+	// FsyncNo leaves flushing to the operating system.
+	FsyncNo
+)
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch s {
+	case "", "everysec":
+		return FsyncEverySec, nil
+	case "always":
+		return FsyncAlways, nil
+	case "no":
+		return FsyncNo, nil
+	default:
+		return FsyncEverySec, fmt.Errorf("unknown fsync policy %q", s)
+	}
+}
+
+func (f FsyncPolicy) String() string {
+	switch f {
+	case FsyncAlways:
+		return "always"
+	case FsyncNo:
+		return "no"
+	default:
+		return "everysec"
+	}
+}
+
+const fsyncInterval = time.Second
+
+type AOFStats struct {
+	FsyncPolicy  string
+	Fsyncs       int64
+	FsyncLastUs  int64
+	FsyncMaxUs   int64
+	FsyncTotalUs int64
+	PendingBytes int64
+	LastSeq      int64
+	Streams      int
+
+	RewriteInProgress bool
+	Rewrites          int64
+	RewriteFailures   int64
+}
+
+func (p *AOFPersister) Stats() AOFStats {
+	p.mu.Lock()
+	inProgress := p.rewriting || !p.rewriteStartedAt.IsZero()
+	rewrites, failures := p.rewrites, p.rewriteFailures
+	p.mu.Unlock()
+	var pending int64
+	for _, s := range p.streams {
+		pending += s.written.Load() - s.synced.Load()
+	}
+	return AOFStats{
+		FsyncPolicy:  p.fsync.String(),
+		Fsyncs:       p.fsyncs.Load(),
+		FsyncLastUs:  p.fsyncLastUs.Load(),
+		FsyncMaxUs:   p.fsyncMaxUs.Load(),
+		FsyncTotalUs: p.fsyncTotalUs.Load(),
+		PendingBytes: pending,
+		LastSeq:      p.LastSeq(),
+		Streams:      len(p.streams),
+
+		RewriteInProgress: inProgress,
+		Rewrites:          rewrites,
+		RewriteFailures:   failures,
+	}
+}
+
+// syncUpTo returns once everything up to logical offset pos of stream s is
+// on disk. Writers queue on the stream's syncMu; whoever gets it next fsyncs
+// all data appended so far, so writers that arrived during the previous
+// fsync find their offset already covered and return without issuing one of
+// their own.
+func (p *AOFPersister) syncUpTo(s *aofStream, pos int64) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	if s.synced.Load() >= pos {
+		return nil
+	}
+	return p.syncLocked(s)
+}
+
+// syncLocked fsyncs all data appended to stream s so far. The caller holds
+// the stream's syncMu, which keeps the file from being closed or swapped
+// underneath the fsync.
+func (p *AOFPersister) syncLocked(s *aofStream) error {
+	s.mu.Lock()
+	f, target := s.file, s.written.Load()
+	s.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+
+	start := time.Now()
+	err := f.Sync()
+	p.recordFsync(time.Since(start))
+	if err != nil {
+		return err
+	}
+	s.synced.Store(target)
+	return nil
+}
+
+func (p *AOFPersister) recordFsync(d time.Duration) {
+	us := d.Microseconds()
+	p.fsyncs.Add(1)
+	p.fsyncLastUs.Store(us)
+	p.fsyncTotalUs.Add(us)
+	for {
+		max := p.fsyncMaxUs.Load()
+		if us <= max || p.fsyncMaxUs.CompareAndSwap(max, us) {
+			return
+		}
+	}
+}
+
+func (p *AOFPersister) startBackgroundSync() {
+	if p.fsync != FsyncEverySec || p.syncStopCh != nil {
+		return
+	}
+	p.syncStopCh = make(chan struct{})
+	p.syncDoneCh = make(chan struct{})
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(fsyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				for _, s := range p.streams {
+					if pos := s.written.Load(); pos > s.synced.Load() {
+						if err := p.syncUpTo(s, pos); err != nil {
+							slog.Error("aof background fsync failed", "stream", s.id, "error", err)
+						}
+					}
+				}
+			}
+		}
+	}(p.syncStopCh, p.syncDoneCh)
+}
+
+func (p *AOFPersister) stopBackgroundSync() {
+	p.mu.Lock()
+	stop, done := p.syncStopCh, p.syncDoneCh
+	p.syncStopCh, p.syncDoneCh = nil, nil
+	p.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// syncDir makes a rename inside dir durable. Errors are ignored because not
+// every platform supports fsync on directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	aofTypeBase = 'b'
+	aofTypeIncr = 'i'
+
+	defaultAOFDirName = "appendonlydir"
+)
+
+// aofPart is one file of a multi-part AOF. Base files hold a full snapshot,
+// either in RDB encoding (".base.rdb") or as AOF records (".base.aof", only
+// produced by migrating a single-file AOF). Incremental files hold the
+// records appended after their base to stream Stream of an AOF split into
+// Streams streams, or of an unsplit one if Streams is 0. Keys are assigned
+// to streams by their shard, so a split AOF also records the number of
+// Shards.
+type aofPart struct {
+	Name    string
+	Seq     int64
+	Type    byte
+	Stream  int
+	Streams int
+	Shards  int
+}
+
+func (pt aofPart) isRDB() bool {
+	return strings.HasSuffix(pt.Name, ".rdb")
+}
+
+func (pt aofPart) layout() int {
+	return max(pt.Streams, 1)
+}
+
+// sameLayout reports whether pt and o assign every key to the same stream;
+// the shard count only matters to a split AOF.
+func (pt aofPart) sameLayout(o aofPart) bool {
+	return pt.layout() == o.layout() && (pt.layout() == 1 || pt.Shards == o.Shards)
+}
+
+// aofManifest lists the parts that make up the AOF, in replay order. It is
+// stored as text, one part per line:
+//
+//	file appendonly.aof.2.base.rdb seq 2 type b
+//	file appendonly.aof.5.incr.aof seq 5 type i
+//	file appendonly.aof.6.incr.aof seq 6 type i stream 0/2 shards 256
+//	file appendonly.aof.7.incr.aof seq 7 type i stream 1/2 shards 256
+//
+// and is only ever replaced atomically, so it always describes a complete,
+// consistent set of files.
+type aofManifest struct {
+	Base  *aofPart
+	Incrs []aofPart
+}
+
+func (m *aofManifest) parts() []aofPart {
+	parts := make([]aofPart, 0, len(m.Incrs)+1)
+	if m.Base != nil {
+		parts = append(parts, *m.Base)
+	}
+	return append(parts, m.Incrs...)
+}
+
+// generations splits the incremental files into runs written with the same
+// number of streams and shards, in order. Within a generation the files of
+// a stream follow each other; a change of either starts a new generation.
+func (m *aofManifest) generations() [][]aofPart {
+	var gens [][]aofPart
+	for i, pt := range m.Incrs {
+		if i == 0 || !pt.sameLayout(m.Incrs[i-1]) {
+			gens = append(gens, nil)
+		}
+		gens[len(gens)-1] = append(gens[len(gens)-1], pt)
+	}
+	return gens
+}
+
+func (m *aofManifest) lastIncr() *aofPart {
+	if len(m.Incrs) == 0 {
+		return nil
+	}
+	return &m.Incrs[len(m.Incrs)-1]
+}
+
+func (m *aofManifest) nextIncrSeq() int64 {
+	if last := m.lastIncr(); last != nil {
+		return last.Seq + 1
+	}
+	return 1
+}
+
+func (m *aofManifest) nextBaseSeq() int64 {
+	if m.Base != nil {
+		return m.Base.Seq + 1
+	}
+	return 1
+}
+
+func (m *aofManifest) encode() []byte {
+	var buf bytes.Buffer
+	for _, pt := range m.parts() {
+		buf.WriteString(pt.line())
+	}
+	return buf.Bytes()
+}
+
+// line returns the manifest line describing pt.
+func (pt aofPart) line() string {
+	s := fmt.Sprintf("file %s seq %d type %c", pt.Name, pt.Seq, pt.Type)
+	if pt.layout() > 1 {
+		s += fmt.Sprintf(" stream %d/%d shards %d", pt.Stream, pt.Streams, pt.Shards)
+	}
+	return s + "\n"
+}
+
+func parseAOFManifest(r io.Reader) (*aofManifest, error) {
+	m := &aofManifest{}
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		pt, err := parseAOFPart(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aof manifest line %d: %w", line, err)
+		}
+		switch pt.Type {
+		case aofTypeBase:
+			if m.Base != nil || len(m.Incrs) > 0 {
+				return nil, fmt.Errorf("invalid aof manifest line %d: unexpected base", line)
+			}
+			m.Base = &pt
+		case aofTypeIncr:
+			if last := m.lastIncr(); last != nil && pt.Seq <= last.Seq {
+				return nil, fmt.Errorf("invalid aof manifest line %d: sequence out of order", line)
+			}
+			m.Incrs = append(m.Incrs, pt)
+		default:
+			return nil, fmt.Errorf("invalid aof manifest line %d: unknown type", line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parseAOFPart parses one manifest line.
+func parseAOFPart(text string) (aofPart, error) {
+	fields := strings.Fields(text)
+	if (len(fields) != 6 && len(fields) != 10) || fields[0] != "file" || fields[2] != "seq" || fields[4] != "type" || len(fields[5]) != 1 {
+		return aofPart{}, errors.New("malformed")
+	}
+	seq, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return aofPart{}, err
+	}
+	if strings.ContainsAny(fields[1], `/\`) {
+		return aofPart{}, errors.New("bad file name")
+	}
+	pt := aofPart{Name: fields[1], Seq: seq, Type: fields[5][0]}
+	if len(fields) == 10 {
+		if fields[6] != "stream" || fields[8] != "shards" || pt.Type != aofTypeIncr {
+			return aofPart{}, errors.New("malformed")
+		}
+		if pt.Stream, pt.Streams, err = parseAOFStream(fields[7]); err != nil {
+			return aofPart{}, err
+		}
+		if pt.Shards, err = strconv.Atoi(fields[9]); err != nil || pt.Shards <= 0 {
+			return aofPart{}, errors.New("bad shards")
+		}
+	}
+	return pt, nil
+}
+
+// parseAOFStream parses the "k/n" stream of an incremental file.
+func parseAOFStream(s string) (int, int, error) {
+	k, n, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, errors.New("bad stream")
+	}
+	stream, err := strconv.Atoi(k)
+	if err != nil {
+		return 0, 0, err
+	}
+	streams, err := strconv.Atoi(n)
+	if err != nil {
+		return 0, 0, err
+	}
+	if stream < 0 || stream >= streams {
+		return 0, 0, errors.New("bad stream")
+	}
+	return stream, streams, nil
+}
+
+func loadAOFManifest(path string) (*aofManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseAOFManifest(f)
+}
+
+func writeAOFManifest(path string, m *aofManifest) error {
+	return writeFileAtomic(path+".tmp", path, func(w io.Writer) error {
+		_, err := w.Write(m.encode())
+		return err
+	})
+}
+
+// removeUnreferencedAOFParts deletes files of the AOF named name in dir that
+// the manifest no longer references, including leftovers of interrupted
+// rewrites. If archiveDir is set, incremental files are moved there instead,
+// with their layout as listed in prev, the manifest m replaced, if known.
+// Backups left by kvcheck repair (".bak") are kept.
+func removeUnreferencedAOFParts(dir, name string, m, prev *aofManifest, archiveDir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{name + ".manifest": true}
+	for _, pt := range m.parts() {
+		keep[pt.Name] = true
+	}
+	dropped := map[string]aofPart{}
+	if prev != nil {
+		for _, pt := range prev.Incrs {
+			dropped[pt.Name] = pt
+		}
+	}
+	var errs []error
+	for _, e := range entries {
+		if e.IsDir() || keep[e.Name()] || !strings.HasPrefix(e.Name(), name+".") || strings.HasSuffix(e.Name(), ".bak") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if archiveDir != "" && strings.HasSuffix(e.Name(), ".incr.aof") {
+			pt, known := dropped[e.Name()]
+			if err := archiveAOFPart(path, archiveDir, name, pt, known); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AOFManifestFiles returns the paths of the files named by the AOF manifest
+// at path, in replay order.
+func AOFManifestFiles(path string) ([]string, error) {
+	m, err := loadAOFManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, pt := range m.parts() {
+		paths = append(paths, filepath.Join(filepath.Dir(path), pt.Name))
+	}
+	return paths, nil
+}
@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// CorruptPolicy selects what happens when a persisted file turns out to be
+// damaged: everything from the damage on is dropped (truncate), only the
+// damaged records are stepped over (skip), or reading stops with an error
+// (fail).
+type CorruptPolicy int
+
+const (
+	CorruptFail CorruptPolicy = iota
+	CorruptTruncate
+	CorruptSkip
+)
+
+func ParseCorruptPolicy(s string) (CorruptPolicy, error) {
+	switch s {
+	case "", "fail":
+		return CorruptFail, nil
+	case "truncate":
+		return CorruptTruncate, nil
+	case "skip":
+		return CorruptSkip, nil
+	default:
+		return CorruptFail, fmt.Errorf("unknown corrupt policy %q", s)
+	}
+}
+
+func (p CorruptPolicy) String() string {
+	switch p {
+	case CorruptTruncate:
+		return "truncate"
+	case CorruptSkip:
+		return "skip"
+	default:
+		return "fail"
+	}
+}
+
+// Damage locates a stretch of a file that could not be read. Length is the
+// number of bytes dropped because of it.
+type Damage struct {
+	Offset int64
+	Length int64
+	Err    error
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// AOFScanResult describes an AOF file read by ScanAOF. KeyID names the key
+// the file is encrypted with, if it is.
+type AOFScanResult struct {
+	Format  AOFFormat
+	KeyID   string
+	Records int
+	Damage  []Damage
+}
+
+// ScanAOF reads the records of an AOF file, calling fn for each, and handles
+// damage according to policy: fail returns the first ErrAOFCorrupt error,
+// truncate drops the rest of the file and skip steps over the bad record
+// with SkipCorrupt. A record cut short at the end of the file, as left by a
+// crash during a write, is reported as damage under every policy. So is an
+// unparsable last line of a text file, which cannot be told apart from it.
+// An encrypted file is decrypted with keys.
+func ScanAOF(r io.Reader, policy CorruptPolicy, keys *Keyring, fn func(AOFRecord)) (AOFScanResult, error) {
+	var res AOFScanResult
+	cr := &countingReader{r: r}
+	ar, err := NewAOFReader(cr, keys)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		_, _ = io.Copy(io.Discard, cr)
+		res.Damage = append(res.Damage, Damage{Length: cr.n, Err: err})
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	res.Format, res.KeyID = ar.Format(), ar.KeyID()
+
+	for {
+		rec, err := ar.Next()
+		if errors.Is(err, io.EOF) {
+			return res, nil
+		}
+		if ar.format == AOFFormatText && errors.Is(err, ErrAOFCorrupt) && ar.atEOF() {
+			err = fmt.Errorf("%w: %v", io.ErrUnexpectedEOF, err)
+		}
+		torn := errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !torn && !errors.Is(err, ErrAOFCorrupt) {
+			return res, err
+		}
+		if err != nil {
+			offset := ar.Offset()
+			if !torn && policy == CorruptFail {
+				return res, fmt.Errorf("offset %d: %w", offset, err)
+			}
+			if torn || policy == CorruptTruncate {
+				if _, err := io.Copy(io.Discard, ar.r); err != nil {
+					return res, err
+				}
+				res.Damage = append(res.Damage, Damage{Offset: offset, Length: cr.n - offset, Err: err})
+				return res, nil
+			}
+			n, _ := ar.SkipCorrupt()
+			res.Damage = append(res.Damage, Damage{Offset: offset, Length: n, Err: err})
+			continue
+		}
+		fn(rec)
+		res.Records++
+	}
+}
+
+// RepairAOF copies the records of src that ScanAOF can read under policy to
+// dst, in the format of src. An encrypted src is decrypted with keys and
+// dst encrypted with the current key.
+func RepairAOF(dst io.Writer, src io.Reader, policy CorruptPolicy, keys *Keyring) (AOFScanResult, error) {
+	br := bufio.NewReader(src)
+	head, _ := br.Peek(aofHeaderSize)
+	format := AOFFormatText
+	var c *fileCipher
+	w := bufio.NewWriter(dst)
+	if bytes.HasPrefix(head, []byte(aofMagic)) {
+		format = AOFFormatBinary
+		if len(head) == aofHeaderSize && binary.BigEndian.Uint16(head[len(aofMagic):]) != aofVersion && keys != nil {
+			var err error
+			if c, err = newAOFCipher(keys.current()); err != nil {
+				return AOFScanResult{}, err
+			}
+		}
+		if _, err := w.Write(aofHeader(c)); err != nil {
+			return AOFScanResult{}, err
+		}
+	}
+
+	var buf []byte
+	var werr error
+	res, err := ScanAOF(br, policy, keys, func(rec AOFRecord) {
+		if werr == nil {
+			buf = appendRecord(buf[:0], format, c, rec)
+			_, werr = w.Write(buf)
+		}
+	})
+	if err != nil {
+		return res, err
+	}
+	return res, errors.Join(werr, w.Flush())
+}
+
+// RDBScanResult describes an RDB file read by ScanRDB. Version is 0 for a
+// headerless gob snapshot. KeyID names the key the file is encrypted with,
+// if it is.
+type RDBScanResult struct {
+	Version  int
+	KeyID    string
+	LastSeq  int64
+	Sections int
+	Entries  int
+	Damage   []Damage
+}
+
+// ScanRDB reads an RDB file in order, calling fn for every entry of the
+// sections that verify; key and the value are only valid during the call.
+// Damage is handled according to policy as in ScanAOF, a damaged section
+// being skipped as a whole. A section with a corrupt header hides where the
+// next one starts, so it ends the scan under every policy but fail. Gob
+// snapshots cannot be read in part and are either read whole or fail. An
+// encrypted file is decrypted with keys.
+func ScanRDB(r io.Reader, policy CorruptPolicy, keys *Keyring, fn func(key []byte, entry Entry)) (RDBScanResult, error) {
+	var res RDBScanResult
+	cr := &countingReader{r: r}
+	br := bufio.NewReaderSize(cr, 256<<10)
+	h, err := readRDBHeader(br)
+	if err != nil {
+		return res, err
+	}
+	res.Version, res.LastSeq = int(h.version), h.lastSeq
+	if !h.sectioned() {
+		var entries []rdbEntry
+		if err := gob.NewDecoder(br).Decode(&entries); err != nil {
+			return res, fmt.Errorf("%w: %v", ErrRDBCorrupt, err)
+		}
+		for _, e := range entries {
+			fn([]byte(e.Key), Entry{Value: e.Value, ExpiresAt: e.ExpiresAt, Meta: e.Meta})
+		}
+		res.Entries = len(entries)
+		return res, nil
+	}
+
+	c, err := h.cipher(keys)
+	if err != nil {
+		return res, err
+	}
+	if c != nil {
+		res.KeyID = c.key.String()
+	}
+	crc := crc32.New(crc32c)
+	crc.Write(h.bytes())
+	tr := io.TeeReader(br, crc)
+	offset := int64(len(h.bytes()))
+	// damaged records the damage at offset and reports whether the scan
+	// goes on after it.
+	damaged := func(length int64, err error, resumable bool) (bool, error) {
+		if policy == CorruptFail {
+			return false, fmt.Errorf("offset %d: %w", offset, err)
+		}
+		if !resumable || policy == CorruptTruncate {
+			if _, err := io.Copy(io.Discard, br); err != nil {
+				return false, err
+			}
+			length = cr.n - offset
+		}
+		res.Damage = append(res.Damage, Damage{Offset: offset, Length: length, Err: err})
+		return resumable && policy == CorruptSkip, nil
+	}
+
+	dec := &rdbSectionDecoder{cipher: c}
+	type entry struct {
+		key   []byte
+		entry Entry
+	}
+	var pending []entry
+	var head [rdbSectionHeader]byte
+	var ordinal uint64
+	for {
+		if _, err := io.ReadFull(tr, head[:1]); err != nil {
+			_, err := damaged(0, truncatedRDB(err), false)
+			return res, err
+		}
+		switch head[0] {
+		case rdbTypeSection, rdbTypeSectionMeta:
+			if _, err := io.ReadFull(tr, head[1:]); err != nil {
+				_, err := damaged(0, truncatedRDB(err), false)
+				return res, err
+			}
+			size := binary.BigEndian.Uint32(head[10:14])
+			if size > maxRDBSectionLength {
+				_, err := damaged(0, fmt.Errorf("%w: section length %d", ErrRDBCorrupt, size), false)
+				return res, err
+			}
+			sec := rdbSection{buf: make([]byte, rdbSectionHeader+int(size)), entries: int(binary.BigEndian.Uint32(head[6:10])), ordinal: ordinal}
+			ordinal++
+			copy(sec.buf, head[:])
+			if _, err := io.ReadFull(tr, sec.buf[rdbSectionHeader:]); err != nil {
+				_, err := damaged(0, truncatedRDB(err), false)
+				return res, err
+			}
+			length := int64(len(sec.buf))
+			if crc32.Checksum(sec.buf[rdbSectionHeader:], crc32c) != binary.BigEndian.Uint32(head[14:18]) {
+				if goOn, err := damaged(length, fmt.Errorf("%w: section checksum mismatch", ErrRDBCorrupt), true); !goOn {
+					return res, err
+				}
+				offset += length
+				continue
+			}
+			pending = pending[:0]
+			if _, err := dec.each(sec, func(key []byte, e Entry) {
+				pending = append(pending, entry{key, e})
+			}); err != nil {
+				if goOn, err := damaged(length, err, true); !goOn {
+					return res, err
+				}
+				offset += length
+				continue
+			}
+			for _, e := range pending {
+				fn(e.key, e.entry)
+			}
+			res.Sections++
+			res.Entries += len(pending)
+			offset += length
+		case rdbTypeEnd:
+			trailer, err := readRDBTrailer(tr, c, ordinal)
+			if err != nil {
+				_, err := damaged(0, err, false)
+				return res, err
+			}
+			want := crc.Sum32()
+			var got [4]byte
+			if _, err := io.ReadFull(br, got[:]); err != nil {
+				_, err := damaged(0, truncatedRDB(err), false)
+				return res, err
+			}
+			// A damaged section already spoils both checks.
+			if len(res.Damage) > 0 {
+				return res, nil
+			}
+			if binary.BigEndian.Uint32(got[:]) != want {
+				_, err := damaged(0, fmt.Errorf("%w: file checksum mismatch", ErrRDBCorrupt), true)
+				return res, err
+			}
+			if total := binary.BigEndian.Uint64(trailer[1:9]); total != uint64(res.Entries) {
+				_, err := damaged(0, fmt.Errorf("%w: trailer counts %d entries, sections hold %d", ErrRDBCorrupt, total, res.Entries), true)
+				return res, err
+			}
+			return res, nil
+		default:
+			_, err := damaged(0, fmt.Errorf("%w: unknown block type %#x", ErrRDBCorrupt, head[0]), false)
+			return res, err
+		}
+	}
+}
+
+// RepairRDB writes the entries of src that ScanRDB can read under policy to
+// dst as a new snapshot. Entries that have expired are left out. An
+// encrypted src is decrypted with keys and dst encrypted with the current
+// key.
+func RepairRDB(dst io.Writer, src io.Reader, policy CorruptPolicy, compression RDBCompression, keys *Keyring) (RDBScanResult, error) {
+	return copyRDB(dst, src, policy, compression, keys, true)
+}
+
+// DecryptRDB writes the entries of src, decrypted with keys, to dst as an
+// unencrypted snapshot. Entries that have expired are left out.
+func DecryptRDB(dst io.Writer, src io.Reader, compression RDBCompression, keys *Keyring) (RDBScanResult, error) {
+	return copyRDB(dst, src, CorruptFail, compression, keys, false)
+}
+
+func copyRDB(dst io.Writer, src io.Reader, policy CorruptPolicy, compression RDBCompression, keys *Keyring, encrypt bool) (RDBScanResult, error) {
+	cm := NewConcurrentMap(16)
+	res, err := ScanRDB(src, policy, keys, func(key []byte, entry Entry) {
+		entry.Value = bytes.Clone(entry.Value)
+		cm.SetEntry(string(key), entry)
+	})
+	if err != nil {
+		return res, err
+	}
+	var key *cipherKey
+	if encrypt && res.KeyID != "" {
+		key = keys.current()
+	}
+	snap := cm.Snapshot()
+	defer snap.Close()
+	w := bufio.NewWriter(dst)
+	if err := encodeRDB(w, snap, res.LastSeq, compression, key); err != nil {
+		return res, err
+	}
+	return res, w.Flush()
+}
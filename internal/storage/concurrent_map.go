@@ -4,18 +4,52 @@ import (
 	"crypto/sha256"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Entry struct {
 	Value     []byte
 	ExpiresAt int64
+	Meta      Meta
+	// CAS identifies the write that stored the entry, so that a client can
+	// make a later write conditional on no other having happened since. It
+	// is unique within the process and not persisted.
+	CAS uint64
+}
+
+var casSeq atomic.Uint64
+
+// item wraps an Entry with approximate access statistics used by the
+// eviction policies. The counters are updated atomically under the shard
+// read lock, so items are stored by pointer and never copied.
+type item struct {
+	Entry
+	lastAccess atomic.Int64
+	freq       atomic.Uint32
+	// pos is the position of the key in the scan order of its shard.
+	pos uint64
+}
+
+func newItem(e Entry) *item {
+	e.CAS = casSeq.Add(1)
+	it := &item{Entry: e}
+	it.lastAccess.Store(time.Now().UnixMilli())
+	it.freq.Store(lfuInitVal)
+	return it
 }
 
 type Shard struct {
 	mu    sync.RWMutex
-	items map[string]Entry
+	items map[string]*item
 	mem   int64
+	// frozen holds the preserved entries of the open snapshots.
+	frozen []*frozenShard
+	// order lists the keys by the position they were inserted at, for Scan.
+	// Removed keys leave holes until they make up half of it.
+	order   []scanSlot
+	holes   int
+	nextPos uint64
 }
 
 type ConcurrentMap struct {
@@ -32,7 +66,7 @@ func NewConcurrentMap(shardCount int) *ConcurrentMap {
 	shards := make([]*Shard, actualShardCount)
 	for i := range shards {
 		shards[i] = &Shard{
-			items: make(map[string]Entry),
+			items: make(map[string]*item),
 		}
 	}
 	return &ConcurrentMap{
@@ -42,66 +76,259 @@ func NewConcurrentMap(shardCount int) *ConcurrentMap {
 }
 
 func (cm *ConcurrentMap) getShard(key string) *Shard {
+	return cm.shards[cm.ShardIndex(key)]
+}
+
+// ShardIndex returns the shard that owns key, letting other components
+// partition their own state along the same boundaries.
+func (cm *ConcurrentMap) ShardIndex(key string) int {
 	h := sha256.Sum256([]byte(key))
 	idx := uint32(h[0]) | uint32(h[1])<<8 | uint32(h[2])<<16 | uint32(h[3])<<24
-	return cm.shards[idx&cm.shardMask]
+	return int(idx & cm.shardMask)
+}
+
+func (cm *ConcurrentMap) ShardCount() int {
+	return len(cm.shards)
 }
 
 func (cm *ConcurrentMap) Set(key string, value []byte, expiresAt int64) int64 {
+	return cm.SetEntry(key, Entry{Value: value, ExpiresAt: expiresAt})
+}
+
+// SetEntry stores the value, deadline and metadata of e under key.
+func (cm *ConcurrentMap) SetEntry(key string, e Entry) int64 {
 	shard := cm.getShard(key)
 	shard.mu.Lock()
 	defer shard.mu.Unlock()
 
-	oldEntry, exists := shard.items[key]
+	shard.preserve(key)
+	oldItem, exists := shard.items[key]
 	var memDelta int64
 
 	if exists {
-		memDelta -= int64(len(key) + len(oldEntry.Value))
+		memDelta -= int64(len(key) + len(oldItem.Value))
 	}
 
-	newEntry := Entry{
-		Value:     value,
-		ExpiresAt: expiresAt,
-	}
-	shard.items[key] = newEntry
-	memDelta += int64(len(key) + len(value))
+	shard.put(key, newItem(e))
+	memDelta += int64(len(key) + len(e.Value))
 	shard.mem += memDelta
 
 	return memDelta
 }
 
+// SetIf stores e under key like SetEntry, but only if a live entry for key
+// exists (present) or does not (!present), and reports whether it did. An
+// entry whose deadline has passed counts as absent.
+func (cm *ConcurrentMap) SetIf(key string, e Entry, present bool) (int64, bool) {
+	shard := cm.getShard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	oldItem, exists := shard.items[key]
+	live := exists && (oldItem.ExpiresAt == 0 || time.Now().UnixMilli() <= oldItem.ExpiresAt)
+	if live != present {
+		return 0, false
+	}
+
+	shard.preserve(key)
+	var memDelta int64
+	if exists {
+		memDelta -= int64(len(key) + len(oldItem.Value))
+	}
+	shard.put(key, newItem(e))
+	memDelta += int64(len(key) + len(e.Value))
+	shard.mem += memDelta
+
+	return memDelta, true
+}
+
+// CompareAndSwap stores e under key if the live entry of key is still the
+// one with the given CAS, or if key has no live entry and cas is 0, and
+// reports whether it did. A non-zero deadline of e that is not in the future
+// deletes the key instead, reported through a negative memDelta.
+func (cm *ConcurrentMap) CompareAndSwap(key string, cas uint64, e Entry) (int64, bool) {
+	shard := cm.getShard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	oldItem, exists := shard.items[key]
+	var current uint64
+	if exists && (oldItem.ExpiresAt == 0 || now <= oldItem.ExpiresAt) {
+		current = oldItem.CAS
+	}
+	if current != cas {
+		return 0, false
+	}
+
+	shard.preserve(key)
+	var memDelta int64
+	if exists {
+		memDelta -= int64(len(key) + len(oldItem.Value))
+	}
+	if e.ExpiresAt == 0 || e.ExpiresAt > now {
+		shard.put(key, newItem(e))
+		memDelta += int64(len(key) + len(e.Value))
+	} else if exists {
+		shard.remove(key)
+	}
+	shard.mem += memDelta
+
+	return memDelta, true
+}
+
 func (cm *ConcurrentMap) Get(key string) ([]byte, int64, bool) {
 	shard := cm.getShard(key)
 	shard.mu.RLock()
 	defer shard.mu.RUnlock()
 
-	entry, exists := shard.items[key]
+	it, exists := shard.items[key]
 	if !exists {
 		return nil, 0, false
 	}
 
-	if entry.ExpiresAt > 0 && time.Now().UnixMilli() > entry.ExpiresAt {
+	now := time.Now().UnixMilli()
+	if it.ExpiresAt > 0 && now > it.ExpiresAt {
 		return nil, 0, false
 	}
+	it.touch(now)
 
-	return entry.Value, entry.ExpiresAt, true
+	return it.Value, it.ExpiresAt, true
 }
 
-func (cm *ConcurrentMap) Delete(key string) int64 {
+// GetEntry returns the live entry of key.
+func (cm *ConcurrentMap) GetEntry(key string) (Entry, bool) {
+	shard := cm.getShard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	it, exists := shard.items[key]
+	if !exists {
+		return Entry{}, false
+	}
+
+	now := time.Now().UnixMilli()
+	if it.ExpiresAt > 0 && now > it.ExpiresAt {
+		return Entry{}, false
+	}
+	it.touch(now)
+
+	return it.Entry, true
+}
+
+// Delete removes key and reports whether it had a live entry; an entry whose
+// deadline has passed is removed too, but counts as absent.
+func (cm *ConcurrentMap) Delete(key string) (int64, bool) {
 	shard := cm.getShard(key)
 	shard.mu.Lock()
 	defer shard.mu.Unlock()
 
-	oldEntry, exists := shard.items[key]
+	oldItem, exists := shard.items[key]
 	if !exists {
-		return 0
+		return 0, false
 	}
 
-	memDelta := -(int64(len(key) + len(oldEntry.Value)))
-	delete(shard.items, key)
+	shard.preserve(key)
+	memDelta := -(int64(len(key) + len(oldItem.Value)))
+	shard.remove(key)
 	shard.mem += memDelta
 
-	return memDelta
+	return memDelta, oldItem.ExpiresAt == 0 || time.Now().UnixMilli() <= oldItem.ExpiresAt
+}
+
+// SetExpiry changes the deadline of an existing live key and returns the
+// previous deadline. Zero removes the expiry; a non-zero deadline that is not
+// in the future deletes the key, reported through a negative memDelta.
+func (cm *ConcurrentMap) SetExpiry(key string, expiresAt int64) (prevExpiresAt int64, memDelta int64, found bool) {
+	shard := cm.getShard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	it, exists := shard.items[key]
+	now := time.Now().UnixMilli()
+	if !exists || (it.ExpiresAt > 0 && now > it.ExpiresAt) {
+		return 0, 0, false
+	}
+
+	shard.preserve(key)
+	prevExpiresAt = it.ExpiresAt
+	if expiresAt != 0 && expiresAt <= now {
+		memDelta = -(int64(len(key) + len(it.Value)))
+		shard.remove(key)
+		shard.mem += memDelta
+		return prevExpiresAt, memDelta, true
+	}
+	it.ExpiresAt = expiresAt
+	return prevExpiresAt, 0, true
+}
+
+// restoreExpiry sets the deadline of key during replay. Unlike SetExpiry it
+// ignores whether the current deadline has already passed, because a later
+// record may legitimately extend the life of a key whose earlier deadline is
+// in the past by now.
+func (cm *ConcurrentMap) restoreExpiry(key string, expiresAt int64) {
+	shard := cm.getShard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if it, exists := shard.items[key]; exists {
+		shard.preserve(key)
+		it.ExpiresAt = expiresAt
+	}
+}
+
+// DeleteIfExpired removes key only if it still carries the given deadline
+// and that deadline has passed, so a stale expiry notification can never
+// delete a value that was rewritten with a different TTL or none at all.
+func (cm *ConcurrentMap) DeleteIfExpired(key string, expiresAt int64) (int64, bool) {
+	shard := cm.getShard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	it, exists := shard.items[key]
+	if !exists || expiresAt <= 0 || it.ExpiresAt != expiresAt || expiresAt > time.Now().UnixMilli() {
+		return 0, false
+	}
+
+	shard.preserve(key)
+	memDelta := -(int64(len(key) + len(it.Value)))
+	shard.remove(key)
+	shard.mem += memDelta
+
+	return memDelta, true
+}
+
+// ExpireSample looks at up to samples keys carrying a TTL in shard idx and
+// deletes those whose deadline has passed. It returns the number of keys with
+// a TTL that were sampled, the deleted keys and the memory released. Go map
+// iteration starts at a random position, which gives a cheap random sample.
+func (cm *ConcurrentMap) ExpireSample(idx, samples int, now int64) (int, []string, int64) {
+	shard := cm.shards[idx]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	sampled, examined := 0, 0
+	var expired []string
+	var memDelta int64
+	for key, it := range shard.items {
+		if sampled >= samples || examined >= 4*samples {
+			break
+		}
+		examined++
+		if it.ExpiresAt <= 0 {
+			continue
+		}
+		sampled++
+		if it.ExpiresAt <= now {
+			shard.preserve(key)
+			delta := -(int64(len(key) + len(it.Value)))
+			shard.remove(key)
+			shard.mem += delta
+			memDelta += delta
+			expired = append(expired, key)
+		}
+	}
+	return sampled, expired, memDelta
 }
 
 func (cm *ConcurrentMap) Exists(key string) bool {
@@ -109,12 +336,12 @@ func (cm *ConcurrentMap) Exists(key string) bool {
 	shard.mu.RLock()
 	defer shard.mu.RUnlock()
 
-	entry, exists := shard.items[key]
+	it, exists := shard.items[key]
 	if !exists {
 		return false
 	}
 
-	if entry.ExpiresAt > 0 && time.Now().UnixMilli() > entry.ExpiresAt {
+	if it.ExpiresAt > 0 && time.Now().UnixMilli() > it.ExpiresAt {
 		return false
 	}
 
@@ -141,15 +368,48 @@ func (cm *ConcurrentMap) MemUsage() int64 {
 	return total
 }
 
-func (cm *ConcurrentMap) Iterate(fn func(key string, entry Entry) bool) {
+// ReplaceWith atomically replaces the contents of cm with those of src, which
+// must have the same shard count and is left empty. All shards are locked
+// while their maps are exchanged, so no operation or snapshot sees a mix of
+// both.
+func (cm *ConcurrentMap) ReplaceWith(src *ConcurrentMap) {
 	for _, shard := range cm.shards {
-		shard.mu.RLock()
-		for key, entry := range shard.items {
-			if !fn(key, entry) {
-				shard.mu.RUnlock()
-				return
-			}
+		shard.mu.Lock()
+	}
+	for i, shard := range cm.shards {
+		from := src.shards[i]
+		from.mu.Lock()
+		shard.preserveAll(from.items)
+		shard.items, from.items = from.items, make(map[string]*item)
+		shard.mem, from.mem = from.mem, 0
+		shard.order, from.order = from.order, nil
+		shard.holes, from.holes = from.holes, 0
+		shard.nextPos, from.nextPos = from.nextPos, 0
+		from.mu.Unlock()
+	}
+	for _, shard := range cm.shards {
+		shard.mu.Unlock()
+	}
+}
+
+func (cm *ConcurrentMap) Iterate(fn func(key string, entry Entry) bool) {
+	for idx := range cm.shards {
+		if !cm.IterateShard(idx, fn) {
+			return
 		}
-		shard.mu.RUnlock()
 	}
 }
+
+// IterateShard calls fn for every entry of shard idx under the shard's read
+// lock and reports whether fn accepted them all.
+func (cm *ConcurrentMap) IterateShard(idx int, fn func(key string, entry Entry) bool) bool {
+	shard := cm.shards[idx]
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	for key, it := range shard.items {
+		if !fn(key, it.Entry) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -22,11 +24,21 @@ func TestConcurrentMap_Delete(t *testing.T) {
 	cm := NewConcurrentMap(16)
 
 	cm.Set("key1", []byte("value1"), 0)
-	cm.Delete("key1")
+	if _, found := cm.Delete("key1"); !found {
+		t.Fatal("delete should report key1 as found")
+	}
 	_, _, exists := cm.Get("key1")
 	if exists {
 		t.Fatal("key1 should not exist after delete")
 	}
+	if _, found := cm.Delete("key1"); found {
+		t.Fatal("a second delete should not find key1")
+	}
+
+	cm.Set("stale", []byte("v"), time.Now().Add(-time.Second).UnixMilli())
+	if memDelta, found := cm.Delete("stale"); found || memDelta >= 0 {
+		t.Fatalf("an expired entry should be removed but not found, got %d, %v", memDelta, found)
+	}
 }
 
 func TestConcurrentMap_Exists(t *testing.T) {
@@ -94,3 +106,251 @@ func BenchmarkConcurrentMapGet(b *testing.B) {
 		cm.Get("bench-key")
 	}
 }
+
+func TestConcurrentMap_EvictLRU(t *testing.T) {
+	cm := NewConcurrentMap(1)
+
+	cm.Set("old", []byte("v"), 0)
+	time.Sleep(5 * time.Millisecond)
+	cm.Set("new", []byte("v"), 0)
+
+	key, memDelta, ok := cm.Evict(EvictAllKeysLRU, 5)
+	if !ok {
+		t.Fatal("expected a key to be evicted")
+	}
+	if key != "old" {
+		t.Fatalf("expected least recently used key to be evicted, got %s", key)
+	}
+	if memDelta != -int64(len("old")+len("v")) {
+		t.Fatalf("unexpected mem delta %d", memDelta)
+	}
+	if cm.Exists("old") || !cm.Exists("new") {
+		t.Fatal("only the evicted key should be removed")
+	}
+}
+
+func TestConcurrentMap_EvictVolatileTTL(t *testing.T) {
+	cm := NewConcurrentMap(1)
+
+	cm.Set("persistent", []byte("v"), 0)
+	if _, _, ok := cm.Evict(EvictVolatileTTL, 5); ok {
+		t.Fatal("volatile-ttl must not evict keys without ttl")
+	}
+
+	cm.Set("later", []byte("v"), time.Now().Add(time.Hour).UnixMilli())
+	cm.Set("sooner", []byte("v"), time.Now().Add(time.Minute).UnixMilli())
+	key, _, ok := cm.Evict(EvictVolatileTTL, 5)
+	if !ok || key != "sooner" {
+		t.Fatalf("expected key with nearest expiry to be evicted, got %q", key)
+	}
+}
+
+func TestConcurrentMap_EvictNoEviction(t *testing.T) {
+	cm := NewConcurrentMap(16)
+	cm.Set("key1", []byte("value1"), 0)
+	if _, _, ok := cm.Evict(EvictNoEviction, 5); ok {
+		t.Fatal("noeviction must never evict")
+	}
+}
+
+func TestConcurrentMap_ScanVisitsEveryKeyOnce(t *testing.T) {
+	cm := NewConcurrentMap(16)
+	for i := 0; i < 100; i++ {
+		cm.Set(fmt.Sprintf("key:%03d", i), []byte("v"), 0)
+	}
+
+	seen := make(map[string]int)
+	cursor := ScanStartCursor
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("scan did not terminate")
+		}
+		keys, next, err := cm.Scan(cursor, 7, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			seen[key]++
+		}
+		// Keys written or deleted mid-scan, enough of them to compact the
+		// scan order, must not disturb the keys already present, and neither
+		// may overwriting those.
+		for i := 0; i < 20; i++ {
+			cm.Set(fmt.Sprintf("extra:%03d:%02d", pages, i), []byte("v"), 0)
+		}
+		for i := 0; i < 20; i++ {
+			cm.Delete(fmt.Sprintf("extra:%03d:%02d", pages, i))
+		}
+		key := fmt.Sprintf("key:%03d", pages*7%100)
+		cm.Set(key, []byte("w"), 0)
+		if e, ok := cm.GetEntry(key); ok {
+			cm.CompareAndSwap(key, e.CAS, Entry{Value: []byte("x")})
+		}
+		if next == ScanStartCursor {
+			break
+		}
+		cursor = next
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		if seen[key] != 1 {
+			t.Fatalf("expected %s to be returned exactly once, got %d", key, seen[key])
+		}
+	}
+}
+
+func TestConcurrentMap_ScanFilterAndInvalidCursor(t *testing.T) {
+	cm := NewConcurrentMap(4)
+	cm.Set("user:1", []byte("v"), 0)
+	cm.Set("user:2", []byte("v"), 0)
+	cm.Set("order:1", []byte("v"), 0)
+	cm.Set("user:expired", []byte("v"), time.Now().Add(-time.Second).UnixMilli())
+
+	keys, next, err := cm.Scan(ScanStartCursor, 100, func(key string) bool {
+		return MatchGlob("user:*", key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != ScanStartCursor || len(keys) != 2 {
+		t.Fatalf("expected 2 live user keys in a single page, got %v (cursor %s)", keys, next)
+	}
+
+	if _, _, err := cm.Scan("not-a-cursor!", 10, nil); err != ErrInvalidCursor {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "a/b", true},
+		{"user:*", "user:42", true},
+		{"user:?", "user:42", false},
+		{"h[ae]llo", "hello", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a\\*", "a*", true},
+		{"a\\*", "ab", false},
+		{"*b*c", "abxbxc", true},
+		{"a*b?d", "axbbcd", true},
+		{"a*b", "abc", false},
+		{"**", "", true},
+		{"a\\", "a\\", true},
+		{"[a-", "b", false},
+		{strings.Repeat("*a", 30) + "b", strings.Repeat("a", 100), false},
+	}
+	for _, c := range cases {
+		if got := MatchGlob(c.pattern, c.s); got != c.want {
+			t.Errorf("MatchGlob(%q, %q) = %v, want %v", c.pattern, c.s, got, c.want)
+		}
+	}
+}
+
+func TestConcurrentMap_ExpireSample(t *testing.T) {
+	cm := NewConcurrentMap(1)
+	now := time.Now().UnixMilli()
+	for i := 0; i < 10; i++ {
+		cm.Set(fmt.Sprintf("dead%d", i), []byte("v"), now-1)
+		cm.Set(fmt.Sprintf("live%d", i), []byte("v"), now+60000)
+		cm.Set(fmt.Sprintf("plain%d", i), []byte("v"), 0)
+	}
+
+	total := 0
+	for {
+		sampled, expired, memDelta := cm.ExpireSample(0, 5, now)
+		if sampled > 5 {
+			t.Fatalf("sampled %d keys, want at most 5", sampled)
+		}
+		if memDelta != -int64(len(expired)*(len("dead0")+1)) {
+			t.Fatalf("unexpected memDelta %d for %v", memDelta, expired)
+		}
+		total += len(expired)
+		if total == 10 {
+			break
+		}
+	}
+	if cm.Keys() != 20 {
+		t.Fatalf("expected 20 keys left, got %d", cm.Keys())
+	}
+	if cm.MemUsage() != 10*int64(len("live0")+1)+10*int64(len("plain0")+1) {
+		t.Fatalf("unexpected mem usage %d", cm.MemUsage())
+	}
+}
+
+func TestConcurrentMap_SnapshotIsPointInTime(t *testing.T) {
+	cm := NewConcurrentMap(16)
+	for i := range 100 {
+		cm.Set(fmt.Sprintf("key%d", i), []byte("old"), 0)
+	}
+	deadline := time.Now().Add(time.Hour).UnixMilli()
+	cm.Set("ttl", []byte("old"), deadline)
+
+	snap := cm.Snapshot()
+	for i := range 50 {
+		cm.Set(fmt.Sprintf("key%d", i), []byte("new"), 0)
+	}
+	cm.Delete("key60")
+	cm.Set("added", []byte("new"), 0)
+	cm.SetExpiry("ttl", 0)
+	replacement := NewConcurrentMap(16)
+	replacement.Set("replaced", []byte("new"), 0)
+	cm.ReplaceWith(replacement)
+
+	got := make(map[string]Entry)
+	for idx := range snap.ShardCount() {
+		snap.IterateShard(idx, func(key string, entry Entry) bool {
+			if _, dup := got[key]; dup {
+				t.Fatalf("key %s visited twice", key)
+			}
+			got[key] = entry
+			return true
+		})
+	}
+	snap.Close()
+
+	if len(got) != 101 {
+		t.Fatalf("expected 101 keys in the snapshot, got %d", len(got))
+	}
+	for key, entry := range got {
+		if string(entry.Value) != "old" {
+			t.Fatalf("snapshot holds %s=%s written after it was taken", key, entry.Value)
+		}
+	}
+	if got["ttl"].ExpiresAt != deadline {
+		t.Fatal("snapshot should keep the expiry the key had when it was taken")
+	}
+	for _, shard := range cm.shards {
+		if len(shard.frozen) != 0 {
+			t.Fatal("closed snapshot should no longer preserve entries")
+		}
+	}
+}
+
+func TestConcurrentMap_CompareAndSwap(t *testing.T) {
+	cm := NewConcurrentMap(4)
+	if _, ok := cm.CompareAndSwap("k", 1, Entry{Value: []byte("v")}); ok {
+		t.Fatal("swap of an absent key should need cas 0")
+	}
+	if _, ok := cm.CompareAndSwap("k", 0, Entry{Value: []byte("v1")}); !ok {
+		t.Fatal("swap of an absent key with cas 0 should succeed")
+	}
+	first, _ := cm.GetEntry("k")
+	cm.Set("k", []byte("v2"), 0)
+	if _, ok := cm.CompareAndSwap("k", first.CAS, Entry{Value: []byte("v3")}); ok {
+		t.Fatal("swap after another write should fail")
+	}
+	second, _ := cm.GetEntry("k")
+	if second.CAS == first.CAS {
+		t.Fatal("every write should get a new CAS")
+	}
+	if memDelta, ok := cm.CompareAndSwap("k", second.CAS, Entry{Value: []byte("v3"), ExpiresAt: -1}); !ok || memDelta != -int64(len("k")+2) {
+		t.Fatalf("swap with a past deadline should delete, got %d (%v)", memDelta, ok)
+	}
+	if cm.Exists("k") || cm.MemUsage() != 0 {
+		t.Fatal("k should be deleted")
+	}
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+var ErrEncryptionKeyNotFound = errors.New("encryption key not found")
+
+const keyIDSize = 8
+
+// Keyring holds the AES keys persisted files are encrypted with. New files
+// are encrypted with the first key; the others only decrypt files written
+// before a rotation, until a rewrite or snapshot has replaced them. A key is
+// identified by the first bytes of its SHA-256, which encrypted files record
+// in their header. A nil Keyring leaves files unencrypted.
+type Keyring struct {
+	keys []*cipherKey
+}
+
+type cipherKey struct {
+	id     [keyIDSize]byte
+	aead   cipher.AEAD
+	secret []byte
+}
+
+func newCipherKey(secret []byte) (*cipherKey, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherKey{aead: aead, secret: secret}, nil
+}
+
+// NewKeyring builds a keyring from raw AES-128, -192 or -256 keys, the
+// current one first.
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption key")
+	}
+	k := &Keyring{}
+	for i, raw := range keys {
+		ck, err := newCipherKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i+1, err)
+		}
+		sum := sha256.Sum256(raw)
+		copy(ck.id[:], sum[:])
+		k.keys = append(k.keys, ck)
+	}
+	return k, nil
+}
+
+// ParseKeyring reads keys encoded in hex or base64, separated by newlines or
+// commas, the current one first. Blank lines and lines starting with '#' are
+// ignored.
+func ParseKeyring(s string) (*Keyring, error) {
+	var keys [][]byte
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			key, err := hex.DecodeString(field)
+			if err != nil {
+				if key, err = base64.StdEncoding.DecodeString(field); err != nil {
+					return nil, fmt.Errorf("key %d: not hex or base64", len(keys)+1)
+				}
+			}
+			keys = append(keys, key)
+		}
+	}
+	return NewKeyring(keys...)
+}
+
+// LoadKeyring reads the keyring from keyFile, or from the environment
+// variable env if keyFile is empty.
+func LoadKeyring(keyFile, env string) (*Keyring, error) {
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return ParseKeyring(string(data))
+	}
+	if env == "" {
+		return nil, errors.New("no encryption key file or environment variable configured")
+	}
+	value, ok := os.LookupEnv(env)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", env)
+	}
+	return ParseKeyring(value)
+}
+
+// CurrentID returns the ID of the key new files are encrypted with, or ""
+// for a nil keyring.
+func (k *Keyring) CurrentID() string {
+	if c := k.current(); c != nil {
+		return c.String()
+	}
+	return ""
+}
+
+func (k *Keyring) current() *cipherKey {
+	if k == nil {
+		return nil
+	}
+	return k.keys[0]
+}
+
+func (k *Keyring) lookup(id []byte) (*cipherKey, error) {
+	if k != nil {
+		for _, c := range k.keys {
+			if string(c.id[:]) == string(id) {
+				return c, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %x", ErrEncryptionKeyNotFound, id)
+}
+
+func (c *cipherKey) String() string {
+	return hex.EncodeToString(c.id[:])
+}
+
+// seal appends to dst a random nonce followed by plaintext encrypted and
+// authenticated together with aad.
+func (c *cipherKey) seal(dst, plaintext, aad []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	dst = append(dst, nonce...)
+	return c.aead.Seal(dst, nonce, plaintext, aad)
+}
+
+// open reverses seal.
+func (c *cipherKey) open(sealed, aad []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(sealed) < n+c.aead.Overhead() {
+		return nil, errors.New("short ciphertext")
+	}
+	return c.aead.Open(nil, sealed[:n], sealed[n:], aad)
+}
+
+// fileSaltSize is the size of the random salt in the header of an encrypted
+// file.
+const fileSaltSize = 16
+
+// fileCipher seals the records or sections of one encrypted file. It uses a
+// key derived from the keyring key and the random salt in the file header,
+// so that files never share a key and random nonces stay far from their
+// collision bound, and authenticates the whole header with everything it
+// seals, so that nothing can be moved from one file to another.
+type fileCipher struct {
+	key    *cipherKey
+	sealer *cipherKey
+	header []byte
+}
+
+// newFileSalt returns a random salt for the header of a new file.
+func newFileSalt() []byte {
+	salt := make([]byte, fileSaltSize)
+	_, _ = rand.Read(salt)
+	return salt
+}
+
+// newFileCipher returns the cipher of the file with the given header,
+// encrypted with key and the salt in the header.
+func newFileCipher(key *cipherKey, header, salt []byte) (*fileCipher, error) {
+	secret, err := hkdf.Key(sha256.New, key.secret, salt, "gopher-kv file", len(key.secret))
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newCipherKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	sealer.id = key.id
+	return &fileCipher{key: key, sealer: sealer, header: header}, nil
+}
+
+// sealsWith reports whether new data is sealed with key, a nil c and key
+// meaning no encryption.
+func (c *fileCipher) sealsWith(key *cipherKey) bool {
+	if c == nil {
+		return key == nil
+	}
+	return c.key == key
+}
+
+// seal is cipherKey.seal, authenticating the file header followed by ad.
+func (c *fileCipher) seal(dst, plaintext, ad []byte) []byte {
+	return c.sealer.seal(dst, plaintext, slices.Concat(c.header, ad))
+}
+
+// open reverses seal.
+func (c *fileCipher) open(sealed, ad []byte) ([]byte, error) {
+	return c.sealer.open(sealed, slices.Concat(c.header, ad))
+}
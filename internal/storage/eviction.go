@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+type EvictionPolicy int
+
+const (
+	EvictNoEviction EvictionPolicy = iota
+	EvictAllKeysLRU
+	EvictAllKeysLFU
+	EvictVolatileTTL
+	EvictAllKeysRandom
+)
+
+const (
+	DefaultEvictionSamples = 5
+
+	// LFU counters follow the Redis logarithmic scheme: new keys start at
+	// lfuInitVal so they are not evicted right away, the increment
+	// probability shrinks as the counter grows, and the counter decays by one
+	// for every lfuDecayMillis the key stays idle.
+	lfuInitVal     = 5
+	lfuLogFactor   = 10
+	lfuDecayMillis = int64(time.Minute / time.Millisecond)
+
+	evictMaxAttempts = 3
+)
+
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "", "noeviction":
+		return EvictNoEviction, nil
+	case "allkeys-lru":
+		return EvictAllKeysLRU, nil
+	case "allkeys-lfu":
+		return EvictAllKeysLFU, nil
+	case "volatile-ttl":
+		return EvictVolatileTTL, nil
+	case "allkeys-random", "random":
+		return EvictAllKeysRandom, nil
+	default:
+		return EvictNoEviction, fmt.Errorf("unknown eviction policy %q", name)
+	}
+}
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictAllKeysLRU:
+		return "allkeys-lru"
+	case EvictAllKeysLFU:
+		return "allkeys-lfu"
+	case EvictVolatileTTL:
+		return "volatile-ttl"
+	case EvictAllKeysRandom:
+		return "allkeys-random"
+	default:
+		return "noeviction"
+	}
+}
+
+func (it *item) touch(now int64) {
+	last := it.lastAccess.Swap(now)
+	counter := lfuDecay(it.freq.Load(), now-last)
+	if counter < math.MaxUint8 {
+		base := float64(0)
+		if counter > lfuInitVal {
+			base = float64(counter - lfuInitVal)
+		}
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	it.freq.Store(counter)
+}
+
+func lfuDecay(counter uint32, idleMillis int64) uint32 {
+	periods := idleMillis / lfuDecayMillis
+	if periods <= 0 {
+		return counter
+	}
+	if periods >= int64(counter) {
+		return 0
+	}
+	return counter - uint32(periods)
+}
+
+// evictionScore ranks a candidate; the sample with the highest score is
+// evicted. Already expired entries are always the preferred victims.
+func evictionScore(policy EvictionPolicy, it *item, now int64) int64 {
+	if it.ExpiresAt > 0 && it.ExpiresAt <= now {
+		return math.MaxInt64
+	}
+	last := it.lastAccess.Load()
+	switch policy {
+	case EvictAllKeysLRU:
+		return now - last
+	case EvictAllKeysLFU:
+		return int64(math.MaxUint8-lfuDecay(it.freq.Load(), now-last))<<32 | (now-last)&math.MaxUint32
+	case EvictVolatileTTL:
+		return -it.ExpiresAt
+	default:
+		return 0
+	}
+}
+
+// Evict samples entries starting from a random shard, removes the best
+// victim for policy and returns its key and memory delta. It reports false
+// when nothing is evictable (empty map, no volatile keys, or noeviction).
+func (cm *ConcurrentMap) Evict(policy EvictionPolicy, samples int) (string, int64, bool) {
+	if policy == EvictNoEviction {
+		return "", 0, false
+	}
+	if samples <= 0 {
+		samples = DefaultEvictionSamples
+	}
+
+	for attempt := 0; attempt < evictMaxAttempts; attempt++ {
+		var (
+			bestShard *Shard
+			bestItem  *item
+			bestKey   string
+			bestScore int64
+		)
+		now := time.Now().UnixMilli()
+		picked := 0
+		start := rand.IntN(len(cm.shards))
+		for probe := 0; probe < len(cm.shards) && picked < samples; probe++ {
+			shard := cm.shards[(start+probe)%len(cm.shards)]
+			shard.mu.RLock()
+			scanned := 0
+			for key, it := range shard.items {
+				if scanned >= 2*samples || picked >= samples {
+					break
+				}
+				scanned++
+				if policy == EvictVolatileTTL && it.ExpiresAt == 0 {
+					continue
+				}
+				picked++
+				score := evictionScore(policy, it, now)
+				if bestItem == nil || score > bestScore {
+					bestShard, bestItem, bestKey, bestScore = shard, it, key, score
+				}
+			}
+			shard.mu.RUnlock()
+		}
+		if bestItem == nil {
+			return "", 0, false
+		}
+
+		bestShard.mu.Lock()
+		if bestShard.items[bestKey] == bestItem {
+			bestShard.preserve(bestKey)
+			memDelta := -(int64(len(bestKey) + len(bestItem.Value)))
+			bestShard.remove(bestKey)
+			bestShard.mem += memDelta
+			bestShard.mu.Unlock()
+			return bestKey, memDelta, true
+		}
+		bestShard.mu.Unlock()
+	}
+	return "", 0, false
+}
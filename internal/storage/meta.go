@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Meta is metadata stored along with a value. The zero Meta is what plain
+// writes store, and takes no room in persisted files.
+type Meta struct {
+	// Flags are opaque to the server, as memcached clients use them.
+	Flags uint32
+	// ContentType is the media type a value was stored with over HTTP.
+	ContentType string
+}
+
+// Metadata is persisted as attributes: of the SET record in the binary AOF,
+// after each entry of the metadata sections of an RDB file. The tags share
+// their numbering with the other AOF attributes.
+const (
+	metaAttrFlags       = 2
+	metaAttrContentType = 3
+)
+
+// appendMetaAttrs appends the attributes of the non-zero fields of m.
+func appendMetaAttrs(dst []byte, m Meta) []byte {
+	if m.Flags != 0 {
+		dst = binary.AppendUvarint(dst, metaAttrFlags)
+		dst = binary.AppendUvarint(dst, uint64(uvarintLen(uint64(m.Flags))))
+		dst = binary.AppendUvarint(dst, uint64(m.Flags))
+	}
+	if m.ContentType != "" {
+		dst = binary.AppendUvarint(dst, metaAttrContentType)
+		dst = binary.AppendUvarint(dst, uint64(len(m.ContentType)))
+		dst = append(dst, m.ContentType...)
+	}
+	return dst
+}
+
+// decodeAttr sets the field attribute tag holds and reports whether tag
+// belongs to the metadata.
+func (m *Meta) decodeAttr(tag uint64, attr []byte) (bool, error) {
+	switch tag {
+	case metaAttrFlags:
+		flags, n := binary.Uvarint(attr)
+		if n != len(attr) || flags > math.MaxUint32 {
+			return true, errors.New("bad flags")
+		}
+		m.Flags = uint32(flags)
+		return true, nil
+	case metaAttrContentType:
+		m.ContentType = string(attr)
+		return true, nil
+	}
+	return false, nil
+}
+
+// decodeMetaAttrs decodes a run of attributes that holds nothing but
+// metadata, skipping tags it does not know.
+func decodeMetaAttrs(buf []byte) (Meta, error) {
+	var m Meta
+	for len(buf) > 0 {
+		tag, size := binary.Uvarint(buf)
+		if size <= 0 {
+			return m, errors.New("bad attribute tag")
+		}
+		attr, rest, ok := readRDBBytes(buf[size:])
+		if !ok {
+			return m, errors.New("bad attribute length")
+		}
+		if _, err := m.decodeAttr(tag, attr); err != nil {
+			return m, err
+		}
+		buf = rest
+	}
+	return m, nil
+}
@@ -2,271 +2,1012 @@ package storage
 
 import (
 	"bufio"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var ErrAOFRewriteInProgress = errors.New("aof rewrite already in progress")
+
+var (
+	errAOFNotOpen = errors.New("aof not open for append")
+	errAOFClosed  = errors.New("aof closed")
+)
+
+type AOFOptions struct {
+	// Path names the AOF. Its parts live in DirName next to it, e.g.
+	// "data/appendonlydir/appendonly.aof.1.incr.aof" for "data/appendonly.aof".
+	// A single-file AOF found at Path is migrated into that layout.
+	Path             string
+	DirName          string
+	RewriteThreshold int64
+	Fsync            FsyncPolicy
+	// Format is used for incremental files created from now on.
+	Format AOFFormat
+	// BaseCompression is used for the RDB-encoded base written by rewrites.
+	BaseCompression RDBCompression
+	// ArchiveDir, if set, receives the incremental files a rewrite drops
+	// instead of deleting them, for point-in-time recovery. Archived files
+	// are removed ArchiveKeepHours after their last write, or never if 0.
+	ArchiveDir       string
+	ArchiveKeepHours int
+	// LoadCorrupt selects how replay handles damaged records, see
+	// ReplayAfter.
+	LoadCorrupt CorruptPolicy
+	// Streams splits the AOF into that many streams, each appended to by its
+	// own file and lock, with the keys of a storage shard always going to the
+	// same one. It is capped at the number of shards; 0 and 1 keep a single
+	// stream.
+	Streams int
+	// Keys, if set, encrypts the files written from now on with its current
+	// key, in the binary format whatever Format says, and decrypts existing
+	// ones. Incremental files written with another key or none are not
+	// appended to; new ones are started instead.
+	Keys *Keyring
+}
+
+// AOFPersister maintains a multi-part AOF: an optional base snapshot, a list
+// of incremental files of which only the last one of every stream is
+// appended to, and a manifest naming them. A rewrite starts new incremental
+// files, writes a fresh base and then atomically swaps the manifest, so a
+// crash at any point leaves a complete set of files behind.
 type AOFPersister struct {
 	path             string
+	dir              string
+	name             string
 	rewriteThreshold int64
+	fsync            FsyncPolicy
+	format           AOFFormat
+	baseCompression  RDBCompression
+	archiveDir       string
+	archiveKeepHours int
+	loadCorrupt      CorruptPolicy
+	keys             *Keyring
 	storage          *ConcurrentMap
 
+	// Locks are taken in the order: the syncMu of every stream, the mu of
+	// every stream, mu.
+	streams   []*aofStream
 	mu        sync.Mutex
-	file      *os.File
+	manifest  *aofManifest
 	rewriting bool
-	incrBuf   [][]byte
+	// closed is set by Close, after which nothing is appended.
+	closed bool
+	// rewriteMu serializes rewrites, so the manifest written last is that of
+	// the rewrite that started last.
+	rewriteMu sync.Mutex
+	// rewriteStartedAt is set while a rewrite runs; the other rewrite fields
+	// describe the rewrites that finished.
+	rewriteStartedAt time.Time
+	rewrites         int64
+	rewriteFailures  int64
+	lastRewriteAt    time.Time
+	lastRewriteTook  time.Duration
+	lastRewriteErr   error
+	// seq is the sequence number of the last record appended or replayed.
+	// Appends take the next one under their stream's lock, so every stream
+	// holds its records in increasing order.
+	seq atomic.Int64
+	// incrSize is the size of the incremental files since the last rewrite.
+	incrSize atomic.Int64
+
+	syncStopCh   chan struct{}
+	syncDoneCh   chan struct{}
+	fsyncs       atomic.Int64
+	fsyncLastUs  atomic.Int64
+	fsyncMaxUs   atomic.Int64
+	fsyncTotalUs atomic.Int64
+}
+
+// aofStream is one stream of the AOF, appended to by its current
+// incremental file.
+type aofStream struct {
+	id         int
+	mu         sync.Mutex
+	file       *os.File
+	fileFormat AOFFormat
+	fileCipher *fileCipher
+	encBuf     []byte
+
+	// written and synced are logical offsets counting every byte appended
+	// to the stream since the persister was created; written is only
+	// advanced under mu.
+	written atomic.Int64
+	synced  atomic.Int64
+	syncMu  sync.Mutex
 }
 
-func NewAOFPersister(path string, rewriteThreshold int64, storage *ConcurrentMap) *AOFPersister {
+func NewAOFPersister(opts AOFOptions, storage *ConcurrentMap) *AOFPersister {
+	dirName := opts.DirName
+	if dirName == "" {
+		dirName = defaultAOFDirName
+	}
+	n := max(opts.Streams, 1)
+	if storage != nil {
+		n = min(n, storage.ShardCount())
+	}
+	streams := make([]*aofStream, n)
+	for i := range streams {
+		streams[i] = &aofStream{id: i}
+	}
+	format := opts.Format
+	if opts.Keys != nil {
+		format = AOFFormatBinary
+	}
 	return &AOFPersister{
-		path:             path,
-		rewriteThreshold: rewriteThreshold,
+		path:             opts.Path,
+		dir:              filepath.Join(filepath.Dir(opts.Path), dirName),
+		name:             filepath.Base(opts.Path),
+		rewriteThreshold: opts.RewriteThreshold,
+		fsync:            opts.Fsync,
+		format:           format,
+		baseCompression:  opts.BaseCompression,
+		archiveDir:       opts.ArchiveDir,
+		archiveKeepHours: opts.ArchiveKeepHours,
+		loadCorrupt:      opts.LoadCorrupt,
+		keys:             opts.Keys,
 		storage:          storage,
+		streams:          streams,
 	}
 }
 
-func (p *AOFPersister) OpenForAppend() error {
+// streamFor returns the stream the records of key go to.
+func (p *AOFPersister) streamFor(key string) *aofStream {
+	if len(p.streams) == 1 {
+		return p.streams[0]
+	}
+	return p.streams[p.storage.ShardIndex(key)%len(p.streams)]
+}
+
+func (p *AOFPersister) lockAll() {
+	for _, s := range p.streams {
+		s.syncMu.Lock()
+	}
+	for _, s := range p.streams {
+		s.mu.Lock()
+	}
 	p.mu.Lock()
-	defer p.mu.Unlock()
+}
+
+func (p *AOFPersister) unlockAll() {
+	p.mu.Unlock()
+	for _, s := range p.streams {
+		s.mu.Unlock()
+	}
+	for _, s := range p.streams {
+		s.syncMu.Unlock()
+	}
+}
+
+func (p *AOFPersister) manifestPath() string {
+	return filepath.Join(p.dir, p.name+".manifest")
+}
+
+func (p *AOFPersister) partName(seq int64, kind string) string {
+	return fmt.Sprintf("%s.%d.%s", p.name, seq, kind)
+}
 
-	return p.openForAppendLocked()
+// Exists reports whether there is an AOF to replay, in either layout.
+func (p *AOFPersister) Exists() bool {
+	if _, err := os.Stat(p.manifestPath()); err == nil {
+		return true
+	}
+	_, err := os.Stat(p.path)
+	return err == nil
+}
+
+func (p *AOFPersister) OpenForAppend() error {
+	p.lockAll()
+	defer p.unlockAll()
+
+	if err := p.openForAppendLocked(); err != nil {
+		return err
+	}
+	p.startBackgroundSync()
+	return nil
 }
 
+// openForAppendLocked opens the last incremental file of every stream. If
+// the AOF was last appended to with another number of streams or shards,
+// which would send keys to other streams, or one of the files is not
+// encrypted with the current key, new files are started for all of them
+// instead. The caller holds every lock.
 func (p *AOFPersister) openForAppendLocked() error {
-	if p.file != nil {
-		return nil
+	if p.closed {
+		return errAOFClosed
+	}
+	if p.manifest == nil {
+		if err := p.loadManifestLocked(); err != nil {
+			return err
+		}
+	}
+
+	gens := p.manifest.generations()
+	last := make([]*aofPart, len(p.streams))
+	cur := aofPart{Streams: len(p.streams), Shards: p.storage.ShardCount()}
+	if len(gens) > 0 && gens[len(gens)-1][0].sameLayout(cur) {
+		gen := gens[len(gens)-1]
+		for i := range gen {
+			last[gen[i].Stream] = &gen[i]
+		}
 	}
-	if err := os.MkdirAll(filepath.Dir(p.path), 0o755); err != nil {
+	if slices.Contains(last, nil) {
+		_, err := p.startIncrsLocked()
 		return err
 	}
-	f, err := os.OpenFile(p.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
-	if err != nil {
+
+	for _, s := range p.streams {
+		if s.file != nil {
+			continue
+		}
+		path := filepath.Join(p.dir, last[s.id].Name)
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if st.Size() == 0 {
+			c, err := p.writeHeader(s, f)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			s.fileFormat, s.fileCipher = p.format, c
+		} else {
+			format, c, err := p.detectAOFFormat(path)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			if !c.sealsWith(p.keys.current()) {
+				f.Close()
+				_, err := p.startIncrsLocked()
+				return err
+			}
+			s.fileFormat, s.fileCipher = format, c
+		}
+		s.file = f
+	}
+	return nil
+}
+
+// loadManifestLocked reads the manifest, creating it on first use. A
+// single-file AOF at p.path becomes the base of the new layout: it is linked
+// into the directory before the manifest referencing it is written and only
+// removed afterwards, so an interrupted migration is simply redone.
+func (p *AOFPersister) loadManifestLocked() error {
+	if err := os.MkdirAll(p.dir, 0o755); err != nil {
+		return err
+	}
+	m, err := loadAOFManifest(p.manifestPath())
+	if errors.Is(err, os.ErrNotExist) {
+		m = &aofManifest{}
+		migrated := false
+		if _, statErr := os.Stat(p.path); statErr == nil {
+			base := aofPart{Name: p.partName(1, "base.aof"), Seq: 1, Type: aofTypeBase}
+			basePath := filepath.Join(p.dir, base.Name)
+			_ = os.Remove(basePath)
+			if err := os.Link(p.path, basePath); err != nil {
+				return err
+			}
+			m.Base = &base
+			migrated = true
+		}
+		for _, s := range p.streams {
+			f, _, part, err := p.createIncrLocked(s, int64(s.id)+1)
+			if err != nil {
+				return err
+			}
+			f.Close()
+			m.Incrs = append(m.Incrs, part)
+		}
+		if err := writeAOFManifest(p.manifestPath(), m); err != nil {
+			return err
+		}
+		if migrated {
+			_ = os.Remove(p.path)
+		}
+	} else if err != nil {
 		return err
 	}
-	p.file = f
+
+	p.manifest = m
+	var size int64
+	for _, pt := range m.Incrs {
+		if st, err := os.Stat(filepath.Join(p.dir, pt.Name)); err == nil {
+			size += st.Size()
+		}
+	}
+	p.incrSize.Store(size)
+	_ = p.removeUnreferencedParts(m, nil)
 	return nil
 }
 
+func (p *AOFPersister) removeUnreferencedParts(m, prev *aofManifest) error {
+	err := removeUnreferencedAOFParts(p.dir, p.name, m, prev, p.archiveDir)
+	return errors.Join(err, pruneAOFArchive(p.archiveDir, p.name, p.archiveKeepHours, time.Now()))
+}
+
+// createIncrLocked creates an empty incremental file of stream s with
+// sequence seq in the configured format and returns it with its cipher.
+func (p *AOFPersister) createIncrLocked(s *aofStream, seq int64) (*os.File, *fileCipher, aofPart, error) {
+	part := aofPart{Name: p.partName(seq, "incr.aof"), Seq: seq, Type: aofTypeIncr}
+	if len(p.streams) > 1 {
+		part.Stream, part.Streams, part.Shards = s.id, len(p.streams), p.storage.ShardCount()
+	}
+	f, err := os.OpenFile(filepath.Join(p.dir, part.Name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, part, err
+	}
+	c, err := p.writeHeader(s, f)
+	if err != nil {
+		f.Close()
+		return nil, nil, part, err
+	}
+	return f, c, part, nil
+}
+
+// writeHeader starts the new file f of stream s and returns the cipher its
+// records are to be sealed with, nil if they are not.
+func (p *AOFPersister) writeHeader(s *aofStream, f *os.File) (*fileCipher, error) {
+	if p.format != AOFFormatBinary {
+		return nil, nil
+	}
+	var c *fileCipher
+	if key := p.keys.current(); key != nil {
+		var err error
+		if c, err = newAOFCipher(key); err != nil {
+			return nil, err
+		}
+	}
+	header := aofHeader(c)
+	if _, err := f.Write(header); err != nil {
+		return nil, err
+	}
+	s.written.Add(int64(len(header)))
+	return c, nil
+}
+
+// detectAOFFormat returns the format of the AOF file at path and its
+// cipher, if it is encrypted.
+func (p *AOFPersister) detectAOFFormat(path string) (AOFFormat, *fileCipher, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return AOFFormatText, nil, err
+	}
+	defer f.Close()
+	ar, err := NewAOFReader(f, p.keys)
+	if err != nil {
+		return AOFFormatText, nil, err
+	}
+	return ar.Format(), ar.cipher, nil
+}
+
 func (p *AOFPersister) AppendSet(key string, value []byte, expiresAt int64) error {
-	line := fmt.Sprintf("SET\t%s\t%s\t%d\n", key, base64.StdEncoding.EncodeToString(value), expiresAt)
-	return p.appendLine([]byte(line))
+	return p.appendRecord(AOFRecord{Op: AOFOpSet, Key: key, Value: value, ExpiresAt: expiresAt})
+}
+
+// AppendEntry logs a SET of the value, deadline and metadata of e.
+func (p *AOFPersister) AppendEntry(key string, e Entry) error {
+	return p.appendRecord(AOFRecord{Op: AOFOpSet, Key: key, Value: e.Value, ExpiresAt: e.ExpiresAt, Meta: e.Meta})
 }
 
 func (p *AOFPersister) AppendDel(key string) error {
-	line := fmt.Sprintf("DEL\t%s\n", key)
-	return p.appendLine([]byte(line))
+	return p.appendRecord(AOFRecord{Op: AOFOpDel, Key: key})
 }
 
-func (p *AOFPersister) appendLine(line []byte) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+func (p *AOFPersister) AppendExpireAt(key string, expiresAt int64) error {
+	return p.appendRecord(AOFRecord{Op: AOFOpExpireAt, Key: key, ExpiresAt: expiresAt})
+}
 
-	if err := p.openForAppendLocked(); err != nil {
-		return err
-	}
+func (p *AOFPersister) AppendPersist(key string) error {
+	return p.appendRecord(AOFRecord{Op: AOFOpPersist, Key: key})
+}
+
+// LastSeq returns the sequence number of the last record appended or
+// replayed.
+func (p *AOFPersister) LastSeq() int64 {
+	return p.seq.Load()
+}
 
-	if _, err := p.file.Write(line); err != nil {
+// Streams returns the number of streams the AOF is appended to.
+func (p *AOFPersister) Streams() int {
+	return len(p.streams)
+}
+
+func (p *AOFPersister) appendRecord(rec AOFRecord) error {
+	rec.Timestamp = time.Now().UnixMilli()
+	s, pos, err := p.writeRecord(rec)
+	if err != nil {
 		return err
 	}
-
-	if p.rewriting {
-		dup := make([]byte, len(line))
-		copy(dup, line)
-		p.incrBuf = append(p.incrBuf, dup)
+	if p.fsync == FsyncAlways {
+		return p.syncUpTo(s, pos)
 	}
-
-	p.maybeTriggerRewriteLocked()
 	return nil
 }
 
-func (p *AOFPersister) maybeTriggerRewriteLocked() {
-	if p.rewriteThreshold <= 0 || p.rewriting || p.file == nil {
-		return
+// writeRecord appends rec to the current incremental file of its stream and
+// returns the stream and the logical offset just past it.
+func (p *AOFPersister) writeRecord(rec AOFRecord) (*aofStream, int64, error) {
+	s := p.streamFor(rec.Key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		// Opening here would skip the caller's checks, such as not
+		// appending to an AOF that failed to load.
+		return s, 0, errAOFNotOpen
+	}
+
+	rec.Seq = p.seq.Add(1)
+	s.encBuf = appendRecord(s.encBuf[:0], s.fileFormat, s.fileCipher, rec)
+	if _, err := s.file.Write(s.encBuf); err != nil {
+		// Hand the number back unless another stream has taken a later one.
+		p.seq.CompareAndSwap(rec.Seq, rec.Seq-1)
+		return s, 0, err
+	}
+	n := int64(len(s.encBuf))
+	pos := s.written.Add(n)
+	if size := p.incrSize.Add(n); p.rewriteThreshold > 0 && size >= p.rewriteThreshold {
+		p.maybeTriggerRewrite()
 	}
-	st, err := p.file.Stat()
-	if err != nil || st.Size() < p.rewriteThreshold {
+	return s, pos, nil
+}
+
+func (p *AOFPersister) maybeTriggerRewrite() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rewriting || p.incrSize.Load() < p.rewriteThreshold {
 		return
 	}
 	p.rewriting = true
-	p.incrBuf = p.incrBuf[:0]
 	go p.rewrite()
 }
 
 func (p *AOFPersister) rewrite() {
-	tmpPath := p.path + ".rewrite.tmp"
-	if err := os.MkdirAll(filepath.Dir(p.path), 0o755); err != nil {
-		p.finishRewriteWithError(err)
-		return
+	_ = p.Rewrite()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rewriting = false
+}
+
+// StartRewrite starts a rewrite in the background, or returns
+// ErrAOFRewriteInProgress if one is already running or scheduled.
+func (p *AOFPersister) StartRewrite() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rewriting || !p.rewriteStartedAt.IsZero() {
+		return ErrAOFRewriteInProgress
 	}
+	p.rewriting = true
+	go p.rewrite()
+	return nil
+}
+
+// Rewrite compacts the AOF into a new base from the current contents of
+// storage and returns once the manifest refers to it. A rewrite already in
+// progress is waited for first.
+func (p *AOFPersister) Rewrite() error {
+	p.rewriteMu.Lock()
+	defer p.rewriteMu.Unlock()
+	start := time.Now()
+	p.mu.Lock()
+	p.rewriteStartedAt = start
+	p.mu.Unlock()
+	err := p.doRewrite()
+	p.finishRewrite(start, err)
+	return err
+}
 
-	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+func (p *AOFPersister) doRewrite() error {
+	// Switch appends to new incremental files and snapshot storage at the
+	// same instant. Everything before it is covered by the new base;
+	// everything after it is replayed on top.
+	p.lockAll()
+	incr, err := p.switchIncrLocked()
+	var snap *Snapshot
+	if err == nil {
+		snap = p.storage.Snapshot()
+		defer snap.Close()
+	}
+	seq := p.manifest.nextBaseSeq()
+	lastSeq := p.seq.Load()
+	p.unlockAll()
 	if err != nil {
-		p.finishRewriteWithError(err)
-		return
+		return err
 	}
 
-	now := time.Now().UnixMilli()
-	p.storage.Iterate(func(key string, entry Entry) bool {
-		if entry.ExpiresAt > 0 && entry.ExpiresAt <= now {
-			return true
-		}
-		line := fmt.Sprintf("SET\t%s\t%s\t%d\n", key, base64.StdEncoding.EncodeToString(entry.Value), entry.ExpiresAt)
-		_, err = tmp.WriteString(line)
-		return err == nil
-	})
+	// Writes apply to storage before they are appended, so the snapshot may
+	// already contain some of the records that land in the new incremental
+	// file. Replaying them again is harmless because every record sets
+	// absolute state: values and deadlines, never deltas.
+	base, err := p.writeBase(seq, snap, lastSeq)
 	if err != nil {
-		tmp.Close()
-		p.finishRewriteWithError(err)
-		return
+		return err
 	}
 
 	p.mu.Lock()
-	buf := make([][]byte, len(p.incrBuf))
-	copy(buf, p.incrBuf)
+	defer p.mu.Unlock()
+	prev := p.manifest
+	m, err := p.commitBaseLocked(base, incr)
+	if err != nil {
+		return err
+	}
+	return p.removeUnreferencedParts(m, prev)
+}
+
+// RestoreWith rewrites the AOF into a base holding the contents of src, for
+// a caller about to replace storage with src. The base is written first,
+// while appends go on. Then, holding writes and every append lock, appends
+// move to new incremental files listed after the base and swap is called to
+// replace storage. The records appended in between go with the old files,
+// which is right since the restore overwrites them. If anything fails, swap
+// is not called and the AOF still matches storage.
+func (p *AOFPersister) RestoreWith(src *ConcurrentMap, writes sync.Locker, swap func()) error {
+	p.rewriteMu.Lock()
+	defer p.rewriteMu.Unlock()
+	start := time.Now()
+	p.mu.Lock()
+	p.rewriteStartedAt = start
+	seq := p.manifest.nextBaseSeq()
 	p.mu.Unlock()
 
-	for _, line := range buf {
-		if _, err := tmp.Write(line); err != nil {
-			tmp.Close()
-			p.finishRewriteWithError(err)
-			return
-		}
+	snap := src.Snapshot()
+	defer snap.Close()
+	base, err := p.writeBase(seq, snap, p.seq.Load())
+	if err == nil {
+		err = p.switchToBase(base, writes, swap)
 	}
+	p.finishRewrite(start, err)
+	return err
+}
 
-	if err := tmp.Sync(); err != nil {
-		tmp.Close()
-		p.finishRewriteWithError(err)
-		return
+func (p *AOFPersister) switchToBase(base aofPart, writes sync.Locker, swap func()) error {
+	writes.Lock()
+	p.lockAll()
+	incr, err := p.switchIncrLocked()
+	var m, prev *aofManifest
+	if err == nil {
+		prev = p.manifest
+		m, err = p.commitBaseLocked(base, incr)
+	} else {
+		_ = os.Remove(filepath.Join(p.dir, base.Name))
 	}
-	if err := tmp.Close(); err != nil {
-		p.finishRewriteWithError(err)
-		return
+	if err == nil {
+		swap()
+	}
+	p.unlockAll()
+	writes.Unlock()
+	if err != nil {
+		return err
 	}
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if p.file != nil {
-		_ = p.file.Close()
-		p.file = nil
+	return p.removeUnreferencedParts(m, prev)
+}
+
+// writeBase writes snap as the base with sequence seq, including the records
+// up to lastSeq.
+func (p *AOFPersister) writeBase(seq int64, snap *Snapshot, lastSeq int64) (aofPart, error) {
+	base := aofPart{Name: p.partName(seq, "base.rdb"), Seq: seq, Type: aofTypeBase}
+	basePath := filepath.Join(p.dir, base.Name)
+	err := writeFileAtomic(basePath+".tmp", basePath, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		if err := encodeRDB(bw, snap, lastSeq, p.baseCompression, p.keys.current()); err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+	return base, err
+}
+
+// commitBaseLocked lists base in the manifest in place of the parts before
+// the incremental file incr and returns the new manifest. If that fails the
+// base is removed. The caller holds p.mu.
+func (p *AOFPersister) commitBaseLocked(base, incr aofPart) (*aofManifest, error) {
+	m := &aofManifest{Base: &base}
+	for _, pt := range p.manifest.Incrs {
+		if pt.Seq >= incr.Seq {
+			m.Incrs = append(m.Incrs, pt)
+		}
+	}
+	if err := writeAOFManifest(p.manifestPath(), m); err != nil {
+		_ = os.Remove(filepath.Join(p.dir, base.Name))
+		return nil, err
+	}
+	p.manifest = m
+	return m, nil
+}
+
+// switchIncrLocked makes the current incremental files durable and starts
+// appending to new ones. It returns the first of the new files. The caller
+// holds every lock.
+func (p *AOFPersister) switchIncrLocked() (aofPart, error) {
+	if err := p.openForAppendLocked(); err != nil {
+		return aofPart{}, err
+	}
+	for _, s := range p.streams {
+		if err := s.file.Sync(); err != nil {
+			return aofPart{}, err
+		}
+		s.synced.Store(s.written.Load())
+	}
+	part, err := p.startIncrsLocked()
+	if err != nil {
+		return part, err
+	}
+	p.incrSize.Store(0)
+	return part, nil
+}
+
+// startIncrsLocked creates a new incremental file for every stream, adds
+// them to the manifest and appends to them from now on. It returns the
+// first of them. The caller holds every lock.
+func (p *AOFPersister) startIncrsLocked() (aofPart, error) {
+	seq := p.manifest.nextIncrSeq()
+	files := make([]*os.File, 0, len(p.streams))
+	ciphers := make([]*fileCipher, 0, len(p.streams))
+	parts := make([]aofPart, 0, len(p.streams))
+	discard := func() {
+		for i, f := range files {
+			f.Close()
+			_ = os.Remove(filepath.Join(p.dir, parts[i].Name))
+		}
+	}
+	for _, s := range p.streams {
+		f, c, part, err := p.createIncrLocked(s, seq+int64(s.id))
+		if err != nil {
+			discard()
+			return part, err
+		}
+		files, ciphers, parts = append(files, f), append(ciphers, c), append(parts, part)
+	}
+	m := &aofManifest{Base: p.manifest.Base, Incrs: append(slices.Clone(p.manifest.Incrs), parts...)}
+	if err := writeAOFManifest(p.manifestPath(), m); err != nil {
+		discard()
+		return parts[0], err
+	}
+	for i, s := range p.streams {
+		if s.file != nil {
+			_ = s.file.Close()
+		}
+		s.file, s.fileFormat, s.fileCipher = files[i], p.format, ciphers[i]
+	}
+	p.manifest = m
+	return parts[0], nil
+}
+
+func (p *AOFPersister) finishRewrite(start time.Time, err error) {
+	took := time.Since(start)
+	p.mu.Lock()
+	p.rewriteStartedAt = time.Time{}
+	p.rewrites++
+	if err != nil {
+		p.rewriteFailures++
 	}
-	_ = os.Remove(p.path)
-	if err := os.Rename(tmpPath, p.path); err != nil {
-		p.rewriting = false
+	p.lastRewriteAt, p.lastRewriteTook, p.lastRewriteErr = time.Now(), took, err
+	p.mu.Unlock()
+
+	if err != nil {
+		slog.Error("aof rewrite failed", "duration_ms", took.Milliseconds(), "error", err)
 		return
 	}
-	_ = p.openForAppendLocked()
-	p.rewriting = false
-	p.incrBuf = nil
+	slog.Info("aof rewrite finished", "duration_ms", took.Milliseconds())
+}
+
+// AOFRewriteStatus describes the rewrites of the AOF. StartedAt is set while
+// a rewrite runs; the Last fields describe the one that finished last and
+// are zero until then. BaseSize is the size of the base, CurrentSize that of
+// all parts together and IncrSize that of the incremental files since the
+// last rewrite, which triggers a rewrite once it reaches RewriteThreshold.
+type AOFRewriteStatus struct {
+	InProgress       bool
+	StartedAt        time.Time
+	Rewrites         int64
+	Failures         int64
+	LastAt           time.Time
+	LastDuration     time.Duration
+	LastErr          error
+	BaseSize         int64
+	CurrentSize      int64
+	IncrSize         int64
+	RewriteThreshold int64
 }
 
-func (p *AOFPersister) finishRewriteWithError(_ error) {
+func (p *AOFPersister) RewriteStatus() AOFRewriteStatus {
 	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.rewriting = false
-	p.incrBuf = nil
+	st := AOFRewriteStatus{
+		InProgress:       p.rewriting || !p.rewriteStartedAt.IsZero(),
+		StartedAt:        p.rewriteStartedAt,
+		Rewrites:         p.rewrites,
+		Failures:         p.rewriteFailures,
+		LastAt:           p.lastRewriteAt,
+		LastDuration:     p.lastRewriteTook,
+		LastErr:          p.lastRewriteErr,
+		IncrSize:         p.incrSize.Load(),
+		RewriteThreshold: p.rewriteThreshold,
+	}
+	m := p.manifest
+	p.mu.Unlock()
+
+	// Manifests are replaced, never modified, so m can be read unlocked.
+	if m != nil {
+		for _, pt := range m.parts() {
+			info, err := os.Stat(filepath.Join(p.dir, pt.Name))
+			if err != nil {
+				continue
+			}
+			st.CurrentSize += info.Size()
+			if pt.Type == aofTypeBase {
+				st.BaseSize = info.Size()
+			}
+		}
+	}
+	return st
+}
+
+// AOFReplayResult describes what a replay applied. BaseEntries counts the
+// entries loaded from an RDB-encoded base, Records the records applied from
+// the other parts and Skipped those already covered by a snapshot. FirstSeq
+// and LastSeq bound the sequence numbers of the applied records. Damage lists
+// the damaged stretches that were dropped.
+type AOFReplayResult struct {
+	BaseEntries int
+	Records     int
+	Skipped     int
+	FirstSeq    int64
+	LastSeq     int64
+	Damage      []AOFReplayDamage
+}
+
+// AOFReplayDamage is damage dropped from the AOF file File during replay.
+// Truncated is set if the file was cut at the damage, and unset if the
+// damaged bytes were skipped and left in place.
+type AOFReplayDamage struct {
+	File string
+	Damage
+	Truncated bool
 }
 
+// Replay applies the whole AOF to storage and returns the number of entries
+// and records loaded. See ReplayAfter.
 func (p *AOFPersister) Replay() (int, error) {
-	if _, err := os.Stat(p.path); errors.Is(err, os.ErrNotExist) {
+	res, err := p.ReplayAfter(0)
+	return res.BaseEntries + res.Records, err
+}
+
+// BaseSeq returns the last sequence number included in the RDB-encoded base
+// of the AOF, or 0 if the AOF has none.
+func (p *AOFPersister) BaseSeq() (int64, error) {
+	m, err := loadAOFManifest(p.manifestPath())
+	if errors.Is(err, os.ErrNotExist) {
 		return 0, nil
 	}
-
-	f, err := os.OpenFile(p.path, os.O_RDWR, 0o644)
 	if err != nil {
 		return 0, err
 	}
-	defer f.Close()
-
-	reader := bufio.NewReader(f)
-	var (
-		offset         int64
-		lastGoodOffset int64
-		loaded         int
-	)
+	if m.Base == nil || !m.Base.isRDB() {
+		return 0, nil
+	}
+	return readRDBLastSeq(filepath.Join(p.dir, m.Base.Name))
+}
 
+// ReplayAfter applies the AOF to storage, skipping the records with sequence
+// number at most after, which a snapshot already loaded into storage
+// includes. The base is skipped if it includes no more than after; callers
+// check BaseSeq first. The streams of a generation of incremental files are
+// replayed concurrently. A record cut short at the end of the last file of
+// a stream is always truncated away; other damage is handled according to
+// LoadCorrupt. Appends continue numbering after the highest sequence number
+// seen, or after if that is higher.
+func (p *AOFPersister) ReplayAfter(after int64) (AOFReplayResult, error) {
+	var res AOFReplayResult
+	err := p.replayAfter(after, &res)
 	for {
-		line, err := reader.ReadString('\n')
-		if err != nil && !errors.Is(err, io.EOF) {
-			return loaded, err
-		}
-		if line != "" {
-			offset += int64(len(line))
-			if parseErr := p.applyLine(strings.TrimRight(line, "\r\n")); parseErr != nil {
-				if trErr := f.Truncate(lastGoodOffset); trErr != nil {
-					return loaded, trErr
-				}
-				break
-			}
-			lastGoodOffset = offset
-			loaded++
-		}
-		if errors.Is(err, io.EOF) {
-			break
+		seq := p.seq.Load()
+		if p.seq.CompareAndSwap(seq, max(seq, after, res.LastSeq)) {
+			return res, err
 		}
 	}
-	return loaded, nil
 }
 
-func (p *AOFPersister) applyLine(line string) error {
-	if line == "" {
-		return nil
+func (p *AOFPersister) replayAfter(after int64, res *AOFReplayResult) error {
+	m, err := loadAOFManifest(p.manifestPath())
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(p.path); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return p.replayFile(p.path, true, after, res)
 	}
-	parts := strings.Split(line, "\t")
-	if len(parts) < 2 {
-		return fmt.Errorf("invalid aof line")
+	if err != nil {
+		return err
 	}
-	switch parts[0] {
-	case "SET":
-		if len(parts) != 4 {
-			return fmt.Errorf("invalid set line")
+
+	if pt := m.Base; pt != nil {
+		path := filepath.Join(p.dir, pt.Name)
+		if pt.isRDB() {
+			err = p.loadRDBPart(path, after, res)
+		} else {
+			err = p.replayFile(path, len(m.Incrs) == 0, after, res)
 		}
-		value, err := base64.StdEncoding.DecodeString(parts[2])
 		if err != nil {
+			return fmt.Errorf("%s: %w", pt.Name, err)
+		}
+	}
+	gens := m.generations()
+	for i, gen := range gens {
+		if err := p.replayGeneration(gen, i == len(gens)-1, after, res); err != nil {
 			return err
 		}
-		expiresAt, err := strconv.ParseInt(parts[3], 10, 64)
+	}
+	return nil
+}
+
+// replayGeneration replays the streams of a generation of incremental files
+// concurrently. latest is set for the last generation, whose files were
+// appended to last.
+func (p *AOFPersister) replayGeneration(gen []aofPart, latest bool, after int64, res *AOFReplayResult) error {
+	streams := make([][]aofPart, gen[0].layout())
+	for _, pt := range gen {
+		streams[pt.Stream] = append(streams[pt.Stream], pt)
+	}
+	results := make([]AOFReplayResult, len(streams))
+	errs := make([]error, len(streams))
+	var wg sync.WaitGroup
+	for k, parts := range streams {
+		wg.Go(func() {
+			for i, pt := range parts {
+				last := latest && i == len(parts)-1
+				if err := p.replayFile(filepath.Join(p.dir, pt.Name), last, after, &results[k]); err != nil {
+					errs[k] = fmt.Errorf("%s: %w", pt.Name, err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	for _, r := range results {
+		res.merge(r)
+	}
+	return errors.Join(errs...)
+}
+
+func (r *AOFReplayResult) merge(o AOFReplayResult) {
+	r.BaseEntries += o.BaseEntries
+	r.Records += o.Records
+	r.Skipped += o.Skipped
+	if o.FirstSeq > 0 && (r.FirstSeq == 0 || o.FirstSeq < r.FirstSeq) {
+		r.FirstSeq = o.FirstSeq
+	}
+	r.LastSeq = max(r.LastSeq, o.LastSeq)
+	r.Damage = append(r.Damage, o.Damage...)
+}
+
+func (p *AOFPersister) loadRDBPart(path string, after int64, res *AOFReplayResult) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if after > 0 {
+		h, err := readRDBHeader(br)
 		if err != nil {
 			return err
 		}
-		if expiresAt > 0 && expiresAt <= time.Now().UnixMilli() {
-			return nil
+		if h.lastSeq > after {
+			return fmt.Errorf("base includes records up to %d, beyond %d", h.lastSeq, after)
 		}
-		p.storage.Set(parts[1], value, expiresAt)
-	case "DEL":
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid del line")
+		res.LastSeq = max(res.LastSeq, h.lastSeq)
+		return nil
+	}
+	n, baseSeq, err := decodeRDB(br, p.storage, p.keys)
+	res.BaseEntries += n
+	res.LastSeq = max(res.LastSeq, baseSeq)
+	return err
+}
+
+func (p *AOFPersister) replayFile(path string, last bool, after int64, res *AOFReplayResult) error {
+	flag := os.O_RDONLY
+	if last {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	policy := p.loadCorrupt
+	if !last && policy == CorruptTruncate {
+		policy = CorruptFail
+	}
+	scan, err := ScanAOF(f, policy, p.keys, func(rec AOFRecord) {
+		if after > 0 && rec.Seq <= after {
+			res.Skipped++
+			return
+		}
+		applyAOFRecord(p.storage, rec)
+		res.Records++
+		if rec.Seq > 0 {
+			if res.FirstSeq == 0 {
+				res.FirstSeq = rec.Seq
+			}
+			res.LastSeq = max(res.LastSeq, rec.Seq)
+		}
+	})
+	if err != nil || len(scan.Damage) == 0 {
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	for i, d := range scan.Damage {
+		// Damage running to the end of the file ends the scan; in the last
+		// file that is a torn write or the tail the policy gives up.
+		tail := i == len(scan.Damage)-1 && d.Offset+d.Length == st.Size()
+		if !last && policy == CorruptFail {
+			return fmt.Errorf("offset %d: %w: %v", d.Offset, ErrAOFCorrupt, d.Err)
+		}
+		res.Damage = append(res.Damage, AOFReplayDamage{File: filepath.Base(path), Damage: d, Truncated: last && tail})
+		if last && tail {
+			return f.Truncate(d.Offset)
 		}
-		p.storage.Delete(parts[1])
-	default:
-		return fmt.Errorf("invalid aof op")
 	}
 	return nil
 }
 
+func applyAOFRecord(storage *ConcurrentMap, rec AOFRecord) {
+	switch rec.Op {
+	case AOFOpSet:
+		// Expired records are still applied so they override older values of
+		// the same key; the caller purges them once replay is complete.
+		storage.SetEntry(rec.Key, Entry{Value: rec.Value, ExpiresAt: rec.ExpiresAt, Meta: rec.Meta})
+	case AOFOpDel:
+		storage.Delete(rec.Key)
+	case AOFOpExpireAt:
+		storage.restoreExpiry(rec.Key, rec.ExpiresAt)
+	case AOFOpPersist:
+		storage.restoreExpiry(rec.Key, 0)
+	}
+}
+
 func (p *AOFPersister) Sync() error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	if p.file == nil {
-		return nil
+	var errs []error
+	for _, s := range p.streams {
+		s.syncMu.Lock()
+		errs = append(errs, p.syncLocked(s))
+		s.syncMu.Unlock()
 	}
-	return p.file.Sync()
+	return errors.Join(errs...)
 }
 
 func (p *AOFPersister) Close() error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	if p.file == nil {
-		return nil
+	p.stopBackgroundSync()
+
+	p.lockAll()
+	defer p.unlockAll()
+	p.closed = true
+	var errs []error
+	for _, s := range p.streams {
+		if s.file != nil {
+			errs = append(errs, s.file.Close())
+			s.file = nil
+		}
 	}
-	err := p.file.Close()
-	p.file = nil
-	return err
+	return errors.Join(errs...)
 }
@@ -1,19 +1,41 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// newOpenAOFPersister returns a persister opened for append, closed at the
+// end of the test if it still is open.
+func newOpenAOFPersister(t *testing.T, opts AOFOptions, storage *ConcurrentMap) *AOFPersister {
+	t.Helper()
+	p := NewAOFPersister(opts, storage)
+	if err := p.OpenForAppend(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
 func TestAOFReplay(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "appendonly.aof")
 
 	cm := NewConcurrentMap(16)
-	p := NewAOFPersister(path, 1024*1024, cm)
+	p := NewAOFPersister(AOFOptions{Path: path, RewriteThreshold: 1024 * 1024}, cm)
 	if err := p.OpenForAppend(); err != nil {
 		t.Fatal(err)
 	}
@@ -31,7 +53,7 @@ func TestAOFReplay(t *testing.T) {
 	}
 
 	recovered := NewConcurrentMap(16)
-	p2 := NewAOFPersister(path, 1024*1024, recovered)
+	p2 := NewAOFPersister(AOFOptions{Path: path, RewriteThreshold: 1024 * 1024}, recovered)
 	n, err := p2.Replay()
 	if err != nil {
 		t.Fatal(err)
@@ -57,8 +79,9 @@ func TestAOFTruncateOnCorruption(t *testing.T) {
 	}
 
 	cm := NewConcurrentMap(16)
-	p := NewAOFPersister(path, 1024*1024, cm)
-	if _, err := p.Replay(); err != nil {
+	p := NewAOFPersister(AOFOptions{Path: path, RewriteThreshold: 1024 * 1024, LoadCorrupt: CorruptTruncate}, cm)
+	res, err := p.ReplayAfter(0)
+	if err != nil {
 		t.Fatal(err)
 	}
 
@@ -68,6 +91,9 @@ func TestAOFTruncateOnCorruption(t *testing.T) {
 	if cm.Exists("k2") {
 		t.Fatal("k2 should not be replayed after corruption")
 	}
+	if len(res.Damage) != 1 || !res.Damage[0].Truncated || res.Damage[0].Offset != 14 || res.Damage[0].Length != int64(len(content)-14) {
+		t.Fatalf("unexpected damage report %+v", res.Damage)
+	}
 
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -86,21 +112,1417 @@ func TestRDBSaveLoad(t *testing.T) {
 	orig.Set("k1", []byte("v1"), 0)
 	orig.Set("k2", []byte("v2"), time.Now().Add(2*time.Second).UnixMilli())
 
-	rdb := NewRDBManager(path)
-	if _, err := rdb.Save(orig); err != nil {
+	rdb := NewRDBManager(RDBOptions{Path: path})
+	if _, err := rdb.Save(orig, 42); err != nil {
 		t.Fatal(err)
 	}
+	if seq, err := rdb.LastSeq(); err != nil || seq != 42 {
+		t.Fatalf("expected last seq 42, got %d (%v)", seq, err)
+	}
 
 	restored := NewConcurrentMap(16)
-	n, err := rdb.Load(restored)
+	n, seq, err := rdb.Load(restored)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if n != 2 {
-		t.Fatalf("expected 2 entries loaded, got %d", n)
+	if n != 2 || seq != 42 {
+		t.Fatalf("expected 2 entries up to seq 42 loaded, got %d up to %d", n, seq)
 	}
 	v, _, ok := restored.Get("k1")
 	if !ok || string(v) != "v1" {
 		t.Fatal("k1 should be restored from rdb")
 	}
 }
+
+func TestRDBLoadsLegacyGobSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.rdb")
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode([]rdbEntry{{Key: "k", Value: []byte("v")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := NewConcurrentMap(16)
+	n, seq, err := NewRDBManager(RDBOptions{Path: path}).Load(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || seq != 0 {
+		t.Fatalf("expected 1 entry without sequence, got %d up to %d", n, seq)
+	}
+	if v, _, ok := cm.Get("k"); !ok || string(v) != "v" {
+		t.Fatal("k should be restored from legacy rdb")
+	}
+}
+
+func TestRDBSectionedFormatRoundTrip(t *testing.T) {
+	for _, compression := range []RDBCompression{RDBCompressionNone, RDBCompressionDeflate} {
+		t.Run(compression.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dump.rdb")
+
+			// A single shard large enough to be split into several sections.
+			orig := NewConcurrentMap(1)
+			value := bytes.Repeat([]byte("x"), 400)
+			deadline := time.Now().Add(time.Hour).UnixMilli()
+			for i := 0; i < 4000; i++ {
+				orig.Set(fmt.Sprintf("key:%d", i), value, deadline)
+			}
+			orig.Set("expired", []byte("v"), time.Now().Add(-time.Second).UnixMilli())
+
+			rdb := NewRDBManager(RDBOptions{Path: path, Compression: compression})
+			if _, err := rdb.Save(orig, 7); err != nil {
+				t.Fatal(err)
+			}
+
+			restored := NewConcurrentMap(16)
+			n, seq, err := rdb.Load(restored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 4000 || seq != 7 || restored.Keys() != 4000 {
+				t.Fatalf("expected 4000 entries up to seq 7, got %d (%d keys) up to %d", n, restored.Keys(), seq)
+			}
+			v, expiresAt, ok := restored.Get("key:1234")
+			if !ok || !bytes.Equal(v, value) || expiresAt != deadline {
+				t.Fatal("key:1234 should be restored with its value and deadline")
+			}
+			if restored.Exists("expired") {
+				t.Fatal("expired entries should not be saved")
+			}
+		})
+	}
+}
+
+func TestRDBDetectsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	orig := NewConcurrentMap(4)
+	for i := 0; i < 100; i++ {
+		orig.Set(fmt.Sprintf("k%d", i), []byte("value"), 0)
+	}
+	rdb := NewRDBManager(RDBOptions{Path: path})
+	path, err := rdb.Save(orig, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)/2] ^= 0xff
+	if err := os.WriteFile(path, flipped, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rdb.Load(NewConcurrentMap(4)); !errors.Is(err, ErrRDBCorrupt) {
+		t.Fatalf("expected ErrRDBCorrupt for a flipped byte, got %v", err)
+	}
+
+	if err := os.WriteFile(path, data[:len(data)-2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rdb.Load(NewConcurrentMap(4)); !errors.Is(err, ErrRDBCorrupt) {
+		t.Fatalf("expected ErrRDBCorrupt for a truncated file, got %v", err)
+	}
+}
+
+func TestRDBRetentionAndListing(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.rdb")
+
+	// A snapshot from before timestamped names is listed like the others.
+	legacy := NewConcurrentMap(4)
+	legacy.Set("old", []byte("v"), 0)
+	if _, err := NewRDBManager(RDBOptions{Path: path}).Save(legacy, 0); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := filepath.Glob(filepath.Join(dir, "dump-*.rdb"))
+	if err := os.Rename(first[0], path); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	rdb := NewRDBManager(RDBOptions{Path: path, KeepLast: 2})
+	cm := NewConcurrentMap(4)
+	var saved []string
+	for i := 0; i < 3; i++ {
+		cm.Set(fmt.Sprintf("k%d", i), []byte("v"), 0)
+		p, err := rdb.Save(cm, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, p)
+	}
+
+	snaps, err := rdb.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 2 || snaps[0].Path != saved[2] || snaps[1].Path != saved[1] {
+		t.Fatalf("expected the two newest snapshots, got %+v", snaps)
+	}
+	if snaps[0].Keys != 3 || snaps[1].Keys != 2 || snaps[0].Size == 0 {
+		t.Fatalf("unexpected snapshot details %+v", snaps)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("the legacy snapshot should have been removed by retention")
+	}
+
+	restored := NewConcurrentMap(4)
+	if n, _, err := rdb.LoadSnapshot(snaps[1].ID, restored); err != nil || n != 2 {
+		t.Fatalf("expected 2 entries from %s, got %d (%v)", snaps[1].ID, n, err)
+	}
+	if _, _, err := rdb.LoadSnapshot("../dump", restored); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected ErrSnapshotNotFound, got %v", err)
+	}
+}
+
+func TestAOFReplayExpiryRecords(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "appendonly.aof")
+
+	cm := NewConcurrentMap(16)
+	p := NewAOFPersister(AOFOptions{Path: path, RewriteThreshold: 1024 * 1024}, cm)
+	if err := p.OpenForAppend(); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Second).UnixMilli()
+	future := time.Now().Add(time.Hour).UnixMilli()
+	// "extended" had a deadline that has passed by replay time, but a later
+	// record pushed it into the future.
+	if err := p.AppendSet("extended", []byte("v"), past); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendExpireAt("extended", future); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendSet("persisted", []byte("v"), future); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendPersist("persisted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := NewConcurrentMap(16)
+	if _, err := NewAOFPersister(AOFOptions{Path: path, RewriteThreshold: 1024 * 1024}, recovered).Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if _, expiresAt, ok := recovered.Get("extended"); !ok || expiresAt != future {
+		t.Fatalf("extended should be live with the later deadline, got %d (%v)", expiresAt, ok)
+	}
+	if _, expiresAt, ok := recovered.Get("persisted"); !ok || expiresAt != 0 {
+		t.Fatalf("persisted should have no expiry, got %d (%v)", expiresAt, ok)
+	}
+}
+
+func TestAOFFsyncAlwaysGroupsConcurrentAppends(t *testing.T) {
+	dir := t.TempDir()
+	p := NewAOFPersister(AOFOptions{Path: filepath.Join(dir, "appendonly.aof"), Fsync: FsyncAlways}, NewConcurrentMap(16))
+	if err := p.OpenForAppend(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Hold the sync lock as if a previous fsync were still running, so every
+	// writer queues behind it.
+	p.streams[0].syncMu.Lock()
+	const writers = 20
+	errCh := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			errCh <- p.AppendSet(fmt.Sprintf("k%d", i), []byte("v"), 0)
+		}(i)
+	}
+	for countRecords(t, incrPath(dir, 1)) < writers {
+		time.Sleep(time.Millisecond)
+	}
+	p.streams[0].syncMu.Unlock()
+
+	for i := 0; i < writers; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := p.Stats()
+	if st.Fsyncs != 1 {
+		t.Fatalf("expected a single group fsync, got %d", st.Fsyncs)
+	}
+	if st.PendingBytes != 0 {
+		t.Fatalf("expected no pending bytes, got %d", st.PendingBytes)
+	}
+}
+
+func TestAOFFsyncNoLeavesBytesPending(t *testing.T) {
+	dir := t.TempDir()
+	p := NewAOFPersister(AOFOptions{Path: filepath.Join(dir, "appendonly.aof"), Fsync: FsyncNo}, NewConcurrentMap(16))
+	if err := p.OpenForAppend(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err := p.AppendSet("k", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.Stats(); st.Fsyncs != 0 || st.PendingBytes == 0 {
+		t.Fatalf("expected pending bytes without fsync, got %+v", st)
+	}
+	if err := p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.Stats(); st.Fsyncs != 1 || st.PendingBytes != 0 {
+		t.Fatalf("expected explicit sync to flush, got %+v", st)
+	}
+}
+
+func TestAOFRewriteKeepsConcurrentAppends(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "appendonly.aof")
+	cm := NewConcurrentMap(16)
+	p := NewAOFPersister(AOFOptions{Path: path, RewriteThreshold: 512, Fsync: FsyncNo}, cm)
+	if err := p.OpenForAppend(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("k%d", i%50)
+		value := []byte(fmt.Sprintf("v%d", i))
+		cm.Set(key, value, 0)
+		if err := p.AppendSet(key, value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		p.mu.Lock()
+		rewriting := p.rewriting
+		p.mu.Unlock()
+		if !rewriting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "appendonlydir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]int{}
+	for _, e := range entries {
+		kinds[filepath.Ext(strings.TrimSuffix(e.Name(), filepath.Ext(e.Name())))+filepath.Ext(e.Name())]++
+	}
+	if len(entries) != 3 || kinds[".base.rdb"] != 1 || kinds[".incr.aof"] != 1 || kinds[".aof.manifest"] != 1 {
+		t.Fatalf("expected one base, one incremental file and the manifest after rewrite, got %v", kinds)
+	}
+
+	recovered := NewConcurrentMap(16)
+	if _, err := NewAOFPersister(AOFOptions{Path: path}, recovered).Replay(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 450; i < 500; i++ {
+		key := fmt.Sprintf("k%d", i%50)
+		if v, _, ok := recovered.Get(key); !ok || string(v) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("%s: expected v%d, got %q (%v)", key, i, v, ok)
+		}
+	}
+}
+
+func incrPath(dir string, seq int) string {
+	return filepath.Join(dir, "appendonlydir", fmt.Sprintf("appendonly.aof.%d.incr.aof", seq))
+}
+
+func countRecords(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ar, err := NewAOFReader(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		if _, err := ar.Next(); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+func TestAOFLoadCorruptPolicies(t *testing.T) {
+	content := "SET\tk1\tdjE=\t0\nBROKEN\tline\nSET\tk2\tdjI=\t0\n"
+	replay := func(policy CorruptPolicy) (*ConcurrentMap, AOFReplayResult, error, string) {
+		path := filepath.Join(t.TempDir(), "appendonly.aof")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cm := NewConcurrentMap(16)
+		res, err := NewAOFPersister(AOFOptions{Path: path, LoadCorrupt: policy}, cm).ReplayAfter(0)
+		data, readErr := os.ReadFile(path)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		return cm, res, err, string(data)
+	}
+
+	cm, res, err, data := replay(CorruptSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cm.Exists("k1") || !cm.Exists("k2") || res.Records != 2 {
+		t.Fatalf("skip should apply the records around the bad line, got %d", res.Records)
+	}
+	if len(res.Damage) != 1 || res.Damage[0].Truncated || res.Damage[0].Length != int64(len("BROKEN\tline\n")) || data != content {
+		t.Fatalf("skip should leave the file alone, got %+v", res.Damage)
+	}
+
+	cm, _, err, data = replay(CorruptFail)
+	if !errors.Is(err, ErrAOFCorrupt) {
+		t.Fatalf("expected ErrAOFCorrupt, got %v", err)
+	}
+	if !cm.Exists("k1") || cm.Exists("k2") || data != content {
+		t.Fatal("fail should stop at the bad line and leave the file alone")
+	}
+
+	// A torn last line is cut off under every policy.
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(path, []byte("SET\tk1\tdjE=\t0\nSET\tk2"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err = NewAOFPersister(AOFOptions{Path: path, LoadCorrupt: CorruptFail}, NewConcurrentMap(16)).ReplayAfter(0)
+	if err != nil || len(res.Damage) != 1 || !res.Damage[0].Truncated {
+		t.Fatalf("expected the torn line to be truncated, got %+v (%v)", res.Damage, err)
+	}
+}
+
+func TestAOFBinaryFormatStopsAtChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "appendonly.aof")
+
+	p := newOpenAOFPersister(t, AOFOptions{Path: path}, NewConcurrentMap(16))
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if err := p.AppendSet(key, []byte("value-"+key), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(incrPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), aofMagic) {
+		t.Fatal("binary aof should start with the magic header")
+	}
+	// Flip a bit in the value of the second record.
+	idx := strings.Index(string(data), "value-k2")
+	data[idx] ^= 0x01
+	if err := os.WriteFile(incrPath(dir, 1), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := NewConcurrentMap(16)
+	n, err := NewAOFPersister(AOFOptions{Path: path}, cm).Replay()
+	if !errors.Is(err, ErrAOFCorrupt) {
+		t.Fatalf("expected ErrAOFCorrupt, got %v", err)
+	}
+	if n != 1 || !cm.Exists("k1") || cm.Exists("k2") {
+		t.Fatalf("expected only k1 to be replayed, got %d records", n)
+	}
+	after, err := os.ReadFile(incrPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(data) {
+		t.Fatal("a checksum mismatch must not truncate the file")
+	}
+}
+
+func TestAOFBinaryFormatTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "appendonly.aof")
+
+	p := newOpenAOFPersister(t, AOFOptions{Path: path}, NewConcurrentMap(16))
+	if err := p.AppendSet("k1", []byte("v1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendSet("k2", []byte("v2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(incrPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(incrPath(dir, 1), st.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := NewConcurrentMap(16)
+	n, err := NewAOFPersister(AOFOptions{Path: path}, cm).Replay()
+	if err != nil || n != 1 || !cm.Exists("k1") {
+		t.Fatalf("expected k1 to be replayed, got %d records (%v)", n, err)
+	}
+	after, err := os.Stat(incrPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= st.Size()-3 {
+		t.Fatal("torn record should be truncated")
+	}
+}
+
+func TestAOFBinaryFormatSkipsRepeatedDamage(t *testing.T) {
+	data := aofHeader(nil)
+	for i := range 100 {
+		start := len(data)
+		data = appendRecord(data, AOFFormatBinary, nil, AOFRecord{Op: AOFOpSet, Key: fmt.Sprintf("k%d", i), Value: []byte("v"), Seq: int64(i + 1)})
+		if i%2 == 1 {
+			data[start+4] ^= 0xff
+		}
+	}
+
+	ar, err := NewAOFReader(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, skips := 0, 0
+	for {
+		_, err := ar.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, ErrAOFCorrupt) {
+			if _, err := ar.SkipCorrupt(); err != nil {
+				t.Fatal(err)
+			}
+			skips++
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		good++
+	}
+	if good != 50 || skips != 50 || ar.Offset() != int64(len(data)) {
+		t.Fatalf("expected 50 records and 50 skips over %d bytes, got %d and %d over %d", len(data), good, skips, ar.Offset())
+	}
+	// Every skip reuses the one resync buffer rather than stacking another.
+	if src, ok := ar.resync.src.(*bufio.Reader); !ok || src.Size() == aofResyncBuffer {
+		t.Fatalf("expected the resync buffer to read the file directly, got %T", ar.resync.src)
+	}
+}
+
+func TestAOFAppendFailsUnlessOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	p := NewAOFPersister(AOFOptions{Path: path}, NewConcurrentMap(16))
+	if err := p.AppendSet("k", []byte("v"), 0); !errors.Is(err, errAOFNotOpen) {
+		t.Fatalf("expected an append before OpenForAppend to fail, got %v", err)
+	}
+	if err := p.OpenForAppend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendSet("k", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendSet("k", []byte("v"), 0); !errors.Is(err, errAOFNotOpen) {
+		t.Fatalf("expected an append after Close to fail, got %v", err)
+	}
+	if err := p.OpenForAppend(); !errors.Is(err, errAOFClosed) {
+		t.Fatalf("expected OpenForAppend after Close to fail, got %v", err)
+	}
+	if n, err := NewAOFPersister(AOFOptions{Path: path}, NewConcurrentMap(16)).Replay(); err != nil || n != 1 {
+		t.Fatalf("expected 1 record, got %d (%v)", n, err)
+	}
+}
+
+func TestAOFMigratesSingleFileAOF(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "appendonly.aof")
+	if err := os.WriteFile(path, []byte("SET\tk1\tdjE=\t0\nSET\tk2\tdjI=\t0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := NewConcurrentMap(16)
+	p := NewAOFPersister(AOFOptions{Path: path}, cm)
+	if n, err := p.Replay(); err != nil || n != 2 {
+		t.Fatalf("expected 2 records from the single-file aof, got %d (%v)", n, err)
+	}
+	if err := p.OpenForAppend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendDel("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("single-file aof should be moved into the aof directory")
+	}
+	manifest, err := os.ReadFile(filepath.Join(dir, "appendonlydir", "appendonly.aof.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "file appendonly.aof.1.base.aof seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n"
+	if string(manifest) != want {
+		t.Fatalf("unexpected manifest:\n%s", manifest)
+	}
+
+	recovered := NewConcurrentMap(16)
+	if _, err := NewAOFPersister(AOFOptions{Path: path}, recovered).Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if recovered.Exists("k1") || !recovered.Exists("k2") {
+		t.Fatal("replay should apply the migrated base and then the incremental file")
+	}
+}
+
+func TestConvertAOFRoundTrip(t *testing.T) {
+	text := "SET\tk1\tdjE=\t0\nPEXPIREAT\tk1\t4102444800000\nSET\tk2\tdjI=\t0\nPERSIST\tk1\nDEL\tk2\n"
+
+	var bin bytes.Buffer
+	n, err := ConvertAOF(&bin, strings.NewReader(text), AOFFormatBinary, nil)
+	if err != nil || n != 5 {
+		t.Fatalf("expected 5 records converted, got %d (%v)", n, err)
+	}
+	if !bytes.HasPrefix(bin.Bytes(), []byte(aofMagic)) {
+		t.Fatal("binary output should start with the magic header")
+	}
+
+	var back bytes.Buffer
+	if _, err := ConvertAOF(&back, &bin, AOFFormatText, nil); err != nil {
+		t.Fatal(err)
+	}
+	if back.String() != text {
+		t.Fatalf("round trip mismatch:\n%q\n%q", back.String(), text)
+	}
+}
+
+func TestAOFTextFormatBinarySafeKeys(t *testing.T) {
+	dir := t.TempDir()
+	opts := AOFOptions{Path: filepath.Join(dir, "appendonly.aof"), Format: AOFFormatText}
+	keys := []string{"plain", "tab\tkey", "line\nbreak\r", "\xff\x00bin", "key=base64"}
+	p := newOpenAOFPersister(t, opts, NewConcurrentMap(16))
+	for i, key := range keys {
+		if err := p.AppendSet(key, []byte(fmt.Sprintf("v%d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.AppendDel("tab\tkey"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := AOFManifestFiles(p.manifestPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(files[len(files)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != len(keys)+1 {
+		t.Fatalf("expected %d lines, got %d:\n%s", len(keys)+1, lines, data)
+	}
+	if !strings.Contains(string(data), "SET\tplain\t") || !strings.Contains(string(data), "SET\tkey=base64\t") {
+		t.Fatalf("expected safe keys to stay readable:\n%s", data)
+	}
+
+	recovered := NewConcurrentMap(16)
+	if n, err := NewAOFPersister(opts, recovered).Replay(); err != nil || n != len(keys)+1 {
+		t.Fatalf("expected %d records, got %d (%v)", len(keys)+1, n, err)
+	}
+	for i, key := range keys {
+		v, _, ok := recovered.Get(key)
+		if key == "tab\tkey" {
+			if ok {
+				t.Fatalf("%q should have been deleted", key)
+			}
+			continue
+		}
+		if !ok || string(v) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("%q: expected v%d, got %q (%v)", key, i, v, ok)
+		}
+	}
+}
+
+func TestAOFRemovesUnreferencedParts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "appendonly.aof")
+	p := newOpenAOFPersister(t, AOFOptions{Path: path}, NewConcurrentMap(16))
+	if err := p.AppendSet("k", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leftovers of a rewrite interrupted before the manifest switched.
+	aofDir := filepath.Join(dir, "appendonlydir")
+	for _, name := range []string{"appendonly.aof.1.base.rdb", "appendonly.aof.2.base.rdb.tmp", "unrelated.txt"} {
+		if err := os.WriteFile(filepath.Join(aofDir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p2 := NewAOFPersister(AOFOptions{Path: path}, NewConcurrentMap(16))
+	if err := p2.OpenForAppend(); err != nil {
+		t.Fatal(err)
+	}
+	defer p2.Close()
+	for _, name := range []string{"appendonly.aof.1.base.rdb", "appendonly.aof.2.base.rdb.tmp"} {
+		if _, err := os.Stat(filepath.Join(aofDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s should have been removed", name)
+		}
+	}
+	for _, name := range []string{"unrelated.txt", "appendonly.aof.1.incr.aof", "appendonly.aof.manifest"} {
+		if _, err := os.Stat(filepath.Join(aofDir, name)); err != nil {
+			t.Fatalf("%s should be kept: %v", name, err)
+		}
+	}
+}
+
+func TestAOFReplayAfterSkipsSnapshottedRecords(t *testing.T) {
+	for _, format := range []AOFFormat{AOFFormatBinary, AOFFormatText} {
+		t.Run(format.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			opts := AOFOptions{Path: filepath.Join(dir, "appendonly.aof"), Format: format}
+
+			p := newOpenAOFPersister(t, opts, NewConcurrentMap(16))
+			for i, v := range []string{"v1", "v2", "v3"} {
+				if err := p.AppendSet(fmt.Sprintf("k%d", i+1), []byte(v), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := p.AppendDel("k1"); err != nil {
+				t.Fatal(err)
+			}
+			if seq := p.LastSeq(); seq != 4 {
+				t.Fatalf("expected last seq 4, got %d", seq)
+			}
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Storage already holds a snapshot including records 1 and 2.
+			cm := NewConcurrentMap(16)
+			cm.Set("k1", []byte("v1"), 0)
+			cm.Set("k2", []byte("snapshot"), 0)
+			p2 := NewAOFPersister(opts, cm)
+			res, err := p2.ReplayAfter(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Records != 2 || res.Skipped != 2 || res.FirstSeq != 3 || res.LastSeq != 4 {
+				t.Fatalf("unexpected replay result %+v", res)
+			}
+			if v, _, _ := cm.Get("k2"); string(v) != "snapshot" {
+				t.Fatalf("record 2 should have been skipped, got %q", v)
+			}
+			if _, _, ok := cm.Get("k1"); ok {
+				t.Fatal("record 4 should have deleted k1")
+			}
+			if v, _, _ := cm.Get("k3"); string(v) != "v3" {
+				t.Fatal("record 3 should have been applied")
+			}
+
+			if err := p2.OpenForAppend(); err != nil {
+				t.Fatal(err)
+			}
+			if err := p2.AppendSet("k4", []byte("v4"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if seq := p2.LastSeq(); seq != 5 {
+				t.Fatalf("appends should continue after the replayed records, got seq %d", seq)
+			}
+			p2.Close()
+		})
+	}
+}
+
+func TestAOFRewriteBaseRecordsLastSeq(t *testing.T) {
+	dir := t.TempDir()
+	opts := AOFOptions{Path: filepath.Join(dir, "appendonly.aof")}
+	cm := NewConcurrentMap(16)
+	p := newOpenAOFPersister(t, opts, cm)
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("k%d", i)
+		cm.Set(key, []byte("v"), 0)
+		if err := p.AppendSet(key, []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.doRewrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p2 := NewAOFPersister(opts, NewConcurrentMap(16))
+	if seq, err := p2.BaseSeq(); err != nil || seq != 3 {
+		t.Fatalf("expected base seq 3, got %d (%v)", seq, err)
+	}
+	if _, err := p2.ReplayAfter(2); err == nil {
+		t.Fatal("a base newer than the snapshot must not be skipped")
+	}
+	res, err := p2.ReplayAfter(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BaseEntries != 0 || res.Records != 0 || p2.LastSeq() != 3 {
+		t.Fatalf("unexpected replay result %+v, last seq %d", res, p2.LastSeq())
+	}
+}
+
+func TestAOFStreamsReplayAcrossLayouts(t *testing.T) {
+	dir := t.TempDir()
+	opts := AOFOptions{Path: filepath.Join(dir, "appendonly.aof"), Streams: 4, Fsync: FsyncNo}
+	cm := NewConcurrentMap(16)
+	p := newOpenAOFPersister(t, opts, cm)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Go(func() {
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("w%d-k%d", w, i%10)
+				value := []byte(fmt.Sprintf("v%d", i))
+				cm.Set(key, value, 0)
+				if err := p.AppendSet(key, value, 0); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := loadAOFManifest(p.manifestPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Incrs) != 4 || m.Incrs[3].Stream != 3 || m.Incrs[3].Streams != 4 {
+		t.Fatalf("expected one incremental file per stream, got %+v", m.Incrs)
+	}
+
+	// Reopen with fewer streams: a new generation is started and the old
+	// one still replays.
+	opts.Streams = 2
+	recovered := NewConcurrentMap(16)
+	p2 := NewAOFPersister(opts, recovered)
+	res, err := p2.ReplayAfter(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p2.OpenForAppend(); err != nil {
+		t.Fatal(err)
+	}
+	if res.Records != 200 || res.FirstSeq != 1 || res.LastSeq != 200 {
+		t.Fatalf("unexpected replay result %+v", res)
+	}
+	if err := p2.AppendDel("w0-k0"); err != nil {
+		t.Fatal(err)
+	}
+	recovered.Delete("w0-k0")
+	if err := p2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = loadAOFManifest(p.manifestPath()); err != nil || len(m.generations()) != 2 {
+		t.Fatalf("expected two generations, got %+v (%v)", m, err)
+	}
+
+	final := NewConcurrentMap(16)
+	n, err := NewAOFPersister(AOFOptions{Path: opts.Path}, final).Replay()
+	if err != nil || n != 201 {
+		t.Fatalf("expected 201 records, got %d (%v)", n, err)
+	}
+	if final.Keys() != 39 || final.Exists("w0-k0") {
+		t.Fatalf("expected 39 keys without w0-k0, got %d", final.Keys())
+	}
+	recovered.Iterate(func(key string, e Entry) bool {
+		if v, _, ok := final.Get(key); !ok || string(v) != string(e.Value) {
+			t.Fatalf("%s: expected %q, got %q (%v)", key, e.Value, v, ok)
+		}
+		return true
+	})
+}
+
+func TestAOFStreamsStartNewGenerationOnShardCountChange(t *testing.T) {
+	opts := AOFOptions{Path: filepath.Join(t.TempDir(), "appendonly.aof"), Streams: 4}
+	p := newOpenAOFPersister(t, opts, NewConcurrentMap(16))
+	if err := p.AppendSet("k", []byte("v1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// With another shard count the key may map to another stream, so its
+	// records must not go on in the old files.
+	p2 := NewAOFPersister(opts, NewConcurrentMap(8))
+	if _, err := p2.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p2.OpenForAppend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p2.AppendSet("k", []byte("v2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadAOFManifest(p.manifestPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gens := m.generations()
+	if len(gens) != 2 || gens[0][0].Shards != 16 || gens[1][0].Shards != 8 {
+		t.Fatalf("expected a generation per shard count, got %+v", m.Incrs)
+	}
+
+	final := NewConcurrentMap(8)
+	if _, err := NewAOFPersister(opts, final).Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := final.Get("k"); string(v) != "v2" {
+		t.Fatalf("expected v2, got %q", v)
+	}
+}
+
+func TestEncryptedAOFAndRDBKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	oldKeys, err := NewKeyring(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := NewKeyring(newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOnly, err := NewKeyring(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := AOFOptions{Path: filepath.Join(dir, "appendonly.aof"), Format: AOFFormatText, Keys: oldKeys}
+	cm := NewConcurrentMap(16)
+	p := newOpenAOFPersister(t, opts, cm)
+	if err := p.AppendSet("a", []byte("secret-a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := AOFManifestFiles(p.manifestPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(files[len(files)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret-a")) || !bytes.HasPrefix(data, []byte(aofMagic)) {
+		t.Fatalf("expected an encrypted binary file, got %q", data)
+	}
+	if _, err := NewAOFPersister(AOFOptions{Path: opts.Path}, NewConcurrentMap(16)).Replay(); !errors.Is(err, ErrEncryptionKeyNotFound) {
+		t.Fatalf("expected ErrEncryptionKeyNotFound without keys, got %v", err)
+	}
+
+	// After a rotation the old file still replays, but appends go to a new
+	// file under the new key.
+	opts.Keys = rotated
+	recovered := NewConcurrentMap(16)
+	p2 := NewAOFPersister(opts, recovered)
+	if n, err := p2.Replay(); err != nil || n != 1 {
+		t.Fatalf("expected 1 record, got %d (%v)", n, err)
+	}
+	if err := p2.OpenForAppend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p2.AppendSet("b", []byte("secret-b"), 0); err != nil {
+		t.Fatal(err)
+	}
+	recovered.Set("b", []byte("secret-b"), 0)
+	if m, err := loadAOFManifest(p2.manifestPath()); err != nil || len(m.Incrs) != 2 {
+		t.Fatalf("expected a new incremental file, got %+v (%v)", m, err)
+	}
+	if _, err := NewAOFPersister(AOFOptions{Path: opts.Path, Keys: newOnly}, NewConcurrentMap(16)).Replay(); !errors.Is(err, ErrEncryptionKeyNotFound) {
+		t.Fatalf("expected the old key to be needed before a rewrite, got %v", err)
+	}
+	if err := p2.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	final := NewConcurrentMap(16)
+	if _, err := NewAOFPersister(AOFOptions{Path: opts.Path, Keys: newOnly}, final).Replay(); err != nil {
+		t.Fatalf("expected the rewritten AOF to need only the new key: %v", err)
+	}
+	if v, _, ok := final.Get("b"); !ok || string(v) != "secret-b" || final.Keys() != 2 {
+		t.Fatalf("unexpected keyspace after rewrite: %d keys, b=%q", final.Keys(), v)
+	}
+
+	rdbOpts := RDBOptions{Path: filepath.Join(dir, "dump.rdb"), Keys: rotated}
+	path, err := NewRDBManager(rdbOpts).Save(recovered, p2.LastSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ScanRDB(f, CorruptFail, newOnly, func([]byte, Entry) {})
+	f.Close()
+	if err != nil || res.KeyID != newOnly.CurrentID() || res.Entries != 2 {
+		t.Fatalf("unexpected scan result %+v (%v)", res, err)
+	}
+	if _, _, err := NewRDBManager(RDBOptions{Path: rdbOpts.Path}).Load(NewConcurrentMap(16)); !errors.Is(err, ErrEncryptionKeyNotFound) {
+		t.Fatalf("expected ErrEncryptionKeyNotFound without keys, got %v", err)
+	}
+	if n, seq, err := NewRDBManager(RDBOptions{Path: rdbOpts.Path, Keys: newOnly}).Load(NewConcurrentMap(16)); err != nil || n != 2 || seq != p2.LastSeq() {
+		t.Fatalf("expected 2 entries up to %d, got %d up to %d (%v)", p2.LastSeq(), n, seq, err)
+	}
+}
+
+// readAOFBytes reads every record of an AOF held in data, stopping at the
+// first error.
+func readAOFBytes(data []byte, keys *Keyring) ([]AOFRecord, error) {
+	ar, err := NewAOFReader(bytes.NewReader(data), keys)
+	if err != nil {
+		return nil, err
+	}
+	var recs []AOFRecord
+	for {
+		rec, err := ar.Next()
+		if errors.Is(err, io.EOF) {
+			return recs, nil
+		}
+		if err != nil {
+			return recs, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func TestEncryptedAOFRecordsAreBoundToFileAndOrder(t *testing.T) {
+	keys, err := NewKeyring(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// newFile returns the header and records 1 to 3 of a new file.
+	newFile := func() ([]byte, [][]byte) {
+		c, err := newAOFCipher(keys.current())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var recs [][]byte
+		for seq := int64(1); seq <= 3; seq++ {
+			recs = append(recs, appendRecord(nil, AOFFormatBinary, c, AOFRecord{Op: AOFOpSet, Key: "k", Value: []byte{byte(seq)}, Seq: seq}))
+		}
+		return aofHeader(c), recs
+	}
+	header, recs := newFile()
+	otherHeader, otherRecs := newFile()
+	if bytes.Equal(header, otherHeader) {
+		t.Fatal("files should not share a header")
+	}
+
+	if got, err := readAOFBytes(slices.Concat(header, recs[0], recs[1], recs[2]), keys); err != nil || len(got) != 3 {
+		t.Fatalf("expected 3 records, got %d (%v)", len(got), err)
+	}
+	for name, data := range map[string][]byte{
+		"reordered":  slices.Concat(header, recs[0], recs[2], recs[1]),
+		"duplicated": slices.Concat(header, recs[0], recs[1], recs[1]),
+		"moved":      slices.Concat(header, recs[0], otherRecs[1]),
+		"rehomed":    slices.Concat(otherHeader, recs[0]),
+	} {
+		if _, err := readAOFBytes(data, keys); !errors.Is(err, ErrAOFCorrupt) {
+			t.Errorf("%s: expected ErrAOFCorrupt, got %v", name, err)
+		}
+	}
+}
+
+// rdbSections returns the header, sections and trailer of an encrypted RDB
+// held in data.
+func rdbSections(t *testing.T, data []byte) ([]byte, [][]byte, []byte) {
+	t.Helper()
+	off := rdbHeaderSize + keyIDSize + fileSaltSize
+	header := data[:off]
+	var sections [][]byte
+	for data[off] != rdbTypeEnd {
+		end := off + rdbSectionHeader + int(binary.BigEndian.Uint32(data[off+10:]))
+		sections = append(sections, data[off:end])
+		off = end
+	}
+	return header, sections, data[off : len(data)-4]
+}
+
+// withRDBChecksum appends the file checksum to the parts of an RDB, as
+// anyone can recompute it.
+func withRDBChecksum(parts ...[]byte) []byte {
+	data := slices.Concat(parts...)
+	return binary.BigEndian.AppendUint32(data, crc32.Checksum(data, crc32c))
+}
+
+func TestEncryptedRDBSectionsAreBoundToFileAndOrder(t *testing.T) {
+	keys, err := NewKeyring(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := NewConcurrentMap(4)
+	for i := range 64 {
+		cm.Set(fmt.Sprintf("k%d", i), []byte("v"), 0)
+	}
+	encode := func() []byte {
+		snap := cm.Snapshot()
+		defer snap.Close()
+		var buf bytes.Buffer
+		if err := encodeRDB(&buf, snap, 7, RDBCompressionNone, keys.current()); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	decode := func(data []byte) error {
+		_, _, err := decodeRDB(bufio.NewReader(bytes.NewReader(data)), NewConcurrentMap(4), keys)
+		return err
+	}
+	data := encode()
+	header, sections, trailer := rdbSections(t, data)
+	if len(sections) != 4 {
+		t.Fatalf("expected a section per shard, got %d", len(sections))
+	}
+	if err := decode(withRDBChecksum(header, slices.Concat(sections...), trailer)); err != nil {
+		t.Fatal(err)
+	}
+
+	otherHeader, otherSections, _ := rdbSections(t, encode())
+	lastSeq := bytes.Clone(header)
+	lastSeq[len(rdbMagic)+2+7]++
+	count := bytes.Clone(trailer)
+	count[8]--
+	for name, data := range map[string][]byte{
+		"reordered": withRDBChecksum(header, sections[1], sections[0], sections[2], sections[3], trailer),
+		"dropped":   withRDBChecksum(header, sections[0], sections[1], sections[2], trailer),
+		"moved":     withRDBChecksum(header, otherSections[0], sections[1], sections[2], sections[3], trailer),
+		"rehomed":   withRDBChecksum(otherHeader, slices.Concat(sections...), trailer),
+		"last seq":  withRDBChecksum(lastSeq, slices.Concat(sections...), trailer),
+		"count":     withRDBChecksum(header, slices.Concat(sections...), count),
+	} {
+		if err := decode(data); !errors.Is(err, ErrRDBCorrupt) {
+			t.Errorf("%s: expected ErrRDBCorrupt, got %v", name, err)
+		}
+	}
+}
+
+func TestRecoverToTimeFromSnapshotAndArchive(t *testing.T) {
+	dir := t.TempDir()
+	opts := PITROptions{
+		RDB: RDBOptions{Path: filepath.Join(dir, "dump.rdb")},
+		AOF: AOFOptions{Path: filepath.Join(dir, "appendonly.aof"), ArchiveDir: filepath.Join(dir, "archive")},
+	}
+	cm := NewConcurrentMap(16)
+	p := newOpenAOFPersister(t, opts.AOF, cm)
+	set := func(key string) {
+		cm.Set(key, []byte("v"), 0)
+		if err := p.AppendSet(key, []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tick := func() time.Time {
+		time.Sleep(5 * time.Millisecond)
+		now := time.Now()
+		time.Sleep(5 * time.Millisecond)
+		return now
+	}
+
+	set("a")
+	if err := p.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := NewRDBManager(opts.RDB).Save(cm, p.LastSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tick()
+	set("b")
+	cm.Delete("a")
+	if err := p.AppendDel("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	beforeC := tick()
+	set("c")
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if archived, _ := filepath.Glob(filepath.Join(dir, "archive", "appendonly.aof.*.incr.aof")); len(archived) != 2 {
+		t.Fatalf("expected 2 archived incremental files, got %v", archived)
+	}
+
+	restored := NewConcurrentMap(16)
+	res, err := RecoverToTime(opts, beforeC, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Snapshot != snapshot || res.Records != 2 || res.FirstSeq != 2 || res.LastSeq != 3 {
+		t.Fatalf("unexpected recovery %+v", res)
+	}
+	if _, _, ok := restored.Get("a"); ok {
+		t.Fatal("a was deleted before the target time")
+	}
+	if _, _, ok := restored.Get("c"); ok {
+		t.Fatal("c was written after the target time")
+	}
+	if _, _, ok := restored.Get("b"); !ok {
+		t.Fatal("b should be recovered")
+	}
+
+	// Without a snapshot before the target, the archive is replayed from
+	// the first record.
+	latest := NewConcurrentMap(16)
+	if err := os.Remove(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	res, err = RecoverToTime(opts, time.Now(), latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Snapshot != "" || res.Records != 4 || latest.Keys() != 2 {
+		t.Fatalf("unexpected recovery %+v with %d keys", res, latest.Keys())
+	}
+}
+
+func TestRecoverToTimeChecksGapsByArchivedLayout(t *testing.T) {
+	archive := func(t *testing.T, streams int) PITROptions {
+		dir := t.TempDir()
+		opts := PITROptions{
+			RDB: RDBOptions{Path: filepath.Join(dir, "dump.rdb")},
+			AOF: AOFOptions{Path: filepath.Join(dir, "appendonly.aof"), ArchiveDir: filepath.Join(dir, "archive"), Streams: streams},
+		}
+		cm := NewConcurrentMap(16)
+		p := newOpenAOFPersister(t, opts.AOF, cm)
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("k%d-%d", round, i)
+				cm.Set(key, []byte("v"), 0)
+				if err := p.AppendSet(key, []byte("v"), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := p.Rewrite(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return opts
+	}
+	// removeArchived deletes the archived file holding record seq.
+	removeArchived := func(t *testing.T, opts PITROptions, seq int64) {
+		archived, _ := filepath.Glob(filepath.Join(opts.AOF.ArchiveDir, "appendonly.aof.*.incr.aof"))
+		for _, path := range archived {
+			if first, err := firstAOFSeq(path, nil); err == nil && first <= seq && first+10 > seq {
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+		}
+		t.Fatalf("no archived file holds record %d", seq)
+	}
+
+	// The archive was written unsplit, so a missing file is a gap even if
+	// the AOF is split now.
+	opts := archive(t, 1)
+	removeArchived(t, opts, 11)
+	opts.AOF.Streams = 4
+	if _, err := RecoverToTime(opts, time.Now(), NewConcurrentMap(16)); !errors.Is(err, ErrRecoveryGap) {
+		t.Fatalf("expected ErrRecoveryGap, got %v", err)
+	}
+
+	// The archive was written split, where a crash may lose the tail of
+	// one stream, even if the AOF is unsplit now.
+	opts = archive(t, 2)
+	removeArchived(t, opts, 1)
+	opts.AOF.Streams = 1
+	res, err := RecoverToTime(opts, time.Now(), NewConcurrentMap(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Records == 0 || res.Records >= 30 || res.LastSeq != 30 {
+		t.Fatalf("unexpected recovery %+v", res)
+	}
+}
+
+func TestScanAOFCorruptPolicies(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(aofHeader(nil))
+	for i := 1; i <= 5; i++ {
+		buf.Write(appendBinaryRecord(nil, nil, AOFRecord{Op: AOFOpSet, Key: fmt.Sprintf("k%d", i), Value: []byte(fmt.Sprintf("value-k%d", i)), Seq: int64(i)}))
+	}
+	data := buf.Bytes()
+	// Corrupt the length of the third record, so that skipping it needs a
+	// scan for the next valid record.
+	bad := strings.Index(string(data), "k3") - aofRecordHeader - 10
+	data[bad] ^= 0x7f
+
+	keys := func(policy CorruptPolicy) ([]string, AOFScanResult, error) {
+		var got []string
+		res, err := ScanAOF(bytes.NewReader(data), policy, nil, func(rec AOFRecord) {
+			got = append(got, rec.Key)
+		})
+		return got, res, err
+	}
+
+	if _, _, err := keys(CorruptFail); !errors.Is(err, ErrAOFCorrupt) {
+		t.Fatalf("expected ErrAOFCorrupt, got %v", err)
+	}
+	got, res, err := keys(CorruptTruncate)
+	if err != nil || strings.Join(got, ",") != "k1,k2" {
+		t.Fatalf("truncate: got %v (%v)", got, err)
+	}
+	if len(res.Damage) != 1 || res.Damage[0].Offset != int64(bad) || res.Damage[0].Length != int64(len(data)-bad) {
+		t.Fatalf("truncate: unexpected damage %+v", res.Damage)
+	}
+	got, res, err = keys(CorruptSkip)
+	if err != nil || strings.Join(got, ",") != "k1,k2,k4,k5" {
+		t.Fatalf("skip: got %v (%v)", got, err)
+	}
+	third := len(appendBinaryRecord(nil, nil, AOFRecord{Op: AOFOpSet, Key: "k3", Value: []byte("value-k3"), Seq: 3}))
+	if len(res.Damage) != 1 || res.Damage[0].Length != int64(third) {
+		t.Fatalf("skip: expected %d bytes dropped, got %+v", third, res.Damage)
+	}
+
+	var repaired bytes.Buffer
+	if _, err := RepairAOF(&repaired, bytes.NewReader(data), CorruptSkip, nil); err != nil {
+		t.Fatal(err)
+	}
+	res, err = ScanAOF(&repaired, CorruptFail, nil, func(AOFRecord) {})
+	if err != nil || res.Records != 4 || res.Format != AOFFormatBinary || len(res.Damage) != 0 {
+		t.Fatalf("repaired aof: %+v (%v)", res, err)
+	}
+}
+
+func TestScanRDBSkipsDamagedSections(t *testing.T) {
+	cm := NewConcurrentMap(4)
+	for i := 0; i < 100; i++ {
+		cm.Set(fmt.Sprintf("k%d", i), []byte("value"), 0)
+	}
+	var buf bytes.Buffer
+	if err := encodeRDB(&buf, cm.Snapshot(), 7, RDBCompressionNone, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// Flip a byte in the data of the first section.
+	data[rdbHeaderSize+rdbSectionHeader+1] ^= 0xff
+
+	count := func(policy CorruptPolicy) (int, RDBScanResult, error) {
+		n := 0
+		res, err := ScanRDB(bytes.NewReader(data), policy, nil, func([]byte, Entry) { n++ })
+		return n, res, err
+	}
+	if _, _, err := count(CorruptFail); !errors.Is(err, ErrRDBCorrupt) {
+		t.Fatalf("expected ErrRDBCorrupt, got %v", err)
+	}
+	if n, res, err := count(CorruptTruncate); err != nil || n != 0 || len(res.Damage) != 1 {
+		t.Fatalf("truncate: %d entries, %+v (%v)", n, res, err)
+	}
+	n, res, err := count(CorruptSkip)
+	if err != nil || n == 0 || n >= 100 || res.Entries != n || res.Sections != 3 || res.LastSeq != 7 {
+		t.Fatalf("skip: %d entries, %+v (%v)", n, res, err)
+	}
+
+	var repaired bytes.Buffer
+	if _, err := RepairRDB(&repaired, bytes.NewReader(data), CorruptSkip, RDBCompressionDeflate, nil); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewConcurrentMap(4)
+	loaded, seq, err := decodeRDB(bufio.NewReader(&repaired), restored, nil)
+	if err != nil || loaded != n || seq != 7 {
+		t.Fatalf("repaired rdb: %d entries, seq %d (%v)", loaded, seq, err)
+	}
+}
+
+func TestMetaPersistsThroughAOFAndRDB(t *testing.T) {
+	for _, format := range []AOFFormat{AOFFormatBinary, AOFFormatText} {
+		t.Run(format.String(), func(t *testing.T) {
+			opts := AOFOptions{Path: filepath.Join(t.TempDir(), "appendonly.aof"), Format: format}
+			p := newOpenAOFPersister(t, opts, NewConcurrentMap(16))
+			meta := Meta{Flags: 42, ContentType: "text/plain;\tcharset=utf-8"}
+			if err := p.AppendEntry("flagged", Entry{Value: []byte("v1"), Meta: meta}); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.AppendSet("plain", []byte("v2"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			recovered := NewConcurrentMap(16)
+			if _, err := NewAOFPersister(opts, recovered).Replay(); err != nil {
+				t.Fatal(err)
+			}
+			if e, ok := recovered.GetEntry("flagged"); !ok || string(e.Value) != "v1" || e.Meta != meta {
+				t.Fatalf("flagged should be replayed with its metadata, got %+v (%v)", e, ok)
+			}
+			if e, ok := recovered.GetEntry("plain"); !ok || e.Meta != (Meta{}) {
+				t.Fatalf("plain should be replayed without metadata, got %+v (%v)", e, ok)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	orig := NewConcurrentMap(1)
+	orig.SetEntry("flagged", Entry{Value: []byte("v1"), Meta: Meta{Flags: 7}})
+	orig.SetEntry("typed", Entry{Value: []byte("v3"), Meta: Meta{ContentType: "image/png"}})
+	orig.Set("plain", []byte("v2"), 0)
+	rdb := NewRDBManager(RDBOptions{Path: path})
+	if _, err := rdb.Save(orig, 1); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewConcurrentMap(16)
+	if _, _, err := rdb.Load(restored); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := restored.GetEntry("flagged"); !ok || e.Meta.Flags != 7 {
+		t.Fatalf("flagged should be restored with its flags, got %+v (%v)", e, ok)
+	}
+	if e, ok := restored.GetEntry("typed"); !ok || e.Meta.ContentType != "image/png" {
+		t.Fatalf("typed should be restored with its content type, got %+v (%v)", e, ok)
+	}
+	if e, ok := restored.GetEntry("plain"); !ok || string(e.Value) != "v2" || e.Meta != (Meta{}) {
+		t.Fatalf("plain should be restored without metadata, got %+v (%v)", e, ok)
+	}
+}
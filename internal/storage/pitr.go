@@ -0,0 +1,397 @@
+package storage
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrRecoveryGap = errors.New("aof records missing for point-in-time recovery")
+
+// archiveAOFPart moves an incremental file dropped from the manifest into
+// archiveDir, keeping its name unless an archived file already has it. If
+// its manifest entry pt is known, the entry is appended to the archive
+// manifest, so that recovery knows whether the file belonged to a split AOF.
+func archiveAOFPart(path, archiveDir, name string, pt aofPart, known bool) error {
+	if err := os.MkdirAll(archiveDir, 0o755); err != nil {
+		return err
+	}
+	dst := filepath.Join(archiveDir, filepath.Base(path))
+	if _, err := os.Stat(dst); err == nil {
+		dst = filepath.Join(archiveDir, fmt.Sprintf("%s-%d.incr.aof", strings.TrimSuffix(filepath.Base(path), ".incr.aof"), time.Now().UnixNano()))
+	}
+	if err := moveFile(path, dst); err != nil {
+		return err
+	}
+	if !known {
+		return nil
+	}
+	pt.Name = filepath.Base(dst)
+	f, err := os.OpenFile(filepath.Join(archiveDir, name+".manifest"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(pt.line())
+	return errors.Join(err, f.Close())
+}
+
+func moveFile(path, dst string) error {
+	if err := os.Rename(path, dst); err == nil {
+		return nil
+	}
+
+	// The archive may live on another file system.
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(dst+".tmp", dst, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+	src.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// loadAOFArchiveManifest returns the entries of the archive manifest of the
+// AOF named name by file name. Lines that do not parse, such as one torn by
+// a crash, are skipped: their files are treated as of unknown layout.
+func loadAOFArchiveManifest(archiveDir, name string) (map[string]aofPart, error) {
+	data, err := os.ReadFile(filepath.Join(archiveDir, name+".manifest"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	parts := map[string]aofPart{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if pt, err := parseAOFPart(line); err == nil {
+			parts[pt.Name] = pt
+		}
+	}
+	return parts, nil
+}
+
+// pruneAOFArchive removes archived files last written more than keepHours
+// ago, and their entries from the archive manifest. A zero keepHours keeps
+// them forever.
+func pruneAOFArchive(archiveDir, name string, keepHours int, now time.Time) error {
+	if archiveDir == "" || keepHours <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(archiveDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var errs []error
+	removed := false
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || e.Name() == name+".manifest" || now.Sub(info.ModTime()) < time.Duration(keepHours)*time.Hour {
+			continue
+		}
+		if err := os.Remove(filepath.Join(archiveDir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+		removed = true
+	}
+	if removed {
+		errs = append(errs, compactAOFArchiveManifest(archiveDir, name))
+	}
+	return errors.Join(errs...)
+}
+
+// compactAOFArchiveManifest drops the entries of files no longer archived.
+func compactAOFArchiveManifest(archiveDir, name string) error {
+	parts, err := loadAOFArchiveManifest(archiveDir, name)
+	if err != nil || parts == nil {
+		return err
+	}
+	var kept []aofPart
+	for _, pt := range parts {
+		if _, err := os.Stat(filepath.Join(archiveDir, pt.Name)); err == nil {
+			kept = append(kept, pt)
+		}
+	}
+	slices.SortFunc(kept, func(a, b aofPart) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	path := filepath.Join(archiveDir, name+".manifest")
+	return writeFileAtomic(path+".tmp", path, func(w io.Writer) error {
+		for _, pt := range kept {
+			if _, err := io.WriteString(w, pt.line()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PITROptions locates the snapshots and the AOF, including its archive, that
+// a point-in-time recovery reads. The files are only read.
+type PITROptions struct {
+	RDB RDBOptions
+	AOF AOFOptions
+}
+
+// PITRResult describes a point-in-time recovery. Snapshot is the path of the
+// snapshot it started from, or "" if it replayed the AOF from the first
+// record. Records counts the AOF records applied on top, FirstSeq and
+// LastSeq bound their sequence numbers and LastTimestamp is the time of the
+// last one in Unix milliseconds.
+type PITRResult struct {
+	Snapshot        string
+	SnapshotEntries int
+	SnapshotSeq     int64
+	Records         int
+	FirstSeq        int64
+	LastSeq         int64
+	LastTimestamp   int64
+}
+
+// aofSegment is an incremental file to replay. split is set if it belongs
+// to an AOF split into several streams, or its layout is not known.
+type aofSegment struct {
+	path     string
+	firstSeq int64
+	keys     *Keyring
+	split    bool
+}
+
+// RecoverToTime rebuilds into storage the keyspace as it was at target: it
+// loads the newest snapshot taken at or before target and applies the AOF
+// records that follow it, from the archive and the live incremental files,
+// in sequence number order up to the last record written at or before
+// target. Records must follow on without gaps, otherwise ErrRecoveryGap is
+// returned; records next to one from a file of a split AOF are exempt,
+// because a crash loses the unsynced tail of each stream on its own. Whether
+// a file was split is taken from the manifest that listed it, live or
+// archived, not from the current options. Text-format records
+// carry no timestamp and cannot be recovered to a point in time.
+func RecoverToTime(opts PITROptions, target time.Time, storage *ConcurrentMap) (PITRResult, error) {
+	var res PITRResult
+	snaps, err := NewRDBManager(opts.RDB).files()
+	if err != nil {
+		return res, err
+	}
+	for _, snap := range snaps {
+		if snap.CreatedAt.After(target) {
+			continue
+		}
+		res.Snapshot = snap.Path
+		res.SnapshotEntries, res.SnapshotSeq, err = loadRDBFile(snap.Path, storage, opts.RDB.Keys)
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", snap.Path, err)
+		}
+		break
+	}
+
+	segments, err := collectAOFSegments(opts.AOF)
+	if err != nil {
+		return res, err
+	}
+	if err := replaySegmentsUntil(segments, target.UnixMilli(), res.SnapshotSeq, storage, &res); err != nil {
+		return res, err
+	}
+	if res.Snapshot == "" && res.Records == 0 {
+		return res, fmt.Errorf("no snapshot or aof record at or before %s", target.Format(time.RFC3339))
+	}
+	return res, nil
+}
+
+// replaySegmentsUntil merges the records of segments by sequence number and
+// applies those that follow last and were written at or before targetMs,
+// stopping at the first later one. A gap in sequence numbers is an error
+// unless the record before or after it comes from a split segment. A segment is only opened once the
+// records before its first one are applied, so about one file per stream is
+// open at a time.
+func replaySegmentsUntil(segments []aofSegment, targetMs, last int64, storage *ConcurrentMap, res *PITRResult) error {
+	var open []*aofCursor
+	lastSplit := false
+	defer func() {
+		for _, c := range open {
+			c.f.Close()
+		}
+	}()
+	for {
+		head := -1
+		for i, c := range open {
+			if head < 0 || c.rec.Seq < open[head].rec.Seq {
+				head = i
+			}
+		}
+		if len(segments) > 0 && (head < 0 || segments[0].firstSeq <= open[head].rec.Seq) {
+			c, err := openAOFCursor(segments[0])
+			segments = segments[1:]
+			if err != nil {
+				return err
+			}
+			if c != nil {
+				open = append(open, c)
+			}
+			continue
+		}
+		if head < 0 {
+			return nil
+		}
+
+		c := open[head]
+		rec := c.rec
+		if rec.Seq > last {
+			switch {
+			case rec.Seq != last+1 && !c.split && !lastSplit:
+				return fmt.Errorf("%s: %w: %d to %d", c.path, ErrRecoveryGap, last+1, rec.Seq-1)
+			case rec.Timestamp == 0:
+				return fmt.Errorf("%s: record %d has no timestamp", c.path, rec.Seq)
+			case rec.Timestamp > targetMs:
+				return nil
+			}
+			applyAOFRecord(storage, rec)
+			last, lastSplit = rec.Seq, c.split
+			res.Records++
+			if res.FirstSeq == 0 {
+				res.FirstSeq = rec.Seq
+			}
+			res.LastSeq, res.LastTimestamp = rec.Seq, rec.Timestamp
+		}
+		ok, err := c.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			c.f.Close()
+			open = slices.Delete(open, head, head+1)
+		}
+	}
+}
+
+// aofCursor reads the numbered records of an AOF file in order; rec holds
+// the one read last.
+type aofCursor struct {
+	path  string
+	split bool
+	f     *os.File
+	ar    *AOFReader
+	rec   AOFRecord
+}
+
+// openAOFCursor opens the file of seg and reads its first record. It
+// returns nil if the file holds none.
+func openAOFCursor(seg aofSegment) (*aofCursor, error) {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+	c := &aofCursor{path: seg.path, split: seg.split, f: f}
+	c.ar, err = NewAOFReader(f, seg.keys)
+	ok := false
+	if err == nil {
+		ok, err = c.next()
+	} else if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	if err != nil || !ok {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// next reads the following record and reports whether there was one.
+func (c *aofCursor) next() (bool, error) {
+	rec, err := c.ar.Next()
+	// A torn record can only end a file that was being written.
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: offset %d: %w", c.path, c.ar.Offset(), err)
+	}
+	if rec.Seq == 0 {
+		return false, fmt.Errorf("%s: record at offset %d has no sequence number", c.path, c.ar.Offset())
+	}
+	c.rec = rec
+	return true, nil
+}
+
+// collectAOFSegments lists the archived and live incremental files ordered
+// by their first sequence number. Files without numbered records are left
+// out.
+func collectAOFSegments(opts AOFOptions) ([]aofSegment, error) {
+	p := NewAOFPersister(opts, nil)
+	var segments []aofSegment
+	if opts.ArchiveDir != "" {
+		entries, err := os.ReadDir(opts.ArchiveDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		archived, err := loadAOFArchiveManifest(opts.ArchiveDir, p.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasPrefix(e.Name(), p.name+".") && strings.HasSuffix(e.Name(), ".incr.aof") {
+				pt, known := archived[e.Name()]
+				segments = append(segments, aofSegment{path: filepath.Join(opts.ArchiveDir, e.Name()), split: !known || pt.layout() > 1})
+			}
+		}
+	}
+	m, err := loadAOFManifest(p.manifestPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if m != nil {
+		for _, pt := range m.Incrs {
+			segments = append(segments, aofSegment{path: filepath.Join(p.dir, pt.Name), split: pt.layout() > 1})
+		}
+	}
+
+	numbered := segments[:0]
+	for _, seg := range segments {
+		seq, err := firstAOFSeq(seg.path, opts.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", seg.path, err)
+		}
+		if seq > 0 {
+			seg.firstSeq, seg.keys = seq, opts.Keys
+			numbered = append(numbered, seg)
+		}
+	}
+	slices.SortFunc(numbered, func(a, b aofSegment) int {
+		return cmp.Compare(a.firstSeq, b.firstSeq)
+	})
+	return numbered, nil
+}
+
+func firstAOFSeq(path string, keys *Keyring) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	ar, err := NewAOFReader(f, keys)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	rec, err := ar.Next()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, nil
+	}
+	return rec.Seq, err
+}
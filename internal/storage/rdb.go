@@ -1,97 +1,292 @@
 package storage
 
 import (
-	"encoding/gob"
+	"bufio"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 )
 
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+type RDBOptions struct {
+	// Path names the snapshots: "data/dump.rdb" keeps them as
+	// "data/dump-<UTC timestamp>.rdb". A snapshot found at Path itself, as
+	// written by earlier versions, is listed and loaded like the others.
+	Path        string
+	Compression RDBCompression
+	// KeepLast and KeepHours bound the snapshots kept after each save: a
+	// snapshot is kept if it is among the KeepLast newest or younger than
+	// KeepHours. A zero value disables that rule, and the newest snapshot is
+	// always kept.
+	KeepLast  int
+	KeepHours int
+	// Keys, if set, encrypts new snapshots with its current key and
+	// decrypts existing ones.
+	Keys *Keyring
+}
+
 type RDBManager struct {
-	path string
+	path        string
+	dir         string
+	stem        string
+	compression RDBCompression
+	keepLast    int
+	keepHours   int
+	keys        *Keyring
 }
 
-type rdbEntry struct {
-	Key       string
-	Value     []byte
-	ExpiresAt int64
+// RDBSnapshot describes one snapshot file. Keys is the number of entries it
+// holds, including those that have expired since it was taken.
+type RDBSnapshot struct {
+	ID        string
+	Path      string
+	Size      int64
+	Keys      int64
+	CreatedAt time.Time
 }
 
-func NewRDBManager(path string) *RDBManager {
-	return &RDBManager{path: path}
+const rdbTimeLayout = "20060102T150405.000Z"
+
+func NewRDBManager(opts RDBOptions) *RDBManager {
+	base := filepath.Base(opts.Path)
+	return &RDBManager{
+		path:        opts.Path,
+		dir:         filepath.Dir(opts.Path),
+		stem:        strings.TrimSuffix(base, filepath.Ext(base)),
+		compression: opts.Compression,
+		keepLast:    opts.KeepLast,
+		keepHours:   opts.KeepHours,
+		keys:        opts.Keys,
+	}
 }
 
-func (r *RDBManager) Save(storage *ConcurrentMap) (string, error) {
-	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+// Save writes a new snapshot of storage as SaveSnapshot does, taking the
+// snapshot itself. lastSeq must be read from the AOF before the call: every
+// record up to it has then already been applied to storage.
+func (r *RDBManager) Save(storage *ConcurrentMap, lastSeq int64) (string, error) {
+	snap := storage.Snapshot()
+	defer snap.Close()
+	return r.SaveSnapshot(snap, lastSeq)
+}
+
+// SaveSnapshot writes snap to a new snapshot file, removes the snapshots the
+// retention policy no longer keeps and returns the path of the new one.
+// lastSeq is the last AOF record whose effect snap includes.
+func (r *RDBManager) SaveSnapshot(snap *Snapshot, lastSeq int64) (string, error) {
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
 		return "", err
 	}
 
-	tmpPath := r.path + ".tmp"
-	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
-	if err != nil {
+	now := time.Now().UTC()
+	path := r.snapshotPath(now)
+	for {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		now = now.Add(time.Millisecond)
+		path = r.snapshotPath(now)
+	}
+
+	if err := writeFileAtomic(path+".tmp", path, func(w io.Writer) error {
+		bw := bufio.NewWriterSize(w, 256<<10)
+		if err := encodeRDB(bw, snap, lastSeq, r.compression, r.keys.current()); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}); err != nil {
 		return "", err
 	}
+	if err := r.prune(now); err != nil {
+		slog.Warn("remove expired snapshots failed", "error", err)
+	}
+	return path, nil
+}
+
+func (r *RDBManager) snapshotPath(t time.Time) string {
+	return filepath.Join(r.dir, fmt.Sprintf("%s-%s.rdb", r.stem, t.Format(rdbTimeLayout)))
+}
 
-	enc := gob.NewEncoder(f)
-	entries := make([]rdbEntry, 0, storage.Keys())
-	now := time.Now().UnixMilli()
-	storage.Iterate(func(key string, entry Entry) bool {
-		if entry.ExpiresAt > 0 && entry.ExpiresAt <= now {
-			return true
+// List returns the snapshots on disk, newest first.
+func (r *RDBManager) List() ([]RDBSnapshot, error) {
+	snaps, err := r.files()
+	if err != nil {
+		return nil, err
+	}
+	for i := range snaps {
+		snaps[i].Keys, err = countRDBEntries(snaps[i].Path)
+		if err != nil {
+			slog.Warn("read snapshot failed", "path", snaps[i].Path, "error", err)
+			snaps[i].Keys = -1
 		}
-		val := make([]byte, len(entry.Value))
-		copy(val, entry.Value)
-		entries = append(entries, rdbEntry{
-			Key:       key,
-			Value:     val,
-			ExpiresAt: entry.ExpiresAt,
-		})
-		return true
+	}
+	return snaps, nil
+}
+
+// files lists the snapshot files without opening them, newest first.
+func (r *RDBManager) files() ([]RDBSnapshot, error) {
+	entries, err := os.ReadDir(r.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snaps []RDBSnapshot
+	prefix, legacy := r.stem+"-", filepath.Base(r.path)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".rdb") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		snap := RDBSnapshot{
+			ID:   strings.TrimSuffix(name, ".rdb"),
+			Path: filepath.Join(r.dir, name),
+			Size: info.Size(),
+		}
+		switch {
+		case name == legacy:
+			snap.CreatedAt = info.ModTime()
+		case strings.HasPrefix(name, prefix):
+			t, err := time.Parse(rdbTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".rdb"))
+			if err != nil {
+				continue
+			}
+			snap.CreatedAt = t
+		default:
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	slices.SortFunc(snaps, func(a, b RDBSnapshot) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
 	})
+	return snaps, nil
+}
 
-	if err := enc.Encode(entries); err != nil {
-		f.Close()
-		return "", err
+func (r *RDBManager) prune(now time.Time) error {
+	if r.keepLast <= 0 && r.keepHours <= 0 {
+		return nil
 	}
-	if err := f.Sync(); err != nil {
-		f.Close()
-		return "", err
+	snaps, err := r.files()
+	if err != nil {
+		return err
 	}
-	if err := f.Close(); err != nil {
-		return "", err
+	var errs []error
+	for i, snap := range snaps {
+		if i == 0 || (r.keepLast > 0 && i < r.keepLast) ||
+			(r.keepHours > 0 && now.Sub(snap.CreatedAt) < time.Duration(r.keepHours)*time.Hour) {
+			continue
+		}
+		if err := os.Remove(snap.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	_ = os.Remove(r.path)
-	if err := os.Rename(tmpPath, r.path); err != nil {
+// Latest returns the path of the newest snapshot, or "" if there is none.
+func (r *RDBManager) Latest() (string, error) {
+	snaps, err := r.files()
+	if err != nil || len(snaps) == 0 {
 		return "", err
 	}
-	return r.path, nil
+	return snaps[0].Path, nil
 }
 
-func (r *RDBManager) Load(storage *ConcurrentMap) (int, error) {
-	if _, err := os.Stat(r.path); errors.Is(err, os.ErrNotExist) {
-		return 0, nil
+// Load reads the newest snapshot into storage and returns the number of
+// entries and the last AOF sequence number it includes.
+func (r *RDBManager) Load(storage *ConcurrentMap) (int, int64, error) {
+	path, err := r.Latest()
+	if err != nil || path == "" {
+		return 0, 0, err
 	}
-	f, err := os.Open(r.path)
+	return loadRDBFile(path, storage, r.keys)
+}
+
+// LoadSnapshot reads the snapshot with the given ID into storage.
+func (r *RDBManager) LoadSnapshot(id string, storage *ConcurrentMap) (int, int64, error) {
+	snaps, err := r.files()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+	for _, snap := range snaps {
+		if snap.ID == id {
+			return loadRDBFile(snap.Path, storage, r.keys)
+		}
+	}
+	return 0, 0, fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+}
+
+func loadRDBFile(path string, storage *ConcurrentMap, keys *Keyring) (int, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
 	}
 	defer f.Close()
 
-	var entries []rdbEntry
-	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+	return decodeRDB(bufio.NewReaderSize(f, 256<<10), storage, keys)
+}
+
+// LastSeq reads only the header of the newest snapshot and returns the last
+// AOF sequence number it includes, or 0 if there is no snapshot.
+func (r *RDBManager) LastSeq() (int64, error) {
+	path, err := r.Latest()
+	if err != nil || path == "" {
 		return 0, err
 	}
+	return readRDBLastSeq(path)
+}
 
-	now := time.Now().UnixMilli()
-	loaded := 0
-	for _, e := range entries {
-		if e.ExpiresAt > 0 && e.ExpiresAt <= now {
-			continue
-		}
-		storage.Set(e.Key, e.Value, e.ExpiresAt)
-		loaded++
+func readRDBLastSeq(path string) (int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h, err := readRDBHeader(bufio.NewReader(f))
+	return h.lastSeq, err
+}
+
+// writeFileAtomic writes a file through fill into tmpPath, fsyncs it and
+// renames it to path, so readers only ever see a complete file.
+func writeFileAtomic(tmpPath, path string, fill func(w io.Writer) error) error {
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := fill(f); err != nil {
+		f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
 	}
-	return loaded, nil
+	syncDir(filepath.Dir(path))
+	return nil
 }
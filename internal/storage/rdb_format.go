@@ -0,0 +1,654 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RDBCompression byte
+
+const (
+	RDBCompressionNone RDBCompression = iota
+	RDBCompressionDeflate
+)
+
+func ParseRDBCompression(s string) (RDBCompression, error) {
+	switch s {
+	case "", "none":
+		return RDBCompressionNone, nil
+	case "deflate":
+		return RDBCompressionDeflate, nil
+	default:
+		return RDBCompressionNone, fmt.Errorf("unknown rdb compression %q", s)
+	}
+}
+
+func (c RDBCompression) String() string {
+	if c == RDBCompressionDeflate {
+		return "deflate"
+	}
+	return "none"
+}
+
+// RDB layout:
+//
+//	header:  magic "GKVRDB" | version uint16 | last AOF sequence int64
+//	         [| key ID 8 bytes | salt 16 bytes]
+//	section: type byte | shard uint32 | compression byte | entries uint32
+//	         | data length uint32 | CRC32C(data) uint32 | data
+//	trailer: type 0xFF | entries uint64 [| sections uint64 | seal 28 bytes]
+//	         | CRC32C(every byte before it) uint32
+//
+// Each shard is written as sections of about rdbSectionSize bytes, so that
+// they can be encoded and loaded in parallel. In encrypted files the data of
+// each section and the trailer are sealed with AES-GCM. Files without a
+// header are gob snapshots of earlier versions.
+const (
+	rdbMagic            = "GKVRDB"
+	rdbVersion          = 2
+	rdbEncryptedVersion = 3
+	rdbHeaderSize       = len(rdbMagic) + 2 + 8
+	rdbSectionHeader    = 1 + 4 + 1 + 4 + 4 + 4
+	rdbSectionAAD       = 1 + 4 + 1 + 4
+	rdbTrailerSize      = 1 + 8 + 4
+	rdbTrailerSealSize  = 8 + 12 + 16
+	rdbTypeSection      = 0x01
+	rdbTypeSectionMeta  = 0x02
+	rdbTypeEnd          = 0xFF
+	rdbSectionSize      = 1 << 20
+	maxRDBSectionLength = 256 << 20
+)
+
+var ErrRDBCorrupt = errors.New("rdb corrupt")
+
+type rdbEntry struct {
+	Key       string
+	Value     []byte
+	ExpiresAt int64
+	Meta      Meta
+}
+
+func rdbHeader(version uint16, lastSeq int64) []byte {
+	header := binary.BigEndian.AppendUint16([]byte(rdbMagic), version)
+	return binary.BigEndian.AppendUint64(header, uint64(lastSeq))
+}
+
+// rdbFileHeader is a decoded RDB header. version is 0 for a headerless gob
+// snapshot; keyID is set for an encrypted file, and salt for one of the
+// current encrypted version.
+type rdbFileHeader struct {
+	version uint16
+	lastSeq int64
+	keyID   []byte
+	salt    []byte
+}
+
+func (h rdbFileHeader) sectioned() bool {
+	return h.version == rdbVersion || h.version == rdbEncryptedVersion
+}
+
+// bytes returns the header as written, which the file checksum covers.
+func (h rdbFileHeader) bytes() []byte {
+	return append(append(rdbHeader(h.version, h.lastSeq), h.keyID...), h.salt...)
+}
+
+// trailerSize returns the size of the trailer of a sectioned file.
+func (h rdbFileHeader) trailerSize() int {
+	if h.version == rdbEncryptedVersion {
+		return rdbTrailerSize + rdbTrailerSealSize
+	}
+	return rdbTrailerSize
+}
+
+// cipher returns the cipher the file is encrypted with, nil if it is not.
+func (h rdbFileHeader) cipher(keys *Keyring) (*fileCipher, error) {
+	if h.keyID == nil {
+		return nil, nil
+	}
+	key, err := keys.lookup(h.keyID)
+	if err != nil {
+		return nil, err
+	}
+	return newFileCipher(key, h.bytes(), h.salt)
+}
+
+// readRDBHeader consumes the header, if any.
+func readRDBHeader(r *bufio.Reader) (rdbFileHeader, error) {
+	var h rdbFileHeader
+	head, err := r.Peek(rdbHeaderSize)
+	if !bytes.HasPrefix(head, []byte(rdbMagic)) {
+		return h, nil
+	}
+	if err != nil {
+		return h, fmt.Errorf("%w: truncated header", ErrRDBCorrupt)
+	}
+	h.version = binary.BigEndian.Uint16(head[len(rdbMagic):])
+	h.lastSeq = int64(binary.BigEndian.Uint64(head[len(rdbMagic)+2:]))
+	size := rdbHeaderSize
+	switch h.version {
+	case rdbVersion:
+	case rdbEncryptedVersion:
+		size += keyIDSize + fileSaltSize
+		if head, err = r.Peek(size); err != nil {
+			return h, fmt.Errorf("%w: truncated header", ErrRDBCorrupt)
+		}
+		h.keyID = bytes.Clone(head[rdbHeaderSize : rdbHeaderSize+keyIDSize])
+		h.salt = bytes.Clone(head[rdbHeaderSize+keyIDSize:])
+	default:
+		return h, fmt.Errorf("%w: unsupported version %d", ErrRDBCorrupt, h.version)
+	}
+	_, _ = r.Discard(size)
+	return h, nil
+}
+
+type rdbSection struct {
+	buf     []byte
+	entries int
+	// ordinal is the position of the section in the file, from 0.
+	ordinal uint64
+}
+
+// rdbSectionAD returns the data authenticated with the sealed data of sec,
+// besides the file header.
+func rdbSectionAD(sec rdbSection) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, sec.ordinal), sec.buf[:rdbSectionAAD]...)
+}
+
+// encodeRDB writes every live entry of snap to w, encrypted with key unless
+// it is nil. Workers take one shard at a time, collect references to its
+// entries under the shard's read lock and encode them into sections after
+// releasing it; values are never modified in place, so the snapshot holds no
+// copies of them. Sections are sealed as they are written, once their
+// ordinal is known.
+func encodeRDB(w io.Writer, snap *Snapshot, lastSeq int64, compression RDBCompression, key *cipherKey) error {
+	crc := crc32.New(crc32c)
+	out := io.MultiWriter(w, crc)
+	h := rdbFileHeader{version: rdbVersion, lastSeq: lastSeq}
+	var c *fileCipher
+	if key != nil {
+		h.version, h.keyID, h.salt = rdbEncryptedVersion, key.id[:], newFileSalt()
+		var err error
+		if c, err = newFileCipher(key, h.bytes(), h.salt); err != nil {
+			return err
+		}
+	}
+	if _, err := out.Write(h.bytes()); err != nil {
+		return err
+	}
+
+	workers := min(runtime.GOMAXPROCS(0), snap.ShardCount())
+	sections := make(chan rdbSection, workers)
+	done := make(chan struct{})
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	now := time.Now().UnixMilli()
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enc := &rdbSectionEncoder{compression: compression, encrypted: c != nil}
+			emit := func(sec rdbSection) bool {
+				select {
+				case sections <- sec:
+					return true
+				case <-done:
+					return false
+				}
+			}
+			for {
+				idx := int(next.Add(1) - 1)
+				if idx >= snap.ShardCount() || !enc.encodeShard(snap, idx, now, emit) {
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(sections)
+	}()
+
+	var total, ordinal uint64
+	for sec := range sections {
+		if c != nil {
+			sec.ordinal = ordinal
+			sec = sealRDBSection(c, sec)
+		}
+		if _, err := out.Write(sec.buf); err != nil {
+			close(done)
+			for range sections {
+			}
+			return err
+		}
+		total += uint64(sec.entries)
+		ordinal++
+	}
+
+	trailer := binary.BigEndian.AppendUint64([]byte{rdbTypeEnd}, total)
+	if c != nil {
+		trailer = binary.BigEndian.AppendUint64(trailer, ordinal)
+		trailer = c.seal(trailer, nil, trailer)
+	}
+	if _, err := out.Write(trailer); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+type rdbSectionEncoder struct {
+	compression RDBCompression
+	// encrypted leaves the data length, checksum and data of sections to
+	// sealRDBSection.
+	encrypted bool
+	entries   []rdbEntry
+	meta      bool
+	data      []byte
+	count     int
+	zbuf      bytes.Buffer
+	zw        *flate.Writer
+}
+
+func (e *rdbSectionEncoder) encodeShard(snap *Snapshot, idx int, now int64, emit func(rdbSection) bool) bool {
+	e.entries = e.entries[:0]
+	snap.IterateShard(idx, func(key string, entry Entry) bool {
+		if entry.ExpiresAt > 0 && entry.ExpiresAt <= now {
+			return true
+		}
+		e.entries = append(e.entries, rdbEntry{Key: key, Value: entry.Value, ExpiresAt: entry.ExpiresAt, Meta: entry.Meta})
+		return true
+	})
+
+	e.meta = slices.ContainsFunc(e.entries, func(ent rdbEntry) bool { return ent.Meta != Meta{} })
+	var attrs []byte
+	for i := range e.entries {
+		ent := &e.entries[i]
+		e.data = binary.AppendUvarint(e.data, uint64(len(ent.Key)))
+		e.data = append(e.data, ent.Key...)
+		e.data = binary.AppendUvarint(e.data, uint64(len(ent.Value)))
+		e.data = append(e.data, ent.Value...)
+		e.data = binary.AppendVarint(e.data, ent.ExpiresAt)
+		if e.meta {
+			attrs = appendMetaAttrs(attrs[:0], ent.Meta)
+			e.data = binary.AppendUvarint(e.data, uint64(len(attrs)))
+			e.data = append(e.data, attrs...)
+		}
+		e.count++
+		if len(e.data) >= rdbSectionSize && !emit(e.flush(idx)) {
+			return false
+		}
+	}
+	clear(e.entries)
+	if e.count > 0 {
+		return emit(e.flush(idx))
+	}
+	return true
+}
+
+func (e *rdbSectionEncoder) flush(idx int) rdbSection {
+	data, compression := e.data, RDBCompressionNone
+	if e.compression == RDBCompressionDeflate {
+		e.zbuf.Reset()
+		if e.zw == nil {
+			e.zw, _ = flate.NewWriter(&e.zbuf, flate.BestSpeed)
+		} else {
+			e.zw.Reset(&e.zbuf)
+		}
+		_, _ = e.zw.Write(e.data)
+		_ = e.zw.Close()
+		// Keep sections that do not shrink uncompressed.
+		if e.zbuf.Len() < len(e.data) {
+			data, compression = e.zbuf.Bytes(), RDBCompressionDeflate
+		}
+	}
+
+	buf := make([]byte, 0, rdbSectionHeader+len(data)+64)
+	if e.meta {
+		buf = append(buf, rdbTypeSectionMeta)
+	} else {
+		buf = append(buf, rdbTypeSection)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(idx))
+	buf = append(buf, byte(compression))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(e.count))
+	if e.encrypted {
+		buf = append(buf, data...)
+	} else {
+		buf = appendRDBSectionData(buf, data)
+	}
+
+	sec := rdbSection{buf: buf, entries: e.count}
+	e.data, e.count = e.data[:0], 0
+	return sec
+}
+
+func appendRDBSectionData(buf, data []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(data, crc32c))
+	return append(buf, data...)
+}
+
+// sealRDBSection seals the data of sec, encoded by an encrypted
+// rdbSectionEncoder, and completes it.
+func sealRDBSection(c *fileCipher, sec rdbSection) rdbSection {
+	data := c.seal(nil, sec.buf[rdbSectionAAD:], rdbSectionAD(sec))
+	buf := make([]byte, 0, rdbSectionHeader+len(data))
+	sec.buf = appendRDBSectionData(append(buf, sec.buf[:rdbSectionAAD]...), data)
+	return sec
+}
+
+// decodeRDB loads a snapshot written by encodeRDB, or by an earlier version,
+// into storage and returns the number of entries and the last sequence
+// number. An encrypted snapshot is decrypted with keys. Entries that expired
+// after the snapshot was taken are loaded as well; the caller purges them
+// and reports how many there were.
+func decodeRDB(r *bufio.Reader, storage *ConcurrentMap, keys *Keyring) (int, int64, error) {
+	h, err := readRDBHeader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !h.sectioned() {
+		n, err := decodeRDBGob(r, storage)
+		return n, h.lastSeq, err
+	}
+	c, err := h.cipher(keys)
+	if err != nil {
+		return 0, h.lastSeq, err
+	}
+	n, err := decodeRDBSections(r, storage, h, c)
+	return n, h.lastSeq, err
+}
+
+// countRDBEntries returns the number of entries in the snapshot at path,
+// read from the trailer. Older gob snapshots have to be decoded in full.
+func countRDBEntries(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h, err := readRDBHeader(bufio.NewReader(f))
+	if err != nil {
+		return 0, err
+	}
+	if !h.sectioned() {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		br := bufio.NewReader(f)
+		if _, err := readRDBHeader(br); err != nil {
+			return 0, err
+		}
+		var entries []rdbEntry
+		if err := gob.NewDecoder(br).Decode(&entries); err != nil {
+			return 0, err
+		}
+		return int64(len(entries)), nil
+	}
+
+	trailer := make([]byte, h.trailerSize())
+	if _, err := f.Seek(-int64(len(trailer)), io.SeekEnd); err != nil {
+		return 0, fmt.Errorf("%w: truncated file", ErrRDBCorrupt)
+	}
+	if _, err := io.ReadFull(f, trailer); err != nil {
+		return 0, truncatedRDB(err)
+	}
+	if trailer[0] != rdbTypeEnd {
+		return 0, fmt.Errorf("%w: missing trailer", ErrRDBCorrupt)
+	}
+	return int64(binary.BigEndian.Uint64(trailer[1:9])), nil
+}
+
+func decodeRDBGob(r io.Reader, storage *ConcurrentMap) (int, error) {
+	var entries []rdbEntry
+	if err := gob.NewDecoder(r).Decode(&entries); err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		storage.SetEntry(e.Key, Entry{Value: e.Value, ExpiresAt: e.ExpiresAt, Meta: e.Meta})
+	}
+	return len(entries), nil
+}
+
+// decodeRDBSections reads the sections in order, verifying each checksum
+// before handing the section to a pool of workers that decompress and apply
+// it, and finally checks the entry count and checksum of the whole file.
+func decodeRDBSections(r *bufio.Reader, storage *ConcurrentMap, h rdbFileHeader, c *fileCipher) (int, error) {
+	crc := crc32.New(crc32c)
+	crc.Write(h.bytes())
+	tr := io.TeeReader(r, crc)
+
+	workers := runtime.GOMAXPROCS(0)
+	work := make(chan rdbSection, workers)
+	failed := make(chan struct{})
+	var loaded atomic.Int64
+	var firstErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(failed)
+		})
+	}
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dec := &rdbSectionDecoder{cipher: c}
+			for sec := range work {
+				n, err := dec.apply(sec, storage)
+				loaded.Add(int64(n))
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	total, err := readRDBSections(r, tr, crc, c, work, failed)
+	close(work)
+	wg.Wait()
+	if err != nil {
+		return int(loaded.Load()), err
+	}
+	if firstErr != nil {
+		return int(loaded.Load()), firstErr
+	}
+	if n := loaded.Load(); uint64(n) != total {
+		return int(n), fmt.Errorf("%w: trailer counts %d entries, sections hold %d", ErrRDBCorrupt, total, n)
+	}
+	return int(total), nil
+}
+
+// readRDBSections feeds the sections read through tr to work and returns the
+// entry count from the trailer once its checksum, and its seal in an
+// encrypted file, match.
+func readRDBSections(r io.Reader, tr io.Reader, crc hash.Hash32, c *fileCipher, work chan<- rdbSection, failed <-chan struct{}) (uint64, error) {
+	var head [rdbSectionHeader]byte
+	var ordinal uint64
+	for {
+		if _, err := io.ReadFull(tr, head[:1]); err != nil {
+			return 0, truncatedRDB(err)
+		}
+		switch head[0] {
+		case rdbTypeSection, rdbTypeSectionMeta:
+			if _, err := io.ReadFull(tr, head[1:]); err != nil {
+				return 0, truncatedRDB(err)
+			}
+			size := binary.BigEndian.Uint32(head[10:14])
+			if size > maxRDBSectionLength {
+				return 0, fmt.Errorf("%w: section length %d", ErrRDBCorrupt, size)
+			}
+			sec := rdbSection{buf: make([]byte, rdbSectionHeader+int(size))}
+			copy(sec.buf, head[:])
+			if _, err := io.ReadFull(tr, sec.buf[rdbSectionHeader:]); err != nil {
+				return 0, truncatedRDB(err)
+			}
+			if crc32.Checksum(sec.buf[rdbSectionHeader:], crc32c) != binary.BigEndian.Uint32(head[14:18]) {
+				return 0, fmt.Errorf("%w: section checksum mismatch", ErrRDBCorrupt)
+			}
+			sec.entries = int(binary.BigEndian.Uint32(head[6:10]))
+			sec.ordinal = ordinal
+			ordinal++
+			select {
+			case work <- sec:
+			case <-failed:
+				return 0, nil
+			}
+		case rdbTypeEnd:
+			trailer, err := readRDBTrailer(tr, c, ordinal)
+			if err != nil {
+				return 0, err
+			}
+			want := crc.Sum32()
+			var got [4]byte
+			if _, err := io.ReadFull(r, got[:]); err != nil {
+				return 0, truncatedRDB(err)
+			}
+			if binary.BigEndian.Uint32(got[:]) != want {
+				return 0, fmt.Errorf("%w: file checksum mismatch", ErrRDBCorrupt)
+			}
+			return binary.BigEndian.Uint64(trailer[1:9]), nil
+		default:
+			return 0, fmt.Errorf("%w: unknown block type %#x", ErrRDBCorrupt, head[0])
+		}
+	}
+}
+
+// readRDBTrailer reads the rest of the trailer, whose type byte has been
+// read, up to the file checksum. In an encrypted file it checks the seal and
+// that the file holds the sections it counts.
+func readRDBTrailer(r io.Reader, c *fileCipher, sections uint64) ([]byte, error) {
+	const counts = 1 + 8 + 8
+	sealed := c != nil
+	trailer := make([]byte, 1+8, 1+8+rdbTrailerSealSize)
+	if sealed {
+		trailer = trailer[:cap(trailer)]
+	}
+	trailer[0] = rdbTypeEnd
+	if _, err := io.ReadFull(r, trailer[1:]); err != nil {
+		return nil, truncatedRDB(err)
+	}
+	if !sealed {
+		return trailer, nil
+	}
+	if _, err := c.open(trailer[counts:], trailer[:counts]); err != nil {
+		return nil, fmt.Errorf("%w: trailer seal mismatch", ErrRDBCorrupt)
+	}
+	if n := binary.BigEndian.Uint64(trailer[9:counts]); n != sections {
+		return nil, fmt.Errorf("%w: trailer counts %d sections, file holds %d", ErrRDBCorrupt, n, sections)
+	}
+	return trailer, nil
+}
+
+func truncatedRDB(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated file", ErrRDBCorrupt)
+	}
+	return err
+}
+
+type rdbSectionDecoder struct {
+	cipher *fileCipher
+	zr     io.ReadCloser
+	buf    bytes.Buffer
+}
+
+// apply decodes a section whose checksum has been verified and stores its
+// entries.
+func (d *rdbSectionDecoder) apply(sec rdbSection, storage *ConcurrentMap) (int, error) {
+	return d.each(sec, func(key []byte, entry Entry) {
+		// Values are copied so that they neither alias the reused buffer nor
+		// keep the whole section alive.
+		entry.Value = bytes.Clone(entry.Value)
+		storage.SetEntry(string(key), entry)
+	})
+}
+
+// each decodes a section whose checksum has been verified and calls fn for
+// every entry. key and the value are only valid during the call.
+func (d *rdbSectionDecoder) each(sec rdbSection, fn func(key []byte, entry Entry)) (int, error) {
+	data := sec.buf[rdbSectionHeader:]
+	if d.cipher != nil {
+		var err error
+		if data, err = d.cipher.open(data, rdbSectionAD(sec)); err != nil {
+			return 0, fmt.Errorf("%w: decrypt section: %v", ErrRDBCorrupt, err)
+		}
+	}
+	switch RDBCompression(sec.buf[5]) {
+	case RDBCompressionNone:
+	case RDBCompressionDeflate:
+		if d.zr == nil {
+			d.zr = flate.NewReader(bytes.NewReader(data))
+		} else {
+			_ = d.zr.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+		}
+		d.buf.Reset()
+		if _, err := d.buf.ReadFrom(d.zr); err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrRDBCorrupt, err)
+		}
+		data = d.buf.Bytes()
+	default:
+		return 0, fmt.Errorf("%w: unknown compression %d", ErrRDBCorrupt, sec.buf[5])
+	}
+
+	n := 0
+	for len(data) > 0 {
+		key, rest, ok := readRDBBytes(data)
+		if !ok {
+			return n, fmt.Errorf("%w: bad entry", ErrRDBCorrupt)
+		}
+		value, rest, ok := readRDBBytes(rest)
+		if !ok {
+			return n, fmt.Errorf("%w: bad entry", ErrRDBCorrupt)
+		}
+		expiresAt, size := binary.Varint(rest)
+		if size <= 0 {
+			return n, fmt.Errorf("%w: bad entry", ErrRDBCorrupt)
+		}
+		data = rest[size:]
+		var meta Meta
+		if sec.buf[0] == rdbTypeSectionMeta {
+			attrs, rest, ok := readRDBBytes(data)
+			if !ok {
+				return n, fmt.Errorf("%w: bad entry", ErrRDBCorrupt)
+			}
+			var err error
+			if meta, err = decodeMetaAttrs(attrs); err != nil {
+				return n, fmt.Errorf("%w: %v", ErrRDBCorrupt, err)
+			}
+			data = rest
+		}
+		fn(key, Entry{Value: value, ExpiresAt: expiresAt, Meta: meta})
+		n++
+	}
+	if n != sec.entries {
+		return n, fmt.Errorf("%w: section counts %d entries, holds %d", ErrRDBCorrupt, sec.entries, n)
+	}
+	return n, nil
+}
+
+func readRDBBytes(buf []byte) ([]byte, []byte, bool) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || n > uint64(len(buf)-size) {
+		return nil, nil, false
+	}
+	end := size + int(n)
+	return buf[size:end], buf[end:], true
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ScanStartCursor starts a scan and is returned again once it is complete.
+const ScanStartCursor = "0"
+
+// Scan walks the keyspace shard by shard, in the order keys were inserted
+// within each shard, examining at most count keys per call. The cursor
+// records the shard and the scan position of the last key visited; a key
+// keeps its position until it is deleted, so every key that exists for the
+// whole duration of a scan is returned exactly once even while other keys
+// are written or deleted concurrently. Keys rejected by filter still count
+// toward count, so a page may be empty while the returned cursor is not
+// finished.
+func (cm *ConcurrentMap) Scan(cursor string, count int, filter func(key string) bool) ([]string, string, error) {
+	shardIdx, after, err := decodeScanCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if shardIdx >= len(cm.shards) {
+		return nil, "", ErrInvalidCursor
+	}
+	if count <= 0 {
+		count = 10
+	}
+
+	candidates := make([]string, 0, count)
+	now := time.Now().UnixMilli()
+	for ; shardIdx < len(cm.shards); shardIdx++ {
+		shard := cm.shards[shardIdx]
+		shard.mu.RLock()
+		i, _ := slices.BinarySearchFunc(shard.order, after+1, func(s scanSlot, pos uint64) int {
+			return cmp.Compare(s.pos, pos)
+		})
+		for ; i < len(shard.order) && count > 0; i++ {
+			slot := shard.order[i]
+			it, ok := shard.items[slot.key]
+			if !ok || it.pos != slot.pos {
+				continue
+			}
+			count--
+			after = slot.pos
+			if it.ExpiresAt > 0 && it.ExpiresAt <= now {
+				continue
+			}
+			candidates = append(candidates, slot.key)
+		}
+		done := i == len(shard.order)
+		shard.mu.RUnlock()
+
+		if !done {
+			return filterKeys(candidates, filter), encodeScanCursor(shardIdx, after), nil
+		}
+		after = 0
+	}
+	return filterKeys(candidates, filter), ScanStartCursor, nil
+}
+
+// scanSlot is an entry of the scan order of a shard. It is a hole once the
+// key is removed or stored again at a later position.
+type scanSlot struct {
+	key string
+	pos uint64
+}
+
+// put stores it under key. A key that is already present keeps its scan
+// position, a new one is appended to the scan order.
+func (s *Shard) put(key string, it *item) {
+	if old, exists := s.items[key]; exists {
+		it.pos = old.pos
+	} else {
+		s.nextPos++
+		it.pos = s.nextPos
+		s.order = append(s.order, scanSlot{key: key, pos: it.pos})
+	}
+	s.items[key] = it
+}
+
+// remove deletes key, compacting the scan order once half of it are holes.
+// Positions are kept, so cursors stay valid.
+func (s *Shard) remove(key string) {
+	delete(s.items, key)
+	s.holes++
+	if s.holes < len(s.order)/2 {
+		return
+	}
+	live := s.order[:0]
+	for _, slot := range s.order {
+		if it, ok := s.items[slot.key]; ok && it.pos == slot.pos {
+			live = append(live, slot)
+		}
+	}
+	clear(s.order[len(live):])
+	s.order, s.holes = live, 0
+}
+
+func filterKeys(keys []string, filter func(key string) bool) []string {
+	if filter == nil {
+		return keys
+	}
+	return slices.DeleteFunc(keys, func(key string) bool { return !filter(key) })
+}
+
+func encodeScanCursor(shardIdx int, after uint64) string {
+	buf := binary.AppendUvarint(nil, uint64(shardIdx))
+	buf = binary.AppendUvarint(buf, after)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeScanCursor(cursor string) (int, uint64, error) {
+	if cursor == "" || cursor == ScanStartCursor {
+		return 0, 0, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, ErrInvalidCursor
+	}
+	shardIdx, n := binary.Uvarint(buf)
+	if n <= 0 || shardIdx > uint64(^uint32(0)) {
+		return 0, 0, ErrInvalidCursor
+	}
+	after, m := binary.Uvarint(buf[n:])
+	if m <= 0 || n+m != len(buf) {
+		return 0, 0, ErrInvalidCursor
+	}
+	return int(shardIdx), after, nil
+}
+
+// MatchGlob reports whether s matches the Redis-style glob pattern. It
+// supports '*', '?', character classes such as "[a-z]" or "[^abc]" and
+// backslash escapes. Unlike path.Match, '*' also matches '/' and a
+// malformed pattern never returns an error.
+func MatchGlob(pattern, s string) bool {
+	// After a mismatch, retry from the last '*' with it swallowing one more
+	// byte of s. Earlier stars never need to be revisited, which keeps this
+	// linear in len(pattern) * len(s).
+	p, i := 0, 0
+	starP, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				p++
+				starP, starI = p, i
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if matched, rest := matchGlobClass(pattern[p+1:], s[i]); matched {
+					p = len(pattern) - len(rest)
+					i++
+					continue
+				}
+			default:
+				if c == '\\' && p+1 < len(pattern) {
+					p++
+					c = pattern[p]
+				}
+				if c == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starI++
+		p, i = starP, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchGlobClass matches c against the character class starting right after
+// '[' and returns the pattern remaining after the closing ']'.
+func matchGlobClass(pattern string, c byte) (bool, string) {
+	negate := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		negate = true
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) >= 2:
+			if pattern[1] == c {
+				matched = true
+			}
+			pattern = pattern[2:]
+		case len(pattern) >= 3 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			pattern = pattern[3:]
+		default:
+			if pattern[0] == c {
+				matched = true
+			}
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return matched != negate, pattern
+}
@@ -0,0 +1,114 @@
+package storage
+
+import "sync"
+
+// Snapshot is a read-only view of a ConcurrentMap as it was at one instant.
+// It is copy-on-write: taking it only registers it with every shard, and
+// while it is open every change to a key first preserves the key's previous
+// entry for it. Reading it holds one shard's read lock at a time, so writers
+// are never held off for the whole read. Close it when done, to stop
+// preserving entries.
+type Snapshot struct {
+	cm     *ConcurrentMap
+	frozen []*frozenShard
+	once   sync.Once
+}
+
+// frozenShard holds the entries a shard had when a snapshot was taken for
+// the keys changed since, nil for keys that did not exist. It is guarded by
+// the shard's lock.
+type frozenShard struct {
+	entries map[string]*Entry
+}
+
+// Snapshot takes a snapshot of cm. All shards are locked while it is taken,
+// so it reflects every operation on cm either entirely or not at all.
+func (cm *ConcurrentMap) Snapshot() *Snapshot {
+	snap := &Snapshot{cm: cm, frozen: make([]*frozenShard, len(cm.shards))}
+	for _, shard := range cm.shards {
+		shard.mu.Lock()
+	}
+	for i, shard := range cm.shards {
+		snap.frozen[i] = &frozenShard{entries: make(map[string]*Entry)}
+		shard.frozen = append(shard.frozen, snap.frozen[i])
+	}
+	for _, shard := range cm.shards {
+		shard.mu.Unlock()
+	}
+	return snap
+}
+
+// preserve records the current entry of key in the open snapshots that do
+// not hold one for it yet. The caller holds the shard's write lock and is
+// about to change key.
+func (s *Shard) preserve(key string) {
+	for _, f := range s.frozen {
+		if _, ok := f.entries[key]; ok {
+			continue
+		}
+		var old *Entry
+		if it, ok := s.items[key]; ok {
+			e := it.Entry
+			old = &e
+		}
+		f.entries[key] = old
+	}
+}
+
+// preserveAll records, in the open snapshots, the current entries of the
+// shard and the absence of the keys in next that it does not hold, before
+// its map is replaced by next.
+func (s *Shard) preserveAll(next map[string]*item) {
+	if len(s.frozen) == 0 {
+		return
+	}
+	for key := range s.items {
+		s.preserve(key)
+	}
+	for key := range next {
+		s.preserve(key)
+	}
+}
+
+func (snap *Snapshot) ShardCount() int {
+	return len(snap.frozen)
+}
+
+// IterateShard calls fn for every entry shard idx held when the snapshot was
+// taken and reports whether fn accepted them all.
+func (snap *Snapshot) IterateShard(idx int, fn func(key string, entry Entry) bool) bool {
+	shard := snap.cm.shards[idx]
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	frozen := snap.frozen[idx].entries
+	for key, it := range shard.items {
+		if _, changed := frozen[key]; changed {
+			continue
+		}
+		if !fn(key, it.Entry) {
+			return false
+		}
+	}
+	for key, e := range frozen {
+		if e != nil && !fn(key, *e) {
+			return false
+		}
+	}
+	return true
+}
+
+// Close releases the snapshot. It must not be read afterwards.
+func (snap *Snapshot) Close() {
+	snap.once.Do(func() {
+		for i, shard := range snap.cm.shards {
+			shard.mu.Lock()
+			for j, f := range shard.frozen {
+				if f == snap.frozen[i] {
+					shard.frozen = append(shard.frozen[:j], shard.frozen[j+1:]...)
+					break
+				}
+			}
+			shard.mu.Unlock()
+		}
+	})
+}
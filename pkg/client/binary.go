@@ -0,0 +1,266 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shinerio/gopher-kv/pkg/protocol"
+)
+
+var errClientClosed = errors.New("client closed")
+
+// binaryTransport sends requests over one connection speaking the binary
+// protocol, any number at a time, matching responses by request ID. A broken
+// connection fails its pending requests and is redialed by the next one.
+type binaryTransport struct {
+	addr    string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conn   *binaryConn
+	nextID uint32
+	closed bool
+}
+
+type binaryConn struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu      sync.Mutex
+	pending map[uint32]chan binaryResult
+	err     error
+}
+
+type binaryResult struct {
+	hdr   protocol.FrameHeader
+	key   []byte
+	value []byte
+	err   error
+}
+
+func newBinaryTransport(addr string, timeout time.Duration) *binaryTransport {
+	return &binaryTransport{addr: addr, timeout: timeout}
+}
+
+// acquire returns the live connection, dialing one if needed, and a new
+// request ID.
+func (t *binaryTransport) acquire() (*binaryConn, uint32, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, 0, errClientClosed
+	}
+	if t.conn == nil || t.conn.failed() {
+		conn, err := net.DialTimeout("tcp", t.addr, t.timeout)
+		if err != nil {
+			return nil, 0, err
+		}
+		t.conn = &binaryConn{
+			conn:    conn,
+			timeout: t.timeout,
+			w:       bufio.NewWriter(conn),
+			pending: make(map[uint32]chan binaryResult),
+		}
+		go t.conn.readLoop()
+	}
+	t.nextID++
+	return t.conn, t.nextID, nil
+}
+
+func (t *binaryTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.conn != nil {
+		t.conn.fail(errClientClosed)
+	}
+	return nil
+}
+
+// roundTrip sends a request and waits for its response.
+func (t *binaryTransport) roundTrip(req protocol.FrameHeader, key, value []byte) (binaryResult, error) {
+	c, id, err := t.acquire()
+	if err != nil {
+		return binaryResult{}, err
+	}
+	req.ID = id
+	req.KeyLen = uint32(len(key))
+	req.ValueLen = uint32(len(value))
+
+	ch := make(chan binaryResult, 1)
+	if err := c.register(id, ch); err != nil {
+		return binaryResult{}, err
+	}
+	if err := c.write(req, key, value); err != nil {
+		c.fail(err)
+		return binaryResult{}, err
+	}
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		return res, res.err
+	case <-timer.C:
+		c.unregister(id)
+		return binaryResult{}, fmt.Errorf("request to %s timed out after %v", t.addr, t.timeout)
+	}
+}
+
+// call is roundTrip returning an error for a response with an error status.
+func (t *binaryTransport) call(op protocol.Op, key []byte, arg int64) (binaryResult, error) {
+	res, err := t.roundTrip(protocol.FrameHeader{Op: op, Arg: arg}, key, nil)
+	if err != nil {
+		return res, err
+	}
+	return res, statusError(res)
+}
+
+// callJSON calls an administrative op and decodes its JSON response data
+// into v.
+func (t *binaryTransport) callJSON(op protocol.Op, key []byte, v any) error {
+	res, err := t.call(op, key, 0)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(res.value, v)
+}
+
+func statusError(res binaryResult) error {
+	if res.hdr.Status != protocol.CodeSuccess {
+		return fmt.Errorf("server error: code=%d, msg=%s", res.hdr.Status, res.value)
+	}
+	return nil
+}
+
+// write sends a request frame. A write that does not finish within the
+// timeout fails, leaving the frame cut short, so the caller fails the
+// connection.
+func (c *binaryConn) write(hdr protocol.FrameHeader, key, value []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	c.w.Write(hdr.AppendTo(make([]byte, 0, protocol.FrameHeaderSize)))
+	c.w.Write(key)
+	c.w.Write(value)
+	return c.w.Flush()
+}
+
+func (c *binaryConn) register(id uint32, ch chan binaryResult) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.pending[id] = ch
+	return nil
+}
+
+func (c *binaryConn) unregister(id uint32) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *binaryConn) failed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// fail closes the connection and fails its pending requests with err.
+func (c *binaryConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	for id, ch := range c.pending {
+		ch <- binaryResult{err: err}
+		delete(c.pending, id)
+	}
+}
+
+// readLoop delivers the responses read from the connection to the requests
+// waiting for them, until the connection fails.
+func (c *binaryConn) readLoop() {
+	r := bufio.NewReader(c.conn)
+	buf := make([]byte, protocol.FrameHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			c.fail(err)
+			return
+		}
+		hdr := protocol.ParseFrameHeader(buf)
+		body := make([]byte, int(hdr.KeyLen)+int(hdr.ValueLen))
+		if _, err := io.ReadFull(r, body); err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[hdr.ID]
+		delete(c.pending, hdr.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- binaryResult{hdr: hdr, key: body[:hdr.KeyLen], value: body[hdr.KeyLen:]}
+		}
+	}
+}
+
+func (t *binaryTransport) set(key string, value []byte, ttl time.Duration) error {
+	req := protocol.FrameHeader{Op: protocol.OpSet, Arg: ttlMillis(ttl)}
+	res, err := t.roundTrip(req, []byte(key), value)
+	if err != nil {
+		return err
+	}
+	return statusError(res)
+}
+
+func (t *binaryTransport) get(key string) ([]byte, error) {
+	res, err := t.roundTrip(protocol.FrameHeader{Op: protocol.OpGet}, []byte(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.hdr.Status == protocol.CodeKeyNotFound {
+		return nil, nil
+	}
+	if err := statusError(res); err != nil {
+		return nil, err
+	}
+	return res.value, nil
+}
+
+func (t *binaryTransport) scanPage(cursor string, opts ScanOptions) ([]string, string, error) {
+	var value []byte
+	value = protocol.AppendBytes(value, []byte(opts.Match))
+	value = protocol.AppendBytes(value, []byte(opts.Prefix))
+	req := protocol.FrameHeader{Op: protocol.OpScan, Arg: int64(opts.Count)}
+	res, err := t.roundTrip(req, []byte(cursor), value)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := statusError(res); err != nil {
+		return nil, "", err
+	}
+	var keys []string
+	for rest := res.value; len(rest) > 0; {
+		key, next, ok := protocol.ReadBytes(rest)
+		if !ok {
+			return nil, "", fmt.Errorf("invalid keys in response")
+		}
+		keys = append(keys, string(key))
+		rest = next
+	}
+	return keys, string(res.key), nil
+}
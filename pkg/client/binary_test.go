@@ -0,0 +1,187 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shinerio/gopher-kv/pkg/protocol"
+)
+
+type testFrame struct {
+	hdr        protocol.FrameHeader
+	key, value []byte
+}
+
+// listenBinary accepts connections on a loopback port and hands each to
+// serve, returning the address to dial.
+func listenBinary(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func readTestFrame(r io.Reader) (testFrame, error) {
+	buf := make([]byte, protocol.FrameHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return testFrame{}, err
+	}
+	hdr := protocol.ParseFrameHeader(buf)
+	body := make([]byte, int(hdr.KeyLen)+int(hdr.ValueLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return testFrame{}, err
+	}
+	return testFrame{hdr, body[:hdr.KeyLen], body[hdr.KeyLen:]}, nil
+}
+
+func writeTestFrame(w io.Writer, f testFrame) error {
+	f.hdr.KeyLen = uint32(len(f.key))
+	f.hdr.ValueLen = uint32(len(f.value))
+	_, err := w.Write(slices.Concat(f.hdr.AppendTo(nil), f.key, f.value))
+	return err
+}
+
+func TestBinaryTransportMatchesResponsesByID(t *testing.T) {
+	const n = 20
+	addr := listenBinary(t, func(conn net.Conn) {
+		// Wait for all requests, then answer them last to first, each GET
+		// with its own key as the value.
+		var reqs []testFrame
+		for range n {
+			f, err := readTestFrame(conn)
+			if err != nil {
+				return
+			}
+			reqs = append(reqs, f)
+		}
+		writeTestFrame(conn, testFrame{hdr: protocol.FrameHeader{Op: protocol.OpGet, ID: 1 << 30}, value: []byte("stray")})
+		for _, req := range slices.Backward(reqs) {
+			resp := testFrame{hdr: protocol.FrameHeader{Op: req.hdr.Op, ID: req.hdr.ID}, value: req.key}
+			if err := writeTestFrame(conn, resp); err != nil {
+				return
+			}
+		}
+		io.Copy(io.Discard, conn)
+	})
+	c := NewClient("", WithBinaryTransport(addr))
+	defer c.Close()
+
+	errs := make(chan error, n)
+	for i := range n {
+		go func() {
+			key := fmt.Sprintf("key-%d", i)
+			value, err := c.Get(key)
+			if err == nil && string(value) != key {
+				err = fmt.Errorf("get %s returned %q", key, value)
+			}
+			errs <- err
+		}()
+	}
+	for range n {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBinaryTransportRedialsAfterFailure(t *testing.T) {
+	var conns atomic.Int32
+	addr := listenBinary(t, func(conn net.Conn) {
+		for first := conns.Add(1) == 1; ; {
+			req, err := readTestFrame(conn)
+			if err != nil || first {
+				// The first connection breaks while a request is pending.
+				return
+			}
+			if err := writeTestFrame(conn, testFrame{hdr: protocol.FrameHeader{Op: req.hdr.Op, ID: req.hdr.ID}}); err != nil {
+				return
+			}
+		}
+	})
+	c := NewClient("", WithBinaryTransport(addr))
+	defer c.Close()
+
+	if err := c.Health(); err == nil {
+		t.Fatal("expected the request on the broken connection to fail")
+	}
+	if err := c.Health(); err != nil {
+		t.Fatalf("expected the next request to redial, got %v", err)
+	}
+
+	c.Close()
+	if err := c.Health(); err != errClientClosed {
+		t.Fatalf("expected %v after Close, got %v", errClientClosed, err)
+	}
+}
+
+func TestBinaryTransportRoundsSubMillisecondTTLsUp(t *testing.T) {
+	args := make(chan int64, 2)
+	addr := listenBinary(t, func(conn net.Conn) {
+		for {
+			req, err := readTestFrame(conn)
+			if err != nil {
+				return
+			}
+			args <- req.hdr.Arg
+			if err := writeTestFrame(conn, testFrame{hdr: protocol.FrameHeader{Op: req.hdr.Op, ID: req.hdr.ID, Arg: 1}}); err != nil {
+				return
+			}
+		}
+	})
+	c := NewClient("", WithBinaryTransport(addr))
+	defer c.Close()
+
+	if err := c.Set("k", []byte("v"), 500*time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Expire("k", time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"set", "expire"} {
+		if got := <-args; got != 1 {
+			t.Fatalf("%s: expected a TTL of 1ms, got %dms", op, got)
+		}
+	}
+}
+
+func TestBinaryTransportWriteTimesOut(t *testing.T) {
+	// The server never reads, so the request cannot be written out.
+	addr := listenBinary(t, func(conn net.Conn) {
+		time.Sleep(5 * time.Second)
+	})
+	bt := newBinaryTransport(addr, 100*time.Millisecond)
+	defer bt.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bt.set("k", make([]byte, 64<<20), 0)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the write to fail")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the write did not time out")
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"iter"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/shinerio/gopher-kv/pkg/protocol"
 )
@@ -16,15 +19,42 @@ import (
 type Client struct {
 	baseURL    string
 	httpClient *http.Client
+	// bin, if set, carries the requests instead of HTTP.
+	bin *binaryTransport
 }
 
-func NewClient(baseURL string) *Client {
-	return &Client{
+// Option configures a Client.
+type Option func(*Client)
+
+// WithBinaryTransport sends the requests over the binary protocol listening
+// at addr (host:port) instead of HTTP; the base URL is then unused. Requests
+// made concurrently share one connection.
+func WithBinaryTransport(addr string) Option {
+	return func(c *Client) {
+		c.bin = newBinaryTransport(addr, c.httpClient.Timeout)
+	}
+}
+
+func NewClient(baseURL string, opts ...Option) *Client {
+	c := &Client{
 		baseURL: baseURL,
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Close releases the connections of the client.
+func (c *Client) Close() error {
+	if c.bin != nil {
+		return c.bin.Close()
+	}
+	c.httpClient.CloseIdleConnections()
+	return nil
 }
 
 func (c *Client) doRequest(method, path string, body interface{}) (*protocol.Response, error) {
@@ -59,13 +89,38 @@ func (c *Client) doRequest(method, path string, body interface{}) (*protocol.Res
 	return &result, nil
 }
 
+// bodyKey returns key as the key and key_b64 fields of a JSON request: keys
+// that are not valid UTF-8 would not survive JSON encoding and go in base64.
+func bodyKey(key string) (string, string) {
+	if utf8.ValidString(key) {
+		return key, ""
+	}
+	return "", base64.StdEncoding.EncodeToString([]byte(key))
+}
+
+// ttlMillis converts ttl to milliseconds, rounding a positive TTL under a
+// millisecond up rather than down to 0, which would mean no expiry.
+func ttlMillis(ttl time.Duration) int64 {
+	if ttl > 0 && ttl < time.Millisecond {
+		return 1
+	}
+	return ttl.Milliseconds()
+}
+
 func (c *Client) Set(key string, value []byte, ttl time.Duration) error {
+	if c.bin != nil {
+		return c.bin.set(key, value, ttl)
+	}
 	req := protocol.SetRequest{
-		Key:   key,
 		Value: base64.StdEncoding.EncodeToString(value),
 	}
+	req.Key, req.KeyB64 = bodyKey(key)
 	if ttl > 0 {
-		req.TTL = int(ttl.Seconds())
+		if ttl%time.Second == 0 {
+			req.TTL = int(ttl / time.Second)
+		} else {
+			req.TTLMs = ttlMillis(ttl)
+		}
 	}
 
 	resp, err := c.doRequest("PUT", "/v1/key", req)
@@ -79,6 +134,9 @@ func (c *Client) Set(key string, value []byte, ttl time.Duration) error {
 }
 
 func (c *Client) Get(key string) ([]byte, error) {
+	if c.bin != nil {
+		return c.bin.get(key)
+	}
 	resp, err := c.doRequest("GET", "/v1/key?k="+url.QueryEscape(key), nil)
 	if err != nil {
 		return nil, err
@@ -109,6 +167,10 @@ func (c *Client) Get(key string) ([]byte, error) {
 }
 
 func (c *Client) Delete(key string) error {
+	if c.bin != nil {
+		_, err := c.bin.call(protocol.OpDelete, []byte(key), 0)
+		return err
+	}
 	resp, err := c.doRequest("DELETE", "/v1/key?k="+url.QueryEscape(key), nil)
 	if err != nil {
 		return err
@@ -124,6 +186,10 @@ func (c *Client) Del(key string) error {
 }
 
 func (c *Client) Exists(key string) (bool, error) {
+	if c.bin != nil {
+		res, err := c.bin.call(protocol.OpExists, []byte(key), 0)
+		return res.hdr.Arg == 1, err
+	}
 	value, err := c.Get(key)
 	if err != nil {
 		return false, err
@@ -132,6 +198,10 @@ func (c *Client) Exists(key string) (bool, error) {
 }
 
 func (c *Client) TTL(key string) (int, error) {
+	if c.bin != nil {
+		res, err := c.bin.call(protocol.OpTTL, []byte(key), 0)
+		return int(res.hdr.Arg), err
+	}
 	resp, err := c.doRequest("GET", "/v1/ttl?k="+url.QueryEscape(key), nil)
 	if err != nil {
 		return 0, err
@@ -153,7 +223,173 @@ func (c *Client) TTL(key string) (int, error) {
 	return int(ttl), nil
 }
 
+// PTTL returns the remaining TTL of key in milliseconds, or -1 when the key
+// has no expiry.
+func (c *Client) PTTL(key string) (int64, error) {
+	if c.bin != nil {
+		res, err := c.bin.call(protocol.OpPTTL, []byte(key), 0)
+		return res.hdr.Arg, err
+	}
+	resp, err := c.doRequest("GET", "/v1/pttl?k="+url.QueryEscape(key), nil)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Code != protocol.CodeSuccess {
+		return 0, fmt.Errorf("server error: code=%d, msg=%s", resp.Code, resp.Msg)
+	}
+
+	dataMap, ok := resp.Data.(map[string]interface{})
+	if !ok {
+		return 0, fmt.Errorf("invalid response data")
+	}
+
+	pttl, ok := dataMap["pttl"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("invalid pttl in response")
+	}
+
+	return int64(pttl), nil
+}
+
+// Expire sets a relative expiry on key with millisecond precision.
+func (c *Client) Expire(key string, ttl time.Duration) error {
+	if c.bin != nil {
+		_, err := c.bin.call(protocol.OpExpire, []byte(key), ttlMillis(ttl))
+		return err
+	}
+	ms := ttlMillis(ttl)
+	return c.expire(key, protocol.ExpireRequest{TTLMs: &ms})
+}
+
+// ExpireAt sets an absolute expiry on key with millisecond precision.
+func (c *Client) ExpireAt(key string, at time.Time) error {
+	if c.bin != nil {
+		_, err := c.bin.call(protocol.OpExpireAt, []byte(key), at.UnixMilli())
+		return err
+	}
+	ms := at.UnixMilli()
+	return c.expire(key, protocol.ExpireRequest{AtMs: &ms})
+}
+
+func (c *Client) expire(key string, req protocol.ExpireRequest) error {
+	req.Key, req.KeyB64 = bodyKey(key)
+	resp, err := c.doRequest("POST", "/v1/expire", req)
+	if err != nil {
+		return err
+	}
+	if resp.Code != protocol.CodeSuccess {
+		return fmt.Errorf("server error: code=%d, msg=%s", resp.Code, resp.Msg)
+	}
+	return nil
+}
+
+// Persist removes the expiry of key and reports whether it had one.
+func (c *Client) Persist(key string) (bool, error) {
+	if c.bin != nil {
+		res, err := c.bin.call(protocol.OpPersist, []byte(key), 0)
+		return res.hdr.Arg == 1, err
+	}
+	var req protocol.PersistRequest
+	req.Key, req.KeyB64 = bodyKey(key)
+	resp, err := c.doRequest("POST", "/v1/persist", req)
+	if err != nil {
+		return false, err
+	}
+	if resp.Code != protocol.CodeSuccess {
+		return false, fmt.Errorf("server error: code=%d, msg=%s", resp.Code, resp.Msg)
+	}
+
+	dataMap, ok := resp.Data.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("invalid response data")
+	}
+	persisted, _ := dataMap["persisted"].(bool)
+	return persisted, nil
+}
+
+// ScanOptions filters a key scan. Count bounds how many keys the server
+// examines per page; zero uses the server default.
+type ScanOptions struct {
+	Match  string
+	Prefix string
+	Count  int
+}
+
+// ScanPage fetches a single page of keys starting at cursor ("0" or "" for the
+// first page). The returned cursor is "0" once the scan is complete.
+func (c *Client) ScanPage(cursor string, opts ScanOptions) ([]string, string, error) {
+	if c.bin != nil {
+		return c.bin.scanPage(cursor, opts)
+	}
+	query := url.Values{"encoding": {"base64"}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	if opts.Match != "" {
+		query.Set("match", opts.Match)
+	}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Count > 0 {
+		query.Set("count", strconv.Itoa(opts.Count))
+	}
+
+	resp, err := c.doRequest("GET", "/v1/keys?"+query.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.Code != protocol.CodeSuccess {
+		return nil, "", fmt.Errorf("server error: code=%d, msg=%s", resp.Code, resp.Msg)
+	}
+
+	data, err := json.Marshal(resp.Data)
+	if err != nil {
+		return nil, "", err
+	}
+	var page protocol.ScanResponseData
+	if err := json.Unmarshal(data, &page); err != nil {
+		return nil, "", err
+	}
+	for i, key := range page.Keys {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid key in response: %w", err)
+		}
+		page.Keys[i] = string(decoded)
+	}
+	return page.Keys, page.Cursor, nil
+}
+
+// Scan iterates over every key matching opts, fetching pages lazily. Iteration
+// stops after the first error, which is yielded with an empty key.
+func (c *Client) Scan(opts ScanOptions) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		cursor := "0"
+		for {
+			keys, next, err := c.ScanPage(cursor, opts)
+			if err != nil {
+				yield("", err)
+				return
+			}
+			for _, key := range keys {
+				if !yield(key, nil) {
+					return
+				}
+			}
+			if next == "0" || next == "" {
+				return
+			}
+			cursor = next
+		}
+	}
+}
+
 func (c *Client) Health() error {
+	if c.bin != nil {
+		_, err := c.bin.call(protocol.OpPing, nil, 0)
+		return err
+	}
 	resp, err := c.doRequest("GET", "/v1/health", nil)
 	if err != nil {
 		return err
@@ -165,6 +401,13 @@ func (c *Client) Health() error {
 }
 
 func (c *Client) Stats() (*protocol.StatsResponseData, error) {
+	if c.bin != nil {
+		var stats protocol.StatsResponseData
+		if err := c.bin.callJSON(protocol.OpStats, nil, &stats); err != nil {
+			return nil, err
+		}
+		return &stats, nil
+	}
 	resp, err := c.doRequest("GET", "/v1/stats", nil)
 	if err != nil {
 		return nil, err
@@ -186,6 +429,13 @@ func (c *Client) Stats() (*protocol.StatsResponseData, error) {
 }
 
 func (c *Client) Snapshot() (*protocol.SnapshotResponseData, error) {
+	if c.bin != nil {
+		var snapshot protocol.SnapshotResponseData
+		if err := c.bin.callJSON(protocol.OpSnapshot, nil, &snapshot); err != nil {
+			return nil, err
+		}
+		return &snapshot, nil
+	}
 	resp, err := c.doRequest("POST", "/v1/snapshot", nil)
 	if err != nil {
 		return nil, err
@@ -203,3 +453,94 @@ func (c *Client) Snapshot() (*protocol.SnapshotResponseData, error) {
 	}
 	return &snapshot, nil
 }
+
+// Snapshots lists the RDB snapshots on the server, newest first.
+func (c *Client) Snapshots() ([]protocol.SnapshotInfo, error) {
+	if c.bin != nil {
+		var list protocol.SnapshotListResponseData
+		if err := c.bin.callJSON(protocol.OpSnapshots, nil, &list); err != nil {
+			return nil, err
+		}
+		return list.Snapshots, nil
+	}
+	resp, err := c.doRequest("GET", "/v1/snapshots", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != protocol.CodeSuccess {
+		return nil, fmt.Errorf("server error: code=%d, msg=%s", resp.Code, resp.Msg)
+	}
+	data, err := json.Marshal(resp.Data)
+	if err != nil {
+		return nil, err
+	}
+	var list protocol.SnapshotListResponseData
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	return list.Snapshots, nil
+}
+
+// RestoreSnapshot replaces the server's keyspace with the snapshot id.
+func (c *Client) RestoreSnapshot(id string) (*protocol.RestoreResponseData, error) {
+	if c.bin != nil {
+		var restored protocol.RestoreResponseData
+		if err := c.bin.callJSON(protocol.OpRestoreSnapshot, []byte(id), &restored); err != nil {
+			return nil, err
+		}
+		return &restored, nil
+	}
+	resp, err := c.doRequest("POST", "/v1/snapshots/"+url.PathEscape(id)+"/restore", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != protocol.CodeSuccess {
+		return nil, fmt.Errorf("server error: code=%d, msg=%s", resp.Code, resp.Msg)
+	}
+	data, err := json.Marshal(resp.Data)
+	if err != nil {
+		return nil, err
+	}
+	var restored protocol.RestoreResponseData
+	if err := json.Unmarshal(data, &restored); err != nil {
+		return nil, err
+	}
+	return &restored, nil
+}
+
+// RewriteAOF starts compacting the server's AOF in the background and
+// returns the rewrite status right after.
+func (c *Client) RewriteAOF() (*protocol.AOFStatusResponseData, error) {
+	return c.aofStatus(protocol.OpRewriteAOF, "POST", "/v1/aof/rewrite")
+}
+
+// AOFStatus reports the state of the server's AOF rewrites.
+func (c *Client) AOFStatus() (*protocol.AOFStatusResponseData, error) {
+	return c.aofStatus(protocol.OpAOFStatus, "GET", "/v1/aof/status")
+}
+
+func (c *Client) aofStatus(op protocol.Op, method, path string) (*protocol.AOFStatusResponseData, error) {
+	if c.bin != nil {
+		var status protocol.AOFStatusResponseData
+		if err := c.bin.callJSON(op, nil, &status); err != nil {
+			return nil, err
+		}
+		return &status, nil
+	}
+	resp, err := c.doRequest(method, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != protocol.CodeSuccess {
+		return nil, fmt.Errorf("server error: code=%d, msg=%s", resp.Code, resp.Msg)
+	}
+	data, err := json.Marshal(resp.Data)
+	if err != nil {
+		return nil, err
+	}
+	var status protocol.AOFStatusResponseData
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
@@ -0,0 +1,108 @@
+package protocol
+
+import "encoding/binary"
+
+// The binary protocol exchanges frames of a fixed header followed by the key
+// and the value, both raw bytes:
+//
+//	op uint8 | flags uint8 | status uint16 | request ID uint32
+//	| key length uint32 | value length uint32 | arg int64
+//
+// Integers are big-endian. A response carries the op and request ID of its
+// request; responses on a connection may come in any order. Status is
+// CodeSuccess or an error code, in which case the value is the error message.
+const FrameHeaderSize = 24
+
+type Op uint8
+
+const (
+	OpPing Op = iota + 1
+	OpGet
+	OpSet
+	OpDelete
+	OpExists
+	OpTTL
+	OpPTTL
+	OpExpire
+	OpExpireAt
+	OpPersist
+	OpScan
+	OpStats
+	OpSnapshot
+	OpSnapshots
+	OpRestoreSnapshot
+	OpRewriteAOF
+	OpAOFStatus
+)
+
+// Flags of an OpSet request, which then reports in arg whether it stored the
+// value.
+const (
+	FlagIfAbsent uint8 = 1 << iota
+	FlagIfPresent
+)
+
+// FrameHeader is the header of a request or response frame. The meaning of
+// Arg depends on the op:
+//
+//   - OpSet, OpExpire: the TTL in milliseconds, 0 for none with OpSet
+//   - OpExpireAt: the deadline in Unix milliseconds
+//   - OpScan: the page size; the key is the cursor and the value the match
+//     pattern and prefix, each a uvarint length and bytes
+//   - responses of OpGet: the remaining TTL in milliseconds, 0 for none
+//   - responses of OpTTL and OpPTTL: as the HTTP API returns them, in
+//     seconds and milliseconds, -1 for no expiry
+//   - responses of OpSet, OpDelete, OpExists and OpPersist: 1 or 0
+//
+// A response to OpScan has the next cursor as its key and the keys as its
+// value, each a uvarint length and bytes; those to OpStats and the other
+// administrative ops have the JSON of their HTTP response data as value.
+type FrameHeader struct {
+	Op       Op
+	Flags    uint8
+	Status   uint16
+	ID       uint32
+	KeyLen   uint32
+	ValueLen uint32
+	Arg      int64
+}
+
+func (h *FrameHeader) AppendTo(dst []byte) []byte {
+	dst = append(dst, byte(h.Op), h.Flags)
+	dst = binary.BigEndian.AppendUint16(dst, h.Status)
+	dst = binary.BigEndian.AppendUint32(dst, h.ID)
+	dst = binary.BigEndian.AppendUint32(dst, h.KeyLen)
+	dst = binary.BigEndian.AppendUint32(dst, h.ValueLen)
+	return binary.BigEndian.AppendUint64(dst, uint64(h.Arg))
+}
+
+// ParseFrameHeader decodes the first FrameHeaderSize bytes of b.
+func ParseFrameHeader(b []byte) FrameHeader {
+	return FrameHeader{
+		Op:       Op(b[0]),
+		Flags:    b[1],
+		Status:   binary.BigEndian.Uint16(b[2:]),
+		ID:       binary.BigEndian.Uint32(b[4:]),
+		KeyLen:   binary.BigEndian.Uint32(b[8:]),
+		ValueLen: binary.BigEndian.Uint32(b[12:]),
+		Arg:      int64(binary.BigEndian.Uint64(b[16:])),
+	}
+}
+
+// AppendBytes appends b with a uvarint length, as the fields of scan
+// requests and responses are encoded.
+func AppendBytes(dst, b []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// ReadBytes returns the field at the start of buf written by AppendBytes and
+// the rest of buf.
+func ReadBytes(buf []byte) ([]byte, []byte, bool) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || n > uint64(len(buf)-size) {
+		return nil, nil, false
+	}
+	buf = buf[size:]
+	return buf[:n], buf[n:], true
+}
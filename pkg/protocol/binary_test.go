@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestFrameHeaderRoundTrip(t *testing.T) {
+	for _, h := range []FrameHeader{
+		{},
+		{Op: OpSet, Flags: FlagIfAbsent, ID: 7, KeyLen: 3, ValueLen: 5, Arg: 1000},
+		{Op: OpAOFStatus, Flags: 0xff, Status: CodeInternalError, ID: math.MaxUint32, KeyLen: math.MaxUint32, ValueLen: math.MaxUint32, Arg: math.MinInt64},
+		{Op: OpTTL, Arg: -1},
+	} {
+		buf := h.AppendTo([]byte("prefix"))
+		if len(buf) != len("prefix")+FrameHeaderSize || !bytes.HasPrefix(buf, []byte("prefix")) {
+			t.Fatalf("AppendTo wrote %d bytes, expected %d after the prefix", len(buf)-len("prefix"), FrameHeaderSize)
+		}
+		if got := ParseFrameHeader(buf[len("prefix"):]); got != h {
+			t.Fatalf("expected %+v, got %+v", h, got)
+		}
+	}
+}
+
+func TestReadBytes(t *testing.T) {
+	var buf []byte
+	buf = AppendBytes(buf, []byte("match*"))
+	buf = AppendBytes(buf, nil)
+	buf = AppendBytes(buf, []byte{0xff, 0x00})
+
+	for _, want := range []string{"match*", "", "\xff\x00"} {
+		field, rest, ok := ReadBytes(buf)
+		if !ok || string(field) != want {
+			t.Fatalf("expected %q, got %q (%v)", want, field, ok)
+		}
+		buf = rest
+	}
+	if len(buf) != 0 {
+		t.Fatalf("expected nothing left, got %q", buf)
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		{0x80},           // truncated length
+		{0x05, 'a', 'b'}, // length beyond the buffer
+		binary.AppendUvarint(nil, math.MaxUint64), // length that overflows an int
+	} {
+		if _, _, ok := ReadBytes(bad); ok {
+			t.Fatalf("expected %x to be rejected", bad)
+		}
+	}
+}
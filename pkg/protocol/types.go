@@ -1,25 +1,31 @@
 package protocol
 
 const (
-	CodeSuccess       = 0
-	CodeKeyNotFound   = 1001
-	CodeKeyExpired    = 1002
-	CodeKeyTooLong    = 2001
-	CodeValueTooLarge = 2002
-	CodeInvalidParam  = 2003
-	CodeMemoryFull    = 3001
-	CodeInternalError = 5001
+	CodeSuccess          = 0
+	CodeKeyNotFound      = 1001
+	CodeKeyExpired       = 1002
+	CodeSnapshotNotFound = 1003
+	CodeKeyTooLong       = 2001
+	CodeValueTooLarge    = 2002
+	CodeInvalidParam     = 2003
+	CodeMemoryFull       = 3001
+	CodeAOFRewriting     = 3002
+	CodeAOFDisabled      = 3003
+	CodeInternalError    = 5001
 )
 
 var CodeMessages = map[int]string{
-	CodeSuccess:       "ok",
-	CodeKeyNotFound:   "key not found",
-	CodeKeyExpired:    "key expired",
-	CodeKeyTooLong:    "key too long",
-	CodeValueTooLarge: "value too large",
-	CodeInvalidParam:  "invalid parameter",
-	CodeMemoryFull:    "memory full",
-	CodeInternalError: "internal error",
+	CodeSuccess:          "ok",
+	CodeKeyNotFound:      "key not found",
+	CodeKeyExpired:       "key expired",
+	CodeSnapshotNotFound: "snapshot not found",
+	CodeKeyTooLong:       "key too long",
+	CodeValueTooLarge:    "value too large",
+	CodeInvalidParam:     "invalid parameter",
+	CodeMemoryFull:       "memory full",
+	CodeAOFRewriting:     "aof rewrite already in progress",
+	CodeAOFDisabled:      "aof disabled",
+	CodeInternalError:    "internal error",
 }
 
 type Response struct {
@@ -28,10 +34,35 @@ type Response struct {
 	Msg  string      `json:"msg"`
 }
 
+// SetRequest and the other requests naming a key in their body may give it
+// in base64 as KeyB64 instead, for keys that are not valid UTF-8.
 type SetRequest struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-	TTL   int    `json:"ttl,omitempty"`
+	Key    string `json:"key"`
+	KeyB64 string `json:"key_b64,omitempty"`
+	Value  string `json:"value"`
+	TTL    int    `json:"ttl,omitempty"`
+	TTLMs  int64  `json:"ttl_ms,omitempty"`
+}
+
+// ExpireRequest sets the expiry of an existing key. Exactly one of the
+// fields must be given: a relative TTL in seconds or milliseconds, or an
+// absolute Unix timestamp in seconds or milliseconds.
+type ExpireRequest struct {
+	Key    string `json:"key"`
+	KeyB64 string `json:"key_b64,omitempty"`
+	TTL    *int64 `json:"ttl,omitempty"`
+	TTLMs  *int64 `json:"ttl_ms,omitempty"`
+	At     *int64 `json:"at,omitempty"`
+	AtMs   *int64 `json:"at_ms,omitempty"`
+}
+
+type PersistRequest struct {
+	Key    string `json:"key"`
+	KeyB64 string `json:"key_b64,omitempty"`
+}
+
+type PersistResponseData struct {
+	Persisted bool `json:"persisted"`
 }
 
 type GetResponseData struct {
@@ -39,17 +70,104 @@ type GetResponseData struct {
 	TTLRemaining int    `json:"ttl_remaining,omitempty"`
 }
 
+// ScanResponseData lists a page of keys, in base64 if the scan was
+// requested with encoding=base64.
+type ScanResponseData struct {
+	Cursor string   `json:"cursor"`
+	Keys   []string `json:"keys"`
+}
+
 type TTLResponseData struct {
 	TTL int `json:"ttl"`
 }
 
+type PTTLResponseData struct {
+	PTTL int64 `json:"pttl"`
+}
+
 type StatsResponseData struct {
-	Keys     int              `json:"keys"`
-	Memory   int64            `json:"memory"`
-	Hits     int64            `json:"hits"`
-	Misses   int64            `json:"misses"`
-	Requests map[string]int64 `json:"requests"`
-	Uptime   int64            `json:"uptime"`
+	Keys           int              `json:"keys"`
+	Memory         int64            `json:"memory"`
+	Hits           int64            `json:"hits"`
+	Misses         int64            `json:"misses"`
+	EvictedKeys    int64            `json:"evicted_keys"`
+	ExpiredKeys    int64            `json:"expired_keys"`
+	ExpireCycleCPU int64            `json:"expire_cycle_cpu"` // microseconds
+	Requests       map[string]int64 `json:"requests"`
+	Uptime         int64            `json:"uptime"`
+	Recovery       *RecoveryReport  `json:"recovery,omitempty"`
+	AOF            *AOFStats        `json:"aof,omitempty"`
+	EncryptionKey  string           `json:"encryption_key,omitempty"` // ID of the key new files are encrypted with
+}
+
+// AOFStats reports AOF durability metrics. PendingBytes counts bytes written
+// to the AOF but not yet fsynced, over all Streams streams.
+type AOFStats struct {
+	FsyncPolicy  string `json:"fsync_policy"`
+	Fsyncs       int64  `json:"fsyncs"`
+	FsyncLastUs  int64  `json:"fsync_last_us"`
+	FsyncMaxUs   int64  `json:"fsync_max_us"`
+	FsyncTotalUs int64  `json:"fsync_total_us"`
+	PendingBytes int64  `json:"pending_bytes"`
+	LastSeq      int64  `json:"last_seq"`
+	Streams      int    `json:"streams"`
+
+	RewriteInProgress bool  `json:"rewrite_in_progress"`
+	Rewrites          int64 `json:"rewrites"`
+	RewriteFailures   int64 `json:"rewrite_failures"`
+}
+
+// AOFStatusResponseData reports the state of AOF rewrites. Times are Unix
+// milliseconds and 0 if there was none; LastRewriteStatus is "ok", "err" or
+// "" before the first rewrite finishes. Sizes are in bytes: BaseSize of the
+// base, CurrentSize of all AOF files and IncrSize of the file being appended
+// to, which triggers a rewrite at RewriteThreshold.
+type AOFStatusResponseData struct {
+	RewriteInProgress     bool   `json:"rewrite_in_progress"`
+	RewriteStartedAt      int64  `json:"rewrite_started_at"`
+	Rewrites              int64  `json:"rewrites"`
+	RewriteFailures       int64  `json:"rewrite_failures"`
+	LastRewriteStatus     string `json:"last_rewrite_status"`
+	LastRewriteError      string `json:"last_rewrite_error,omitempty"`
+	LastRewriteAt         int64  `json:"last_rewrite_at"`
+	LastRewriteDurationMs int64  `json:"last_rewrite_duration_ms"`
+	BaseSize              int64  `json:"base_size"`
+	CurrentSize           int64  `json:"current_size"`
+	IncrSize              int64  `json:"incr_size"`
+	RewriteThreshold      int64  `json:"rewrite_threshold"`
+}
+
+// RecoveryReport summarizes the data restored from AOF/RDB at startup.
+// Source is "none", "rdb", "aof" or "rdb+aof" when the RDB snapshot was
+// loaded and only the AOF records after it were replayed. AOFDamage lists
+// the damaged stretches of the AOF handled under the LoadCorrupt policy and
+// DroppedBytes their total size; Error is set if loading failed.
+type RecoveryReport struct {
+	Source        string            `json:"source"`
+	Entries       int               `json:"entries"`
+	RDBEntries    int               `json:"rdb_entries,omitempty"`
+	AOFRecords    int               `json:"aof_records,omitempty"`
+	AOFSkipped    int               `json:"aof_skipped,omitempty"`
+	LastSeq       int64             `json:"last_seq,omitempty"`
+	LiveKeys      int               `json:"live_keys"`
+	ExpiredOnLoad int               `json:"expired_on_load"`
+	TTLTracked    int               `json:"ttl_tracked"`
+	DurationMs    int64             `json:"duration_ms"`
+	LoadCorrupt   string            `json:"load_corrupt,omitempty"`
+	AOFDamage     []AOFDamageReport `json:"aof_damage,omitempty"`
+	DroppedBytes  int64             `json:"dropped_bytes,omitempty"`
+	Error         string            `json:"error,omitempty"`
+}
+
+// AOFDamageReport locates damage found in an AOF file at startup. Action is
+// "truncated" if the file was cut at Offset, or "skipped" if the damaged
+// bytes were stepped over and left in place.
+type AOFDamageReport struct {
+	File    string `json:"file"`
+	Offset  int64  `json:"offset"`
+	Dropped int64  `json:"dropped_bytes"`
+	Action  string `json:"action"`
+	Error   string `json:"error"`
 }
 
 type SnapshotResponseData struct {
@@ -57,6 +175,25 @@ type SnapshotResponseData struct {
 	Path   string `json:"path"`
 }
 
+// SnapshotInfo describes an RDB snapshot on disk. CreatedAt is in Unix
+// milliseconds; Keys is -1 if the file could not be read.
+type SnapshotInfo struct {
+	ID        string `json:"id"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Keys      int64  `json:"keys"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type SnapshotListResponseData struct {
+	Snapshots []SnapshotInfo `json:"snapshots"`
+}
+
+type RestoreResponseData struct {
+	ID   string `json:"id"`
+	Keys int    `json:"keys"`
+}
+
 type HealthResponseData struct {
 	Status string `json:"status"`
 }